@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// adminTokenEnv sets the admin token without showing it in the process list
+const adminTokenEnv = "SAMPLE_ADMIN_TOKEN"
+
+// limits are the settings changed at runtime with the admin api, unset fields of an update are left unchanged
+type limits struct {
+	Workers    *int     `json:"workers,omitempty"`
+	RateLimit  *float64 `json:"rate_limit,omitempty"`
+	MaxPerHost *int     `json:"max_per_host,omitempty"`
+}
+
+func (l *limits) validate() error {
+	if l.Workers != nil && *l.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if (l.RateLimit != nil && *l.RateLimit < 0) || (l.MaxPerHost != nil && *l.MaxPerHost < 0) {
+		return fmt.Errorf("rate_limit and max_per_host can't be negative")
+	}
+	return nil
+}
+
+// options returns a copy of the run options, as changed by the admin api
+func (s *server) options() options {
+	s.optsMu.Lock()
+	defer s.optsMu.Unlock()
+	return s.opts
+}
+
+// attach makes the downloader of a run in the namespace of t one of those changed by the admin api
+func (s *server) attach(d *download.Downloader, t *tenant) {
+	s.optsMu.Lock()
+	defer s.optsMu.Unlock()
+	s.current[d] = t
+	s.applyLimits(d, t) // limits changed since the options were copied
+}
+
+// detach forgets the downloader of a completed run
+func (s *server) detach(d *download.Downloader) {
+	s.optsMu.Lock()
+	defer s.optsMu.Unlock()
+	delete(s.current, d)
+}
+
+// applyLimits sets the limits of the run options, capped by those of the tenant, on the downloader,
+// optsMu must be held
+func (s *server) applyLimits(d *download.Downloader, t *tenant) {
+	opts := s.opts
+	if t != nil {
+		t.apply(&opts)
+	}
+	d.SetWorkers(opts.Workers)
+	d.SetRateLimit(opts.RateLimit)
+	d.SetMaxPerHost(opts.MaxPerHost)
+}
+
+// authorized checks the bearer token of an admin request
+func (s *server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// handleLimits replies with the current limits on GET and changes them on PUT, the limits apply to the
+// run in progress and to the next ones
+func (s *server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		update := &limits{}
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := update.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.setLimits(update)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := s.options()
+	writeJSON(w, http.StatusOK, &limits{Workers: &opts.Workers, RateLimit: &opts.RateLimit, MaxPerHost: &opts.MaxPerHost})
+}
+
+func (s *server) setLimits(update *limits) {
+	s.optsMu.Lock()
+	defer s.optsMu.Unlock()
+
+	if update.Workers != nil {
+		s.opts.Workers = *update.Workers
+	}
+	if update.RateLimit != nil {
+		s.opts.RateLimit = *update.RateLimit
+	}
+	if update.MaxPerHost != nil {
+		s.opts.MaxPerHost = *update.MaxPerHost
+	}
+	fmt.Println(fmt.Sprintf("admin - workers %d, rate limit %g/s, max per host %d", s.opts.Workers, s.opts.RateLimit, s.opts.MaxPerHost))
+	for d, t := range s.current {
+		s.applyLimits(d, t)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	goimage "image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Actions of --animated on the animated gif, webp and png downloads
+const (
+	animatedKeep       = "keep"
+	animatedFirstFrame = "first-frame"
+	animatedMP4        = "mp4"
+	animatedWebM       = "webm"
+)
+
+// stillJPEGQuality is the quality of the stills written for the first frame of an animation or a
+// rasterized document
+const stillJPEGQuality = 90
+
+// convertAnimated returns a post process stage for the animated downloads, nil when they are kept as
+// they are. first-frame replaces the file by a jpeg of its first frame, mp4 and webm convert it with
+// ffmpeg to a video next to it, <name>.mp4 or <name>.webm, which becomes the path of the result. The
+// still images go through unchanged.
+func convertAnimated(action string) func(*download.Result) error {
+	if action == "" || action == animatedKeep {
+		return nil
+	}
+	return func(r *download.Result) error {
+		format, err := animatedFormat(r.Path)
+		if err != nil || format == "" {
+			return err
+		}
+		r.SetMeta("animated", format)
+		switch action {
+		case animatedFirstFrame:
+			err = firstFrame(r.Path, format)
+		case animatedMP4, animatedWebM:
+			var video string
+			if video, err = convertVideo(r.Path, action); err == nil {
+				r.Path = video
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("animated %s: %s", format, err)
+		}
+		r.Bytes = fileSize(r.Path)
+		r.SetMeta("animated_action", action)
+		return nil
+	}
+}
+
+// animatedFormat returns gif, webp or png when the file at path is an animation in that format, empty
+// when it is a still image or another format
+func animatedFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header := make([]byte, 32)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		all, err := gif.DecodeAll(file)
+		if err != nil || len(all.Image) < 2 {
+			return "", nil // a broken gif is left to --verify-decode
+		}
+		return "gif", nil
+	case len(header) >= 21 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		// the extended format flags an animation in its VP8X chunk
+		if string(header[12:16]) == "VP8X" && header[20]&0x02 != 0 {
+			return "webp", nil
+		}
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		if animatedPNG(file) {
+			return "png", nil
+		}
+	}
+	return "", nil
+}
+
+// animatedPNG reports whether the chunks of a png, read from after its signature, have an acTL chunk
+// before the image data, which makes it an apng
+func animatedPNG(file *os.File) bool {
+	if _, err := file.Seek(8, io.SeekStart); err != nil {
+		return false
+	}
+	var chunk [8]byte
+	for {
+		if _, err := io.ReadFull(file, chunk[:]); err != nil {
+			return false
+		}
+		switch string(chunk[4:]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		length := int64(binary.BigEndian.Uint32(chunk[:4]))
+		if _, err := file.Seek(length+4, io.SeekCurrent); err != nil { // the data and its crc
+			return false
+		}
+	}
+}
+
+// firstFrame replaces the animation at path by a jpeg of its first frame, the format of the output
+// files. The first frame of an animated webp is extracted by ffmpeg.
+func firstFrame(path, format string) error {
+	if format == "webp" {
+		return ffmpeg(path, path, "-frames:v", "1", "-c:v", "mjpeg", "-q:v", "2")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var frame goimage.Image
+	if format == "gif" {
+		frame, err = gif.Decode(file)
+	} else {
+		frame, err = png.Decode(file) // the default image of an apng is its first frame
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return writeStill(path, frame)
+}
+
+// writeStill replaces the file at path by a jpeg of img over a white background
+func writeStill(path string, img goimage.Image) error {
+	still := goimage.NewRGBA(img.Bounds())
+	draw.Draw(still, still.Bounds(), goimage.NewUniform(color.White), goimage.Point{}, draw.Src)
+	draw.Draw(still, still.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".still-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = jpeg.Encode(tmp, still, &jpeg.Options{Quality: stillJPEGQuality})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// convertVideo converts the animation at path to an mp4 or a webm video next to it, removes the
+// animation and returns the path of the video
+func convertVideo(path, container string) (string, error) {
+	video := strings.TrimSuffix(path, filepath.Ext(path)) + "." + container
+	args := []string{"-an", "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "32"}
+	if container == animatedMP4 {
+		// h264 in yuv420p needs even dimensions, and faststart lets a browser play it while loading
+		args = []string{"-an", "-c:v", "libx264", "-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-movflags", "+faststart"}
+	}
+	if err := ffmpeg(path, video, args...); err != nil {
+		return "", err
+	}
+	return video, os.Remove(path)
+}
+
+// ffmpeg runs ffmpeg on the input with the output args, writing to a temporary file renamed to output
+// once it succeeded, so output can be the input
+func ffmpeg(input, output string, args ...string) error {
+	tmp := filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".ffmpeg")
+	defer os.Remove(tmp)
+	format := strings.TrimPrefix(filepath.Ext(output), ".")
+	if format == "jpg" {
+		format = "image2"
+	}
+	cmd := exec.Command("ffmpeg", append(append([]string{"-y", "-loglevel", "error", "-i", input}, args...), "-f", format, tmp)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("ffmpeg: %s: %s", err, msg)
+		}
+		return fmt.Errorf("ffmpeg: %s", err)
+	}
+	return os.Rename(tmp, output)
+}
+
+// fileSize returns the size of the file at path, 0 when it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
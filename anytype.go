@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Extensions of the outputs of --content-type-any
+const (
+	anyTypeExt       = ".bin" // of the urls without an extension
+	maxAnyTypeExtLen = 10
+)
+
+// compoundExts are the double extensions kept whole, archive.tar.gz is not a .gz of a .tar to its users
+var compoundExts = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst"}
+
+// setAnyTypeExts names the outputs of --content-type-any after the extension of their url, lowercased,
+// rather than .jpg, as videos, archives or models are downloaded with the images
+func setAnyTypeExts(jobs []*download.Job) {
+	for _, j := range jobs {
+		j.Ext = urlExt(j.URL)
+	}
+}
+
+// urlExt returns the extension of the path of a url, anyTypeExt when it has none made of letters and
+// digits
+func urlExt(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return anyTypeExt
+	}
+	name := strings.ToLower(path.Base(u.Path))
+	for _, ext := range compoundExts {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return ext
+		}
+	}
+	ext := path.Ext(name)
+	if len(ext) < 2 || len(ext) > maxAnyTypeExtLen || len(ext) == len(name) {
+		return anyTypeExt
+	}
+	for _, c := range ext[1:] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return anyTypeExt
+		}
+	}
+	return ext
+}
+
+// checkAnyType rejects the image stages --content-type-any leaves out, they would fail or alter the
+// other files
+func checkAnyType(opts *options) error {
+	if !opts.ContentTypeAny {
+		return nil
+	}
+	switch {
+	case opts.VerifyDecode:
+		return errors.New("--verify-decode decodes images, it can't be used with --content-type-any")
+	case opts.NearDup != "":
+		return errors.New("--near-dup hashes images, it can't be used with --content-type-any")
+	case opts.Animated != "" && opts.Animated != animatedKeep:
+		return errors.New("--animated converts images, it can't be used with --content-type-any")
+	case opts.SanitizeSVG || opts.RasterizeDPI > 0:
+		return errors.New("--sanitize-svg and --rasterize-dpi process images, they can't be used with --content-type-any")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiAuth protects the api of a node with static bearer tokens, each with its own rate limit, and
+// client certificates verified against a CA. When both are configured either one is accepted.
+// Tenant tokens, and certificates whose common name is a tenant, scope the requests to the tenant.
+type apiAuth struct {
+	tokens     map[string]*principal
+	clientCert bool
+	tenants    map[string]*tenant
+}
+
+// principal is who a token authenticates
+type principal struct {
+	tenant *tenant      // nil for the default namespace
+	bucket *tokenBucket // nil means no rate limit
+}
+
+// addTenants makes the tenant tokens accepted by the api
+func (a *apiAuth) addTenants(tenants map[string]*tenant) error {
+	a.tenants = tenants
+	for name, t := range tenants {
+		if t.Token == "" {
+			continue // authenticated by client certificate only
+		}
+		if a.tokens == nil {
+			a.tokens = map[string]*principal{}
+		}
+		if _, ok := a.tokens[t.Token]; ok {
+			return fmt.Errorf("tenant %s: token already in use", name)
+		}
+		a.tokens[t.Token] = &principal{tenant: t, bucket: t.api}
+	}
+	return nil
+}
+
+// loadTokens reads a file of "token [requests per second]" lines, blank lines and # comments are ignored
+func loadTokens(path string) (map[string]*principal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]*principal{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		p := &principal{}
+		if len(fields) > 1 {
+			rate, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil || rate <= 0 {
+				return nil, fmt.Errorf("%s:%d: invalid rate %q", path, line, fields[1])
+			}
+			p.bucket = newTokenBucket(rate)
+		}
+		tokens[fields[0]] = p
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token in %s", path)
+	}
+	return tokens, nil
+}
+
+// wrap rejects the requests without a valid token or client certificate, and those over the token rate
+// limit, the tenant of the others is set in the request context
+func (a *apiAuth) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.clientCert && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			t := a.tenants[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+			if t != nil && t.api != nil && !t.api.take() {
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next(w, r.WithContext(withTenant(r.Context(), t)))
+			return
+		}
+		if a.tokens != nil {
+			if p := a.token(r); p != nil {
+				if p.bucket != nil && !p.bucket.take() {
+					http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+					return
+				}
+				next(w, r.WithContext(withTenant(r.Context(), p.tenant)))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// token looks up the bearer token of the request, comparing it to every known token in constant time
+func (a *apiAuth) token(r *http.Request) *principal {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	given := []byte(strings.TrimPrefix(header, "Bearer "))
+	var found *principal
+	for token, p := range a.tokens {
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			found = p
+		}
+	}
+	return found
+}
+
+// tokenBucket allows a number of requests per second with bursts of up to one second of requests
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: burst(rate), last: time.Now()}
+}
+
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// take consumes a request and reports false when the rate is exceeded
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > burst(b.rate) {
+		b.tokens = burst(b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// loadCertPool reads a file of PEM certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// serverTLS is the tls config of a node, client certificates are verified against clientCA when set.
+// They are not required at the handshake so the probes keep working without one, the api checks them.
+func serverTLS(clientCA string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// nodeClient is the http client of the coordinator, sending the bearer token and the client certificate
+// to the nodes and verifying their certificate against ca when set
+func nodeClient(timeout time.Duration, token, ca, cert, key string) (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Timeout: timeout, Transport: &bearerTransport{base: transport, token: token}}, nil
+}
+
+// bearerTransport sets the Authorization header of the requests when a token is set
+type bearerTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsRetryFailed is how long a failed credentials lookup is reused before the chain is tried again
+const awsRetryFailed = 30 * time.Second
+
+// awsCredentials are the keys requests to AWS are signed with, temporary ones have an expiration
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsChain resolves the credentials like the AWS SDKs: from the env variables, the shared credentials
+// file, the container credentials endpoint, then the instance metadata service. Temporary credentials
+// are kept until shortly before they expire.
+type awsChain struct {
+	mu      sync.Mutex
+	creds   *awsCredentials
+	err     error
+	retryAt time.Time
+	client  *http.Client
+}
+
+func newAWSChain() *awsChain {
+	return &awsChain{client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+// get returns the current credentials
+func (c *awsChain) get() (*awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.creds != nil && (c.creds.Expiration.IsZero() || now.Add(5*time.Minute).Before(c.creds.Expiration)) {
+		return c.creds, nil
+	}
+	if c.err != nil && now.Before(c.retryAt) {
+		return nil, c.err
+	}
+	c.creds, c.err = c.resolve()
+	if c.err != nil {
+		c.retryAt = now.Add(awsRetryFailed)
+	}
+	return c.creds, c.err
+}
+
+func (c *awsChain) resolve() (*awsCredentials, error) {
+	if creds, err := awsFileCredentials(); creds != nil || err != nil {
+		return creds, err
+	}
+	if creds, err := c.containerCredentials(); creds != nil || err != nil {
+		return creds, err
+	}
+	if !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		if creds, err := c.instanceCredentials(); err == nil {
+			return creds, nil
+		}
+	}
+	return nil, errors.New("no aws credentials in the environment, the shared credentials file, the container or the instance metadata")
+}
+
+// awsFileCredentials reads the credentials from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN env variables, or else from the AWS_PROFILE section of the shared credentials file
+func awsFileCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	section, err := readINISection(path, profile)
+	if err != nil {
+		return nil, err
+	}
+	if section["aws_access_key_id"] == "" {
+		return nil, nil
+	}
+	return &awsCredentials{
+		AccessKeyID:     section["aws_access_key_id"],
+		SecretAccessKey: section["aws_secret_access_key"],
+		SessionToken:    section["aws_session_token"],
+	}, nil
+}
+
+// containerCredentials fetches the credentials of the task role from the ECS or EKS credentials endpoint
+func (c *awsChain) containerCredentials() (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = "http://169.254.170.2" + relative
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	creds := &awsCredentials{}
+	if err := c.getJSON(req, creds); err != nil {
+		return nil, fmt.Errorf("container credentials: %s", err)
+	}
+	return creds, nil
+}
+
+// instanceCredentials fetches the credentials of the instance profile with IMDSv2
+func (c *awsChain) instanceCredentials() (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := c.getText(req)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/", nil)
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	roles, err := c.getText(req)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return nil, errors.New("no instance profile")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/"+role, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	creds := &awsCredentials{}
+	if err := c.getJSON(req, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (c *awsChain) getText(req *http.Request) (string, error) {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected http status %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	return string(body), err
+}
+
+func (c *awsChain) getJSON(req *http.Request, v *awsCredentials) error {
+	body, err := c.getText(req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		return err
+	}
+	if v.AccessKeyID == "" {
+		return errors.New("no access key in the reply")
+	}
+	return nil
+}
+
+// readINISection returns the key = value pairs of a section of an ini file, none when the file is missing
+func readINISection(path, name string) (map[string]string, error) {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == name
+			continue
+		}
+		if i := strings.Index(line, "="); in && i > 0 {
+			values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return values, scanner.Err()
+}
+
+// awsRegion is the region of AWS_REGION or AWS_DEFAULT_REGION, us-east-1 by default
+func awsRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// sigv4Key derives the signature version 4 key of a date (yyyymmdd), region and service
+func sigv4Key(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, and the slashes when keepSlash,
+// as the canonical requests of the AWS and GCS V4 signatures require
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the query sorted by name then value, as the V4 signatures require
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, false)+"="+uriEncode(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// checkTimeout is the time a url has to answer when --timeout is not set
+const checkTimeout = 10 * time.Second
+
+// linkCheck is the outcome of checking a url of the manifest
+type linkCheck struct {
+	Key         int           `json:"key"`
+	URL         string        `json:"url"`
+	Status      int           `json:"status,omitempty"`
+	Latency     time.Duration `json:"latency"`
+	Bytes       int64         `json:"bytes"` // -1 when the server does not tell
+	ContentType string        `json:"content_type,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+func (c *linkCheck) ok() bool {
+	return c.Error == "" && c.Status < http.StatusBadRequest
+}
+
+// checkCommand checks the urls of the images files without downloading them, as a link checker: each
+// url gets a HEAD, or a GET of its first byte when the server refuses the HEAD, through the auth and
+// presigning of a run. The status, latency, size and content type of the urls are printed as a table
+// or as json, and check fails when one of them is invalid or did not answer with a success.
+func checkCommand(args []string) error {
+	fs := newFlagSet("check")
+	opts := addRunFlags(fs)
+	asJSON := fs.Bool("json", false, "print the checks as a json array")
+	fs.Parse(args)
+
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("please supply the images.json file path")
+	}
+	jobs, invalid, err := manifestJobs(*opts, fs.Args()...)
+	if err == nil {
+		jobs, _, err = filterJobs(*opts, jobs)
+	}
+	if err != nil {
+		return err
+	}
+	checker, err := newLinkChecker(*opts, checkTimeout)
+	if err != nil {
+		return err
+	}
+
+	checks := make([]*linkCheck, len(jobs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				j := jobs[i]
+				if reason, ok := invalid[j.Key]; ok {
+					checks[i] = &linkCheck{Key: j.Key, URL: j.URL, Bytes: -1, Error: reason}
+					continue
+				}
+				checks[i] = checker.check(j)
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	failed := 0
+	for _, c := range checks {
+		if !c.ok() {
+			failed++
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		printChecks(checks)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d urls failed the check", failed, len(checks))
+	}
+	return nil
+}
+
+// linkChecker sends the requests of check with the request hooks of a run that sign or authorize them
+type linkChecker struct {
+	client *http.Client
+	hooks  []func(*http.Request) error
+}
+
+// newLinkChecker returns a checker with the hooks of opts, its requests have --timeout or timeout
+func newLinkChecker(opts options, timeout time.Duration) (*linkChecker, error) {
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	c := &linkChecker{client: &http.Client{Timeout: timeout}}
+	dav, err := newDAVClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	c.hooks = append(c.hooks, dav.authorize, newPresigner(opts.PresignCommand, opts.PresignExpiry).sign)
+	if opts.HostConfig != "" {
+		config, err := loadHostConfig(opts.HostConfig)
+		if err != nil {
+			return nil, err
+		}
+		c.hooks = append(c.hooks, config.apply)
+	}
+	if source := newOAuth2Source(opts); source != nil {
+		c.hooks = append(c.hooks, source.authorize)
+	}
+	if signer := newSigV4Signer(opts); signer != nil {
+		c.hooks = append(c.hooks, signer.sign)
+	}
+	return c, nil
+}
+
+// check sends a HEAD to the url of j, then a GET of its first byte when the HEAD is refused, as with a
+// 403 of an url presigned for GET only
+func (c *linkChecker) check(j *download.Job) *linkCheck {
+	result := &linkCheck{Key: j.Key, URL: j.URL, Bytes: -1}
+	started := time.Now()
+	res, err := c.send(http.MethodHead, j.URL, nil)
+	if err == nil && (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented) {
+		res.Body.Close()
+		started = time.Now()
+		res, err = c.send(http.MethodGet, j.URL, http.Header{"Range": {"bytes=0-0"}})
+	}
+	result.Latency = time.Since(started)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1))
+	res.Body.Close()
+	result.Status = res.StatusCode
+	result.ContentType = res.Header.Get("Content-Type")
+	result.Bytes = res.ContentLength
+	if res.StatusCode == http.StatusPartialContent {
+		result.Bytes = rangeTotal(res.Header.Get("Content-Range"))
+	}
+	return result
+}
+
+// send sends a request with the headers, set before the hooks sign it
+func (c *linkChecker) send(method, raw string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	for _, hook := range c.hooks {
+		if err := hook(req); err != nil {
+			return nil, err
+		}
+	}
+	return c.client.Do(req)
+}
+
+// rangeTotal returns the size of the file of a Content-Range, as in bytes 0-0/1234, -1 when it is unknown
+func rangeTotal(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+// printChecks prints the checks as a table, in the order of the manifest
+func printChecks(checks []*linkCheck) {
+	fmt.Println(fmt.Sprintf("%-6s %9s %10s %-24s %s", "status", "latency", "size", "type", "url"))
+	for _, c := range checks {
+		status, latency, size := strconv.Itoa(c.Status), c.Latency.Round(time.Millisecond).String(), "-"
+		if c.Error != "" {
+			status = "error"
+		}
+		if c.Latency == 0 {
+			latency = "-" // an invalid entry, not requested
+		}
+		if c.Bytes >= 0 {
+			size = humanBytes(c.Bytes)
+		}
+		contentType := c.ContentType
+		if i := strings.Index(contentType, ";"); i >= 0 {
+			contentType = contentType[:i]
+		}
+		line := fmt.Sprintf("%-6s %9s %10s %-24s %s", status, latency, size, contentType, c.URL)
+		if c.Error != "" {
+			line += ": " + c.Error
+		}
+		fmt.Println(line)
+	}
+}
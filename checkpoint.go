@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// checkpointName is the file of the checkpoint of a run in its output directory
+const checkpointName = ".checkpoint.jsonl"
+
+// checkpointHeader is the first line of a checkpoint, what --resume-last needs to build the jobs of
+// the run again
+type checkpointHeader struct {
+	Started   time.Time `json:"started"`
+	Options   options   `json:"options"`
+	Report    string    `json:"report,omitempty"`
+	Manifests []string  `json:"manifests"`
+	Jobs      int       `json:"jobs"`
+	// Secrets are the flags of the secret options the run was given, their values are not saved
+	Secrets []string `json:"secrets,omitempty"`
+}
+
+// newCheckpointHeader returns the header of the checkpoint of a new run, with absolute paths so the run
+// can be resumed from another directory
+func newCheckpointHeader(opts options, reportPath string, manifests []string, started time.Time, jobs int) *checkpointHeader {
+	h := &checkpointHeader{Started: started, Options: opts, Report: reportPath, Jobs: jobs}
+	if abs, err := filepath.Abs(reportPath); err == nil && reportPath != "" {
+		h.Report = abs
+	}
+	for _, m := range manifests {
+		if abs, err := filepath.Abs(m); err == nil {
+			m = abs
+		}
+		h.Manifests = append(h.Manifests, m)
+	}
+	h.Secrets = secretFlags(opts)
+	return h
+}
+
+// resumeOptions returns the options of the run of a checkpoint, with the secrets and the flags only of
+// a download run of the resuming command line. A secret the run had that is given neither by its flag
+// nor its environment variable fails the resume, the run would not behave the same without it.
+func resumeOptions(header *checkpointHeader, current options) (options, error) {
+	resumed, missing := restoreSecrets(header.Options, header.Secrets, current)
+	resumed.Prune, resumed.PruneDryRun, resumed.Interactive = current.Prune, current.PruneDryRun, current.Interactive
+	if len(missing) > 0 {
+		return resumed, fmt.Errorf("the secrets of the run are not saved in its checkpoint, give %s again to resume it", strings.Join(missing, ", "))
+	}
+	return resumed, nil
+}
+
+// checkpoint journals a run so a crash or an OOM kill mid run can be resumed: a header, then a line per
+// completed job with its result, flushed and synced every interval. The jobs without a line, pending or
+// in flight when the run died, are the ones --resume-last downloads again. The checkpoint is removed
+// once the run finishes.
+type checkpoint struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newCheckpoint starts the checkpoint of a run in its output directory, with the results a resumed
+// run already has
+func newCheckpoint(header *checkpointHeader, completed []*download.Result, interval time.Duration) (*checkpoint, error) {
+	path := filepath.Join(header.Options.OutDir, checkpointName)
+	if err := os.MkdirAll(header.Options.OutDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{path: path, f: f, w: bufio.NewWriter(f), stop: make(chan struct{}), done: make(chan struct{})}
+	c.enc = json.NewEncoder(c.w)
+	err = c.enc.Encode(header)
+	for _, r := range completed {
+		if err == nil {
+			err = c.enc.Encode(r)
+		}
+	}
+	if err == nil {
+		err = c.flush()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	go c.tick(interval)
+	return c, nil
+}
+
+// record is the completion hook adding the result of a job, those canceled or left unprocessed are
+// downloaded again by a resumed run
+func (c *checkpoint) record(r *download.Result) {
+	if r.Status == download.StatusCanceled || r.Status == download.StatusUnprocessed {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(r); err != nil {
+		fmt.Println(fmt.Sprintf("checkpoint - can't record job #%d: %s", r.Key, err))
+	}
+}
+
+func (c *checkpoint) tick(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			err := c.flush()
+			c.mu.Unlock()
+			if err != nil {
+				fmt.Println(fmt.Sprintf("checkpoint - can't write %s: %s", c.path, err))
+			}
+		}
+	}
+}
+
+func (c *checkpoint) flush() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	return c.f.Sync()
+}
+
+// remove ends the checkpoint of a finished run
+func (c *checkpoint) remove() error {
+	close(c.stop)
+	<-c.done
+	c.f.Close()
+	return os.Remove(c.path)
+}
+
+// readCheckpoint reads the checkpoint of the output directory, a last line cut by the crash is ignored
+func readCheckpoint(outDir string) (*checkpointHeader, []*download.Result, error) {
+	path := filepath.Join(outDir, checkpointName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("no checkpoint of a run in %s to resume", outDir)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	header := &checkpointHeader{}
+	if !scanner.Scan() {
+		return nil, nil, errors.New(path + ": empty checkpoint")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var results []*download.Result
+	for scanner.Scan() {
+		r := &download.Result{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			break
+		}
+		results = append(results, r)
+	}
+	return header, results, scanner.Err()
+}
+
+// resumeJobs returns the jobs of the run of a checkpoint it did not complete, with the results of those
+// it did, the manifests must still have the jobs of the run
+func resumeJobs(header *checkpointHeader, completed []*download.Result, jobs []*download.Job) ([]*download.Job, error) {
+	if len(jobs) != header.Jobs {
+		return nil, fmt.Errorf("the manifests of the checkpoint now have %d jobs instead of %d, start a new run", len(jobs), header.Jobs)
+	}
+	done := make(map[int]bool, len(completed))
+	for _, r := range completed {
+		done[r.Key] = true
+	}
+	var remaining []*download.Job
+	for _, j := range jobs {
+		if !done[j.Key] {
+			remaining = append(remaining, j)
+		}
+	}
+	return remaining, nil
+}
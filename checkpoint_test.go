@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestCheckpointIsOptIn(t *testing.T) {
+	opts, _, _, err := readArgs([]string{"images.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.CheckpointInterval != 0 {
+		t.Errorf("checkpoint interval %s by default, want none", opts.CheckpointInterval)
+	}
+}
+
+func TestCheckpointHeaderRecordsTheSecretsByFlag(t *testing.T) {
+	opts := options{WebDAVPassword: "hunter2"}
+	header := newCheckpointHeader(opts, "", nil, time.Now(), 0)
+	if len(header.Secrets) != 1 || header.Secrets[0] != "webdav-password" {
+		t.Fatalf("secrets %v, want [webdav-password]", header.Secrets)
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("the checkpoint has the value of a secret: %s", data)
+	}
+}
+
+func TestResumeOptions(t *testing.T) {
+	os.Unsetenv(webdavPasswordEnv)
+	header := &checkpointHeader{Options: options{Options: download.Options{Workers: 7}, WebDAVOut: "https://dav"}, Secrets: []string{"webdav-password"}}
+
+	if _, err := resumeOptions(header, options{}); err == nil || !strings.Contains(err.Error(), "--webdav-password") {
+		t.Errorf("resume without the secret: %v, want an error naming --webdav-password", err)
+	}
+
+	resumed, err := resumeOptions(header, options{WebDAVPassword: "again", Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.WebDAVPassword != "again" || !resumed.Prune || resumed.Workers != 7 || resumed.WebDAVOut != "https://dav" {
+		t.Errorf("resumed options %+v", resumed)
+	}
+
+	os.Setenv(webdavPasswordEnv, "from-env")
+	defer os.Unsetenv(webdavPasswordEnv)
+	if _, err := resumeOptions(header, options{}); err != nil {
+		t.Errorf("resume with the secret in the environment: %s", err)
+	}
+}
+
+func TestReadCheckpointIgnoresACutLastLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sample-checkpoint-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := &checkpointHeader{Options: options{Options: download.Options{OutDir: dir}}, Jobs: 3}
+	cp, err := newCheckpoint(header, []*download.Result{{Key: 1, Status: download.StatusOK}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.record(&download.Result{Key: 2, Status: download.StatusFailed})
+	cp.record(&download.Result{Key: 3, Status: download.StatusCanceled}) // downloaded again
+	cp.mu.Lock()
+	cp.flush()
+	cp.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(dir, checkpointName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"key":4,"sta`)
+	f.Close()
+
+	read, completed, err := readCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Jobs != 3 || len(completed) != 2 || completed[0].Key != 1 || completed[1].Key != 2 {
+		t.Fatalf("header %+v, completed %+v", read, completed)
+	}
+	remaining, err := resumeJobs(read, completed, []*download.Job{{Key: 1}, {Key: 2}, {Key: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].Key != 3 {
+		t.Errorf("remaining jobs %+v, want job 3", remaining)
+	}
+	if err := cp.remove(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeAsksForTheURLTransformAgain(t *testing.T) {
+	opts := options{URLTransform: "./resolve --token transform-secret"}
+	header := newCheckpointHeader(opts, "", nil, time.Now(), 0)
+	data, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "transform-secret") {
+		t.Errorf("the checkpoint has the url transform: %s", data)
+	}
+
+	if _, err := resumeOptions(header, options{}); err == nil || !strings.Contains(err.Error(), "--url-transform") {
+		t.Errorf("resume without the url transform: %v, want an error naming --url-transform", err)
+	}
+	resumed, err := resumeOptions(header, options{URLTransform: "s/a/b/"})
+	if err != nil || resumed.URLTransform != "s/a/b/" {
+		t.Errorf("resumed url transform %q, %v", resumed.URLTransform, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The completion scripts complete the commands, and the flags of a command from its -h so they stay
+// in line with the flag sets without being listed twice
+const (
+	bashCompletion = `_sample() {
+	local cur=${COMP_WORDS[COMP_CWORD]} cmd=
+	if [ "$COMP_CWORD" -gt 1 ] && [[ " %[1]s " == *" ${COMP_WORDS[1]} "* ]]; then
+		cmd=${COMP_WORDS[1]}
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$(sample $cmd -h 2>&1 | sed -n 's/^  -\([^ ]*\).*/--\1/p')" -- "$cur"))
+	elif [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%[1]s" -- "$cur") $(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F _sample sample
+`
+	zshCompletion = `#compdef sample
+_sample() {
+	local -a commands flags
+	local cmd=
+	commands=(%[1]s)
+	if (( CURRENT > 2 )) && (( ${commands[(I)${words[2]}]} )); then
+		cmd=${words[2]}
+	fi
+	if [[ $PREFIX == -* ]]; then
+		flags=(${(f)"$(sample $cmd -h 2>&1 | sed -n 's/^  -\([^ ]*\).*/--\1/p')"})
+		compadd -a flags
+	elif (( CURRENT == 2 )); then
+		compadd -a commands
+		_files
+	else
+		_files
+	fi
+}
+compdef _sample sample
+`
+	fishCompletion = `function __sample_command
+	set -l tokens (commandline -opc)
+	if test (count $tokens) -gt 1; and contains -- $tokens[2] %[1]s
+		echo $tokens[2]
+	end
+end
+function __sample_flags
+	sample (__sample_command) -h 2>&1 | sed -n 's/^  -\([^ ]*\).*/--\1/p'
+end
+complete -c sample -n 'string match -q -- "-*" (commandline -ct)' -f -a '(__sample_flags)'
+%[2]s`
+)
+
+// completion prints the completion script of a shell
+func completion(args []string) error {
+	fs := newFlagSet("completion")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the shell, bash, zsh or fish")
+	}
+
+	names := commandNames()
+	switch shell := fs.Arg(0); shell {
+	case "bash":
+		fmt.Printf(bashCompletion, strings.Join(names, " "))
+	case "zsh":
+		fmt.Printf(zshCompletion, strings.Join(names, " "))
+	case "fish":
+		var described []string
+		for _, name := range names {
+			described = append(described, fmt.Sprintf("complete -c sample -n 'test (count (commandline -opc)) -eq 1' -f -a %s -d %q\n", name, help[name].summary))
+		}
+		fmt.Printf(fishCompletion, strings.Join(names, " "), strings.Join(described, ""))
+	default:
+		return fmt.Errorf("unsupported shell %q, expected bash, zsh or fish", shell)
+	}
+	return nil
+}
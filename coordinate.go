@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// nodeTokenEnv sets the bearer token of the coordinator without showing it in the process list
+const nodeTokenEnv = "SAMPLE_NODE_TOKEN"
+
+// coordinate shards the manifest into chunks and dispatches them to the worker nodes started with
+// `sample serve`. A chunk whose node fails is put back in the queue for another node, and a node
+// failing --max-failures times in a row is dropped. The results of all nodes make up the report.
+func coordinate(args []string) error {
+	fs := newFlagSet("coordinate")
+	nodes := fs.String("nodes", "", "comma separated base urls of the worker nodes, e.g. http://10.0.0.2:8080")
+	chunkSize := fs.Int("chunk-size", 100, "number of jobs sent to a node at once")
+	chunkTimeout := fs.Duration("chunk-timeout", 0, "time a node has to process a chunk, 0 means no timeout")
+	maxFailures := fs.Int("max-failures", 3, "consecutive failures after which a node is dropped")
+	reportPath := fs.String("report", "", "write the run results as json to this file")
+	token := fs.String("token", os.Getenv(nodeTokenEnv), "bearer token sent to the nodes or its secretref://, defaults to $"+nodeTokenEnv)
+	tlsCA := fs.String("tls-ca", "", "CA file verifying the certificates of https nodes")
+	tlsCert := fs.String("tls-cert", "", "client certificate file presented to the nodes")
+	tlsKey := fs.String("tls-key", "", "private key file of --tls-cert")
+	opts := options{}
+	fs.BoolVar(&opts.Dataset, "dataset", false, "place images in <split>/<label> sub directories on the nodes")
+	fs.StringVar(&opts.Split, "split", "80,10,10", "train,val,test split ratios of the dataset mode")
+	fs.Parse(args)
+
+	if *nodes == "" {
+		return errors.New("please supply the worker --nodes")
+	}
+	if fs.NArg() < 1 {
+		return errors.New("please supply the images.jon file path")
+	}
+	if *chunkSize < 1 {
+		*chunkSize = 1
+	}
+
+	jobs, invalid, err := loadJobs(opts, fs.Args()...)
+	if err != nil {
+		return err
+	}
+
+	if *token, err = secretRefs(*token); err != nil {
+		return err
+	}
+	d := newDispatcher(jobs, *chunkSize)
+	client, err := nodeClient(*chunkTimeout, *token, *tlsCA, *tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+	wg := &sync.WaitGroup{}
+	for _, node := range strings.Split(*nodes, ",") {
+		wg.Add(1)
+		go d.runNode(wg, client, strings.TrimRight(strings.TrimSpace(node), "/"), *maxFailures)
+	}
+	wg.Wait()
+
+	rep := &report{Options: opts, Results: append(d.finish(), invalid...)}
+	return finish(rep, *reportPath)
+}
+
+// dispatcher hands out chunks to the nodes and collects their results
+type dispatcher struct {
+	sync.Mutex
+	cond     *sync.Cond
+	queue    [][]*download.Job
+	inflight int
+	run      string // prefix of the idempotency keys of the chunks
+	results  []*download.Result
+}
+
+func newDispatcher(jobs []*download.Job, chunkSize int) *dispatcher {
+	d := &dispatcher{run: newRunID(time.Now())}
+	d.cond = sync.NewCond(d)
+	for len(jobs) > 0 {
+		n := chunkSize
+		if n > len(jobs) {
+			n = len(jobs)
+		}
+		d.queue = append(d.queue, jobs[:n])
+		jobs = jobs[n:]
+	}
+	return d
+}
+
+// next returns the next chunk, waiting while chunks are in flight as they may be put back, and false once all are done
+func (d *dispatcher) next() ([]*download.Job, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	for len(d.queue) == 0 && d.inflight > 0 {
+		d.cond.Wait()
+	}
+	if len(d.queue) == 0 {
+		return nil, false
+	}
+	c := d.queue[0]
+	d.queue = d.queue[1:]
+	d.inflight++
+	return c, true
+}
+
+// complete records the results of a processed chunk
+func (d *dispatcher) complete(results []*download.Result) {
+	d.Lock()
+	defer d.Unlock()
+	d.inflight--
+	d.results = append(d.results, results...)
+	d.cond.Broadcast()
+}
+
+// requeue puts back a chunk whose node failed
+func (d *dispatcher) requeue(c []*download.Job) {
+	d.Lock()
+	defer d.Unlock()
+	d.inflight--
+	d.queue = append(d.queue, c)
+	d.cond.Broadcast()
+}
+
+// finish returns the collected results, the jobs left when every node was dropped are reported as failed
+func (d *dispatcher) finish() []*download.Result {
+	d.Lock()
+	defer d.Unlock()
+	for _, c := range d.queue {
+		for _, j := range c {
+			r := download.NewResult(j)
+			r.Status, r.Error, r.ErrorClass = download.StatusFailed, "no worker node available", download.ErrorConnect
+			d.results = append(d.results, r)
+		}
+	}
+	d.queue = nil
+	return d.results
+}
+
+// runNode sends chunks to a node until there are none left or the node failed too many times in a row
+func (d *dispatcher) runNode(wg *sync.WaitGroup, client *http.Client, node string, maxFailures int) {
+	defer wg.Done()
+
+	failures := 0
+	for {
+		c, ok := d.next()
+		if !ok {
+			return
+		}
+		fmt.Println(fmt.Sprintf("node %s - Sending chunk of %d jobs", node, len(c)))
+		// a chunk keeps its key when it is put back, so a node the retry goes back to replays its reply
+		// instead of downloading the chunk twice
+		results, err := postChunk(client, node, fmt.Sprintf("%s-%d", d.run, c[0].Key), c)
+		if err != nil {
+			d.requeue(c)
+			failures++
+			fmt.Println(fmt.Sprintf("node %s - Failed chunk, it is put back in the queue: %s", node, err))
+			if failures >= maxFailures {
+				fmt.Println(fmt.Sprintf("node %s - Dropped after %d failures", node, failures))
+				return
+			}
+			time.Sleep(time.Duration(failures) * time.Second)
+			continue
+		}
+		failures = 0
+		d.complete(results)
+	}
+}
+
+func postChunk(client *http.Client, node, key string, jobs []*download.Job) ([]*download.Result, error) {
+	body, err := json.Marshal(&chunk{Jobs: jobs})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, node+"/chunks", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyHeader, key)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %s", res.Status)
+	}
+	results := &chunkResults{}
+	if err := json.NewDecoder(res.Body).Decode(results); err != nil {
+		return nil, err
+	}
+	return results.Results, nil
+}
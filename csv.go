@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// readImageCSV builds an image struct from a csv file. When the first row names a "url" column it is read
+// as a header and the "url", "label", "id", "checksum", "srcset" and "variants" columns are used, the variants separated by |,
+// otherwise the first column is the url and the optional second column the label.
+func readImageCSV(imageFilePath string) (*image, error) {
+	data, err := readManifest(imageFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var rows [][]string
+	var lines []int // of the rows
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, csvError(imageFilePath, err)
+		}
+		line, _ := reader.FieldPos(0)
+		rows, lines = append(rows, row), append(lines, line)
+	}
+
+	urlCol, labelCol, idCol, checksumCol, srcsetCol, variantsCol := 0, 1, -1, -1, -1, -1
+	if len(rows) > 0 {
+		if col := indexOf(rows[0], "url"); col >= 0 {
+			urlCol, labelCol, idCol, checksumCol = col, indexOf(rows[0], "label"), indexOf(rows[0], "id"), indexOf(rows[0], "checksum")
+			srcsetCol, variantsCol = indexOf(rows[0], "srcset"), indexOf(rows[0], "variants")
+			rows, lines = rows[1:], lines[1:]
+		}
+	}
+
+	content := &image{}
+	hasLabels, hasIDs := false, false
+	for i, row := range rows {
+		srcset := ""
+		if srcsetCol >= 0 && srcsetCol < len(row) {
+			srcset = row[srcsetCol]
+		}
+		if (len(row) <= urlCol || row[urlCol] == "") && srcset == "" {
+			continue
+		}
+		if len(row) <= urlCol {
+			row = append(row, make([]string, urlCol+1-len(row))...)
+		}
+		if err := checkURL(row[urlCol]); err != nil && srcset == "" {
+			content.Invalid = extend(content.Invalid, len(content.Urls)+1)
+			content.Invalid[len(content.Urls)] = fmt.Sprintf("line %d: %s", lines[i], err)
+		}
+		label := ""
+		if labelCol >= 0 && labelCol < len(row) {
+			label = row[labelCol]
+			hasLabels = hasLabels || label != ""
+		}
+		content.Urls = append(content.Urls, row[urlCol])
+		content.Labels = append(content.Labels, label)
+		if idCol >= 0 && idCol < len(row) {
+			content.IDs = append(content.IDs, row[idCol])
+			hasIDs = hasIDs || row[idCol] != ""
+		} else {
+			content.IDs = append(content.IDs, "")
+		}
+		if checksumCol >= 0 && checksumCol < len(row) && row[checksumCol] != "" {
+			content.Checksums = extend(content.Checksums, len(content.Urls))
+			content.Checksums[len(content.Urls)-1] = row[checksumCol]
+		}
+		if srcset != "" {
+			content.Srcsets = extend(content.Srcsets, len(content.Urls))
+			content.Srcsets[len(content.Urls)-1] = srcset
+		}
+		if variantsCol >= 0 && variantsCol < len(row) && row[variantsCol] != "" {
+			content.Variants = extendVariants(content.Variants, len(content.Urls))
+			content.Variants[len(content.Urls)-1] = strings.Split(row[variantsCol], "|")
+		}
+	}
+	if len(content.Urls) == 0 {
+		return nil, errors.New("no urls in " + imageFilePath)
+	}
+	if !hasLabels {
+		content.Labels = nil
+	}
+	if !hasIDs {
+		content.IDs = nil
+	}
+	return content, nil
+}
+
+// indexOf returns the position of the column named name in the header row, or -1
+func indexOf(header []string, name string) int {
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), name) {
+			return i
+		}
+	}
+	return -1
+}
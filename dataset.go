@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// datasetSplits are the splits in the order the --split ratios are given
+var datasetSplits = []string{"train", "val", "test"}
+
+const (
+	unlabeled      = "unlabeled"
+	datasetSummary = "dataset.csv"
+)
+
+// parseSplit parses the train,val,test ratios, they are relative to their sum
+func parseSplit(split string) ([]float64, error) {
+	parts := strings.Split(split, ",")
+	if len(parts) != len(datasetSplits) {
+		return nil, fmt.Errorf("--split needs %d ratios, got %q", len(datasetSplits), split)
+	}
+
+	ratios := make([]float64, len(parts))
+	total := 0.0
+	for i, part := range parts {
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || ratio < 0 {
+			return nil, fmt.Errorf("invalid --split ratio %q", part)
+		}
+		ratios[i] = ratio
+		total += ratio
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("--split ratios must not all be 0")
+	}
+	for i := range ratios {
+		ratios[i] /= total
+	}
+	return ratios, nil
+}
+
+// assignDatasetDirs sets each job directory to <split>/<label>. The split is picked from a hash of the url
+// so an image stays in the same split across runs no matter its position in the file.
+func assignDatasetDirs(jobs []*download.Job, labels []string, ratios []float64) {
+	for i, j := range jobs {
+		label := unlabeled
+		if i < len(labels) && labels[i] != "" {
+			label = sanitizeLabel(labels[i])
+		}
+		j.Dir = filepath.Join(splitFor(j.URL, ratios), label)
+	}
+}
+
+// splitFor maps the url hash into the cumulative ratios
+func splitFor(url string, ratios []float64) string {
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	point := float64(h.Sum64()%10000) / 10000
+
+	cumulative := 0.0
+	for i, ratio := range ratios {
+		cumulative += ratio
+		if point < cumulative {
+			return datasetSplits[i]
+		}
+	}
+	return datasetSplits[len(datasetSplits)-1]
+}
+
+// sanitizeLabel makes a label safe to use as a directory name
+func sanitizeLabel(label string) string {
+	label = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(label))
+	if label == "" || label == "." || label == ".." {
+		return unlabeled
+	}
+	return label
+}
+
+// writeDatasetSummary writes the number of downloaded images per split and label to dataset.csv in outDir
+func writeDatasetSummary(outDir string, results []*download.Result) error {
+	counts := map[string]int{}
+	for _, res := range results {
+		if res.Status == download.StatusOK && res.Dir != "" {
+			counts[filepath.ToSlash(res.Dir)]++
+		}
+	}
+	dirs := make([]string, 0, len(counts))
+	for dir := range counts {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	file, err := os.Create(filepath.Join(outDir, datasetSummary))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"split", "label", "images"})
+	for _, dir := range dirs {
+		parts := strings.SplitN(dir, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		w.Write([]string{parts[0], parts[1], strconv.Itoa(counts[dir])})
+	}
+	w.Flush()
+	return w.Error()
+}
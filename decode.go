@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	goimage "image"
+	"os"
+
+	"github.com/lawrence/sample/download"
+)
+
+// verifyDecode is a validation stage that fully decodes the downloaded image, catching truncated or
+// corrupt files whose header still looks fine, the svg and pdf are checked by verifyDocument
+func verifyDecode(r *download.Result) error {
+	format, err := documentFormat(r.Path)
+	if err != nil {
+		return err
+	}
+	if format != "" {
+		return verifyDocument(r.Path, format)
+	}
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, _, err := goimage.Decode(file); err != nil {
+		return fmt.Errorf("decode: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// dedupCompactLines is the number of lines past which the log is compacted when it is opened, once most
+// of them are superseded by later lines of the same urls
+const dedupCompactLines = 1000
+
+// dedupDB is a log of the downloaded urls shared by separate invocations, a json line is appended for
+// each download under a lock so concurrent runs don't lose each other's entries, and the last line of a
+// url wins. Entries are kept per output root, so runs writing to different directories don't skip each
+// other's urls.
+type dedupDB struct {
+	path  string
+	root  string
+	known map[string]dedupEntry // entries of the root as loaded
+}
+
+type dedupEntry struct {
+	SHA256  string    `json:"sha256"`
+	Path    string    `json:"path"`
+	Bytes   int64     `json:"bytes"`
+	Updated time.Time `json:"updated"`
+}
+
+// dedupLine is a line of the log, the entry of a url downloaded to a root
+type dedupLine struct {
+	Root string `json:"root"`
+	URL  string `json:"url"`
+	dedupEntry
+}
+
+// openDedupDB loads the entries of outDir from the log at path, and compacts the log when most of its
+// lines are superseded or its last line was cut
+func openDedupDB(path, outDir string) (*dedupDB, error) {
+	root, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+	db := &dedupDB{path: path, root: root}
+
+	err = withFileLock(path, true, func() error {
+		entries, lines, cut, err := readDedupLog(path)
+		if err != nil {
+			return err
+		}
+		db.known = map[string]dedupEntry{}
+		count := 0
+		for r, urls := range entries {
+			count += len(urls)
+			if r == root {
+				db.known = urls
+			}
+		}
+		if cut || lines > dedupCompactLines && lines > 2*count {
+			return compactDedupLog(path, entries)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// readDedupLog returns the entries of the log by root and url, with its number of lines and whether
+// its last line was cut by a run that stopped while appending it
+func readDedupLog(path string) (map[string]map[string]dedupEntry, int, bool, error) {
+	entries := map[string]map[string]dedupEntry{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	lines, bad := 0, 0
+	for scanner.Scan() {
+		lines++
+		if bad > 0 {
+			return nil, 0, false, fmt.Errorf("%s: line %d is not a dedup entry", path, bad)
+		}
+		var line dedupLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			bad = lines
+			continue
+		}
+		if entries[line.Root] == nil {
+			entries[line.Root] = map[string]dedupEntry{}
+		}
+		entries[line.Root][line.URL] = line.dedupEntry
+	}
+	return entries, lines, bad > 0, scanner.Err()
+}
+
+// compactDedupLog rewrites the log with a line per entry, the caller holds the exclusive lock
+func compactDedupLog(path string, entries map[string]map[string]dedupEntry) error {
+	var data []byte
+	for root, urls := range entries {
+		for url, entry := range urls {
+			line, err := json.Marshal(dedupLine{Root: root, URL: url, dedupEntry: entry})
+			if err != nil {
+				return err
+			}
+			data = append(append(data, line...), '\n')
+		}
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// check returns a before job hook skipping the urls already downloaded to this root whose file is
+// still there with the same size, unless force is set
+func (db *dedupDB) check(force bool) func(*download.Result) error {
+	return func(r *download.Result) error {
+		if force {
+			return nil
+		}
+		entry, ok := db.known[r.URL]
+		if !ok {
+			return nil
+		}
+		if info, err := os.Stat(entry.Path); err != nil || info.Size() != entry.Bytes {
+			return nil
+		}
+		r.Path, r.Bytes, r.SHA256 = entry.Path, entry.Bytes, entry.SHA256
+		r.SetMeta("dedup", "hit")
+		return fmt.Errorf("already downloaded to %s: %w", entry.Path, download.ErrSkip)
+	}
+}
+
+// record is a completion hook appending the downloaded files to the log as they complete, a run that
+// stops keeps the entries of the files it wrote
+func (db *dedupDB) record(r *download.Result) {
+	if r.Status != download.StatusOK || r.Path == "" {
+		return
+	}
+	path, err := filepath.Abs(r.Path)
+	if err != nil {
+		return
+	}
+	line, err := json.Marshal(dedupLine{Root: db.root, URL: r.URL, dedupEntry: dedupEntry{SHA256: r.SHA256, Path: path, Bytes: r.Bytes, Updated: time.Now()}})
+	if err == nil {
+		err = withFileLock(db.path, true, func() error {
+			f, err := os.OpenFile(db.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(append(line, '\n')); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("dedup - can't record %s in %s: %s", r.URL, db.path, err))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestDedupLogIsAppendedAndCompacted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dedup.log")
+	out := filepath.Join(dir, "out")
+	file := filepath.Join(out, "1.jpg")
+	if err := os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openDedupDB(path, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < dedupCompactLines; i++ {
+		db.record(&download.Result{URL: "http://a.com/1.jpg", Path: file, Bytes: 5, Status: download.StatusOK})
+	}
+	other, err := openDedupDB(path, filepath.Join(dir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.record(&download.Result{URL: "http://a.com/2.jpg", Path: file, Bytes: 5, Status: download.StatusOK})
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"root":"` + out)) // a run stopped while appending
+	f.Close()
+
+	if db, err = openDedupDB(path, out); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.known) != 1 {
+		t.Errorf("%d entries of the root, want 1", len(db.known))
+	}
+	r := &download.Result{URL: "http://a.com/1.jpg"}
+	if err := db.check(false)(r); r.Meta["dedup"] != "hit" || err == nil {
+		t.Errorf("downloaded url not skipped: %v", err)
+	}
+	if err := db.check(true)(&download.Result{URL: "http://a.com/1.jpg"}); err != nil {
+		t.Errorf("downloaded url skipped with --force: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 || !bytes.HasSuffix(data, []byte("\n")) {
+		t.Errorf("log of %d lines after it was compacted, want 2", lines)
+	}
+}
+
+func TestDedupLogRejectsAnInvalidLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	if err := ioutil.WriteFile(path, []byte("not json\n{\"root\":\"/out\",\"url\":\"http://a.com/1.jpg\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDedupDB(path, "/out"); err == nil {
+		t.Error("log with an invalid line opened")
+	}
+}
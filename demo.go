@@ -4,130 +4,407 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"sync"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
 )
 
 const workersCount  = 3
 
-type pool struct {
-	sync.RWMutex
-	jobs map[int]*job
-	workers []*worker
-}
-
-type job struct {
-	key int
-	url string
-}
-
-type worker struct{
-	id int
-}
-
 type image struct {
 	Urls []string `json:"urls"`
+	// Labels are optional, when set they are parallel to Urls
+	Labels []string `json:"labels,omitempty"`
+	// IDs are optional names of the entries parallel to Urls, see validateEntries
+	IDs []string `json:"ids,omitempty"`
+	// Checksums are optional expected checksums of the entries parallel to Urls, see validateEntries
+	Checksums []string `json:"checksums,omitempty"`
+	// Manifests are the files the urls come from when several were merged, see readImages
+	Manifests []string `json:"-"`
+	// Variants are the optional variants of the entries parallel to Urls, see expandVariants
+	Variants [][]string `json:"-"`
+	// Srcsets are the optional srcset attributes of the entries parallel to Urls, see selectSrcsets
+	Srcsets []string `json:"-"`
+	// Originals are the urls of the entries a srcset candidate or a variant replaced, parallel to Urls
+	Originals []string `json:"-"`
+	// Invalid are the reasons the entries parallel to Urls could not be read, see validateEntries
+	Invalid []string `json:"-"`
+}
+
+// commands are the subcommands, without one the args are the flags and images file of a download run
+var commands = map[string]func(args []string) error{
+	"retry":       retry,
+	"serve":       serve,
+	"coordinate":  coordinate,
+	"check":       checkCommand,
+	"diff":        diff,
+	"get":         get,
+	"report":      history,
+	"mockserver":  mockserver,
+	"completion":  completion,
+	"self-update": selfUpdate,
+	"version":     versionCommand,
+	"verify":      verify,
 }
 
 func main() {
-	imageFilePath, err := readFilePathArgs()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalln(err.Error())
+			}
+			return
+		}
+	}
+
+	opts, reportPath, imageFilePaths, err := readArgs(os.Args[1:])
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
-	image, err := readImageFile(imageFilePath)
+	started := time.Now()
+	var header *checkpointHeader
+	var completed []*download.Result // by the run resumed
+	if opts.ResumeLast {
+		if header, completed, err = readCheckpoint(opts.OutDir); err != nil {
+			log.Fatalln(err.Error())
+		}
+		resumed, err := resumeOptions(header, opts)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		opts, reportPath, imageFilePaths, started = resumed, header.Report, header.Manifests, header.Started
+	}
+
+	jobs, invalid, err := loadJobs(opts, imageFilePaths...)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	if header != nil {
+		if jobs, err = resumeJobs(header, completed, jobs); err != nil {
+			log.Fatalln(err.Error())
+		}
+		fmt.Println(fmt.Sprintf("resume - %d jobs completed before, %d to download", len(completed), len(jobs)))
+	} else {
+		header = newCheckpointHeader(opts, reportPath, imageFilePaths, started, len(jobs))
+	}
 
-	workerPool := createWorkerPool(workersCount)
-	workerPool.setJobsFromUrls(image)
-	workerPool.start()
-}
+	if opts.Interactive {
+		if err := confirmPlan(opts, jobs, invalid); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
 
-// createWorkerPool creates a pool of workers
-func createWorkerPool(workersCount int) *pool {
-	workers := make([]*worker, workersCount)
-	for i := range workers {
-		workers[i] = &worker{id: i}
+	var extra []download.Option
+	var cp *checkpoint
+	if opts.CheckpointInterval > 0 {
+		if cp, err = newCheckpoint(header, completed, opts.CheckpointInterval); err != nil {
+			log.Fatalln(err.Error())
+		}
+		extra = append(extra, download.WithOnComplete(cp.record))
 	}
-	return &pool{workers: workers}
-}
+	results, err := process(opts, jobs, extra...)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if len(completed) > 0 {
+		results = append(completed, results...)
+		sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	}
+	results = append(results, invalid...)
+	recordRun(opts, started, results)
 
-// setJobsFromUrls builds a job object from image urls and sets the job to the pool
-func (p *pool) setJobsFromUrls(img *image) {
-	jobs := make(map[int]*job, len(img.Urls))
-	for key, url := range img.Urls {
-		jobs[key] = &job{url: url, key:key}
+	rep := &report{Options: opts, Results: results}
+	if opts.Prune || opts.PruneDryRun {
+		if err := prune(rep, imageFilePaths); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+	err = finish(rep, reportPath)
+	if cp != nil {
+		if err := cp.remove(); err != nil {
+			fmt.Println(fmt.Sprintf("checkpoint - %s", err))
+		}
+	}
+	notifyRun(opts, started, results, err)
+	if err != nil {
+		log.Fatalln(err.Error())
 	}
-	p.jobs = jobs
 }
 
-// start will async run each workers and wait until all jobs are processed by the workers
-func (p *pool) start() {
-	wg := &sync.WaitGroup{}
-	wg.Add(len(p.workers)) //wait for n workers
-	for _, worker := range p.workers {
-		go worker.run(wg, p)
+// loadJobs reads the images files and builds the filtered slice of jobs of the shard, placed in their dataset
+// directories in dataset mode. The invalid entries of the slice are left out of the jobs and returned as
+// skipped results, see manifestJobs, with those of the shard left out by --include and --exclude.
+func loadJobs(opts options, imageFilePaths ...string) ([]*download.Job, []*download.Result, error) {
+	var filtered []*download.Job
+	jobs, reasons, err := manifestJobs(opts, imageFilePaths...)
+	if err == nil {
+		jobs, filtered, err = filterJobs(opts, jobs)
 	}
-	wg.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	jobs = sliceJobs(opts, jobs)
+	jobs = shardJobs(jobs, opts.ShardIndex, opts.ShardCount, opts.ShardMode)
+	skipped := filteredResults(shardJobs(filtered, opts.ShardIndex, opts.ShardCount, opts.ShardMode))
+	if len(reasons) == 0 {
+		return jobs, skipped, nil
+	}
+	valid, invalid := skipInvalid(jobs, reasons)
+	return valid, append(invalid, skipped...), nil
 }
 
-//getJob returns a job or nil if there are no jobs
-func (p *pool) getJob() *job {
-	p.Lock()
-	defer p.Unlock()
+// manifestJobs builds the jobs of every shard of the images files, see readImages, with the reasons of
+// the invalid entries by key, see validateEntries. With --strict an invalid entry fails instead.
+func manifestJobs(opts options, imageFilePaths ...string) ([]*download.Job, map[int]string, error) {
+	image, err := readImages(imageFilePaths)
+	if err == nil {
+		selectSrcsets(image, opts.PreferWidth, opts.PreferDensity)
+	}
+	if err == nil && !opts.GlobOff {
+		image, err = expandGlobs(image)
+	}
+	var dav *davClient
+	if err == nil {
+		dav, err = newDAVClient(opts)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	image = expandWebDAV(image, dav)
+	image = expandVariants(image)
 
-	for key, job := range p.jobs {
-		//naive approach to remove job - so other jobs won't pick it up
-		delete(p.jobs, key)
-		return job
+	reasons := map[int]string{}
+	for key, reason := range validateEntries(image) {
+		if reason != "" {
+			reasons[key] = reason
+		}
+	}
+	if opts.Strict && len(reasons) > 0 {
+		first := -1
+		for key := range reasons {
+			if first < 0 || key < first {
+				first = key
+			}
+		}
+		return nil, nil, fmt.Errorf("%s: %d invalid entries, entry %d: %s", strings.Join(imageFilePaths, ", "), len(reasons), first, reasons[first])
+	}
+	jobs := jobsFromUrls(image)
+	cleanJobs(jobs, newURLCleaner(opts))
+	rules, err := loadRewriteRules(opts.RewriteRules)
+	if err != nil {
+		return nil, nil, err
+	}
+	rewriteJobs(jobs, rules, reasons)
+	transform, err := parseURLTransform(opts.URLTransform)
+	if err == nil {
+		err = transformJobs(jobs, transform, reasons)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.FollowTorrent {
+		followTorrents(jobs, reasons)
+	}
+	if opts.ContentTypeAny {
+		setAnyTypeExts(jobs)
+	}
+	if opts.Dataset {
+		ratios, err := parseSplit(opts.Split)
+		if err != nil {
+			return nil, nil, err
+		}
+		assignDatasetDirs(jobs, image.Labels, ratios)
 	}
-	return nil
+	shards, err := parseShardDirs(opts.ShardDirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if shards != nil {
+		assignShardDirs(jobs, shards)
+	}
+	return jobs, reasons, nil
 }
 
-// run executes the workers - the workers will keep running to process jobs and exits when there are no more jobs
-func (w *worker) run(wg *sync.WaitGroup, p *pool) {
-	for {
-		job := p.getJob()
-		if job == nil {
-			break // if there are no more jobs, stop worker
+// process runs the jobs with a downloader configured from opts, and the extra options, and returns their results
+func process(opts options, jobs []*download.Job, extra ...download.Option) ([]*download.Result, error) {
+	dav, err := newDAVClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	hooks := append(extra, download.WithBeforeRequest(dav.authorize), download.WithBeforeRequest(newPresigner(opts.PresignCommand, opts.PresignExpiry).sign))
+	torrents := &torrentProtocol{seed: opts.TorrentSeed}
+	hooks = append(hooks, download.WithProtocol(schemeMagnet, torrents), download.WithProtocol(schemeTorrent, torrents))
+	var after []func() error // run once all jobs are processed
+	if opts.HostConfig != "" {
+		config, err := loadHostConfig(opts.HostConfig)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithBeforeRequest(config.apply), download.WithHostPolicy(config.policy))
+	}
+	if source := newOAuth2Source(opts); source != nil {
+		hooks = append(hooks, download.WithBeforeRequest(source.authorize), download.WithAfterResponse(source.check))
+	}
+	if signer := newSigV4Signer(opts); signer != nil {
+		hooks = append(hooks, download.WithBeforeRequest(signer.sign))
+	}
+	if opts.CookieJar != "" || opts.Session != "" {
+		jar, err := openSession(opts)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithCookieJar(jar))
+		if opts.CookieJar != "" {
+			after = append(after, jar.save)
+		}
+	}
+	if opts.DedupDB != "" {
+		db, err := openDedupDB(opts.DedupDB, opts.OutDir)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithBeforeJob(db.check(opts.Force)), download.WithOnComplete(db.record))
+	}
+	if opts.NearDup != "" {
+		index, err := loadDhashIndex(opts.OutDir)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithPostProcess(index.dedup(opts.NearDup, opts.NearDupThreshold)))
+		after = append(after, index.save)
+	}
+	if check := conflictCheck(opts); check != nil {
+		hooks = append(hooks, download.WithBeforeJob(check))
+	}
+	if opts.VerifyDecode {
+		hooks = append(hooks, download.WithValidate(verifyDecode))
+	}
+	if opts.Clamd != "" {
+		hooks = append(hooks, download.WithPostProcess(scanClamd(opts.Clamd, opts.Infected, opts.QuarantineDir)))
+	}
+	if !opts.ContentTypeAny && !opts.StreamThrough {
+		hooks = append(hooks, download.WithPostProcess(processDocuments(opts.SanitizeSVG, opts.RasterizeDPI)))
+	}
+	if convert := convertAnimated(opts.Animated); convert != nil {
+		hooks = append(hooks, download.WithPostProcess(convert))
+	}
+	if opts.ExecPost != "" {
+		hooks = append(hooks, download.WithPostProcess(execPost(opts.ExecPost)))
+	}
+	if opts.WebDAVOut != "" {
+		sink, err := newWebDAVSink(opts, dav)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithSink(sink))
+	}
+	if opts.SMBOut != "" {
+		sink, err := newSMBSink(opts)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithSink(sink))
+	}
+	if opts.StreamThrough {
+		sink, err := newPassThrough(opts)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, download.WithPassThrough(sink))
+	} else {
+		if opts.IngestURL != "" {
+			sink, err := newIngestSink(opts)
+			if err != nil {
+				return nil, err
+			}
+			hooks = append(hooks, download.WithSink(sink))
+		}
+		if opts.S3Out != "" {
+			sink, err := newS3Sink(opts)
+			if err != nil {
+				return nil, err
+			}
+			hooks = append(hooks, download.WithSink(sink))
 		}
-		w.downloadImage(job)
 	}
-	wg.Done()
-}
 
-func (w *worker) downloadImage(j *job) {
-	fmt.Println(fmt.Sprintf("worker #%d - Downloading job #%d - %s", w.id, j.key, j.url))
+	if err := applyMirrors(jobs, opts.Mirrors); err != nil {
+		return nil, err
+	}
+	var duplicates map[int][]*download.Job // of the same cleaned url, downloaded once
+	if newURLCleaner(opts) != nil {
+		jobs, duplicates = uniqueJobs(jobs)
+	}
 
-	res, e := http.Get(j.url)
-	if e != nil {
-		log.Fatal(e)
+	delta := newDeltaProtocol(opts.OutDir, jobs, opts.Zsync)
+	hooks = append(hooks, download.WithProtocol(schemeRsync, delta))
+	if opts.Zsync {
+		hooks = append(hooks, download.WithProtocol("http", delta), download.WithProtocol("https", delta))
 	}
-	defer res.Body.Close()
 
-	file, err := os.Create(fmt.Sprintf(".data/%d.jpg", j.key))
+	if size := averageJobSize(opts); size > 0 {
+		hooks = append(hooks, download.WithAverageJobSize(size))
+	}
+	reporter, err := newProgressReporter(opts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if reporter != nil {
+		hooks = append(hooks, reporter.options()...)
+		after = append([]func() error{reporter.close}, after...)
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, res.Body)
-	if err != nil {
-		log.Fatal(err)
+	downloader := download.NewDownloader(append([]download.Option{download.WithOptions(opts.Options)}, hooks...)...)
+	downloader.SetJobs(jobs)
+	downloader.Start()
+
+	for _, fn := range after {
+		if err := fn(); err != nil {
+			return nil, err
+		}
+	}
+	results := downloader.Results()
+	if len(duplicates) > 0 {
+		results = append(results, duplicateResults(results, duplicates, opts.OutDir)...)
+		sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
 	}
+	return results, nil
+}
 
-	fmt.Println(fmt.Sprintf("worker #%d - Completed job #%d - %s", w.id, j.key, j.url))
+// jobsFromUrls builds a job object from each image url, keyed by its position in the file
+func jobsFromUrls(img *image) []*download.Job {
+	jobs := make([]*download.Job, len(img.Urls))
+	for key, url := range img.Urls {
+		jobs[key] = &download.Job{URL: url, Key: key}
+		if key < len(img.IDs) {
+			jobs[key].ID = img.IDs[key]
+		}
+		if key < len(img.Manifests) {
+			jobs[key].Manifest = img.Manifests[key]
+		}
+		if key < len(img.Checksums) {
+			jobs[key].Checksum = img.Checksums[key]
+		}
+		if key < len(img.Originals) {
+			jobs[key].Original = img.Originals[key]
+		}
+	}
+	return jobs
 }
 
-// readImageFile builds an image struct with the image urls
+// readImageFile builds an image struct with the image urls, files with a .csv extension are read by readImageCSV
 func readImageFile(imageFilePath string) (*image, error) {
-	jsonFIle, err := ioutil.ReadFile(imageFilePath)
+	if strings.EqualFold(filepath.Ext(imageFilePath), ".csv") {
+		return readImageCSV(imageFilePath)
+	}
+
+	jsonFIle, err := readManifest(imageFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -135,16 +412,28 @@ func readImageFile(imageFilePath string) (*image, error) {
 	content := &image{}
 	err = json.Unmarshal(jsonFIle, content)
 	if err != nil {
-		return nil, err
+		return nil, jsonError(imageFilePath, jsonFIle, err)
 	}
+	locateInvalid(content, jsonFIle)
 	return content, nil
 }
 
-// readFilePathArgs reads the os args to get the images file path args
-func readFilePathArgs() (string, error) {
-	args := os.Args
-	if len(args) < 2 {
-		return "", errors.New("please supply the images.jon file path")
+// readArgs parses the run flags and the images file path args
+func readArgs(args []string) (options, string, []string, error) {
+	fs := newFlagSet("sample")
+	opts := addRunFlags(fs)
+	reportPath := fs.String("report", "", "write the run results as json to this file")
+	fs.BoolVar(&opts.Prune, "prune", false, "after a run without failures, delete the files of the output directory no entry of the images file produced")
+	fs.BoolVar(&opts.PruneDryRun, "prune-dry-run", false, "list the files --prune would delete")
+	fs.BoolVar(&opts.Interactive, "interactive", false, "preview the plan of the run and ask for confirmation before starting it")
+	fs.BoolVar(&opts.ResumeLast, "resume-last", false, "resume the run of --out that crashed or was killed, from its --checkpoint-interval checkpoint, with its options and images files, the secrets, --ingest-url, --exec-post, --presign-command, --notify-webhook and --url-transform must be given again")
+	fs.Parse(args)
+
+	if err := opts.validate(); err != nil {
+		return *opts, "", nil, err
+	}
+	if fs.NArg() < 1 && !opts.ResumeLast {
+		return *opts, "", nil, errors.New("please supply the images.jon file path")
 	}
-	return args[1], nil
-}
\ No newline at end of file
+	return *opts, *reportPath, fs.Args(), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	goimage "image"
+	_ "image/gif" // decoders registered for goimage.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/lawrence/sample/download"
+)
+
+const (
+	nearDupFlag = "flag"
+	nearDupSkip = "skip"
+)
+
+// dhashIndexFile is kept in the output directory so near duplicates are detected across runs
+const dhashIndexFile = ".dhash.json"
+
+// dhashIndex maps the downloaded files to their difference hash
+type dhashIndex struct {
+	sync.Mutex
+	path   string
+	Hashes map[string]uint64 `json:"hashes"`
+}
+
+// loadDhashIndex reads the index of outDir, a missing index is empty
+func loadDhashIndex(outDir string) (*dhashIndex, error) {
+	index := &dhashIndex{path: filepath.Join(outDir, dhashIndexFile), Hashes: map[string]uint64{}}
+	content, err := ioutil.ReadFile(index.path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, fmt.Errorf("%s: %s", index.path, err)
+	}
+	return index, nil
+}
+
+// save writes the index back to the output directory
+func (idx *dhashIndex) save() error {
+	idx.Lock()
+	defer idx.Unlock()
+
+	content, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(idx.path, content, 0644)
+}
+
+// dedup returns a post process stage that hashes each downloaded image and compares it to the indexed ones.
+// In flag mode near duplicates are only noted in the result meta, in skip mode their file is removed
+// and the job is reported as skipped. Files that can't be decoded as images are left alone.
+func (idx *dhashIndex) dedup(mode string, threshold int) func(*download.Result) error {
+	return func(r *download.Result) error {
+		hash, err := dhashFile(r.Path)
+		if err != nil {
+			return nil
+		}
+		r.SetMeta("dhash", strconv.FormatUint(hash, 16))
+
+		idx.Lock()
+		defer idx.Unlock()
+
+		for path, other := range idx.Hashes {
+			if path == r.Path || bits.OnesCount64(hash^other) > threshold {
+				continue
+			}
+			r.SetMeta("near_duplicate_of", path)
+			if mode == nearDupSkip {
+				if err := os.Remove(r.Path); err != nil {
+					return err
+				}
+				r.Path = ""
+				return fmt.Errorf("near duplicate of %s: %w", path, download.ErrSkip)
+			}
+			break
+		}
+		idx.Hashes[r.Path] = hash
+		return nil
+	}
+}
+
+// dhashFile decodes the image at path and computes its 64 bit difference hash
+func dhashFile(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	img, _, err := goimage.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+	return dhash(img), nil
+}
+
+// dhash shrinks the image to a 9x8 grayscale grid and sets a bit for each cell brighter than its right neighbour
+func dhash(img goimage.Image) uint64 {
+	const width, height = 9, 8
+	var grid [height][width]uint64
+
+	b := img.Bounds()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// average the luminance over the area of the source covered by the cell
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+			if x1 == x0 {
+				x1++
+			}
+			if y1 == y0 {
+				y1++
+			}
+			var sum, count uint64
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += (299*uint64(r) + 587*uint64(g) + 114*uint64(b)) / 1000
+					count++
+				}
+			}
+			grid[y][x] = sum / count
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// manifestDiff are the jobs of a new images file compared to the old one, by output name
+type manifestDiff struct {
+	added     []*download.Job
+	changed   []*download.Job
+	unchanged int
+	// stale are the outputs of the old jobs the new ones don't write anymore
+	stale []string
+}
+
+// diff downloads only the entries added or changed between two images files, and with --prune removes
+// the files of the entries that are gone, so an output directory can be kept in sync incrementally
+func diff(args []string) error {
+	fs := newFlagSet("diff")
+	opts := addRunFlags(fs)
+	reportPath := fs.String("report", "", "write the run results as json to this file")
+	prune := fs.Bool("prune", false, "delete the files of the entries removed from the old images file")
+	fs.Parse(args)
+
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("please supply the old and the new images file paths")
+	}
+	oldJobs, _, err := loadJobs(*opts, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	newJobs, _, err := loadJobs(*opts, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	d := diffJobs(opts.OutDir, oldJobs, newJobs)
+	fmt.Println(fmt.Sprintf("diff - %d added, %d changed, %d unchanged, %d removed",
+		len(d.added), len(d.changed), d.unchanged, len(d.stale)))
+
+	var results []*download.Result
+	if jobs := append(d.added, d.changed...); len(jobs) > 0 {
+		started := time.Now()
+		if results, err = process(*opts, jobs); err != nil {
+			return err
+		}
+		recordRun(*opts, started, results)
+	}
+	if *prune {
+		for _, path := range d.stale {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			fmt.Println(fmt.Sprintf("diff - removed %s", path))
+		}
+	}
+	return finish(&report{Options: *opts, Results: results}, *reportPath)
+}
+
+// diffJobs compares the jobs by the name of their output file, their id or else their key. A job is
+// changed when its url or directory differs, its old output is then stale when it was in another directory
+// or had another extension.
+func diffJobs(outDir string, oldJobs, newJobs []*download.Job) *manifestDiff {
+	old := make(map[string]*download.Job, len(oldJobs))
+	for _, j := range oldJobs {
+		old[jobName(j)] = j
+	}
+
+	d := &manifestDiff{}
+	for _, j := range newJobs {
+		prev, ok := old[jobName(j)]
+		delete(old, jobName(j))
+		switch {
+		case !ok:
+			d.added = append(d.added, j)
+		case prev.URL != j.URL || prev.Dir != j.Dir:
+			d.changed = append(d.changed, j)
+			if prev.Dir != j.Dir || download.JobExt(prev) != download.JobExt(j) {
+				d.stale = append(d.stale, download.OutputPath(outDir, prev))
+			}
+		default:
+			d.unchanged++
+		}
+	}
+	for _, j := range oldJobs {
+		if _, ok := old[jobName(j)]; ok {
+			d.stale = append(d.stale, download.OutputPath(outDir, j))
+		}
+	}
+	return d
+}
+
+// jobName is the id of a job, or its key when it has none
+func jobName(j *download.Job) string {
+	if j.ID != "" {
+		return j.ID
+	}
+	return strconv.Itoa(j.Key)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Formats of the vector and document assets of mixed manifests
+const (
+	formatSVG = "svg"
+	formatPDF = "pdf"
+)
+
+// documentSniffSize is the start of a file read to tell an svg or a pdf
+const documentSniffSize = 4096
+
+// pdfTrailerSize is the end of a pdf searched for its %%EOF marker
+const pdfTrailerSize = 1024
+
+// processDocuments returns a post process stage for the svg and pdf downloads, which the image stages
+// leave alone: an svg is stripped of its scripts, event handlers and javascript: urls when sanitize
+// is set, and with a dpi both are rasterized to a jpeg of their first page, the format of the output
+// files. The svg and pdf kept as they are get their extension instead of .jpg, the result path is
+// renamed to it.
+func processDocuments(sanitize bool, dpi int) func(*download.Result) error {
+	return func(r *download.Result) error {
+		format, err := documentFormat(r.Path)
+		if err != nil || format == "" {
+			return err
+		}
+		r.SetMeta("format", format)
+		if format == formatSVG && sanitize && dpi == 0 {
+			removed, err := sanitizeSVGFile(r.Path)
+			if err != nil {
+				return fmt.Errorf("sanitize svg: %s", err)
+			}
+			r.SetMeta("svg_removed", strconv.Itoa(removed))
+		}
+		if dpi > 0 {
+			if err := rasterize(r.Path, format, dpi); err != nil {
+				return fmt.Errorf("rasterize %s: %s", format, err)
+			}
+			r.SetMeta("rasterized", fmt.Sprintf("%s@%ddpi", format, dpi))
+		} else if ext := "." + format; filepath.Ext(r.Path) != ext {
+			named := strings.TrimSuffix(r.Path, filepath.Ext(r.Path)) + ext
+			if err := os.Rename(r.Path, named); err != nil {
+				return err
+			}
+			r.Path = named
+		}
+		r.Bytes = fileSize(r.Path)
+		return nil
+	}
+}
+
+// documentFormat returns svg or pdf when the file at path is one, empty otherwise
+func documentFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, documentSniffSize)
+	n, _ := io.ReadFull(file, head)
+	head = bytes.TrimLeft(bytes.TrimPrefix(head[:n], utf8BOM), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return formatPDF, nil
+	case bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg")):
+		return formatSVG, nil
+	}
+	return "", nil
+}
+
+// verifyDocument is the --verify-decode check of an svg or a pdf: an svg parses to the end with an
+// svg root element, a pdf ends with its %%EOF marker
+func verifyDocument(path, format string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if format == formatPDF {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		tail := make([]byte, pdfTrailerSize)
+		offset := info.Size() - pdfTrailerSize
+		if offset < 0 {
+			offset = 0
+		}
+		n, _ := file.ReadAt(tail, offset)
+		if !bytes.Contains(tail[:n], []byte("%%EOF")) {
+			return errors.New("pdf without its %%EOF marker, truncated")
+		}
+		return nil
+	}
+
+	dec := xml.NewDecoder(file)
+	dec.Strict = false
+	root := ""
+	for {
+		t, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("svg: %s", err)
+		}
+		if start, ok := t.(xml.StartElement); ok && root == "" {
+			root = start.Name.Local
+		}
+	}
+	if root != "svg" {
+		return fmt.Errorf("svg: root element is %q", root)
+	}
+	return nil
+}
+
+// sanitizeSVGFile rewrites the svg at path without its active content, see sanitizeSVG, and returns
+// the number of elements and attributes it removed
+func sanitizeSVGFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	clean, removed, err := sanitizeSVG(data)
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".svg")
+	if err := ioutil.WriteFile(tmp, clean, 0644); err != nil {
+		return 0, err
+	}
+	return removed, os.Rename(tmp, path)
+}
+
+// sanitizeSVG drops the script elements of an svg, those of an embedded html included, the on*
+// event handler attributes and the attributes whose value is a javascript: url, such as an href or
+// the values of an animation. The rest of the document is written back token by token.
+func sanitizeSVG(data []byte) ([]byte, int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	var out bytes.Buffer
+	removed := 0
+	skipping := 0 // depth inside a removed element
+	for {
+		t, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if skipping > 0 || strings.EqualFold(t.Name.Local, "script") {
+				if skipping == 0 {
+					removed++
+				}
+				skipping++
+				continue
+			}
+			out.WriteString("<" + rawName(t.Name))
+			for _, attr := range t.Attr {
+				value := strings.ToLower(strings.Map(dropSpace, attr.Value))
+				if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") || strings.HasPrefix(value, "javascript:") {
+					removed++
+					continue
+				}
+				out.WriteString(" " + rawName(attr.Name) + `="` + attrEscaper.Replace(attr.Value) + `"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipping > 0 {
+				skipping--
+				continue
+			}
+			out.WriteString("</" + rawName(t.Name) + ">")
+		case xml.CharData:
+			if skipping == 0 {
+				out.WriteString(textEscaper.Replace(string(t)))
+			}
+		case xml.Comment:
+			if skipping == 0 {
+				out.WriteString("<!--" + string(t) + "-->")
+			}
+		case xml.ProcInst:
+			out.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			out.WriteString("<!" + string(t) + ">")
+		}
+	}
+	return out.Bytes(), removed, nil
+}
+
+// textEscaper and attrEscaper escape the text and the attribute values written back, unlike
+// xml.EscapeText they keep the new lines and tabs as they are
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;")
+)
+
+// rawName writes a name of RawToken back with its prefix
+func rawName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// dropSpace removes the spaces and control characters browsers ignore in a url, as in "java\tscript:"
+func dropSpace(r rune) rune {
+	if r <= ' ' {
+		return -1
+	}
+	return r
+}
+
+// rasterize replaces the svg or pdf at path by a jpeg of its first page at dpi, rendered by
+// rsvg-convert or pdftoppm to a png
+func rasterize(path, format string, dpi int) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".raster")
+	rendered := tmp + ".png"
+	defer os.Remove(rendered)
+	d := strconv.Itoa(dpi)
+	var cmd *exec.Cmd
+	if format == formatSVG {
+		cmd = exec.Command("rsvg-convert", "--dpi-x", d, "--dpi-y", d, "--format", "png", "--output", rendered, path)
+	} else {
+		cmd = exec.Command("pdftoppm", "-r", d, "-f", "1", "-singlefile", "-png", path, tmp)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s: %s", cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("%s: %s", cmd.Args[0], err)
+	}
+	file, err := os.Open(rendered)
+	if err != nil {
+		return err
+	}
+	img, err := png.Decode(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return writeStill(path, img)
+}
@@ -0,0 +1,55 @@
+package download
+
+import "time"
+
+// stopReason returns why no new job should be started, or an empty string while the run is within its
+// byte, duration and disk budgets. It must be called with the lock held.
+func (d *Downloader) stopReason() string {
+	switch {
+	case d.maxTotalBytes > 0 && d.transferred >= d.maxTotalBytes:
+		return "total bytes budget exhausted"
+	case d.maxDuration > 0 && time.Since(d.started) >= d.maxDuration:
+		return "run duration budget exhausted"
+	case d.maxDiskUsage > 0 && d.diskUsage >= d.maxDiskUsage && d.diskPolicy != DiskPruneOldest:
+		return "disk usage quota reached"
+	}
+	return ""
+}
+
+// addTransferred counts the bytes of a finished job against the budgets, it must be called with the lock held
+func (d *Downloader) addTransferred(r *Result) {
+	if r.Status == StatusSkipped {
+		// nothing was transferred and the file, if any, was counted when the disk usage was measured
+		if r.Path != "" {
+			d.written[r.Path] = true
+		}
+		return
+	}
+	if r.TransferBytes > 0 {
+		d.transferred += r.TransferBytes
+	} else {
+		d.transferred += r.Bytes
+	}
+	if r.Path != "" {
+		d.diskUsage += r.Bytes
+		d.written[r.Path] = true
+	}
+}
+
+// markUnprocessed records the jobs left in the queue once a budget stopped the workers
+func (d *Downloader) markUnprocessed() {
+	d.mu.Lock()
+	reason := d.stopReason()
+	left := d.queue.Jobs()
+	d.queue.Clear()
+	d.mu.Unlock()
+
+	if len(left) > 0 {
+		d.logf("%s - %d jobs left unprocessed", reason, len(left))
+	}
+	for _, j := range left {
+		res := NewResult(j)
+		res.Status, res.Error = StatusUnprocessed, reason
+		d.done(res)
+	}
+}
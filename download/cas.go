@@ -0,0 +1,187 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// casIndexFile maps urls and etags to the objects of the content addressable store
+const casIndexFile = "index.json"
+
+// Links of the outputs to the objects of the content addressable store
+const (
+	CASHardLinks = "hard"
+	// CASSymlinks lets the store be on another file system than the output directories, the
+	// outputs are then a link farm pointing to the objects by name
+	CASSymlinks = "symlink"
+)
+
+// cas is a content addressable store of downloaded files named by their sha256, output files are
+// hard links to its objects so a url whose content is already stored doesn't need to be fetched again
+type cas struct {
+	sync.Mutex
+	dir      string
+	symlinks bool
+	index    casIndex
+}
+
+type casIndex struct {
+	URLs  map[string]string `json:"urls"`  // url to sha256
+	ETags map[string]string `json:"etags"` // host and etag to sha256
+}
+
+// openCAS loads the store index of dir, a missing or unreadable index starts empty
+func openCAS(dir, links string, log Logger) *cas {
+	c := &cas{dir: dir, symlinks: links == CASSymlinks, index: casIndex{URLs: map[string]string{}, ETags: map[string]string{}}}
+	if abs, err := filepath.Abs(dir); err == nil && c.symlinks {
+		c.dir = abs // the links must not depend on the working directory
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, casIndexFile))
+	if err == nil {
+		err = json.Unmarshal(content, &c.index)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cas - ignoring index of %s: %s", dir, err)
+	}
+	if c.index.URLs == nil {
+		c.index.URLs = map[string]string{}
+	}
+	if c.index.ETags == nil {
+		c.index.ETags = map[string]string{}
+	}
+	return c
+}
+
+func (c *cas) objectPath(sum string) string {
+	return filepath.Join(c.dir, "objects", sum[:2], sum)
+}
+
+// linkURL links path to the stored content of url and returns its sha256 and size, false if url is not stored
+func (c *cas) linkURL(url, path string) (string, int64, bool) {
+	if c == nil {
+		return "", 0, false
+	}
+	c.Lock()
+	sum, ok := c.index.URLs[url]
+	c.Unlock()
+	if !ok {
+		return "", 0, false
+	}
+	n, ok := c.link(sum, path)
+	return sum, n, ok
+}
+
+// linkETag links path to the stored content with the same etag from the same host as the response
+func (c *cas) linkETag(res *http.Response, path string) (string, int64, bool) {
+	etag := res.Header.Get("ETag")
+	if c == nil || etag == "" {
+		return "", 0, false
+	}
+	c.Lock()
+	sum, ok := c.index.ETags[res.Request.URL.Host+" "+etag]
+	c.Unlock()
+	if !ok {
+		return "", 0, false
+	}
+	n, ok := c.link(sum, path)
+	if ok {
+		c.Lock()
+		c.index.URLs[res.Request.URL.String()] = sum
+		c.Unlock()
+	}
+	return sum, n, ok
+}
+
+// link replaces path with a hard link to the object, copying it when hard links are not possible,
+// or with a symbolic link
+func (c *cas) link(sum, path string) (int64, bool) {
+	object := c.objectPath(sum)
+	info, err := os.Stat(object)
+	if err != nil {
+		return 0, false
+	}
+	os.Remove(path)
+	if c.symlinks {
+		return info.Size(), os.Symlink(object, path) == nil
+	}
+	if err := os.Link(object, path); err != nil {
+		if err := copyFile(object, path); err != nil {
+			return 0, false
+		}
+	}
+	return info.Size(), true
+}
+
+// store adds the downloaded file at path to the store, or replaces it with a link to the object
+// when the same content is already stored, and records its url and etag
+func (c *cas) store(path, sum string, res *http.Response) error {
+	object := c.objectPath(sum)
+	added := false
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(path, object); err != nil {
+			if err := copyFile(path, object); err != nil {
+				return err
+			}
+		}
+		added = true
+	}
+	if !added || c.symlinks {
+		if _, ok := c.link(sum, path); !ok {
+			return fmt.Errorf("cas: can't link %s", object)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.index.URLs[res.Request.URL.String()] = sum
+	if etag := res.Header.Get("ETag"); etag != "" {
+		c.index.ETags[res.Request.URL.Host+" "+etag] = sum
+	}
+	return nil
+}
+
+// save writes the index back to the store directory
+func (c *cas) save() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	content, err := json.Marshal(c.index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.dir, casIndexFile), content, 0644)
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,258 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// cassetteFile is the index of the interactions of a cassette directory, the bodies are stored next
+// to it by their sha256 so the identical ones of a large manifest are stored once
+const cassetteFile = "cassette.jsonl"
+
+// ErrNotRecorded is returned, wrapped, when replaying a request the cassette has no response for
+var ErrNotRecorded = errors.New("not recorded")
+
+// interaction is a line of a cassette: a request and its response, or the error it failed with
+type interaction struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Status     string      `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"` // sha256 of the body
+	Error      string      `json:"error,omitempty"`
+}
+
+// recorder is a Fetcher recording the interactions of the fetcher it wraps to a cassette. A response is
+// recorded once its body was read to the end, or when it is closed unread if it is the response of a
+// HEAD or of an error status, whose body is never read. The aborted transfers are not recorded.
+type recorder struct {
+	next Fetcher
+	dir  string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openRecorder starts a new cassette in dir, replacing the interactions of a previous recording
+func openRecorder(next Fetcher, dir string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filepath.Join(dir, cassetteFile))
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{next: next, dir: dir, file: file}, nil
+}
+
+func (r *recorder) Do(req *http.Request) (*http.Response, error) {
+	it := &interaction{Method: req.Method, URL: req.URL.String()}
+	res, err := r.next.Do(req)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			it.Error = err.Error()
+			r.write(it)
+		}
+		return nil, err
+	}
+	it.StatusCode, it.Status, it.Header = res.StatusCode, res.Status, res.Header.Clone()
+	tmp, err := ioutil.TempFile(r.dir, ".body")
+	if err != nil {
+		return res, nil // the transfer goes on unrecorded
+	}
+	bodyless := req.Method == http.MethodHead || res.StatusCode < 200 || res.StatusCode >= 300
+	res.Body = &recordingBody{ReadCloser: res.Body, tmp: tmp, sum: sha256.New(), bodyless: bodyless, commit: func(sum string) error {
+		if sum != "" {
+			it.Body = sum
+			if err := os.Rename(tmp.Name(), filepath.Join(r.dir, sum)); err != nil {
+				return err
+			}
+		}
+		return r.write(it)
+	}}
+	return res, nil
+}
+
+func (r *recorder) write(it *interaction) error {
+	line, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *recorder) close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// recordingBody writes the body to a temporary file as it is read and commits it to the cassette at its end
+type recordingBody struct {
+	io.ReadCloser
+	tmp  *os.File
+	sum  hash.Hash
+	read int64
+	// bodyless responses are recorded without body when they are closed unread
+	bodyless bool
+	commit   func(sum string) error // with an empty sum the response is recorded without body
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if n > 0 && b.tmp != nil {
+		b.sum.Write(p[:n])
+		if _, werr := b.tmp.Write(p[:n]); werr != nil {
+			b.discard()
+		}
+	}
+	if err == io.EOF && b.tmp != nil {
+		tmp := b.tmp
+		b.tmp = nil
+		if tmp.Close() != nil || b.commit(hex.EncodeToString(b.sum.Sum(nil))) != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	if b.tmp != nil && b.read == 0 && b.bodyless {
+		b.commit("")
+	}
+	b.discard()
+	return b.ReadCloser.Close()
+}
+
+func (b *recordingBody) discard() {
+	if b.tmp != nil {
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+		b.tmp = nil
+	}
+}
+
+// replayer is a Fetcher serving the responses of a cassette without network. The interactions of a
+// request are replayed in the order they were recorded, e.g. a 503 then the 200 of its retry, the last
+// one is repeated.
+type replayer struct {
+	dir  string
+	mu   sync.Mutex
+	byID map[string][]*interaction
+	err  error // of the cassette, every request fails with it
+}
+
+// openReplayer loads the cassette of dir, a missing or broken cassette fails the requests
+func openReplayer(dir string, log Logger) *replayer {
+	r := &replayer{dir: dir, byID: map[string][]*interaction{}}
+	file, err := os.Open(filepath.Join(dir, cassetteFile))
+	if err != nil {
+		r.err = fmt.Errorf("replay - can't open the cassette: %w", err)
+		log.Printf("%s", r.err)
+		return r
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		it := &interaction{}
+		if err := json.Unmarshal(scanner.Bytes(), it); err != nil {
+			r.err = fmt.Errorf("replay - line %d of the cassette: %w", line, err)
+			break
+		}
+		id := interactionID(it.Method, it.URL)
+		r.byID[id] = append(r.byID[id], it)
+	}
+	if err := scanner.Err(); err != nil && r.err == nil {
+		r.err = fmt.Errorf("replay - can't read the cassette: %w", err)
+	}
+	if r.err != nil {
+		log.Printf("%s", r.err)
+		return r
+	}
+	log.Printf("replay - %d requests recorded in %s", len(r.byID), dir)
+	return r
+}
+
+func interactionID(method, url string) string {
+	return method + " " + url
+}
+
+func (r *replayer) next(req *http.Request) (*interaction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := interactionID(req.Method, req.URL.String())
+	recorded := r.byID[id]
+	if len(recorded) == 0 {
+		return nil, false
+	}
+	if len(recorded) > 1 {
+		r.byID[id] = recorded[1:]
+	}
+	return recorded[0], true
+}
+
+func (r *replayer) Do(req *http.Request) (*http.Response, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	it, ok := r.next(req)
+	if !ok {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrNotRecorded)
+	}
+	if it.Error != "" {
+		return nil, errors.New(it.Error)
+	}
+	res := &http.Response{
+		Status:     it.Status,
+		StatusCode: it.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     it.Header.Clone(),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	if it.Body != "" {
+		body, err := os.Open(filepath.Join(r.dir, it.Body))
+		if err != nil {
+			return nil, fmt.Errorf("replay - missing body of %s: %w", req.URL, err)
+		}
+		info, err := body.Stat()
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		res.Body, res.ContentLength = body, info.Size()
+	}
+	return res, nil
+}
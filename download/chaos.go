@@ -0,0 +1,107 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned, wrapped, by the failures injected by the chaos options
+var ErrInjected = errors.New("injected fault")
+
+// chaosFetcher injects faults into the requests of the fetcher it wraps, see Options.ChaosFailRate
+type chaosFetcher struct {
+	next         Fetcher
+	failRate     float64
+	slowRate     float64
+	slowRead     time.Duration
+	truncateRate float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newChaosFetcher returns next itself when no fault is injected
+func newChaosFetcher(next Fetcher, opts Options) Fetcher {
+	if opts.ChaosFailRate <= 0 && opts.ChaosSlowRate <= 0 && opts.ChaosTruncateRate <= 0 {
+		return next
+	}
+	slowRead := opts.ChaosSlowRead
+	if slowRead <= 0 {
+		slowRead = 100 * time.Millisecond
+	}
+	return &chaosFetcher{
+		next:         next,
+		failRate:     opts.ChaosFailRate,
+		slowRate:     opts.ChaosSlowRate,
+		slowRead:     slowRead,
+		truncateRate: opts.ChaosTruncateRate,
+		rand:         rand.New(rand.NewSource(opts.ChaosSeed)),
+	}
+}
+
+// draw reports whether a fault of the rate happens
+func (c *chaosFetcher) draw(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.Float64() < rate
+}
+
+func (c *chaosFetcher) Do(req *http.Request) (*http.Response, error) {
+	if c.draw(c.failRate) {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrInjected)
+	}
+	res, err := c.next.Do(req)
+	if err != nil || req.Method == http.MethodHead {
+		return res, err
+	}
+	body := &chaosBody{ReadCloser: res.Body, limit: -1}
+	if c.draw(c.slowRate) {
+		body.delay = c.slowRead
+	}
+	if c.draw(c.truncateRate) {
+		// a clean end before the whole body, as a proxy closing early would, for the validation to catch
+		c.mu.Lock()
+		body.limit = c.rand.Int63n(4096)
+		if res.ContentLength > 0 {
+			body.limit = c.rand.Int63n(res.ContentLength)
+		}
+		c.mu.Unlock()
+	}
+	if body.delay > 0 || body.limit >= 0 {
+		res.Body = body
+	}
+	return res, nil
+}
+
+// chaosBody slows down the reads of a body by delay and ends it after limit bytes, unless negative
+type chaosBody struct {
+	io.ReadCloser
+	delay time.Duration
+	limit int64
+	read  int64
+}
+
+func (b *chaosBody) Read(p []byte) (int, error) {
+	if b.limit >= 0 {
+		if b.read >= b.limit {
+			return 0, io.EOF
+		}
+		if left := b.limit - b.read; int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	if b.delay > 0 {
+		time.Sleep(b.delay)
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,213 @@
+package download
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Checksum algorithms of Options.Checksums and of the Job checksums
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+)
+
+var checksumHashes = map[string]func() hash.Hash{
+	ChecksumMD5:    md5.New,
+	ChecksumSHA1:   sha1.New,
+	ChecksumSHA256: sha256.New,
+	ChecksumSHA512: sha512.New,
+}
+
+// ChecksumNames returns the checksum algorithms that can be computed and verified, sorted
+func ChecksumNames() []string {
+	names := make([]string, 0, len(checksumHashes))
+	for name := range checksumHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checksumAlgorithms names the algorithm of a bare hex checksum by its length
+var checksumAlgorithms = map[int]string{32: ChecksumMD5, 40: ChecksumSHA1, 64: ChecksumSHA256, 128: ChecksumSHA512}
+
+// ErrChecksumMismatch is returned, wrapped, when a file doesn't have the checksum of its job
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ParseChecksum splits an "algorithm:hex" checksum, the algorithm of a bare hex checksum is told by its length
+func ParseChecksum(checksum string) (string, string, error) {
+	algorithm, sum := "", strings.ToLower(strings.TrimSpace(checksum))
+	if i := strings.Index(sum, ":"); i >= 0 {
+		algorithm, sum = sum[:i], sum[i+1:]
+	} else {
+		algorithm = checksumAlgorithms[len(sum)]
+	}
+	if _, ok := checksumHashes[algorithm]; !ok {
+		return "", "", fmt.Errorf("unknown algorithm of checksum %q", checksum)
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != checksumHashes[algorithm]().Size() {
+		return "", "", fmt.Errorf("checksum %q is not a %s", checksum, algorithm)
+	}
+	return algorithm, sum, nil
+}
+
+// ValidateChecksums checks a comma separated list of algorithms of Options.Checksums
+func ValidateChecksums(algorithms string) error {
+	for _, name := range splitList(algorithms) {
+		if _, ok := checksumHashes[name]; !ok {
+			return fmt.Errorf("unknown checksum algorithm %q", name)
+		}
+	}
+	return nil
+}
+
+// checksummer computes the checksums of a transfer while it is written, sha256 always and the extra
+// algorithms of the options and of the job checksum
+type checksummer struct {
+	names  []string
+	hashes []hash.Hash
+}
+
+func newChecksummer(extra []string, j *Job) *checksummer {
+	names := append([]string{ChecksumSHA256}, extra...)
+	if algorithm, _, err := ParseChecksum(j.Checksum); err == nil {
+		names = append(names, algorithm)
+	}
+	c := &checksummer{}
+	for _, name := range names {
+		if indexOfString(c.names, name) >= 0 {
+			continue
+		}
+		if newHash, ok := checksumHashes[name]; ok {
+			c.names = append(c.names, name)
+			c.hashes = append(c.hashes, newHash())
+		}
+	}
+	return c
+}
+
+// writer is fed the body as it is copied to the file
+func (c *checksummer) writer() io.Writer {
+	writers := make([]io.Writer, len(c.hashes))
+	for i, h := range c.hashes {
+		writers[i] = h
+	}
+	return io.MultiWriter(writers...)
+}
+
+// result sets the sums on the result, sha256 in SHA256 and the others in Checksums
+func (c *checksummer) result(r *Result) {
+	for i, name := range c.names {
+		sum := hex.EncodeToString(c.hashes[i].Sum(nil))
+		if name == ChecksumSHA256 {
+			r.SHA256 = sum
+			continue
+		}
+		if r.Checksums == nil {
+			r.Checksums = map[string]string{}
+		}
+		r.Checksums[name] = sum
+	}
+}
+
+// verifyChecksum checks the checksum of the job against the sums of the result. A file linked from the
+// store only has its sha256, a checksum of another algorithm is then left unverified rather than read again.
+func verifyChecksum(j *Job, r *Result) error {
+	if j.Checksum == "" {
+		return nil
+	}
+	algorithm, want, err := ParseChecksum(j.Checksum)
+	if err != nil {
+		return err
+	}
+	got := r.Checksums[algorithm]
+	if algorithm == ChecksumSHA256 {
+		got = r.SHA256
+	}
+	if got == "" || got == want {
+		return nil
+	}
+	return fmt.Errorf("%s %s instead of %s: %w", algorithm, got, want, ErrChecksumMismatch)
+}
+
+// HashFile returns the sums of a file by algorithm, and its size
+func HashFile(path string, algorithms ...string) (map[string]string, int64, error) {
+	hashes := map[string]hash.Hash{}
+	var writers []io.Writer
+	for _, name := range algorithms {
+		newHash, ok := checksumHashes[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown checksum algorithm %q", name)
+		}
+		if _, ok := hashes[name]; !ok {
+			hashes[name] = newHash()
+			writers = append(writers, hashes[name])
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	n, err := io.Copy(io.MultiWriter(append(writers, ioutil.Discard)...), file)
+	if err != nil {
+		return nil, n, err
+	}
+	sums := make(map[string]string, len(hashes))
+	for name, h := range hashes {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, n, nil
+}
+
+// writeSidecars writes a <file>.<algorithm> file of each sum of the result, in the format of sha256sum -c
+func writeSidecars(r *Result) error {
+	sums := map[string]string{ChecksumSHA256: r.SHA256}
+	for name, sum := range r.Checksums {
+		sums[name] = sum
+	}
+	for name, sum := range sums {
+		if sum == "" {
+			continue
+		}
+		line := sum + "  " + filepath.Base(r.Path) + "\n"
+		if err := ioutil.WriteFile(r.Path+"."+name, []byte(line), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitList returns the trimmed non empty items of a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func indexOfString(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
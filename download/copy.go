@@ -0,0 +1,23 @@
+package download
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBuffers are the buffers of the transfers with Options.IOBuffer, a pool per size
+var copyBuffers sync.Map // int64 -> *sync.Pool
+
+// copyBody writes body to w through a buffer of size bytes, or the 32 kB one of io.Copy when size is 0.
+// The bodies are decoded and hashed on the way so the kernel can't splice them from the socket to the
+// file, a large buffer still cuts the number of reads and writes of the fast transfers.
+func copyBody(w io.Writer, body io.Reader, size int64) (int64, error) {
+	if size <= 0 {
+		return io.Copy(w, body)
+	}
+	pool, _ := copyBuffers.LoadOrStore(size, &sync.Pool{New: func() interface{} { return make([]byte, size) }})
+	buf := pool.(*sync.Pool).Get().([]byte)
+	defer pool.(*sync.Pool).Put(buf)
+	// hide the ReaderFrom of the file, it would copy through its own small buffer
+	return io.CopyBuffer(struct{ io.Writer }{w}, body, buf)
+}
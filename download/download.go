@@ -0,0 +1,876 @@
+// Package download runs a pool of workers that fetch urls into an output directory.
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job statuses as reported by Status and in results
+const (
+	StatusQueued   = "queued"
+	StatusRunning  = "running"
+	StatusOK       = "ok"
+	StatusFailed   = "failed"
+	StatusTimeout  = "timeout"
+	StatusCanceled = "canceled"
+	StatusSkipped  = "skipped"
+	// StatusUnprocessed is reported for jobs not started because the run budget was exhausted
+	StatusUnprocessed = "unprocessed"
+)
+
+// ErrSkip can be returned, possibly wrapped, by a post process stage to report the job as skipped rather than failed
+var ErrSkip = errors.New("skipped")
+
+// ErrUnknownJob is returned when cancelling a job that is not queued or in flight
+var ErrUnknownJob = errors.New("job is not queued or running")
+
+// Options configures a Downloader
+type Options struct {
+	Workers int           `json:"workers"`
+	Timeout time.Duration `json:"timeout"`
+	OutDir  string        `json:"out_dir"`
+	Retries int           `json:"retries"`
+	// Order is the Order* order the jobs are started in, OrderManifest by default, Seed draws
+	// the OrderShuffle order
+	Order string `json:"order,omitempty"`
+	Seed  int64  `json:"seed,omitempty"`
+	// NotFound is the NotFound* policy of 404 responses, failing by default
+	NotFound string `json:"not_found,omitempty"`
+	// Redirects is the Redirect* policy of 3xx responses, following them by default
+	Redirects string `json:"redirects,omitempty"`
+	// Encodings is the Accept-Encoding list of supported encodings, gzip and deflate but not br or
+	// zstd, or EncodingNone, the transport default is used when empty
+	Encodings string `json:"encodings,omitempty"`
+	// MinSpeed in bytes per second and StallTimeout abort and retry transfers that are too slow for too long
+	MinSpeed     int64         `json:"min_speed,omitempty"`
+	StallTimeout time.Duration `json:"stall_timeout,omitempty"`
+	// MaxTotalBytes and MaxDuration bound the whole run, once exceeded no new job is started
+	MaxTotalBytes int64         `json:"max_total_bytes,omitempty"`
+	MaxDuration   time.Duration `json:"max_duration,omitempty"`
+	// MaxDiskUsage is a quota on the size of the output directory, including the files already there,
+	// DiskPolicy says whether reaching it stops the run or prunes the oldest files
+	MaxDiskUsage int64  `json:"max_disk_usage,omitempty"`
+	DiskPolicy   string `json:"disk_policy,omitempty"`
+	// MaxMemory is a ceiling of the heap in bytes, no new job is started while the heap is close to it
+	MaxMemory int64 `json:"max_memory,omitempty"`
+	// MaxOpenFiles caps the jobs in flight so their descriptors fit in this many open files, the limit
+	// of the process (raised to its hard limit) when 0, no cap when negative
+	MaxOpenFiles int `json:"max_open_files,omitempty"`
+	// Checksums is a comma separated list of Checksum* algorithms computed while the files are written,
+	// on top of sha256. ChecksumSidecars writes them next to each file as <file>.<algorithm>.
+	Checksums        string `json:"checksums,omitempty"`
+	ChecksumSidecars bool   `json:"checksum_sidecars,omitempty"`
+	// ResponseHeaders is a comma separated list of the response headers kept in Result.Headers
+	ResponseHeaders string `json:"response_headers,omitempty"`
+	// NoPreallocate disables the preallocation of the files of the responses of known length
+	NoPreallocate bool `json:"no_preallocate,omitempty"`
+	// Fsync is the Fsync* policy of the written files, FsyncNever when empty
+	Fsync string `json:"fsync,omitempty"`
+	// IOBuffer is the size of the buffers the connections are read and the files written through,
+	// larger ones than the defaults save syscalls on fast links
+	IOBuffer int64 `json:"io_buffer,omitempty"`
+	// CASDir enables the content addressable store, outputs are then hard links to its objects
+	// and urls already stored are linked instead of downloaded again
+	CASDir string `json:"cas_dir,omitempty"`
+	// CASLinks is how the outputs link to the objects, CASHardLinks by default or CASSymlinks
+	CASLinks string `json:"cas_links,omitempty"`
+	// HTTPCacheDir enables a private http cache honoring Cache-Control, so overlapping runs
+	// don't hit the origins again for fresh responses
+	HTTPCacheDir string `json:"http_cache_dir,omitempty"`
+	// Record is a cassette directory the requests and their responses are recorded to, Replay one
+	// they are served back from without network, so a run can be reproduced offline
+	Record string `json:"record,omitempty"`
+	Replay string `json:"replay,omitempty"`
+	// ChaosFailRate, ChaosSlowRate and ChaosTruncateRate inject faults into a fraction of the requests,
+	// to exercise the retries and validations: a failure before the request is sent, reads of the body
+	// slowed by ChaosSlowRead (100ms by default), a body ending early without error. ChaosSeed seeds the
+	// draws.
+	ChaosFailRate     float64       `json:"chaos_fail_rate,omitempty"`
+	ChaosSlowRate     float64       `json:"chaos_slow_rate,omitempty"`
+	ChaosSlowRead     time.Duration `json:"chaos_slow_read,omitempty"`
+	ChaosTruncateRate float64       `json:"chaos_truncate_rate,omitempty"`
+	ChaosSeed         int64         `json:"chaos_seed,omitempty"`
+	// RateLimit is the maximum number of requests started per second and MaxPerHost the maximum number
+	// of concurrent requests to a host, both unlimited when 0 and adjustable while running
+	RateLimit  float64 `json:"rate_limit,omitempty"`
+	MaxPerHost int     `json:"max_per_host,omitempty"`
+	// HedgePercentile enables hedged requests: a response slower than this percentile of the recent
+	// response times gets a second request, HedgeDelay is the delay until enough of them are known
+	HedgePercentile float64       `json:"hedge_percentile,omitempty"`
+	HedgeDelay      time.Duration `json:"hedge_delay,omitempty"`
+	// FastSkip sends a HEAD request for the files of a previous run and skips the ones whose etag, or
+	// modification time and length, did not change, see SkipStats
+	FastSkip bool `json:"fast_skip,omitempty"`
+	// ContentDisposition names the outputs by the filename of the Content-Disposition of the responses,
+	// when they have one, instead of the job key. NameCollision is the Name* policy of the files of
+	// the run with the same name, NameRename by default.
+	ContentDisposition bool   `json:"content_disposition,omitempty"`
+	NameCollision      string `json:"name_collision,omitempty"`
+	// SinkWorkers runs the sinks in a pool of their own, so a slow destination doesn't hold the workers
+	// fetching, SinkBuffer bounds the downloads waiting for a sink worker, SinkWorkers when 0. The
+	// sinks run in the fetching worker when 0.
+	SinkWorkers int `json:"sink_workers,omitempty"`
+	SinkBuffer  int `json:"sink_buffer,omitempty"`
+	// MaxFileSize fails the jobs whose file is larger with ErrTooLarge, by their Content-Length before
+	// the body is read when it is known. No limit when 0.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// RetryBudget caps the retries of the run to this ratio of its requests of the last minute, plus a
+	// few, so an outage of the hosts fails the jobs fast rather than retrying them all. No cap when 0.
+	RetryBudget float64 `json:"retry_budget,omitempty"`
+}
+
+// Job is a single url to download, the key identifies the job and names its output file
+type Job struct {
+	Key int    `json:"key"`
+	URL string `json:"url"`
+	// ID is an optional name of the job given by the manifest, it names the output file instead of the key
+	ID string `json:"id,omitempty"`
+	// Manifest is the file the job comes from when several manifests are merged
+	Manifest string `json:"manifest,omitempty"`
+	// Dir is an optional sub directory of the output directory the file is written to
+	Dir string `json:"dir,omitempty"`
+	// Mirrors are alternate urls of the same file, retries go through them in turn
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Checksum is the expected "algorithm:hex" checksum of the file, see ParseChecksum
+	Checksum string `json:"checksum,omitempty"`
+	// Original is the url of the manifest when URL is a rewrite of it
+	Original string `json:"original_url,omitempty"`
+	// Ext is the extension of the output file with its dot, DefaultExt when empty
+	Ext string `json:"ext,omitempty"`
+}
+
+// Result is the outcome of a single job
+type Result struct {
+	Key int    `json:"key"`
+	ID  string `json:"id,omitempty"`
+	URL string `json:"url"`
+	// Manifest is the file the job comes from when several manifests are merged
+	Manifest string `json:"manifest,omitempty"`
+	Dir      string `json:"dir,omitempty"`
+	// Source is the mirror the file was fetched from when it is not URL, Original the url of the
+	// manifest when URL is a rewrite of it
+	Source   string `json:"source,omitempty"`
+	Original string `json:"original_url,omitempty"`
+	// Ext is the extension of the output file of the job, see Job.Ext
+	Ext    string `json:"ext,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Err is the error of a job that did not complete, for errors.Is and errors.As, it is not saved with
+	// the result
+	Err error `json:"-"`
+	// ErrorClass is the Error* class of the error of a job that did not complete
+	ErrorClass string `json:"error_class,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	// SHA256 is the checksum of the written file, computed while it is downloaded
+	SHA256 string `json:"sha256,omitempty"`
+	// Checksums are the sums of the other Options.Checksums algorithms, by algorithm, and Checksum
+	// the expected one of the job
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Checksum  string            `json:"checksum,omitempty"`
+	// Headers are the Options.ResponseHeaders of the response the file was written from
+	Headers map[string]string `json:"headers,omitempty"`
+	// TransferBytes is the size on the wire when the body was compressed
+	TransferBytes int64         `json:"transfer_bytes,omitempty"`
+	Duration      time.Duration `json:"duration"`
+	Attempts      int           `json:"attempts"`
+	// Stages is the time the job spent in each Stage* stage it went through
+	Stages map[string]time.Duration `json:"stages,omitempty"`
+	// Meta holds details added by the post process stages
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// NewResult returns a result for a job, with the key, url and other fields it keeps of the job
+func NewResult(j *Job) *Result {
+	r := &Result{}
+	r.SetJob(j)
+	return r
+}
+
+// SetJob sets the fields the result keeps of its job
+func (r *Result) SetJob(j *Job) {
+	r.Key, r.ID, r.URL, r.Manifest, r.Dir, r.Checksum, r.Original, r.Ext = j.Key, j.ID, j.URL, j.Manifest, j.Dir, j.Checksum, j.Original, j.Ext
+}
+
+// Job returns the job of a result to fetch it again, without its mirrors which the result does not keep
+func (r *Result) Job() *Job {
+	return &Job{Key: r.Key, URL: r.URL, ID: r.ID, Manifest: r.Manifest, Dir: r.Dir, Checksum: r.Checksum, Original: r.Original, Ext: r.Ext}
+}
+
+// SetMeta records a detail about the result, it is meant for post process stages
+func (r *Result) SetMeta(key, value string) {
+	if r.Meta == nil {
+		r.Meta = map[string]string{}
+	}
+	r.Meta[key] = value
+}
+
+// Downloader is a pool of workers processing a set of jobs
+type Downloader struct {
+	mu         sync.RWMutex
+	queue      Queue // of the jobs in the order they are started, see Options.Order
+	order      string
+	seed       int64
+	inflight   map[int]context.CancelFunc
+	results    map[int]*Result
+	workers    int // size of the pool, running may exceed it until the extra workers stop
+	running    int
+	nextWorker int
+	wg         *sync.WaitGroup // set while the pool is started
+	// streaming is set by Enqueue, the workers then wait on wake for more jobs until closed
+	streaming     bool
+	closed        bool
+	wake          *sync.Cond
+	stream        chan *Result // see Stream
+	finished      bool
+	client        *http.Client
+	fetcher       Fetcher // the client unless WithFetcher set one
+	protocols     map[string]http.RoundTripper
+	recorder      *recorder
+	outDir        string
+	retries       int
+	notFound      string
+	encodings     string
+	minSpeed      int64
+	stallTimeout  time.Duration
+	maxTotalBytes int64
+	maxDuration   time.Duration
+	started       time.Time
+	transferred   int64
+	maxDiskUsage  int64
+	diskPolicy    string
+	diskUsage     int64
+	written       map[string]bool // output files of this run, never pruned
+	pruneMu       sync.Mutex
+	cas           *cas
+	passThrough   PassThrough // nil when the downloads are written to outDir
+	sinkPool      *sinkPool   // nil when the sinks run in the fetching workers
+	stageStats    stageStats
+	// jobsSet is when SetJobs queued its jobs, enqueued when Enqueue queued each of its own, the
+	// start of the wait of a job for a worker
+	jobsSet       time.Time
+	enqueued      map[int]time.Time
+	rate          *rateLimiter
+	hosts         *hostLimiter
+	hostPolicy    func(*url.URL) *HostPolicy
+	hostRates     hostRates
+	hedge         *hedger
+	skips         *skipIndex
+	hostStats     hostStats
+	eta           etaModel
+	memory        *memoryGate
+	fds           *fdBudget
+	ioBuffer      int64
+	checksums     []string
+	sidecars      bool
+	keepHeaders   []string
+	noPreallocate bool
+	fsync         *syncer
+	opts          Options // of WithOptions
+	retryDelay    time.Duration
+	retryable     func(error) bool
+	retryBudget   retryBudget
+	log           Logger
+	// contentDisposition names the outputs by the Content-Disposition of the responses, names holds the
+	// key of the job each of those paths was given to, reserved the key of the job of each key or id
+	// named output
+	contentDisposition bool
+	nameCollision      string
+	names              map[string]int
+	reserved           map[string]int
+	hooks              hooks
+}
+
+type worker struct {
+	id int
+}
+
+// defaultRetryDelay is the base wait between attempts, it grows linearly with each attempt
+const defaultRetryDelay = 500 * time.Millisecond
+
+// NewDownloader creates a pool of workers configured by the options. WithOptions sets them from an
+// Options struct, the options after it refine it.
+func NewDownloader(options ...Option) *Downloader {
+	d := &Downloader{
+		queue:      NewMemoryQueue(),
+		inflight:   map[int]context.CancelFunc{},
+		results:    map[int]*Result{},
+		written:    map[string]bool{},
+		workers:    1,
+		client:     &http.Client{},
+		rate:       &rateLimiter{},
+		hosts:      newHostLimiter(0),
+		fsync:      &syncer{},
+		retryDelay: defaultRetryDelay,
+		log:        stdoutLogger{},
+	}
+	d.wake = sync.NewCond(&d.mu)
+	for _, option := range options {
+		option(d)
+	}
+	d.open()
+	return d
+}
+
+// open sets up the parts of the downloader backed by files or process wide settings, once the options
+// are applied so they use the logger and client of the options
+func (d *Downloader) open() {
+	opts := d.opts
+	if d.outDir != "" && d.passThrough == nil {
+		// created once here, the jobs only create their sub directory
+		if err := os.MkdirAll(d.outDir, 0755); err != nil {
+			d.logf("output - can't create %s: %s", d.outDir, err)
+		}
+	}
+	d.memory = newMemoryGate(opts.MaxMemory, d.log)
+	d.fds = newFDBudget(opts.MaxOpenFiles, d.workers, d.log)
+	if opts.CASDir != "" {
+		d.cas = openCAS(opts.CASDir, opts.CASLinks, d.log)
+	}
+	if opts.FastSkip {
+		d.skips = openSkipIndex(opts.OutDir, d.log)
+	}
+	if opts.HTTPCacheDir != "" {
+		client := *d.client // the client may be the one of WithClient, it is not changed
+		if client.Transport == nil {
+			client.Transport = http.DefaultTransport
+		}
+		client.Transport = newCachingTransport(client.Transport, opts.HTTPCacheDir)
+		d.client = &client
+	}
+	if d.fetcher == nil {
+		d.fetcher = clientFetcher{d.client}
+	}
+	d.fetcher = newProtocolFetcher(d.fetcher, d.protocols, d.hooks.runBeforeRequest)
+	if opts.Replay != "" {
+		d.fetcher = openReplayer(opts.Replay, d.log)
+	} else if opts.Record != "" {
+		r, err := openRecorder(d.fetcher, opts.Record)
+		if err != nil {
+			d.logf("record - can't start the cassette: %s", err)
+		} else {
+			d.fetcher, d.recorder = r, r
+		}
+	}
+	d.fetcher = newChaosFetcher(d.fetcher, opts)
+}
+
+// SetJobs sets the jobs to process, replacing any queued jobs
+func (d *Downloader) SetJobs(jobs []*Job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queue.Clear()
+	d.queue.Push(orderJobs(jobs, d.order, d.seed)...)
+	d.reserveNames(jobs)
+	d.jobsSet = time.Now()
+	d.eta.setJobs(jobs)
+}
+
+// Len returns the number of queued jobs
+func (d *Downloader) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.queue.Len()
+}
+
+// Inflight returns the number of jobs being processed
+func (d *Downloader) Inflight() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.inflight)
+}
+
+// Start will async run each workers and wait until all jobs are processed by the workers
+// Jobs still queued when the run budget is exhausted are reported as unprocessed.
+func (d *Downloader) Start() {
+	d.mu.Lock()
+	d.started = time.Now()
+	d.mu.Unlock()
+	if err := d.initDiskUsage(); err != nil {
+		d.logf("disk quota - can't measure %s: %s", d.outDir, err)
+	}
+
+	d.mu.Lock()
+	d.sinkPool = startSinkPool(d)
+	wg := &sync.WaitGroup{}
+	d.wg = wg
+	for d.running < d.workers {
+		d.spawn()
+	}
+	d.mu.Unlock()
+	wg.Wait() //wait for the workers, including the ones started by SetWorkers
+	d.sinkPool.close()
+	d.mu.Lock()
+	d.wg = nil
+	d.sinkPool = nil
+	d.mu.Unlock()
+	d.markUnprocessed()
+	if err := d.cas.save(); err != nil {
+		d.logf("cas - can't save the index: %s", err)
+	}
+	if err := d.fsync.flush(); err != nil {
+		d.logf("fsync - can't sync the last files: %s", err)
+	}
+	if err := d.recorder.close(); err != nil {
+		d.logf("record - can't save the cassette: %s", err)
+	}
+	d.closeStream()
+	d.printHostStats()
+	d.printStageStats()
+	if stats, ok := d.SkipStats(); ok {
+		d.logf("fast skip - %d unchanged (%d bytes not downloaded), %d changed, %d new",
+			stats.Unchanged, stats.SavedBytes, stats.Changed, stats.New)
+		if err := d.skips.save(); err != nil {
+			d.logf("fast skip - can't save the index: %s", err)
+		}
+	}
+}
+
+// CancelJob removes a queued job or aborts it if it is in flight, the job is then reported as canceled
+func (d *Downloader) CancelJob(key int) error {
+	d.mu.Lock()
+	if j, ok := d.queue.Remove(key); ok {
+		d.mu.Unlock()
+		res := NewResult(j)
+		res.Status = StatusCanceled
+		d.done(res)
+		return nil
+	}
+	defer d.mu.Unlock()
+
+	if cancel, ok := d.inflight[key]; ok {
+		cancel()
+		return nil
+	}
+	return ErrUnknownJob
+}
+
+// Status returns the status of a job and false if the job is unknown
+func (d *Downloader) Status(key int) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, ok := d.queue.Get(key); ok {
+		return StatusQueued, true
+	}
+	if _, ok := d.inflight[key]; ok {
+		return StatusRunning, true
+	}
+	if res, ok := d.results[key]; ok {
+		return res.Status, true
+	}
+	return "", false
+}
+
+// Results returns the results of the processed jobs ordered by key
+func (d *Downloader) Results() []*Result {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	results := make([]*Result, 0, len(d.results))
+	for _, res := range d.results {
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results
+}
+
+// getJob returns a job with its context and the time it waited in the queue, or nil if there are no
+// jobs, or if the pool shrank, the calling worker is then no longer counted as running
+func (d *Downloader) getJob() (*Job, context.Context, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		if d.running > d.workers || d.stopReason() != "" {
+			d.running-- // stop scheduling, in flight jobs still complete
+			return nil, nil, 0
+		}
+		if job, ok := d.queue.Pop(); ok {
+			ctx, cancel := context.WithCancel(context.Background())
+			d.inflight[job.Key] = cancel
+			return job, ctx, d.queueWait(job.Key)
+		}
+		if !d.streaming || d.closed {
+			d.running--
+			return nil, nil, 0
+		}
+		d.wake.Wait() // for Enqueue or Close
+	}
+}
+
+// done records the outcome of a processed job, releases its context and runs the completion hooks
+func (d *Downloader) done(r *Result) {
+	d.mu.Lock()
+	if cancel, ok := d.inflight[r.Key]; ok {
+		cancel()
+		delete(d.inflight, r.Key)
+	}
+	d.results[r.Key] = r
+	d.addTransferred(r)
+	prune := d.diskPolicy == DiskPruneOldest && d.maxDiskUsage > 0 && d.diskUsage > d.maxDiskUsage
+	d.mu.Unlock()
+
+	if prune {
+		d.pruneOldest()
+	}
+
+	d.hostStats.job(r)
+	d.stageStats.job(r)
+	d.eta.finish(r)
+	d.hooks.runDone(r)
+	d.publish(r)
+}
+
+// run executes the workers - the workers will keep running to process jobs and exits when there are no more jobs
+func (w *worker) run(wg *sync.WaitGroup, d *Downloader) {
+	for {
+		d.memory.wait(d)
+		d.fds.acquire()
+		job, ctx, wait := d.getJob()
+		if job == nil {
+			d.fds.release()
+			break // if there are no more jobs, stop worker
+		}
+		if res := w.downloadImage(ctx, d, job, wait); res != nil {
+			d.done(res)
+		}
+		d.fds.release()
+	}
+	wg.Done()
+}
+
+// downloadImage fetches the job url into the output directory, failures are reported in the result instead of stopping
+// the run. A download handed to the sink pool returns nil, the pool completes it.
+func (w *worker) downloadImage(ctx context.Context, d *Downloader, j *Job, wait time.Duration) *Result {
+	d.logf("worker #%d - Downloading job #%d - %s", w.id, j.Key, j.URL)
+
+	started := time.Now()
+	res := NewResult(j)
+	res.addStage(StageQueue, wait)
+	err := d.hooks.runBeforeJob(res)
+	if err == nil {
+		err = d.skips.check(ctx, d, j, res)
+	}
+	if err == nil {
+		err = w.fetchWithRetries(ctx, d, j, res)
+	}
+	if err == nil {
+		stage := time.Now()
+		err = d.hooks.runPostProcess(res)
+		if len(d.hooks.postProcess) > 0 {
+			res.addStage(StageProcess, time.Since(stage))
+		}
+	}
+	if err == nil && d.sinkPool != nil {
+		d.sinkPool.queue <- &sinkJob{ctx: ctx, job: j, result: res, started: started, queued: time.Now()}
+		return nil
+	}
+	if err == nil {
+		stage := time.Now()
+		err = d.hooks.runSinks(res)
+		if len(d.hooks.sinks) > 0 {
+			res.addStage(StageSink, time.Since(stage))
+		}
+	}
+	return d.complete(ctx, fmt.Sprintf("worker #%d", w.id), j, res, err, started)
+}
+
+// complete sets the status, duration and error of a processed job, who is the worker logging it
+func (d *Downloader) complete(ctx context.Context, who string, j *Job, res *Result, err error, started time.Time) *Result {
+	res.Duration = time.Since(started)
+	if err != nil {
+		res.Status = StatusFailed
+		if ctx.Err() == context.Canceled {
+			res.Status = StatusCanceled
+		} else if errors.Is(err, ErrSkip) {
+			res.Status = StatusSkipped
+		} else if isTimeout(err) {
+			res.Status = StatusTimeout
+		}
+		res.Error, res.Err = err.Error(), err
+		if res.Status == StatusCanceled {
+			res.ErrorClass = ErrorCanceled
+		} else if res.Status != StatusSkipped {
+			res.ErrorClass = ClassifyError(err)
+		}
+		if res.Status == StatusSkipped {
+			d.logf("%s - Skipped job #%d - %s: %s", who, j.Key, j.URL, err)
+			return res
+		}
+		d.logf("%s - Failed job #%d - %s: %s", who, j.Key, j.URL, err)
+		return res
+	}
+
+	res.Status = StatusOK
+	d.logf("%s - Completed job #%d - %s", who, j.Key, j.URL)
+	return res
+}
+
+// fetchWithRetries calls fetch until it succeeds, fails for good, the retries are exhausted or the job is canceled,
+// the bytes and path of the last attempt are set on res.
+// Each retry moves on to the next of the job mirrors, and every mirror gets at least one attempt.
+// A transfer rejected by the validation hooks is removed and counts as a failed attempt.
+func (w *worker) fetchWithRetries(ctx context.Context, d *Downloader, j *Job, res *Result) error {
+	urls := append([]string{j.URL}, j.Mirrors...)
+	maxAttempts, delay := d.attempts(j, len(urls))
+
+	for {
+		url := urls[res.Attempts%len(urls)]
+		res.Attempts++
+		d.retryBudget.request()
+		stage := time.Now()
+		n, path, err := w.fetch(ctx, d, j, url, res)
+		res.addStage(StageFetch, time.Since(stage))
+		res.Bytes, res.Path = n, path
+		if err == nil {
+			stage = time.Now()
+			err = verifyChecksum(j, res)
+			if err == nil {
+				err = d.hooks.runValidate(res)
+			}
+			if err != nil && !errors.Is(err, ErrSkip) {
+				err = &validationError{err}
+			}
+			if j.Checksum != "" || len(d.hooks.validate) > 0 {
+				res.addStage(StageValidate, time.Since(stage))
+			}
+			if err != nil {
+				os.Remove(path)
+				res.Path = ""
+			}
+		}
+		if err == nil && d.sidecars {
+			err = writeSidecars(res)
+		}
+		if err == nil || !d.isRetryable(err) || res.Attempts >= maxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if !d.retryBudget.allow(d) {
+			res.SetMeta("retry_budget", "exhausted")
+			return err
+		}
+
+		d.logf("worker #%d - Retrying job #%d - %s: %s", w.id, j.Key, url, err)
+		d.hooks.runOnRetry(j, res.Attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay * time.Duration(res.Attempts)):
+		}
+	}
+}
+
+// fetch does the actual transfer and returns the number of bytes written and the output path
+func (w *worker) fetch(ctx context.Context, d *Downloader, j *Job, url string, result *Result) (int64, string, error) {
+	path := OutputPath(d.outDir, j)
+	if d.passThrough == nil {
+		var err error
+		if path, err = d.outputPath(j); err != nil {
+			return 0, "", err
+		}
+	}
+	result.Source = sourceOf(j, url)
+	// the name of the output is only known from the response with the Content-Disposition names
+	if sum, n, ok := d.cas.linkURL(url, path); ok && !d.contentDisposition {
+		result.SHA256 = sum
+		result.SetMeta("cas", "hit")
+		return n, path, nil
+	}
+
+	a, err := d.roundTrip(ctx, j, url, result)
+	if err != nil {
+		return 0, "", err
+	}
+	defer a.close()
+	res, cancel := a.res, a.cancel
+
+	if err := d.hooks.runAfterResponse(res); err != nil {
+		return 0, "", err
+	}
+	result.Headers = nil // of a previous attempt
+	for _, name := range d.keepHeaders {
+		if value := res.Header.Get(name); value != "" {
+			if result.Headers == nil {
+				result.Headers = map[string]string{}
+			}
+			result.Headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	if err := checkStatus(res, d.notFound); err != nil {
+		return 0, "", err
+	}
+	if err := checkDeclaredSize(res, d.opts.MaxFileSize); err != nil {
+		return 0, "", err
+	}
+	path = d.dispositionPath(j, path, res)
+	if d.passThrough != nil {
+		n, err := d.passBody(j, res, result, path, cancel)
+		return n, "", err
+	}
+	if sum, n, ok := d.cas.linkETag(res, path); ok {
+		result.SHA256 = sum
+		result.SetMeta("cas", "etag")
+		return n, path, nil
+	}
+	body, wire, err := decodeBody(res)
+	if err != nil {
+		return 0, "", err
+	}
+	body = limitSize(body, d.opts.MaxFileSize)
+	d.eta.transfer(j.Key, res.ContentLength, wire)
+
+	d.replaced(path)
+	if d.cas != nil {
+		os.Remove(path) // it may be a link to an object, which must not be truncated
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	length := identityLength(res)
+	if !d.noPreallocate {
+		if err := preallocate(file, length); err != nil {
+			os.Remove(path)
+			return 0, "", err
+		}
+	}
+
+	sums := newChecksummer(d.checksums, j)
+	body = io.TeeReader(body, sums.writer())
+	stop := watchStall(wire, cancel, d.minSpeed, d.stallTimeout)
+	n, err := copyBody(file, body, d.ioBuffer)
+	if stop() && err != nil {
+		err = ErrStalled
+	}
+	if wire.count() != n {
+		result.TransferBytes = wire.count()
+	}
+	if err == nil && !d.noPreallocate && length > 0 && n != length {
+		err = file.Truncate(n)
+	}
+	if err == nil {
+		err = d.fsync.file(file)
+	}
+	if err == nil {
+		sums.result(result)
+		if d.cas != nil {
+			err = d.cas.store(path, result.SHA256, res)
+		}
+	}
+	if err == nil && url == j.URL {
+		d.skips.record(url, path, n, result.SHA256, res)
+	}
+	if err == nil {
+		err = d.fsync.written(path)
+	}
+	if err != nil {
+		os.Remove(path) // don't leave a partial file behind
+		return n, "", err
+	}
+	return n, path, nil
+}
+
+// passBody streams the body of a response to the pass through, nothing is written to path. The
+// checksums are verified as the body ends, so the pass through sees a mismatch as a failed read.
+func (d *Downloader) passBody(j *Job, res *http.Response, result *Result, path string, cancel context.CancelFunc) (int64, error) {
+	body, wire, err := decodeBody(res)
+	if err != nil {
+		return 0, err
+	}
+	body = limitSize(body, d.opts.MaxFileSize)
+	d.eta.transfer(j.Key, res.ContentLength, wire)
+
+	sums := newChecksummer(d.checksums, j)
+	decoded := &countingReader{r: io.TeeReader(body, sums.writer())}
+	verified := &verifiedBody{r: decoded, verify: func() error {
+		sums.result(result)
+		return verifyChecksum(j, result)
+	}}
+	name, err := filepath.Rel(d.outDir, path)
+	if err != nil {
+		name = filepath.Base(path)
+	}
+	stop := watchStall(wire, cancel, d.minSpeed, d.stallTimeout)
+	err = d.passThrough.PutStream(result, filepath.ToSlash(name), verified)
+	if stop() && err != nil {
+		err = ErrStalled
+	}
+	n := decoded.count()
+	if wire.count() != n {
+		result.TransferBytes = wire.count()
+	}
+	return n, err
+}
+
+// verifiedBody reads r then ends with the error of verify, if any, in place of io.EOF
+type verifiedBody struct {
+	r      io.Reader
+	verify func() error
+	done   bool
+	err    error
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.done, b.err = true, io.EOF
+		if verr := b.verify(); verr != nil {
+			b.err = verr
+		}
+		return n, b.err
+	}
+	return n, err
+}
+
+// outputPath returns the file a job is written to, creating its sub directory
+func (d *Downloader) outputPath(j *Job) (string, error) {
+	if j.Dir != "" {
+		if err := os.MkdirAll(filepath.Join(d.outDir, j.Dir), 0755); err != nil {
+			return "", err
+		}
+	}
+	return OutputPath(d.outDir, j), nil
+}
+
+// DefaultExt is the extension of the output files of the jobs without one
+const DefaultExt = ".jpg"
+
+// OutputPath returns the file a job is written to in outDir, named by its id or else its key, with
+// the extension of the job
+func OutputPath(outDir string, j *Job) string {
+	if j.ID != "" {
+		return filepath.Join(outDir, j.Dir, j.ID+JobExt(j))
+	}
+	return filepath.Join(outDir, j.Dir, fmt.Sprintf("%d%s", j.Key, JobExt(j)))
+}
+
+// JobExt returns the extension of the output file of a job
+func JobExt(j *Job) string {
+	if j.Ext == "" {
+		return DefaultExt
+	}
+	return j.Ext
+}
+
+// isTimeout reports whether err was caused by a request or transfer timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
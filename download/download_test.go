@@ -0,0 +1,418 @@
+package download
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawrence/sample/download/testutil"
+)
+
+// discardLogger drops the progress lines of the downloaders of the tests
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+// testRetryDelay keeps the waits between the attempts of the tests short
+const testRetryDelay = time.Millisecond
+
+// newTestDownloader returns a downloader of the requests of fetcher into a temporary directory, with
+// short retry delays
+func newTestDownloader(t *testing.T, fetcher Fetcher, opts Options, options ...Option) *Downloader {
+	t.Helper()
+	if opts.OutDir == "" {
+		opts.OutDir = t.TempDir()
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 1
+	}
+	options = append([]Option{
+		WithOptions(opts),
+		WithRetryPolicy(RetryPolicy{Retries: opts.Retries, Delay: testRetryDelay}),
+		WithFetcher(fetcher),
+		WithLogger(discardLogger{}),
+	}, options...)
+	return NewDownloader(options...)
+}
+
+// run downloads the jobs of urls and returns their results by key, from 1
+func run(d *Downloader, urls ...string) map[int]*Result {
+	jobs := make([]*Job, len(urls))
+	for i, u := range urls {
+		jobs[i] = &Job{Key: i + 1, URL: u}
+	}
+	d.SetJobs(jobs)
+	d.Start()
+	results := map[int]*Result{}
+	for _, r := range d.Results() {
+		results[r.Key] = r
+	}
+	return results
+}
+
+func TestDownloadWritesTheBody(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("image")})
+	d := newTestDownloader(t, testutil.NewFetcher(responses), Options{})
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusOK || r.Attempts != 1 || r.Bytes != 5 {
+		t.Fatalf("result %+v", r)
+	}
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil || string(data) != "image" {
+		t.Errorf("file %q, %v", data, err)
+	}
+	if filepath.Base(r.Path) != "1.jpg" {
+		t.Errorf("path %s, want 1.jpg", r.Path)
+	}
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg",
+		testutil.Response{Status: http.StatusServiceUnavailable},
+		testutil.Response{Status: http.StatusTooManyRequests},
+		testutil.Response{Body: []byte("image")})
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{Retries: 3})
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusOK || r.Attempts != 3 || fetcher.Count("/a.jpg") != 3 {
+		t.Fatalf("result %+v after %d requests", r, fetcher.Count("/a.jpg"))
+	}
+}
+
+func TestRetriesAreExhausted(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Status: http.StatusBadGateway})
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{Retries: 2})
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusFailed || r.Attempts != 3 || fetcher.Count("/a.jpg") != 3 {
+		t.Fatalf("result %+v after %d requests", r, fetcher.Count("/a.jpg"))
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Status: status})
+		fetcher := testutil.NewFetcher(responses)
+		d := newTestDownloader(t, fetcher, Options{Retries: 3})
+
+		r := run(d, "http://example.com/a.jpg")[1]
+		if r.Status != StatusFailed || r.Attempts != 1 || r.ErrorClass != ErrorHTTP4xx {
+			t.Errorf("%d: result %+v", status, r)
+		}
+		if fetcher.Count("/a.jpg") != 1 {
+			t.Errorf("%d: %d requests, want 1", status, fetcher.Count("/a.jpg"))
+		}
+	}
+}
+
+func TestNotFoundSkipPolicy(t *testing.T) {
+	d := newTestDownloader(t, testutil.NewFetcher(testutil.NewResponses()), Options{Retries: 3, NotFound: NotFoundSkip})
+
+	r := run(d, "http://example.com/missing.jpg")[1]
+	if r.Status != StatusSkipped || r.Attempts != 1 || r.ErrorClass != "" {
+		t.Fatalf("result %+v", r)
+	}
+}
+
+func TestRetryDelayGrowsWithTheAttempts(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Status: http.StatusServiceUnavailable})
+	var mu sync.Mutex
+	var attempts []time.Time
+	d := newTestDownloader(t, testutil.NewFetcher(responses), Options{},
+		WithRetryPolicy(RetryPolicy{Retries: 3, Delay: delay}),
+		WithBeforeRequest(func(*http.Request) error {
+			mu.Lock()
+			attempts = append(attempts, time.Now())
+			mu.Unlock()
+			return nil
+		}))
+
+	run(d, "http://example.com/a.jpg")
+	if len(attempts) != 4 {
+		t.Fatalf("%d attempts, want 4", len(attempts))
+	}
+	for i := 1; i < len(attempts); i++ {
+		if wait := attempts[i].Sub(attempts[i-1]); wait < delay*time.Duration(i) {
+			t.Errorf("wait before attempt %d is %s, want at least %s", i+1, wait, delay*time.Duration(i))
+		}
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Status: http.StatusServiceUnavailable})
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{},
+		WithRetryPolicy(RetryPolicy{Retries: 3, Delay: testRetryDelay, Retryable: func(error) bool { return false }}))
+
+	if r := run(d, "http://example.com/a.jpg")[1]; r.Attempts != 1 {
+		t.Fatalf("%d attempts, want 1", r.Attempts)
+	}
+}
+
+func TestCancelJobInFlight(t *testing.T) {
+	responses := testutil.NewResponses().Add("/slow.jpg", testutil.Response{Delay: time.Minute})
+	d := newTestDownloader(t, testutil.NewFetcher(responses), Options{Retries: 3})
+	d.SetJobs([]*Job{{Key: 1, URL: "http://example.com/slow.jpg"}})
+
+	done := make(chan struct{})
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	for status, _ := d.Status(1); status != StatusRunning; status, _ = d.Status(1) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := d.CancelJob(1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the canceled job is still running")
+	}
+	r := d.Results()[0]
+	if r.Status != StatusCanceled || r.Attempts != 1 || r.ErrorClass != ErrorCanceled {
+		t.Fatalf("result %+v", r)
+	}
+	if err := d.CancelJob(1); err != ErrUnknownJob {
+		t.Errorf("cancel of a finished job: %v, want ErrUnknownJob", err)
+	}
+}
+
+func TestCancelJobQueued(t *testing.T) {
+	d := newTestDownloader(t, testutil.NewFetcher(testutil.NewResponses()), Options{})
+	d.SetJobs([]*Job{{Key: 1, URL: "http://example.com/a.jpg"}})
+	if status, _ := d.Status(1); status != StatusQueued {
+		t.Fatalf("status %s, want queued", status)
+	}
+	if err := d.CancelJob(1); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := d.Status(1); status != StatusCanceled {
+		t.Errorf("status %s, want canceled", status)
+	}
+}
+
+// recordingSink records the results it receives
+type recordingSink struct {
+	mu      sync.Mutex
+	results []*Result
+	err     error
+}
+
+func (s *recordingSink) Put(r *Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, r)
+	return s.err
+}
+
+func TestHooksRunInOrder(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("bad")}, testutil.Response{Body: []byte("good")})
+	fetcher := testutil.NewFetcher(responses)
+	var mu sync.Mutex
+	var calls []string
+	call := func(name string) {
+		mu.Lock()
+		calls = append(calls, name)
+		mu.Unlock()
+	}
+	sink := &recordingSink{}
+	d := newTestDownloader(t, fetcher, Options{Retries: 1},
+		WithBeforeJob(func(*Result) error { call("before job"); return nil }),
+		WithBeforeRequest(func(req *http.Request) error {
+			call("before request")
+			req.Header.Set("Authorization", "Bearer token")
+			return nil
+		}),
+		WithAfterResponse(func(*http.Response) error { call("after response"); return nil }),
+		WithValidate(func(r *Result) error {
+			call("validate")
+			if data, _ := ioutil.ReadFile(r.Path); string(data) == "bad" {
+				return errors.New("corrupt")
+			}
+			return nil
+		}),
+		WithOnRetry(func(j *Job, attempt int, err error) { call("retry") }),
+		WithPostProcess(func(r *Result) error {
+			call("post process")
+			r.SetMeta("processed", "yes")
+			return nil
+		}),
+		WithSink(sink),
+		WithOnComplete(func(*Result) { call("complete") }),
+	)
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusOK || r.Meta["processed"] != "yes" {
+		t.Fatalf("result %+v", r)
+	}
+	want := []string{"before job", "before request", "after response", "validate", "retry",
+		"before request", "after response", "validate", "post process", "complete"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("calls %v, want %v", calls, want)
+		}
+	}
+	if len(sink.results) != 1 || sink.results[0] != r {
+		t.Errorf("sink got %d results", len(sink.results))
+	}
+	for _, req := range fetcher.Requests() {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("request without the header of the hook")
+		}
+	}
+}
+
+func TestSinkErrorFailsTheJob(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("image")})
+	sink := &recordingSink{err: &HTTPStatusError{Code: http.StatusBadGateway, Status: "502 Bad Gateway"}}
+	d := newTestDownloader(t, testutil.NewFetcher(responses), Options{}, WithSink(sink))
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusFailed || r.ErrorClass != ErrorHTTP5xx {
+		t.Fatalf("result %+v", r)
+	}
+}
+
+// recordingQueue is a Queue recording the jobs popped from it
+type recordingQueue struct {
+	Queue
+	popped []int
+}
+
+func (q *recordingQueue) Pop() (*Job, bool) {
+	j, ok := q.Queue.Pop()
+	if ok {
+		q.popped = append(q.popped, j.Key)
+	}
+	return j, ok
+}
+
+func TestWithQueue(t *testing.T) {
+	responses := testutil.NewResponses().
+		Add("/a.jpg", testutil.Response{Body: []byte("a")}).
+		Add("/b.jpg", testutil.Response{Body: []byte("b")})
+	q := &recordingQueue{Queue: NewMemoryQueue()}
+	d := newTestDownloader(t, testutil.NewFetcher(responses), Options{}, WithQueue(q))
+
+	results := run(d, "http://example.com/a.jpg", "http://example.com/b.jpg")
+	if results[1].Status != StatusOK || results[2].Status != StatusOK {
+		t.Fatalf("results %+v %+v", results[1], results[2])
+	}
+	if len(q.popped) != 2 || q.popped[0] != 1 || q.popped[1] != 2 {
+		t.Errorf("popped %v, want [1 2]", q.popped)
+	}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue()
+	q.Push(&Job{Key: 1}, &Job{Key: 2}, &Job{Key: 3})
+	q.Push(&Job{Key: 1, URL: "replaced"}) // keeps its place
+	if _, ok := q.Remove(2); !ok {
+		t.Fatal("job 2 not removed")
+	}
+	q.Push(&Job{Key: 2}) // queued again, last
+	var keys []int
+	for j, ok := q.Pop(); ok; j, ok = q.Pop() {
+		if j.Key == 1 && j.URL != "replaced" {
+			t.Errorf("job 1 not replaced")
+		}
+		keys = append(keys, j.Key)
+	}
+	if len(keys) != 3 || keys[0] != 1 || keys[1] != 3 || keys[2] != 2 {
+		t.Errorf("popped %v, want [1 3 2]", keys)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d jobs left", q.Len())
+	}
+}
+
+func TestTransportErrorsAreRetried(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("image")})
+	fetcher := testutil.NewFetcher(responses)
+	var failed int
+	fetcher.Fail = func(*http.Request) error {
+		if failed < 2 {
+			failed++
+			return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return nil
+	}
+	d := newTestDownloader(t, fetcher, Options{Retries: 3})
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusOK || r.Attempts != 3 {
+		t.Fatalf("result %+v", r)
+	}
+}
+
+func TestResultKeepsTheErrorOfTheJob(t *testing.T) {
+	responses := testutil.NewResponses().
+		Add("/missing.jpg", testutil.Response{Status: http.StatusNotFound}).
+		Add("/large.jpg", testutil.Response{Body: []byte("a large image")})
+	d := newTestDownloader(t, testutil.NewFetcher(responses), Options{MaxFileSize: 4})
+
+	results := run(d, "http://example.com/missing.jpg", "http://example.com/large.jpg")
+	var statusErr *HTTPStatusError
+	if !errors.As(results[1].Err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Errorf("error of the 404 job %v, want an HTTPStatusError", results[1].Err)
+	}
+	if !errors.Is(results[2].Err, ErrTooLarge) {
+		t.Errorf("error of the large job %v, want ErrTooLarge", results[2].Err)
+	}
+	if d := newTestDownloader(t, testutil.NewFetcher(responses), Options{}); run(d, "http://example.com/large.jpg")[1].Err != nil {
+		t.Error("error set on a completed job")
+	}
+}
+
+func TestOutputDirErrorsAreNotRetried(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("image")})
+	dir := filepath.Join(t.TempDir(), "new", "out")
+	results := run(newTestDownloader(t, testutil.NewFetcher(responses), Options{OutDir: dir, Retries: 3}), "http://example.com/a.jpg")
+	if results[1].Status != StatusOK {
+		t.Fatalf("job in a new output directory failed: %s", results[1].Error)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fetcher := testutil.NewFetcher(responses)
+	results = run(newTestDownloader(t, fetcher, Options{OutDir: filepath.Join(file, "out"), Retries: 3}), "http://example.com/a.jpg")
+	if r := results[1]; r.Status != StatusFailed || r.ErrorClass != ErrorIO || r.Attempts != 1 {
+		t.Errorf("job in an output directory under a file: %s %s after %d attempts, want a failed io error after 1",
+			r.Status, r.ErrorClass, r.Attempts)
+	}
+}
+
+func TestDispositionNamesDontTakeTheOutputsOfOtherJobs(t *testing.T) {
+	for policy, want := range map[string]string{NameRename: "2-1.jpg", NameOverwrite: "1.jpg", NameKey: "1.jpg"} {
+		responses := testutil.NewResponses().
+			Add("/a", testutil.Response{Header: http.Header{"Content-Disposition": {`attachment; filename="2.jpg"`}}, Body: []byte("a")}).
+			Add("/b", testutil.Response{Body: []byte("b")})
+		opts := Options{ContentDisposition: true, NameCollision: policy}
+		results := run(newTestDownloader(t, testutil.NewFetcher(responses), opts), "http://example.com/a", "http://example.com/b")
+		if name := filepath.Base(results[1].Path); name != want {
+			t.Errorf("%s: job 1 named 2.jpg by its response written to %s, want %s", policy, name, want)
+		}
+		if b, err := ioutil.ReadFile(results[2].Path); err != nil || string(b) != "b" {
+			t.Errorf("%s: output of job 2 %q, %v", policy, b, err)
+		}
+	}
+	if name := dispositionName(`attachment; filename="a;rm -rf.jpg"`); name != "arm -rf.jpg" {
+		t.Errorf("name %q, want the ; stripped", name)
+	}
+}
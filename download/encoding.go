@@ -0,0 +1,113 @@
+package download
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// EncodingNone disables compression, useful for formats that are already compressed like most images
+const EncodingNone = "none"
+
+// supportedEncodings are the content codings that can be decoded. br and zstd are not, they have no
+// decoder in the standard library and the module has no dependencies.
+var supportedEncodings = map[string]bool{"gzip": true, "deflate": true}
+
+// ValidateEncodings checks a comma separated Accept-Encoding list, EncodingNone or an empty list
+func ValidateEncodings(encodings string) error {
+	if encodings == "" || encodings == EncodingNone {
+		return nil
+	}
+	for _, enc := range strings.Split(encodings, ",") {
+		if !supportedEncodings[strings.TrimSpace(enc)] {
+			return fmt.Errorf("unsupported encoding %q, supported are gzip and deflate, br and zstd are not", enc)
+		}
+	}
+	return nil
+}
+
+// newTransport returns the transport for the encoding option. An empty encoding keeps the default
+// behaviour of the http transport, which requests gzip and decompresses it on its own, otherwise
+// the transport compression is disabled and decodeBody handles the response. A readBuffer size
+// replaces the 4 kB buffer the connections are read through.
+func newTransport(encodings string, readBuffer int64) http.RoundTripper {
+	if encodings == "" && readBuffer <= 0 {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = encodings != ""
+	if readBuffer > 0 {
+		transport.ReadBufferSize = int(readBuffer)
+	}
+	return transport
+}
+
+// setAcceptEncoding sets the Accept-Encoding header of the encoding option
+func setAcceptEncoding(req *http.Request, encodings string) {
+	switch encodings {
+	case "":
+	case EncodingNone:
+		req.Header.Set("Accept-Encoding", "identity")
+	default:
+		req.Header.Set("Accept-Encoding", encodings)
+	}
+}
+
+// countingReader counts the bytes read from the wire, the count can be read while the body is copied
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// decodeBody returns a reader of the decoded response body and the counter of its encoded bytes
+func decodeBody(res *http.Response) (io.Reader, *countingReader, error) {
+	wire := &countingReader{r: res.Body}
+	switch enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return wire, wire, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(wire)
+		return r, wire, err
+	case "deflate":
+		// deflate is meant to be zlib wrapped but some servers send raw deflate
+		buffered := bufio.NewReader(wire)
+		header, err := buffered.Peek(2)
+		if err != nil {
+			return nil, wire, err
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			r, err := zlib.NewReader(buffered)
+			return r, wire, err
+		}
+		return flate.NewReader(buffered), wire, nil
+	default:
+		return nil, wire, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+}
+
+// EncodingNames returns the content codings that can be decoded, sorted
+func EncodingNames() []string {
+	names := make([]string, 0, len(supportedEncodings))
+	for name := range supportedEncodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,65 @@
+package download
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateEncodings(t *testing.T) {
+	for _, encodings := range []string{"", EncodingNone, "gzip", "gzip, deflate"} {
+		if err := ValidateEncodings(encodings); err != nil {
+			t.Errorf("%q: %s", encodings, err)
+		}
+	}
+	for _, encodings := range []string{"br", "gzip,zstd", "compress"} {
+		if err := ValidateEncodings(encodings); err == nil {
+			t.Errorf("%q: no error", encodings)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	const body = "the body of the response"
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		w.Write([]byte(body))
+		w.Close()
+		return buf.Bytes()
+	}
+	tests := map[string][]byte{
+		"":         []byte(body),
+		"identity": []byte(body),
+		"gzip":     compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+		"x-gzip":   compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+		"deflate":  compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		"Deflate":  compress(func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw }), // raw, as some servers send it
+	}
+	for encoding, encoded := range tests {
+		res := &http.Response{Header: http.Header{"Content-Encoding": {encoding}}, Body: ioutil.NopCloser(bytes.NewReader(encoded))}
+		r, wire, err := decodeBody(res)
+		if err != nil {
+			t.Errorf("%q: %s", encoding, err)
+			continue
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil || string(decoded) != body {
+			t.Errorf("%q: %q, %v", encoding, decoded, err)
+		}
+		if wire.count() != int64(len(encoded)) {
+			t.Errorf("%q: %d bytes counted, want %d", encoding, wire.count(), len(encoded))
+		}
+	}
+
+	res := &http.Response{Header: http.Header{"Content-Encoding": {"br"}}, Body: ioutil.NopCloser(strings.NewReader(body))}
+	if _, _, err := decodeBody(res); err == nil {
+		t.Error("br body decoded")
+	}
+}
@@ -0,0 +1,77 @@
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Classes of the errors of the failed jobs, in Result.ErrorClass, so the causes of the failures can
+// be aggregated whatever the wording of the errors
+const (
+	ErrorDNS        = "dns"
+	ErrorConnect    = "connect"
+	ErrorTLS        = "tls"
+	ErrorTimeout    = "timeout"
+	ErrorHTTP4xx    = "http_4xx"
+	ErrorHTTP5xx    = "http_5xx"
+	ErrorValidation = "validation"
+	ErrorIO         = "io"
+	ErrorCanceled   = "canceled"
+	ErrorOther      = "other"
+)
+
+// validationError is an error of the checksum or the validation hooks, rejecting the transferred body
+type validationError struct {
+	err error
+}
+
+func (e *validationError) Error() string { return e.err.Error() }
+func (e *validationError) Unwrap() error { return e.err }
+
+// ClassifyError returns the Error* class of the error a job failed with, Result.ErrorClass is set with
+// it, the sinks and hooks wrapping their errors with %w keep the class of the cause
+func ClassifyError(err error) string {
+	var (
+		validation *validationError
+		statusErr  *HTTPStatusError
+		dnsErr     *net.DNSError
+		opErr      *net.OpError
+		pathErr    *os.PathError
+		linkErr    *os.LinkError
+		recordErr  tls.RecordHeaderError
+		authority  x509.UnknownAuthorityError
+		hostname   x509.HostnameError
+		invalid    x509.CertificateInvalidError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.As(err, &validation), errors.Is(err, ErrChecksumMismatch), errors.Is(err, ErrTooLarge),
+		errors.Is(err, ErrUnsupportedScheme), errors.Is(err, ErrRedirectRefused):
+		return ErrorValidation
+	case errors.As(err, &statusErr):
+		if statusErr.Code >= 500 {
+			return ErrorHTTP5xx
+		}
+		return ErrorHTTP4xx // with the 3xx not followed under RedirectNone
+	case isTimeout(err), errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrStalled):
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.As(err, &recordErr), errors.As(err, &authority), errors.As(err, &hostname), errors.As(err, &invalid),
+		strings.Contains(err.Error(), "tls: "):
+		return ErrorTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.Is(err, ErrInjected):
+		return ErrorConnect // the injected faults fail the requests before they are sent
+	case errors.As(err, &opErr), errors.As(err, &pathErr), errors.As(err, &linkErr),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, ErrNoSpace):
+		return ErrorIO
+	}
+	return ErrorOther
+}
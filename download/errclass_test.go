@@ -0,0 +1,101 @@
+package download
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/lawrence/sample/download/testutil"
+)
+
+// timeoutError is a net.Error timing out, as the deadlines of the connections fail
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	get := func(err error) error { return &url.Error{Op: "Get", URL: "http://example.com/a.jpg", Err: err} }
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{get(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), ErrorDNS},
+		{get(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), ErrorConnect},
+		{fmt.Errorf("fault: %w", ErrInjected), ErrorConnect},
+		{get(x509.UnknownAuthorityError{}), ErrorTLS},
+		{get(errors.New("remote error: tls: handshake failure")), ErrorTLS},
+		{get(&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), ErrorTimeout},
+		{context.DeadlineExceeded, ErrorTimeout},
+		{ErrStalled, ErrorTimeout},
+		{&HTTPStatusError{Code: http.StatusNotFound, Status: "404 Not Found"}, ErrorHTTP4xx},
+		{&HTTPStatusError{Code: http.StatusFound, Status: "302 Found"}, ErrorHTTP4xx},
+		{fmt.Errorf("sink: %w", &HTTPStatusError{Code: http.StatusBadGateway, Status: "502 Bad Gateway"}), ErrorHTTP5xx},
+		{&validationError{errors.New("not an image")}, ErrorValidation},
+		{fmt.Errorf("job 1: %w", ErrChecksumMismatch), ErrorValidation},
+		{ErrTooLarge, ErrorValidation},
+		{fmt.Errorf("ftp: %w", ErrUnsupportedScheme), ErrorValidation},
+		{get(fmt.Errorf("%w: other.com", ErrRedirectRefused)), ErrorValidation},
+		{get(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), ErrorIO},
+		{&os.PathError{Op: "open", Path: "/out/1.jpg", Err: syscall.EACCES}, ErrorIO},
+		{io.ErrUnexpectedEOF, ErrorIO},
+		{fmt.Errorf("10 bytes: %w", ErrNoSpace), ErrorIO},
+		{get(context.Canceled), ErrorCanceled},
+		{errors.New("something else"), ErrorOther},
+	}
+	for _, test := range tests {
+		if got := ClassifyError(test.err); got != test.want {
+			t.Errorf("ClassifyError(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
+
+func TestResultErrorClass(t *testing.T) {
+	responses := testutil.NewResponses().
+		Add("/missing.jpg", testutil.Response{Status: http.StatusNotFound}).
+		Add("/down.jpg", testutil.Response{Status: http.StatusServiceUnavailable}).
+		Add("/ok.jpg", testutil.Response{Body: []byte("image")})
+	fetcher := testutil.NewFetcher(responses)
+	fetcher.Fail = func(req *http.Request) error {
+		if req.URL.Host == "unknown.example.com" {
+			return &net.DNSError{Err: "no such host", Name: req.URL.Host, IsNotFound: true}
+		}
+		return nil
+	}
+	d := newTestDownloader(t, fetcher, Options{})
+
+	results := run(d, "http://example.com/missing.jpg", "http://example.com/down.jpg", "http://unknown.example.com/a.jpg", "http://example.com/ok.jpg")
+	for key, want := range map[int]string{1: ErrorHTTP4xx, 2: ErrorHTTP5xx, 3: ErrorDNS, 4: ""} {
+		if got := results[key].ErrorClass; got != want {
+			t.Errorf("job #%d class %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestRefusedRedirectsAreNotRetried(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("image")) }))
+	defer other.Close()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, other.URL+"/a.jpg", http.StatusFound)
+	}))
+	defer server.Close()
+
+	d := newTestDownloader(t, nil, Options{Redirects: RedirectSameHost, Retries: 3})
+	r := run(d, server.URL+"/a.jpg")[1]
+	if !errors.Is(r.Err, ErrRedirectRefused) || r.ErrorClass != ErrorValidation || requests != 1 {
+		t.Errorf("redirect to another host: %v of class %s after %d requests, want ErrRedirectRefused of class validation after 1",
+			r.Err, r.ErrorClass, requests)
+	}
+}
@@ -0,0 +1,236 @@
+package download
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// etaWindow is the span of the recent completions the throughput is measured over, at least
+// etaMinSamples completions are kept when the jobs are slower than that
+const (
+	etaWindow     = 30 * time.Second
+	etaMinSamples = 10
+)
+
+// Progress is the state of a run with the estimate of its remaining time
+type Progress struct {
+	Total    int `json:"total"`
+	Done     int `json:"done"`
+	Queued   int `json:"queued"`
+	Inflight int `json:"inflight"`
+	// Bytes were written by the completed jobs, RemainingBytes is the estimate of what the others will write
+	Bytes          int64 `json:"bytes"`
+	RemainingBytes int64 `json:"remaining_bytes"`
+	// Throughput is the bytes per second of the recent completions
+	Throughput float64       `json:"throughput"`
+	Elapsed    time.Duration `json:"elapsed"`
+	// ETA is the estimated remaining time, -1 until it can be estimated
+	ETA time.Duration `json:"eta"`
+}
+
+// etaModel estimates the remaining time of a run by host: the bytes left of a host over its recent
+// throughput. The size of a job left is the Content-Length of its transfer once the response arrived,
+// else its size in the fast skip index, else the average size of the completed jobs of its host, of
+// the run, or of the previous runs.
+type etaModel struct {
+	mu          sync.Mutex
+	jobs        map[int]*Job // by key, as set
+	transfers   map[int]etaTransfer
+	finished    map[string]*etaTotals // by host
+	recent      []etaCompletion
+	since       time.Time // of the completion before the recent ones
+	averageSize int64
+}
+
+type etaTransfer struct {
+	length int64 // -1 when unknown
+	wire   *countingReader
+}
+
+type etaTotals struct {
+	jobs  int
+	bytes int64
+}
+
+type etaCompletion struct {
+	at    time.Time
+	host  string
+	bytes int64
+}
+
+// WithAverageJobSize sets the size expected of the jobs until some of the run completed, e.g. the
+// average of the previous runs
+func WithAverageJobSize(n int64) Option {
+	return func(d *Downloader) { d.eta.averageSize = n }
+}
+
+func (m *etaModel) setJobs(jobs []*Job) {
+	m.mu.Lock()
+	m.jobs = make(map[int]*Job, len(jobs))
+	m.mu.Unlock()
+	m.add(jobs)
+}
+
+func (m *etaModel) add(jobs []*Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs == nil {
+		m.jobs = map[int]*Job{}
+	}
+	for _, j := range jobs {
+		m.jobs[j.Key] = j
+	}
+}
+
+// transfer records the response of a job, a retry replaces the transfer of the previous attempt
+func (m *etaModel) transfer(key int, length int64, wire *countingReader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.transfers == nil {
+		m.transfers = map[int]etaTransfer{}
+	}
+	m.transfers[key] = etaTransfer{length: length, wire: wire}
+}
+
+// finish records a processed job, the failed ones count as jobs of their host that wrote nothing
+func (m *etaModel) finish(r *Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.transfers, r.Key)
+	if r.Status == StatusCanceled || r.Status == StatusUnprocessed {
+		return
+	}
+	if m.finished == nil {
+		m.finished = map[string]*etaTotals{}
+	}
+	host := hostOf(r.URL)
+	t, ok := m.finished[host]
+	if !ok {
+		t = &etaTotals{}
+		m.finished[host] = t
+	}
+	var n int64
+	if r.Status == StatusOK {
+		n = r.Bytes
+	}
+	t.jobs++
+	t.bytes += n
+
+	now := time.Now()
+	m.recent = append(m.recent, etaCompletion{at: now, host: host, bytes: n})
+	for len(m.recent) > etaMinSamples && now.Sub(m.recent[0].at) > etaWindow {
+		m.since = m.recent[0].at
+		m.recent = m.recent[1:]
+	}
+}
+
+// Progress returns the counts of the run and the estimate of its remaining bytes and time
+func (d *Downloader) Progress() Progress {
+	d.mu.RLock()
+	started := d.started
+	queued := d.queue.Jobs()
+	pending := make([]int, 0, len(queued)+len(d.inflight))
+	for _, j := range queued {
+		pending = append(pending, j.Key)
+	}
+	for key := range d.inflight {
+		pending = append(pending, key)
+	}
+	p := Progress{Queued: len(queued), Inflight: len(d.inflight), Done: len(d.results), ETA: -1}
+	d.mu.RUnlock()
+	p.Total = p.Done + len(pending)
+	if started.IsZero() {
+		return p
+	}
+
+	m := &d.eta
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	p.Elapsed = now.Sub(started)
+
+	var all etaTotals
+	for _, t := range m.finished {
+		all.jobs += t.jobs
+		all.bytes += t.bytes
+	}
+	p.Bytes = all.bytes
+	left := map[string]int64{}
+	for _, key := range pending {
+		j, ok := m.jobs[key]
+		if !ok {
+			continue
+		}
+		host := hostOf(j.URL)
+		size := m.expectedSize(d, j, host, all)
+		if t, ok := m.transfers[key]; ok {
+			if t.length >= 0 {
+				size = t.length
+			}
+			if size -= t.wire.count(); size < 0 {
+				size = 0
+			}
+		}
+		left[host] += size
+		p.RemainingBytes += size
+	}
+
+	since := m.since
+	if since.Before(started) {
+		since = started
+	}
+	span := now.Sub(since)
+	switch {
+	case len(pending) == 0:
+		p.ETA = 0
+		return p
+	case len(m.recent) == 0 || span <= 0:
+		return p
+	}
+	byHost := map[string]int64{}
+	var written int64
+	for _, c := range m.recent {
+		byHost[c.host] += c.bytes
+		written += c.bytes
+	}
+	p.Throughput = float64(written) / span.Seconds()
+	if p.Throughput <= 0 || p.RemainingBytes == 0 {
+		// nothing to go by but the pace of the completions, e.g. when the recent ones all failed
+		p.ETA = span * time.Duration(len(pending)) / time.Duration(len(m.recent))
+		return p
+	}
+	p.ETA = time.Duration(float64(p.RemainingBytes) / p.Throughput * float64(time.Second))
+	// a host slower than the others, e.g. capped by --max-per-host, finishes last
+	for host, n := range left {
+		if rate := float64(byHost[host]) / span.Seconds(); rate > 0 {
+			if eta := time.Duration(float64(n) / rate * float64(time.Second)); eta > p.ETA {
+				p.ETA = eta
+			}
+		}
+	}
+	return p
+}
+
+// expectedSize is the size a job left is expected to write before its response arrives
+func (m *etaModel) expectedSize(d *Downloader, j *Job, host string, all etaTotals) int64 {
+	if n, ok := d.skips.size(j.URL); ok {
+		return n
+	}
+	if t, ok := m.finished[host]; ok && t.jobs > 0 {
+		return t.bytes / int64(t.jobs)
+	}
+	if all.jobs > 0 {
+		return all.bytes / int64(all.jobs)
+	}
+	return m.averageSize
+}
+
+// hostOf returns the host of a url, empty when it doesn't parse
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
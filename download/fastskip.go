@@ -0,0 +1,186 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// skipIndexFile is the index of the fast skip in the output directory
+const skipIndexFile = ".fastskip.json"
+
+// skipIndex remembers the validators of the files downloaded to the output directory. A url already in
+// the index gets a HEAD request first, and the GET is only sent when the object changed since, so
+// repeated runs over the same manifest cost a HEAD per unchanged file.
+type skipIndex struct {
+	sync.Mutex
+	path    string
+	entries map[string]skipEntry // by url
+	stats   SkipStats
+}
+
+type skipEntry struct {
+	Path         string `json:"path"`
+	Bytes        int64  `json:"bytes"`
+	SHA256       string `json:"sha256,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Length is the Content-Length of the response, -1 when it was not known
+	Length int64 `json:"length"`
+}
+
+// SkipStats counts the checks of the fast skip during a run
+type SkipStats struct {
+	// Unchanged files were skipped, SavedBytes is their size
+	Unchanged  int   `json:"unchanged"`
+	SavedBytes int64 `json:"saved_bytes"`
+	// Changed files were downloaded again, New ones were not in the index
+	Changed int `json:"changed"`
+	New     int `json:"new"`
+}
+
+// openSkipIndex loads the index of outDir, a missing or unreadable index starts empty
+func openSkipIndex(outDir string, log Logger) *skipIndex {
+	idx := &skipIndex{path: filepath.Join(outDir, skipIndexFile), entries: map[string]skipEntry{}}
+	content, err := ioutil.ReadFile(idx.path)
+	if err == nil {
+		err = json.Unmarshal(content, &idx.entries)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("fast skip - ignoring index %s: %s", idx.path, err)
+	}
+	if idx.entries == nil {
+		idx.entries = map[string]skipEntry{}
+	}
+	return idx
+}
+
+// check sends a HEAD request for a job already in the index whose file is still there, and returns
+// ErrSkip with the result filled from the index when the validators of the object did not change
+func (idx *skipIndex) check(ctx context.Context, d *Downloader, j *Job, result *Result) error {
+	if idx == nil {
+		return nil
+	}
+	idx.Lock()
+	entry, ok := idx.entries[j.URL]
+	idx.Unlock()
+	path, err := d.outputPath(j)
+	if err != nil {
+		return err
+	}
+	if ok && d.contentDisposition && filepath.Dir(entry.Path) == filepath.Dir(path) {
+		path = d.claimName(j, path, entry.Path) // named by the previous response
+	}
+	if ok {
+		info, err := os.Stat(path)
+		ok = err == nil && entry.Path == path && info.Size() == entry.Bytes
+	}
+	if !ok {
+		idx.count(func(s *SkipStats) { s.New++ })
+		return nil
+	}
+
+	a, err := d.send(ctx, http.MethodHead, j.URL)
+	if err != nil {
+		idx.count(func(s *SkipStats) { s.Changed++ })
+		return nil // the GET gets the retries
+	}
+	a.close()
+	if a.res.StatusCode != http.StatusOK || !entry.matches(a.res) {
+		idx.count(func(s *SkipStats) { s.Changed++ })
+		return nil
+	}
+
+	idx.count(func(s *SkipStats) {
+		s.Unchanged++
+		s.SavedBytes += entry.Bytes
+	})
+	result.Path, result.Bytes, result.SHA256 = path, entry.Bytes, entry.SHA256
+	result.SetMeta("fast_skip", "unchanged")
+	return fmt.Errorf("unchanged since the last run: %w", ErrSkip)
+}
+
+// matches reports whether the response has the validators of the entry, the etag when there is one,
+// the modification time and length otherwise
+func (e skipEntry) matches(res *http.Response) bool {
+	if e.ETag != "" {
+		return res.Header.Get("ETag") == e.ETag
+	}
+	if e.LastModified == "" {
+		return false
+	}
+	return res.Header.Get("Last-Modified") == e.LastModified && res.ContentLength == e.Length
+}
+
+// record adds the response of a downloaded file to the index, only when it has a validator
+func (idx *skipIndex) record(url, path string, n int64, sum string, res *http.Response) {
+	if idx == nil {
+		return
+	}
+	entry := skipEntry{
+		Path:         path,
+		Bytes:        n,
+		SHA256:       sum,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Length:       res.ContentLength,
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	if entry.ETag == "" && entry.LastModified == "" {
+		delete(idx.entries, url)
+		return
+	}
+	idx.entries[url] = entry
+}
+
+// size returns the size of the file of url at the last run, false when the url is not in the index
+func (idx *skipIndex) size(url string) (int64, bool) {
+	if idx == nil {
+		return 0, false
+	}
+	idx.Lock()
+	defer idx.Unlock()
+	entry, ok := idx.entries[url]
+	return entry.Bytes, ok
+}
+
+func (idx *skipIndex) count(fn func(*SkipStats)) {
+	idx.Lock()
+	defer idx.Unlock()
+	fn(&idx.stats)
+}
+
+// save writes the index back to the output directory
+func (idx *skipIndex) save() error {
+	if idx == nil {
+		return nil
+	}
+	idx.Lock()
+	defer idx.Unlock()
+
+	content, err := json.Marshal(idx.entries)
+	if err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// SkipStats returns the counters of the fast skip, false when it is disabled
+func (d *Downloader) SkipStats() (SkipStats, bool) {
+	if d.skips == nil {
+		return SkipStats{}, false
+	}
+	d.skips.Lock()
+	defer d.skips.Unlock()
+	return d.skips.stats, true
+}
@@ -0,0 +1,49 @@
+package download
+
+// A job holds up to fdsPerJob descriptors at once: its connection, a hedged one, its output file and
+// one for the post process stages. fdsReserved are left to the listeners, indexes and logs.
+const (
+	fdsPerJob   = 4
+	fdsReserved = 64
+)
+
+// fdBudget caps the number of jobs in flight so their descriptors fit in the limit of open files
+type fdBudget struct {
+	slots chan struct{}
+}
+
+// newFDBudget returns the budget of maxOpenFiles descriptors, of the limit of the process when 0, or
+// nil when it is negative, unknown or large enough for the workers
+func newFDBudget(maxOpenFiles, workers int, log Logger) *fdBudget {
+	if maxOpenFiles < 0 {
+		return nil
+	}
+	limit := openFilesLimit()
+	if maxOpenFiles > 0 && (limit == 0 || maxOpenFiles < limit) {
+		limit = maxOpenFiles
+	}
+	if limit == 0 {
+		return nil
+	}
+	jobs := (limit - fdsReserved) / fdsPerJob
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs < workers {
+		log.Printf("fds - %d open files allowed, at most %d of the %d workers run at once", limit, jobs, workers)
+	}
+	return &fdBudget{slots: make(chan struct{}, jobs)}
+}
+
+// acquire waits for the descriptors of a job
+func (b *fdBudget) acquire() {
+	if b != nil {
+		b.slots <- struct{}{}
+	}
+}
+
+func (b *fdBudget) release() {
+	if b != nil {
+		<-b.slots
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package download
+
+// openFilesLimit returns 0, the limit of open files is not known on this platform
+func openFilesLimit() int {
+	return 0
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package download
+
+import "syscall"
+
+// openFilesLimit returns the soft limit of open files of the process, raised up to the hard limit when
+// permitted, 0 when it can't be read
+func openFilesLimit() int {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	if rl.Cur < rl.Max {
+		raised := rl
+		raised.Cur = rl.Max
+		if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised) == nil {
+			rl = raised
+		} // e.g. darwin refuses more than kern.maxfilesperproc, the soft limit stays
+	}
+	if rl.Cur > 1<<20 {
+		return 1 << 20 // unlimited as far as the workers go
+	}
+	return int(rl.Cur)
+}
@@ -0,0 +1,97 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Fsync policies of the written files
+const (
+	// FsyncNever leaves the files to the page cache, the fastest
+	FsyncNever = "never"
+	// FsyncPerFile syncs each file and its directory before the job completes
+	FsyncPerFile = "per-file"
+	// FsyncBatch syncs the files and their directories every fsyncBatchSize files and at the end of the run
+	FsyncBatch = "batch"
+)
+
+const fsyncBatchSize = 256
+
+// syncer applies the fsync policy to the files of a run
+type syncer struct {
+	mode    string
+	mu      sync.Mutex
+	pending []string // written since the last batch
+}
+
+// file syncs the content of a file being written, with FsyncPerFile
+func (s *syncer) file(f *os.File) error {
+	if s.mode != FsyncPerFile {
+		return nil
+	}
+	return f.Sync()
+}
+
+// written records a completed file, its directory is synced with FsyncPerFile and a batch is due
+// every fsyncBatchSize files with FsyncBatch
+func (s *syncer) written(path string) error {
+	switch s.mode {
+	case FsyncPerFile:
+		return syncDir(filepath.Dir(path))
+	case FsyncBatch:
+		s.mu.Lock()
+		s.pending = append(s.pending, path)
+		due := len(s.pending) >= fsyncBatchSize
+		s.mu.Unlock()
+		if due {
+			return s.flush()
+		}
+	}
+	return nil
+}
+
+// flush syncs the files of the batch, then their directories
+func (s *syncer) flush() error {
+	s.mu.Lock()
+	paths := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	dirs := map[string]bool{}
+	var first error
+	for _, path := range paths {
+		dirs[filepath.Dir(path)] = true
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue // removed since, e.g. quarantined
+		}
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// syncDir makes the entries of a directory durable, directories can't be synced on windows
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,236 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHedgeDelay is the hedging delay until enough response times are known for the percentile
+	defaultHedgeDelay = time.Second
+	// hedgeSamples is the number of recent response times the percentile is computed over, and
+	// minHedgeSamples the number needed before it is used
+	hedgeSamples    = 200
+	minHedgeSamples = 20
+)
+
+// attempt is a request whose response headers were received
+type attempt struct {
+	res    *http.Response
+	url    string
+	cancel context.CancelFunc // aborts the transfer of the body
+	done   func()
+}
+
+// close releases the response, the context and the host slot of the attempt
+func (a *attempt) close() {
+	a.res.Body.Close()
+	a.cancel()
+	a.done()
+}
+
+// sourceOf is the Source of a result fetched from url, empty when it is the job url
+func sourceOf(j *Job, url string) string {
+	if url == j.URL {
+		return ""
+	}
+	return url
+}
+
+// send makes a request to url within the pool limits and returns once its response headers are received
+func (d *Downloader) send(ctx context.Context, method, url string) (*attempt, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx) // lets the stall watch abort only this attempt
+	req = req.WithContext(ctx)
+	setAcceptEncoding(req, d.encodings)
+	if err := d.hooks.runBeforeRequest(req); err != nil {
+		cancel()
+		return nil, err
+	}
+	policy := d.policyFor(req.URL)
+	maxConcurrent := 0
+	if policy != nil {
+		maxConcurrent = policy.MaxConcurrent
+	}
+	release, err := d.hosts.acquire(ctx, req.URL.Host, maxConcurrent)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	fail := func(err error) (*attempt, error) {
+		release()
+		cancel()
+		return nil, err
+	}
+	if policy != nil && policy.RateLimit > 0 {
+		if err := d.hostRates.get(req.URL.Host, policy.RateLimit).wait(ctx); err != nil {
+			return fail(err)
+		}
+	}
+	if err := d.rate.wait(ctx); err != nil {
+		return fail(err)
+	}
+
+	sent := time.Now()
+	res, err := d.fetcher.Do(req)
+	if err != nil {
+		d.hostStats.request(req.URL.Host, 0)
+		return fail(err)
+	}
+	d.hedge.observe(time.Since(sent))
+	d.hostStats.request(req.URL.Host, time.Since(sent))
+	return &attempt{res: res, url: url, cancel: cancel, done: release}, nil
+}
+
+// roundTrip sends the request of an attempt. With hedging, when the response headers take longer than
+// the hedging delay a second request is sent to the next mirror of the job, or to the same url, and the
+// first response is kept while the other request is canceled.
+func (d *Downloader) roundTrip(ctx context.Context, j *Job, url string, result *Result) (*attempt, error) {
+	delay := d.hedge.delay()
+	if delay <= 0 {
+		return d.send(ctx, http.MethodGet, url)
+	}
+
+	outcomes := make(chan hedgeOutcome, 2)
+	var cancels []context.CancelFunc
+	start := func(url string) {
+		ctx, cancel := context.WithCancel(ctx)
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			a, err := d.send(ctx, http.MethodGet, url)
+			outcomes <- hedgeOutcome{i, a, err}
+		}()
+	}
+	start(url)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 {
+				pending++
+				start(nextURL(j, url))
+			}
+		case o := <-outcomes:
+			pending--
+			if o.err != nil {
+				err = o.err
+				if len(cancels) == 1 {
+					pending = 0 // the request failed before the hedging delay, the retries take over
+				}
+				continue
+			}
+
+			// keep the first response, the other request is canceled and closed once it returns
+			for i, cancel := range cancels {
+				if i != o.i {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if lost := <-outcomes; lost.a != nil {
+						lost.a.close()
+					}
+				}
+			}(pending)
+
+			winner, inner, parent := o.a, o.a.cancel, cancels[o.i]
+			winner.cancel = func() {
+				inner()
+				parent()
+			}
+			if len(cancels) > 1 {
+				result.SetMeta("hedged", "true")
+				result.Source = sourceOf(j, winner.url)
+			}
+			return winner, nil
+		}
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil, err
+}
+
+type hedgeOutcome struct {
+	i   int
+	a   *attempt
+	err error
+}
+
+// nextURL returns the mirror after url of the job, or url itself when the job has no mirror
+func nextURL(j *Job, url string) string {
+	urls := append([]string{j.URL}, j.Mirrors...)
+	for i, u := range urls {
+		if u == url {
+			return urls[(i+1)%len(urls)]
+		}
+	}
+	return url
+}
+
+// hedger computes the hedging delay as a percentile of the recent response times
+type hedger struct {
+	mu         sync.Mutex
+	percentile float64
+	initial    time.Duration
+	samples    []time.Duration
+	next       int
+}
+
+// newHedger returns nil, which disables hedging, when percentile is 0
+func newHedger(percentile float64, initial time.Duration) *hedger {
+	if percentile <= 0 {
+		return nil
+	}
+	if initial <= 0 {
+		initial = defaultHedgeDelay
+	}
+	return &hedger{percentile: percentile, initial: initial}
+}
+
+// observe records the time a response took to start
+func (h *hedger) observe(took time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, took)
+		return
+	}
+	h.samples[h.next] = took
+	h.next = (h.next + 1) % hedgeSamples
+}
+
+// delay returns how long to wait for a response before hedging, 0 when hedging is disabled
+func (h *hedger) delay() time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < minHedgeSamples {
+		return h.initial
+	}
+	sorted := append([]time.Duration(nil), h.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(float64(len(sorted)) * h.percentile / 100)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/lawrence/sample/download/testutil"
+)
+
+func TestHedgedRequestToTheMirrorWins(t *testing.T) {
+	responses := testutil.NewResponses().
+		Add("/slow.jpg", testutil.Response{Delay: time.Minute, Body: []byte("slow")}).
+		Add("/fast.jpg", testutil.Response{Body: []byte("fast")})
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{HedgePercentile: 95, HedgeDelay: 10 * time.Millisecond})
+	d.SetJobs([]*Job{{Key: 1, URL: "http://example.com/slow.jpg", Mirrors: []string{"http://mirror.example.com/fast.jpg"}}})
+
+	start := time.Now()
+	d.Start()
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("took %s, the slow request was waited for", took)
+	}
+	r := d.Results()[0]
+	if r.Status != StatusOK || r.Meta["hedged"] != "true" || r.Source != "http://mirror.example.com/fast.jpg" {
+		t.Fatalf("result %+v", r)
+	}
+	if data, _ := ioutil.ReadFile(r.Path); string(data) != "fast" {
+		t.Errorf("file %q, want the body of the mirror", data)
+	}
+	if fetcher.Count("/slow.jpg") != 1 || fetcher.Count("/fast.jpg") != 1 {
+		t.Errorf("%d requests to the url and %d to the mirror, want 1 each", fetcher.Count("/slow.jpg"), fetcher.Count("/fast.jpg"))
+	}
+}
+
+func TestHedgedRequestToTheSameURL(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg",
+		testutil.Response{Delay: time.Minute, Body: []byte("slow")},
+		testutil.Response{Body: []byte("fast")})
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{HedgePercentile: 95, HedgeDelay: 10 * time.Millisecond})
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusOK || r.Meta["hedged"] != "true" || r.Source != "" || r.Attempts != 1 {
+		t.Fatalf("result %+v", r)
+	}
+	if fetcher.Count("/a.jpg") != 2 {
+		t.Errorf("%d requests, want 2", fetcher.Count("/a.jpg"))
+	}
+}
+
+func TestFastResponsesAreNotHedged(t *testing.T) {
+	responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("image")})
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{HedgePercentile: 95, HedgeDelay: time.Minute})
+
+	r := run(d, "http://example.com/a.jpg")[1]
+	if r.Status != StatusOK || r.Meta["hedged"] != "" || fetcher.Count("/a.jpg") != 1 {
+		t.Fatalf("result %+v after %d requests", r, fetcher.Count("/a.jpg"))
+	}
+}
+
+func TestHedgerDelay(t *testing.T) {
+	if h := newHedger(0, time.Second); h != nil || h.delay() != 0 {
+		t.Fatal("hedging enabled without a percentile")
+	}
+	h := newHedger(90, 0)
+	if h.delay() != defaultHedgeDelay {
+		t.Errorf("delay %s before the samples, want %s", h.delay(), defaultHedgeDelay)
+	}
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if h.delay() != 91*time.Millisecond {
+		t.Errorf("delay %s, want the 90th percentile 91ms", h.delay())
+	}
+	// the oldest samples are replaced once the window is full
+	for i := 0; i < hedgeSamples; i++ {
+		h.observe(time.Second)
+	}
+	if h.delay() != time.Second {
+		t.Errorf("delay %s, want 1s", h.delay())
+	}
+}
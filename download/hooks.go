@@ -0,0 +1,143 @@
+package download
+
+import "net/http"
+
+// Option configures optional behaviour of a Downloader
+type Option func(*Downloader)
+
+// hooks are the callbacks registered through the With* options, each hook point may hold several callbacks
+type hooks struct {
+	beforeJob     []func(*Result) error
+	beforeRequest []func(*http.Request) error
+	afterResponse []func(*http.Response) error
+	onRetry       []func(j *Job, attempt int, err error)
+	validate      []func(*Result) error
+	postProcess   []func(*Result) error
+	onComplete    []func(*Result)
+	onError       []func(*Result)
+	sinks         []Sink
+}
+
+// WithCookieJar sets the cookie jar of the http client, so cookies set by the responses are sent
+// back with the next requests
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(d *Downloader) { d.client.Jar = jar }
+}
+
+// WithBeforeJob registers a hook called before a job is fetched with its result holding the job key, url
+// and dir. Returning ErrSkip, possibly wrapped, reports the job as skipped without fetching it, the hook may
+// then set the path of an existing output on the result. Other errors fail the job.
+func WithBeforeJob(fn func(*Result) error) Option {
+	return func(d *Downloader) { d.hooks.beforeJob = append(d.hooks.beforeJob, fn) }
+}
+
+// WithBeforeRequest registers a hook called before each request is sent, it may mutate the request
+// (e.g. to set an auth header) and returning an error fails the attempt
+func WithBeforeRequest(fn func(*http.Request) error) Option {
+	return func(d *Downloader) { d.hooks.beforeRequest = append(d.hooks.beforeRequest, fn) }
+}
+
+// WithAfterResponse registers a hook called with each response before its body is written,
+// returning an error fails the attempt
+func WithAfterResponse(fn func(*http.Response) error) Option {
+	return func(d *Downloader) { d.hooks.afterResponse = append(d.hooks.afterResponse, fn) }
+}
+
+// WithOnRetry registers a hook called when a failed attempt is about to be retried
+func WithOnRetry(fn func(j *Job, attempt int, err error)) Option {
+	return func(d *Downloader) { d.hooks.onRetry = append(d.hooks.onRetry, fn) }
+}
+
+// WithValidate registers a check of each transferred file, returning an error removes the file and fails
+// the attempt so it is retried, from the next mirror when the job has some
+func WithValidate(fn func(*Result) error) Option {
+	return func(d *Downloader) { d.hooks.validate = append(d.hooks.validate, fn) }
+}
+
+// WithPostProcess registers a stage run on each downloaded file before the job is recorded,
+// returning an error marks the job as failed
+func WithPostProcess(fn func(*Result) error) Option {
+	return func(d *Downloader) { d.hooks.postProcess = append(d.hooks.postProcess, fn) }
+}
+
+// WithOnComplete registers a hook called with the result of every finished job, successful or not
+func WithOnComplete(fn func(*Result)) Option {
+	return func(d *Downloader) { d.hooks.onComplete = append(d.hooks.onComplete, fn) }
+}
+
+// WithOnError registers a hook called with the result of every job that did not complete
+func WithOnError(fn func(*Result)) Option {
+	return func(d *Downloader) { d.hooks.onError = append(d.hooks.onError, fn) }
+}
+
+func (h *hooks) runBeforeJob(r *Result) error {
+	for _, fn := range h.beforeJob {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hooks) runBeforeRequest(req *http.Request) error {
+	for _, fn := range h.beforeRequest {
+		if err := fn(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hooks) runAfterResponse(res *http.Response) error {
+	for _, fn := range h.afterResponse {
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hooks) runOnRetry(j *Job, attempt int, err error) {
+	for _, fn := range h.onRetry {
+		fn(j, attempt, err)
+	}
+}
+
+func (h *hooks) runValidate(r *Result) error {
+	for _, fn := range h.validate {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hooks) runPostProcess(r *Result) error {
+	for _, fn := range h.postProcess {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hooks) runSinks(r *Result) error {
+	for _, s := range h.sinks {
+		if err := s.Put(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDone calls the completion hooks, and the error hooks when the job did not complete
+func (h *hooks) runDone(r *Result) {
+	if r.Status != StatusOK && r.Status != StatusSkipped {
+		for _, fn := range h.onError {
+			fn(r)
+		}
+	}
+	for _, fn := range h.onComplete {
+		fn(r)
+	}
+}
@@ -0,0 +1,73 @@
+package download
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HostPolicy adjusts the limits and the retries of the downloader for the requests to some hosts
+type HostPolicy struct {
+	// RateLimit is the maximum number of requests per second to each host of the policy and
+	// MaxConcurrent the maximum number of concurrent requests to it, on top of the pool limits
+	RateLimit     float64
+	MaxConcurrent int
+	// Retries replaces the retries of the downloader for the jobs whose url has the policy when set
+	Retries *int
+	// RetryDelay replaces the base wait between attempts when not 0
+	RetryDelay time.Duration
+}
+
+// WithHostPolicy registers the lookup of the policy of a url, returning nil keeps the defaults
+func WithHostPolicy(fn func(u *url.URL) *HostPolicy) Option {
+	return func(d *Downloader) { d.hostPolicy = fn }
+}
+
+// policyFor returns the policy of a url, nil when it has none
+func (d *Downloader) policyFor(u *url.URL) *HostPolicy {
+	if d.hostPolicy == nil || u == nil {
+		return nil
+	}
+	return d.hostPolicy(u)
+}
+
+// hostRates holds a rate limiter by host for the hosts whose policy has a rate limit
+type hostRates struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func (r *hostRates) get(host string, perSecond float64) *rateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limiters == nil {
+		r.limiters = map[string]*rateLimiter{}
+	}
+	l, ok := r.limiters[host]
+	if !ok {
+		l = &rateLimiter{}
+		l.set(perSecond)
+		r.limiters[host] = l
+	}
+	return l
+}
+
+// attempts returns the maximum number of attempts of a job and the base wait between them
+func (d *Downloader) attempts(j *Job, urls int) (int, time.Duration) {
+	retries, delay := d.retries, d.retryDelay
+	u, _ := url.Parse(j.URL)
+	if p := d.policyFor(u); p != nil {
+		if p.Retries != nil {
+			retries = *p.Retries
+		}
+		if p.RetryDelay > 0 {
+			delay = p.RetryDelay
+		}
+	}
+	// every mirror gets at least one attempt
+	if retries+1 < urls {
+		return urls, delay
+	}
+	return retries + 1, delay
+}
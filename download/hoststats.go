@@ -0,0 +1,133 @@
+package download
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HostStats are the aggregates of the requests and jobs of a host during a run
+type HostStats struct {
+	Host     string `json:"host"`
+	Requests int    `json:"requests"`
+	// Jobs counts the jobs of the host by their url, Succeeded those that completed or were skipped
+	Jobs      int   `json:"jobs"`
+	Succeeded int   `json:"succeeded"`
+	Retries   int   `json:"retries"`
+	Bytes     int64 `json:"bytes"`
+	// P50 and P95 are percentiles of the time to the response headers
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	// Throughput is the bytes per second of the jobs of the host
+	Throughput float64 `json:"throughput"`
+}
+
+// hostStats collects the HostStats of a run
+type hostStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSamples
+}
+
+type hostSamples struct {
+	HostStats
+	latencies []time.Duration
+	busy      time.Duration
+}
+
+func (s *hostStats) get(host string) *hostSamples {
+	if s.hosts == nil {
+		s.hosts = map[string]*hostSamples{}
+	}
+	h, ok := s.hosts[host]
+	if !ok {
+		h = &hostSamples{HostStats: HostStats{Host: host}}
+		s.hosts[host] = h
+	}
+	return h
+}
+
+// request records a request to host answered after latency, 0 when it failed
+func (s *hostStats) request(host string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.get(host)
+	h.Requests++
+	if latency > 0 {
+		h.latencies = append(h.latencies, latency)
+	}
+}
+
+// job records the outcome of a job under the host of its url
+func (s *hostStats) job(r *Result) {
+	u, err := url.Parse(r.URL)
+	if err != nil || r.Status == StatusCanceled || r.Status == StatusUnprocessed {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.get(u.Host)
+	h.Jobs++
+	if r.Status == StatusOK || r.Status == StatusSkipped {
+		h.Succeeded++
+	}
+	if r.Attempts > 1 {
+		h.Retries += r.Attempts - 1
+	}
+	if r.Status == StatusOK {
+		h.Bytes += r.Bytes
+		h.busy += r.Duration
+	}
+}
+
+// HostStats returns the aggregates of each host, the busiest first
+func (d *Downloader) HostStats() []HostStats {
+	d.hostStats.mu.Lock()
+	defer d.hostStats.mu.Unlock()
+
+	stats := make([]HostStats, 0, len(d.hostStats.hosts))
+	for _, h := range d.hostStats.hosts {
+		st := h.HostStats
+		if len(h.latencies) > 0 {
+			sorted := append([]time.Duration(nil), h.latencies...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			st.P50 = sorted[len(sorted)*50/100]
+			st.P95 = sorted[len(sorted)*95/100]
+		}
+		if h.busy > 0 {
+			st.Throughput = float64(h.Bytes) / h.busy.Seconds()
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Host < stats[j].Host
+	})
+	return stats
+}
+
+// printHostStats writes the per host summary of the run
+func (d *Downloader) printHostStats() {
+	for _, st := range d.HostStats() {
+		d.logf("hosts - %s: %d requests, %d/%d jobs ok, %d retries, p50 %s, p95 %s, %s/s",
+			st.Host, st.Requests, st.Succeeded, st.Jobs, st.Retries,
+			st.P50.Round(time.Millisecond), st.P95.Round(time.Millisecond), formatBytes(int64(st.Throughput)))
+	}
+}
+
+// formatBytes renders n with a kB, MB or GB unit (powers of 1024)
+func formatBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value, i := float64(n), 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
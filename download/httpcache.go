@@ -0,0 +1,228 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cachingTransport is a small private http cache in front of the transport. Fresh responses are served
+// from disk without a request, stale ones with validators are revalidated with a conditional request.
+type cachingTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+// cacheEntry is the metadata stored next to a cached body
+type cacheEntry struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header"`
+	Stored     time.Time   `json:"stored"`
+	// Fresh is how long after Stored the response can be used without revalidation
+	Fresh time.Duration `json:"fresh"`
+}
+
+func newCachingTransport(next http.RoundTripper, dir string) http.RoundTripper {
+	return &cachingTransport{next: next, dir: dir}
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	key := t.key(req)
+	entry, cached := t.load(key)
+	if cached && time.Since(entry.Stored) < entry.Fresh {
+		return t.cachedResponse(req, key, entry)
+	}
+
+	if cached {
+		// conditional request on a copy, the caller's request must not be modified
+		req = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cached && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		entry.Stored = time.Now()
+		entry.Fresh, _ = freshness(res.Header)
+		for _, name := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+			if value := res.Header.Get(name); value != "" {
+				entry.Header.Set(name, value)
+			}
+		}
+		t.saveEntry(key, entry)
+		return t.cachedResponse(req, key, entry)
+	}
+
+	fresh, storable := freshness(res.Header)
+	storable = storable && res.StatusCode == http.StatusOK && res.Header.Get("Vary") == "" &&
+		(fresh > 0 || res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != "")
+	if !storable {
+		return res, nil
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return res, nil
+	}
+	tmp, err := ioutil.TempFile(t.dir, key+".tmp")
+	if err != nil {
+		return res, nil
+	}
+	entry = &cacheEntry{StatusCode: res.StatusCode, Status: res.Status, Header: res.Header, Stored: time.Now(), Fresh: fresh}
+	res.Body = &cachingBody{ReadCloser: res.Body, tmp: tmp, commit: func() error {
+		if err := os.Rename(tmp.Name(), t.bodyPath(key)); err != nil {
+			return err
+		}
+		return t.saveEntry(key, entry)
+	}}
+	return res, nil
+}
+
+func (t *cachingTransport) key(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.String() + "\n" + req.Header.Get("Accept-Encoding")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *cachingTransport) bodyPath(key string) string {
+	return filepath.Join(t.dir, key+".body")
+}
+
+func (t *cachingTransport) entryPath(key string) string {
+	return filepath.Join(t.dir, key+".json")
+}
+
+func (t *cachingTransport) load(key string) (*cacheEntry, bool) {
+	content, err := ioutil.ReadFile(t.entryPath(key))
+	if err != nil {
+		return nil, false
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(t.bodyPath(key)); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (t *cachingTransport) saveEntry(key string, entry *cacheEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.entryPath(key), content, 0644)
+}
+
+func (t *cachingTransport) cachedResponse(req *http.Request, key string, entry *cacheEntry) (*http.Response, error) {
+	body, err := os.Open(t.bodyPath(key))
+	if err != nil {
+		return t.next.RoundTrip(req)
+	}
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return t.next.RoundTrip(req)
+	}
+	header := entry.Header.Clone()
+	header.Set("X-Cache", "HIT")
+	return &http.Response{
+		Status:        entry.Status,
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: info.Size(),
+		Request:       req,
+	}, nil
+}
+
+// freshness returns how long a response may be served from the cache and whether it may be stored at all
+func freshness(header http.Header) (time.Duration, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store":
+			return 0, false
+		case directive == "no-cache":
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if fresh := expires.Sub(date); fresh > 0 {
+			return fresh, true
+		}
+	}
+	return 0, true
+}
+
+// cachingBody writes the body to a temporary file as it is read and commits it to the cache once fully read
+type cachingBody struct {
+	io.ReadCloser
+	tmp    *os.File
+	commit func() error
+	done   bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.tmp != nil {
+		if _, werr := b.tmp.Write(p[:n]); werr != nil {
+			b.discard()
+		}
+	}
+	if err == io.EOF && b.tmp != nil && !b.done {
+		b.done = true
+		if b.tmp.Close() != nil || b.commit() != nil {
+			os.Remove(b.tmp.Name())
+		}
+		b.tmp = nil
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	b.discard()
+	return b.ReadCloser.Close()
+}
+
+// discard drops a partially cached body
+func (b *cachingBody) discard() {
+	if b.tmp != nil {
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+		b.tmp = nil
+	}
+}
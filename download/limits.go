@@ -0,0 +1,149 @@
+package download
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SetWorkers changes the size of the pool, while running new workers are started right away and
+// extra workers stop once their current job is done
+func (d *Downloader) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.workers = n
+	d.wake.Broadcast() // the extra workers waiting for jobs stop
+	if d.wg == nil || d.running == 0 {
+		return // not started or all the workers already stopped
+	}
+	for d.running < d.workers {
+		d.spawn()
+	}
+}
+
+// spawn starts a worker, the downloader lock must be held
+func (d *Downloader) spawn() {
+	w := &worker{id: d.nextWorker}
+	d.nextWorker++
+	d.running++
+	d.wg.Add(1)
+	go w.run(d.wg, d)
+}
+
+// SetRateLimit changes the maximum number of requests started per second by the pool, 0 removes the limit
+func (d *Downloader) SetRateLimit(perSecond float64) {
+	d.rate.set(perSecond)
+}
+
+// SetMaxPerHost changes the maximum number of concurrent requests to a host, 0 removes the cap.
+// A worker waiting for a host keeps its slot in the pool.
+func (d *Downloader) SetMaxPerHost(n int) {
+	d.hosts.set(n)
+}
+
+// rateLimiter spaces the requests evenly to stay under a number of requests per second
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) set(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.interval = 0
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+}
+
+// wait blocks until the request may be sent or the context is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.interval == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// hostLimiter caps the number of concurrent requests to each host
+type hostLimiter struct {
+	mu      sync.Mutex
+	max     int
+	active  map[string]int
+	changed chan struct{} // closed when a slot is released or the cap changes
+}
+
+func newHostLimiter(max int) *hostLimiter {
+	return &hostLimiter{max: max, active: map[string]int{}, changed: make(chan struct{})}
+}
+
+func (h *hostLimiter) set(max int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.max = max
+	h.broadcast()
+}
+
+// acquire waits for a free slot of the host and returns the func releasing it, limit is a lower cap
+// of the host when not 0
+func (h *hostLimiter) acquire(ctx context.Context, host string, limit int) (func(), error) {
+	for {
+		h.mu.Lock()
+		max := h.max
+		if limit > 0 && (max <= 0 || limit < max) {
+			max = limit
+		}
+		if max <= 0 || h.active[host] < max {
+			h.active[host]++
+			h.mu.Unlock()
+			return func() { h.release(host) }, nil
+		}
+		changed := h.changed
+		h.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (h *hostLimiter) release(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.active[host]--; h.active[host] <= 0 {
+		delete(h.active, host)
+	}
+	h.broadcast()
+}
+
+// broadcast wakes up the waiting acquires, the lock must be held
+func (h *hostLimiter) broadcast() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
@@ -0,0 +1,75 @@
+package download
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// memoryHighWater is the share of MaxMemory above which no new job is started, and memoryCheckInterval
+// how often the heap is measured while the intake is held
+const (
+	memoryHighWater     = 0.9
+	memoryCheckInterval = 100 * time.Millisecond
+)
+
+// memoryGate holds the intake of the workers while the heap is close to the memory ceiling, the jobs in
+// flight complete and release their buffers before new ones are started
+type memoryGate struct {
+	mu      sync.Mutex
+	log     Logger
+	limit   int64
+	checked time.Time
+	over    bool
+}
+
+// newMemoryGate returns the gate of a ceiling in bytes, nil without ceiling. The ceiling is also the
+// soft memory limit of the runtime, so the collector works harder as the heap grows near it.
+func newMemoryGate(limit int64, log Logger) *memoryGate {
+	if limit <= 0 {
+		return nil
+	}
+	debug.SetMemoryLimit(limit)
+	return &memoryGate{limit: limit, log: log}
+}
+
+// wait returns once the heap is under the high water mark, or right away when no job is in flight as
+// the heap can't shrink by waiting then
+func (g *memoryGate) wait(d *Downloader) {
+	if g == nil {
+		return
+	}
+	for g.overLimit() {
+		if d.Inflight() == 0 {
+			return
+		}
+		time.Sleep(memoryCheckInterval)
+	}
+}
+
+// overLimit measures the heap at most every memoryCheckInterval, a collection is forced before the
+// intake is held so garbage alone doesn't hold it
+func (g *memoryGate) overLimit() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checked) < memoryCheckInterval {
+		return g.over
+	}
+	high := uint64(float64(g.limit) * memoryHighWater)
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > high {
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+	}
+	g.checked = time.Now()
+	wasOver := g.over
+	g.over = m.HeapAlloc > high
+	if g.over && !wasOver {
+		g.log.Printf("memory - heap at %s of the %s ceiling, holding new jobs", formatBytes(int64(m.HeapAlloc)), formatBytes(g.limit))
+	} else if !g.over && wasOver {
+		g.log.Printf("memory - heap down to %s, resuming", formatBytes(int64(m.HeapAlloc)))
+	}
+	return g.over
+}
@@ -0,0 +1,114 @@
+package download
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Name collision policies, when the Content-Disposition filenames of two jobs of a run are the same
+const (
+	// NameRename adds -1, -2... before the extension of the later files, as browsers do
+	NameRename = "rename"
+	// NameOverwrite lets the last file win
+	NameOverwrite = "overwrite"
+	// NameKey falls back to the numeric key name
+	NameKey = "key"
+)
+
+// maxNameLength is the longest file name most file systems accept, in bytes
+const maxNameLength = 255
+
+// dispositionPath returns the output path named by the Content-Disposition of the response in the
+// directory of path, or path when the response has no usable filename or the names are not enabled
+func (d *Downloader) dispositionPath(j *Job, path string, res *http.Response) string {
+	if !d.contentDisposition {
+		return path
+	}
+	name := dispositionName(res.Header.Get("Content-Disposition"))
+	if name == "" {
+		return path
+	}
+	return d.claimName(j, path, filepath.Join(filepath.Dir(path), name))
+}
+
+// reserveNames reserves the key or id named outputs of the jobs before any response is named, the caller
+// holds the lock
+func (d *Downloader) reserveNames(jobs []*Job) {
+	if !d.contentDisposition {
+		return
+	}
+	if d.reserved == nil {
+		d.reserved = map[string]int{}
+	}
+	for _, j := range jobs {
+		d.reserved[OutputPath(d.outDir, j)] = j.Key
+	}
+}
+
+// claimName reserves named for the job and returns the path it is written to, by the collision policy
+// when another job of the run already has it. The key or id named output of another job is never
+// given, whatever the policy: the name is renamed, or else the key name of the job is used.
+func (d *Downloader) claimName(j *Job, path, named string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.names == nil {
+		d.names = map[string]int{}
+	}
+
+	candidate := named
+	ext := filepath.Ext(named)
+	for i := 1; ; i++ {
+		key, taken := d.names[candidate]
+		owner, reserved := d.reserved[candidate]
+		switch {
+		case reserved && owner != j.Key:
+			if d.nameCollision != NameRename {
+				return path
+			}
+		case !taken || key == j.Key || d.nameCollision == NameOverwrite:
+			d.names[candidate] = j.Key
+			return candidate
+		case d.nameCollision == NameKey:
+			return path
+		}
+		candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(named, ext), i, ext)
+	}
+}
+
+// dispositionName returns the sanitized filename of a Content-Disposition header, filename* included,
+// or an empty string. Directories are dropped and the name can't be hidden, so it never escapes the
+// output directory nor shadows its indexes.
+func dispositionName(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	name := strings.Replace(params["filename"], "\\", "/", -1)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == ';' {
+			return -1 // nor ; which the shells and smbclient split the commands on
+		}
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_' // not allowed on windows
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > maxNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxNameLength-len(ext)], "") + ext
+	}
+	return name
+}
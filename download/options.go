@@ -0,0 +1,158 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Logger receives the progress lines of the downloader, a *log.Logger is one
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdoutLogger prints the lines to the standard output, the default logger
+type stdoutLogger struct{}
+
+func (stdoutLogger) Printf(format string, v ...interface{}) {
+	fmt.Println(fmt.Sprintf(format, v...))
+}
+
+func (d *Downloader) logf(format string, v ...interface{}) {
+	d.log.Printf(format, v...)
+}
+
+// Fetcher performs the requests of the downloader, a *http.Client is the default one
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// RetryPolicy is how the failed attempts of the jobs are retried
+type RetryPolicy struct {
+	// Retries is the number of attempts after the first one
+	Retries int
+	// Delay is the base wait between attempts, it grows linearly with each attempt
+	Delay time.Duration
+	// Retryable tells the errors worth another attempt, it replaces the default that retries everything
+	// but the 4xx statuses other than 408 and 429, skips and a full disk
+	Retryable func(error) bool
+}
+
+// Sink receives each downloaded file once it passed the post process stages, e.g. to store it
+// elsewhere, returning an error fails the job
+type Sink interface {
+	Put(r *Result) error
+}
+
+// WithOptions configures the downloader from an Options struct, it replaces what the options before it set
+func WithOptions(opts Options) Option {
+	return func(d *Downloader) {
+		d.opts = opts
+		d.workers = opts.Workers
+		d.client = &http.Client{
+			Transport:     newTransport(opts.Encodings, opts.IOBuffer),
+			Timeout:       opts.Timeout,
+			CheckRedirect: checkRedirect(opts.Redirects),
+		}
+		d.outDir = opts.OutDir
+		d.retries = opts.Retries
+		d.notFound = opts.NotFound
+		d.encodings = opts.Encodings
+		d.minSpeed = opts.MinSpeed
+		d.stallTimeout = opts.StallTimeout
+		d.maxTotalBytes = opts.MaxTotalBytes
+		d.maxDuration = opts.MaxDuration
+		d.maxDiskUsage = opts.MaxDiskUsage
+		d.diskPolicy = opts.DiskPolicy
+		d.rate.set(opts.RateLimit)
+		d.hosts = newHostLimiter(opts.MaxPerHost)
+		d.hedge = newHedger(opts.HedgePercentile, opts.HedgeDelay)
+		d.order = opts.Order
+		d.seed = opts.Seed
+		d.contentDisposition = opts.ContentDisposition
+		d.nameCollision = opts.NameCollision
+		d.ioBuffer = opts.IOBuffer
+		d.checksums = splitList(opts.Checksums)
+		d.sidecars = opts.ChecksumSidecars
+		d.keepHeaders = splitList(opts.ResponseHeaders)
+		d.noPreallocate = opts.NoPreallocate
+		d.fsync = &syncer{mode: opts.Fsync}
+		d.retryBudget.ratio = opts.RetryBudget
+	}
+}
+
+// WithWorkers sets the size of the pool
+func WithWorkers(n int) Option {
+	return func(d *Downloader) { d.workers = n }
+}
+
+// WithOutDir sets the output directory
+func WithOutDir(dir string) Option {
+	return func(d *Downloader) {
+		d.outDir = dir
+		d.opts.OutDir = dir
+	}
+}
+
+// WithClient sets the http client of the requests, the transport, timeout and redirect settings of
+// the Options then don't apply
+func WithClient(c *http.Client) Option {
+	return func(d *Downloader) { d.client = c }
+}
+
+// WithFetcher sets what performs the requests instead of the http client, e.g. a fake of the tests,
+// the client settings and http cache of the Options then don't apply
+func WithFetcher(f Fetcher) Option {
+	return func(d *Downloader) { d.fetcher = f }
+}
+
+// WithQueue sets the storage of the queued jobs, a queue kept in memory by default
+func WithQueue(q Queue) Option {
+	return func(d *Downloader) { d.queue = q }
+}
+
+// WithRetryPolicy sets how failed attempts are retried, the host policies still override the retries
+// and delay of their hosts
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(d *Downloader) {
+		d.retries = p.Retries
+		if p.Delay > 0 {
+			d.retryDelay = p.Delay
+		}
+		d.retryable = p.Retryable
+	}
+}
+
+// WithSink registers a sink of the downloaded files, the sinks are called in turn after the post
+// process stages
+func WithSink(s Sink) Option {
+	return func(d *Downloader) { d.hooks.sinks = append(d.hooks.sinks, s) }
+}
+
+// PassThrough stores the bodies of the downloads in place of the output directory, see WithPassThrough
+type PassThrough interface {
+	// PutStream stores the body of the output at name, the slash separated path it would have in the
+	// output directory. body fails when the transfer does or when the checksums don't match, the
+	// object must then not be kept.
+	PutStream(r *Result, name string, body io.Reader) error
+}
+
+// WithPassThrough streams each download to p as its body arrives, nothing is written to the disk: the
+// results have no path, so the validation, post process and sink hooks reading the file don't apply
+func WithPassThrough(p PassThrough) Option {
+	return func(d *Downloader) { d.passThrough = p }
+}
+
+// WithLogger sets the logger of the progress lines, they are printed to the standard output by default
+func WithLogger(l Logger) Option {
+	return func(d *Downloader) { d.log = l }
+}
+
+// isRetryable reports whether an attempt failing with err is retried, see RetryPolicy
+func (d *Downloader) isRetryable(err error) bool {
+	if d.retryable != nil {
+		return d.retryable(err)
+	}
+	return retryable(err)
+}
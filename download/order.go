@@ -0,0 +1,36 @@
+package download
+
+import (
+	"math/rand"
+	"net/url"
+	"sort"
+)
+
+// Job orders, the order the queued jobs are started in
+const (
+	// OrderManifest starts the jobs in the order they were given to SetJobs
+	OrderManifest = "manifest"
+	// OrderShuffle starts them in a random order drawn from the seed, the same seed gives the same order
+	OrderShuffle = "shuffle"
+	// OrderHost groups the jobs by host, in manifest order within a host, so connections get reused
+	OrderHost = "host"
+)
+
+// orderJobs returns the jobs in the order they are started
+func orderJobs(jobs []*Job, order string, seed int64) []*Job {
+	ordered := append([]*Job(nil), jobs...)
+	switch order {
+	case OrderShuffle:
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case OrderHost:
+		hosts := make(map[*Job]string, len(ordered))
+		for _, j := range ordered {
+			if u, err := url.Parse(j.URL); err == nil {
+				hosts[j] = u.Host
+			}
+		}
+		sort.SliceStable(ordered, func(i, j int) bool { return hosts[ordered[i]] < hosts[ordered[j]] })
+	}
+	return ordered
+}
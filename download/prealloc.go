@@ -0,0 +1,39 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ErrNoSpace is returned, wrapped, when the file of a response can't be preallocated for lack of disk
+// space, the job fails right away instead of when the disk fills up
+var ErrNoSpace = errors.New("not enough disk space")
+
+// identityLength returns the Content-Length of a response whose body is written as is, -1 otherwise
+func identityLength(res *http.Response) int64 {
+	enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if res.Uncompressed || (enc != "" && enc != "identity") {
+		return -1
+	}
+	return res.ContentLength
+}
+
+// preallocate reserves the Content-Length of an identity encoded response for its file, so it is laid
+// out in one piece. The file systems and platforms without fallocate write the file as it comes.
+func preallocate(f *os.File, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	unsupported, err := fallocate(f, length)
+	switch {
+	case err == nil || unsupported:
+		return nil
+	case errors.Is(err, syscall.ENOSPC):
+		return fmt.Errorf("%d bytes for %s: %w", length, f.Name(), ErrNoSpace)
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+package download
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves size bytes for the file, unsupported reports whether the file system doesn't allow it
+func fallocate(f *os.File, size int64) (unsupported bool, err error) {
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS || err == syscall.EINVAL {
+		return true, err
+	}
+	return false, err
+}
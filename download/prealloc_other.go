@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package download
+
+import (
+	"errors"
+	"os"
+)
+
+// fallocate is not supported on this platform, the file grows as it is written
+func fallocate(f *os.File, size int64) (unsupported bool, err error) {
+	return true, errors.New("fallocate is not supported")
+}
@@ -0,0 +1,91 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrUnsupportedScheme is returned, wrapped, for the urls whose scheme is neither http, https nor one
+// registered with WithProtocol
+var ErrUnsupportedScheme = errors.New("unsupported url scheme")
+
+// WithProtocol registers the transport of the urls of a scheme, e.g. a torrent client answering
+// magnet: urls with the content as the response body. Its requests still go through the hooks, the
+// retries and the cassettes of the other requests. A transport returning http.ErrSkipAltProtocol
+// leaves the request to the http client, as the alternate protocols of http.Transport do, and sends
+// the requests of its own through ProtocolFetcher.
+func WithProtocol(scheme string, rt http.RoundTripper) Option {
+	return func(d *Downloader) {
+		if d.protocols == nil {
+			d.protocols = map[string]http.RoundTripper{}
+		}
+		d.protocols[scheme] = rt
+	}
+}
+
+// fetcherKey is the context key of the Fetcher of the requests a protocol sends on its own
+type fetcherKey struct{}
+
+// ProtocolFetcher returns the Fetcher a transport registered with WithProtocol sends the other requests
+// a request needs through, e.g. those of the parts of its file: they get the before request hooks, so
+// the auth and signatures of their own url, and the http client of the downloader with its timeout,
+// redirect policy, transport and cache. It is nil for a request that doesn't come from a downloader.
+func ProtocolFetcher(req *http.Request) Fetcher {
+	f, _ := req.Context().Value(fetcherKey{}).(Fetcher)
+	return f
+}
+
+// protocolFetcher sends the requests of the registered schemes to their transport, and the others to
+// the fetcher it wraps
+type protocolFetcher struct {
+	next      Fetcher
+	protocols map[string]http.RoundTripper
+	prepare   func(*http.Request) error // the before request hooks of the requests of the protocols
+}
+
+// newProtocolFetcher returns next itself when no protocol is registered
+func newProtocolFetcher(next Fetcher, protocols map[string]http.RoundTripper, prepare func(*http.Request) error) Fetcher {
+	if len(protocols) == 0 {
+		return next
+	}
+	return &protocolFetcher{next: next, protocols: protocols, prepare: prepare}
+}
+
+func (f *protocolFetcher) Do(req *http.Request) (*http.Response, error) {
+	if rt, ok := f.protocols[req.URL.Scheme]; ok {
+		sub := preparedFetcher{next: f.next, prepare: f.prepare}
+		res, err := rt.RoundTrip(req.WithContext(context.WithValue(req.Context(), fetcherKey{}, Fetcher(sub))))
+		if err != http.ErrSkipAltProtocol {
+			return res, err
+		}
+	}
+	return f.next.Do(req)
+}
+
+// preparedFetcher runs the before request hooks of a request then sends it to next
+type preparedFetcher struct {
+	next    Fetcher
+	prepare func(*http.Request) error
+}
+
+func (f preparedFetcher) Do(req *http.Request) (*http.Response, error) {
+	if err := f.prepare(req); err != nil {
+		return nil, err
+	}
+	return f.next.Do(req)
+}
+
+// clientFetcher sends the requests to the http client of the downloader, failing those of the other
+// schemes with ErrUnsupportedScheme rather than the error string of the client
+type clientFetcher struct {
+	client *http.Client
+}
+
+func (f clientFetcher) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%s: %w %q", req.URL, ErrUnsupportedScheme, req.URL.Scheme)
+	}
+	return f.client.Do(req)
+}
@@ -0,0 +1,110 @@
+package download
+
+// Queue stores the jobs waiting for a worker, in the order they are started. The downloader calls it
+// under its lock, an implementation doesn't need to be safe for concurrent use.
+type Queue interface {
+	// Push appends jobs to the queue, a job of a key already queued replaces it
+	Push(jobs ...*Job)
+	// Pop removes and returns the next job, false when the queue is empty
+	Pop() (*Job, bool)
+	// Get returns the queued job of a key
+	Get(key int) (*Job, bool)
+	// Remove removes the queued job of a key and returns it
+	Remove(key int) (*Job, bool)
+	// Jobs returns the queued jobs in the order they are started
+	Jobs() []*Job
+	// Len returns the number of queued jobs
+	Len() int
+	// Clear removes all the jobs
+	Clear()
+}
+
+// NewMemoryQueue returns the default queue, kept in memory
+func NewMemoryQueue() Queue {
+	return &memoryQueue{jobs: map[int]queuedJob{}}
+}
+
+// memoryQueue holds the jobs by key and their keys in order. The entries of the removed jobs are
+// skipped when they come up, each entry has the sequence number of the push it was made by so the
+// entry of a removed job doesn't start the job pushed again with its key.
+type memoryQueue struct {
+	jobs    map[int]queuedJob
+	entries []queuedJob
+	seq     int
+}
+
+type queuedJob struct {
+	*Job
+	seq int
+}
+
+func (q *memoryQueue) Push(jobs ...*Job) {
+	for _, j := range jobs {
+		if queued, ok := q.jobs[j.Key]; ok {
+			q.jobs[j.Key] = queuedJob{j, queued.seq} // keeps its place
+			continue
+		}
+		q.seq++
+		q.jobs[j.Key] = queuedJob{j, q.seq}
+		q.entries = append(q.entries, queuedJob{j, q.seq})
+	}
+}
+
+func (q *memoryQueue) Pop() (*Job, bool) {
+	for len(q.entries) > 0 {
+		e := q.entries[0]
+		q.entries = q.entries[1:]
+		if queued, ok := q.jobs[e.Key]; ok && queued.seq == e.seq {
+			delete(q.jobs, e.Key)
+			return queued.Job, true
+		}
+	}
+	return nil, false
+}
+
+func (q *memoryQueue) Get(key int) (*Job, bool) {
+	queued, ok := q.jobs[key]
+	return queued.Job, ok
+}
+
+func (q *memoryQueue) Remove(key int) (*Job, bool) {
+	queued, ok := q.jobs[key]
+	if !ok {
+		return nil, false
+	}
+	delete(q.jobs, key)
+	if len(q.entries) > 2*len(q.jobs)+64 {
+		q.compact()
+	}
+	return queued.Job, true
+}
+
+func (q *memoryQueue) Jobs() []*Job {
+	jobs := make([]*Job, 0, len(q.jobs))
+	for _, e := range q.entries {
+		if queued, ok := q.jobs[e.Key]; ok && queued.seq == e.seq {
+			jobs = append(jobs, queued.Job)
+		}
+	}
+	return jobs
+}
+
+func (q *memoryQueue) Len() int {
+	return len(q.jobs)
+}
+
+func (q *memoryQueue) Clear() {
+	q.jobs = map[int]queuedJob{}
+	q.entries = nil
+}
+
+// compact drops the entries of the removed jobs, e.g. after many cancellations
+func (q *memoryQueue) compact() {
+	var entries []queuedJob
+	for _, e := range q.entries {
+		if queued, ok := q.jobs[e.Key]; ok && queued.seq == e.seq {
+			entries = append(entries, e)
+		}
+	}
+	q.entries = entries
+}
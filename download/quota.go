@@ -0,0 +1,123 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Disk quota policies
+const (
+	DiskStop        = "stop"
+	DiskPruneOldest = "prune-oldest"
+)
+
+// outputFile is a file of the output directory considered for pruning
+type outputFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// scanOutput returns the regular files of the output directory, hidden files such as indexes are left out
+func scanOutput(dir string) ([]outputFile, error) {
+	var files []outputFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, outputFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// initDiskUsage counts the files already in the output directory against the quota
+func (d *Downloader) initDiskUsage() error {
+	if d.maxDiskUsage <= 0 {
+		return nil
+	}
+	files, err := scanOutput(d.outDir)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diskUsage = 0
+	for _, f := range files {
+		d.diskUsage += f.size
+	}
+	return nil
+}
+
+// replaced discounts an existing output file that is about to be overwritten
+func (d *Downloader) replaced(path string) {
+	if d.maxDiskUsage <= 0 {
+		return
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		d.mu.Lock()
+		d.diskUsage -= info.Size()
+		d.mu.Unlock()
+	}
+}
+
+// pruneOldest deletes the oldest output files until the usage is back under the quota. Files written
+// by the current run are never pruned, once only those are left the run stops as with DiskStop.
+func (d *Downloader) pruneOldest() {
+	d.pruneMu.Lock()
+	defer d.pruneMu.Unlock()
+
+	d.mu.RLock()
+	over := d.diskUsage - d.maxDiskUsage
+	d.mu.RUnlock()
+	if over <= 0 {
+		return
+	}
+
+	files, err := scanOutput(d.outDir)
+	if err != nil {
+		d.logf("disk quota - prune failed: %s", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var freed int64
+	for _, f := range files {
+		if freed >= over {
+			break
+		}
+		d.mu.RLock()
+		current := d.written[f.path]
+		d.mu.RUnlock()
+		if current {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			continue
+		}
+		d.logf("disk quota - pruned %s", f.path)
+		freed += f.size
+	}
+
+	d.mu.Lock()
+	d.diskUsage -= freed
+	if freed < over {
+		d.diskPolicy = DiskStop // only files of this run are left, stop instead
+	}
+	d.mu.Unlock()
+}
@@ -0,0 +1,82 @@
+package download
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudgetReserve is the retries allowed on top of the ratio, so the first failures of a run and
+// the small runs still get their retries
+const retryBudgetReserve = 10
+
+// retryBudgetWindow is how far back the requests and retries of the budget are counted, in buckets of
+// a second, so the budget recovers once an outage is over
+const retryBudgetWindow = 60
+
+// retryBudget caps the retries of the whole run to a ratio of its recent requests: while the hosts fail
+// together, the jobs fail at their first attempt instead of each spending its retries, which would
+// multiply the load on the failing hosts and the duration of the run.
+type retryBudget struct {
+	mu        sync.Mutex
+	ratio     float64 // no budget when 0
+	buckets   [retryBudgetWindow]budgetBucket
+	exhausted bool
+}
+
+type budgetBucket struct {
+	second            int64
+	requests, retries int
+}
+
+func (b *retryBudget) bucket(now time.Time) *budgetBucket {
+	s := now.Unix()
+	bucket := &b.buckets[s%retryBudgetWindow]
+	if bucket.second != s {
+		*bucket = budgetBucket{second: s}
+	}
+	return bucket
+}
+
+// request counts an attempt of a job
+func (b *retryBudget) request() {
+	if b.ratio <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).requests++
+}
+
+// allow tells whether a job can retry and counts the retry. Once exhausted, the budget is available
+// again when the retries are down to half of it.
+func (b *retryBudget) allow(d *Downloader) bool {
+	if b.ratio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if now.Unix()-bucket.second < retryBudgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	limit := b.ratio*float64(requests) + retryBudgetReserve
+	if b.exhausted {
+		limit /= 2 // so the budget doesn't flap with each new request while the outage lasts
+	}
+	allowed := float64(retries+1) <= limit
+	if !allowed && !b.exhausted {
+		d.logf("retry budget - exhausted, %d retries of %d requests in the last %ds, failing without retrying", retries, requests, retryBudgetWindow)
+	} else if allowed && b.exhausted {
+		d.logf("retry budget - available again")
+	}
+	b.exhausted = !allowed
+	if allowed {
+		b.bucket(now).retries++
+	}
+	return allowed
+}
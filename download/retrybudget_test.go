@@ -0,0 +1,77 @@
+package download
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/lawrence/sample/download/testutil"
+)
+
+func TestRetryBudgetWithoutRatioAllowsEveryRetry(t *testing.T) {
+	d := NewDownloader(WithLogger(discardLogger{}))
+	var b retryBudget
+	for i := 0; i < 100; i++ {
+		if !b.allow(d) {
+			t.Fatalf("retry %d not allowed", i+1)
+		}
+	}
+}
+
+func TestRetryBudgetIsAvailableAgainAtHalfOfIt(t *testing.T) {
+	d := NewDownloader(WithLogger(discardLogger{}))
+	b := retryBudget{ratio: 0.1}
+	for i := 0; i < retryBudgetReserve; i++ {
+		if !b.allow(d) {
+			t.Fatalf("retry %d of the reserve not allowed", i+1)
+		}
+	}
+	if b.allow(d) {
+		t.Fatal("retry allowed past the reserve")
+	}
+	// 10 retries of 100 requests are within the budget of 20 but not within its half
+	for i := 0; i < 100; i++ {
+		b.request()
+	}
+	if b.allow(d) {
+		t.Fatal("retry allowed before the retries are down to half of the budget")
+	}
+	for i := 0; i < 20; i++ {
+		b.request()
+	}
+	if !b.allow(d) {
+		t.Fatal("retry not allowed with the retries at half of the budget")
+	}
+	if b.exhausted {
+		t.Error("budget still exhausted")
+	}
+}
+
+func TestRetryBudgetFailsTheJobsOfAnOutageFast(t *testing.T) {
+	const jobs, retries = 20, 3
+	responses := testutil.NewResponses()
+	urls := make([]string, jobs)
+	for i := range urls {
+		path := "/" + strconv.Itoa(i) + ".jpg"
+		responses.Add(path, testutil.Response{Status: http.StatusServiceUnavailable})
+		urls[i] = "http://example.com" + path
+	}
+	fetcher := testutil.NewFetcher(responses)
+	d := newTestDownloader(t, fetcher, Options{Retries: retries, RetryBudget: 0.1})
+
+	var exhausted int
+	for _, r := range run(d, urls...) {
+		if r.Status != StatusFailed {
+			t.Errorf("job #%d %s", r.Key, r.Status)
+		}
+		if r.Meta["retry_budget"] == "exhausted" {
+			exhausted++
+		}
+	}
+	if exhausted == 0 {
+		t.Error("no job failed for the budget")
+	}
+	if n := len(fetcher.Requests()); n >= jobs*(retries+1) {
+		t.Errorf("%d requests, the budget saved none", n)
+	}
+}
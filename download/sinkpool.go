@@ -0,0 +1,71 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sinkJob is a download waiting for a sink worker
+type sinkJob struct {
+	ctx     context.Context
+	job     *Job
+	result  *Result
+	started time.Time
+	queued  time.Time // when the fetching worker started waiting for the queue
+}
+
+// sinkPool runs the sinks of the downloads apart from the workers fetching them: the fetching workers
+// hand their downloads over through a bounded queue and go on with the next job, they only wait when
+// the queue is full, so a slow destination and a slow origin each idle their own pool only
+type sinkPool struct {
+	queue chan *sinkJob
+	wg    sync.WaitGroup
+}
+
+// startSinkPool starts the sink workers of the options, it returns nil when the sinks run in the
+// fetching workers or there are none
+func startSinkPool(d *Downloader) *sinkPool {
+	n := d.opts.SinkWorkers
+	if n <= 0 || len(d.hooks.sinks) == 0 {
+		return nil
+	}
+	buffer := d.opts.SinkBuffer
+	if buffer <= 0 {
+		buffer = n
+	}
+	p := &sinkPool{queue: make(chan *sinkJob, buffer)}
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		go p.run(d, i)
+	}
+	return p
+}
+
+func (p *sinkPool) run(d *Downloader, id int) {
+	defer p.wg.Done()
+	who := fmt.Sprintf("sink #%d", id)
+	for s := range p.queue {
+		stage := time.Now()
+		s.result.addStage(StageSinkQueue, stage.Sub(s.queued))
+		err := d.hooks.runSinks(s.result)
+		s.result.addStage(StageSink, time.Since(stage))
+		ctx := s.ctx
+		if !errors.Is(err, context.Canceled) {
+			// the sinks don't watch the job context, their result stands when the job was canceled meanwhile
+			ctx = context.Background()
+		}
+		d.done(d.complete(ctx, who, s.job, s.result, err, s.started))
+	}
+}
+
+// close waits for the downloads in the queue once the fetching workers stopped
+func (p *sinkPool) close() {
+	if p == nil {
+		return
+	}
+	close(p.queue)
+	p.wg.Wait()
+}
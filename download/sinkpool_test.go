@@ -0,0 +1,107 @@
+package download
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawrence/sample/download/testutil"
+)
+
+// blockingSink holds its uploads until released, then returns err
+type blockingSink struct {
+	started chan int
+	release chan struct{}
+	err     error
+
+	mu             sync.Mutex
+	active, maxRun int
+}
+
+func newBlockingSink(err error) *blockingSink {
+	return &blockingSink{started: make(chan int, 100), release: make(chan struct{}), err: err}
+}
+
+func (s *blockingSink) Put(r *Result) error {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxRun {
+		s.maxRun = s.active
+	}
+	s.mu.Unlock()
+	s.started <- r.Key
+	<-s.release
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return s.err
+}
+
+func TestSinkPoolRunsApartFromTheFetchingWorkers(t *testing.T) {
+	const jobs = 6
+	responses := testutil.NewResponses()
+	urls := make([]string, jobs)
+	for i := range urls {
+		path := "/" + strconv.Itoa(i) + ".jpg"
+		responses.Add(path, testutil.Response{Body: []byte("image")})
+		urls[i] = "http://example.com" + path
+	}
+	fetcher := testutil.NewFetcher(responses)
+	sink := newBlockingSink(nil)
+	d := newTestDownloader(t, fetcher, Options{SinkWorkers: 2, SinkBuffer: jobs}, WithSink(sink))
+
+	done := make(chan map[int]*Result)
+	go func() { done <- run(d, urls...) }()
+	<-sink.started
+	<-sink.started
+	// the fetching worker goes on while both sink workers are uploading
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fetcher.Requests()) < jobs && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(fetcher.Requests()); n != jobs {
+		t.Errorf("%d jobs fetched while the sinks are busy, want %d", n, jobs)
+	}
+	close(sink.release)
+	results := <-done
+	for key, r := range results {
+		if r.Status != StatusOK {
+			t.Errorf("job #%d %s: %s", key, r.Status, r.Error)
+		}
+	}
+	if len(results) != jobs {
+		t.Errorf("%d results, want %d", len(results), jobs)
+	}
+	if sink.maxRun != 2 {
+		t.Errorf("%d concurrent uploads, want 2", sink.maxRun)
+	}
+}
+
+func TestSinkPoolReportsTheUploadOfACanceledJob(t *testing.T) {
+	tests := map[string]struct {
+		err              error
+		status, errClass string
+	}{
+		"uploaded": {nil, StatusOK, ""},
+		"failed":   {&HTTPStatusError{Code: http.StatusBadGateway, Status: "502 Bad Gateway"}, StatusFailed, ErrorHTTP5xx},
+	}
+	for name, test := range tests {
+		responses := testutil.NewResponses().Add("/a.jpg", testutil.Response{Body: []byte("image")})
+		sink := newBlockingSink(test.err)
+		d := newTestDownloader(t, testutil.NewFetcher(responses), Options{SinkWorkers: 1}, WithSink(sink))
+
+		done := make(chan map[int]*Result)
+		go func() { done <- run(d, "http://example.com/a.jpg") }()
+		<-sink.started
+		if err := d.CancelJob(1); err != nil {
+			t.Fatal(err)
+		}
+		close(sink.release)
+		r := (<-done)[1]
+		if r.Status != test.status || r.ErrorClass != test.errClass {
+			t.Errorf("%s: status %s class %q, want %s %q", name, r.Status, r.ErrorClass, test.status, test.errClass)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrTooLarge is returned, wrapped, when a file is larger than Options.MaxFileSize
+var ErrTooLarge = errors.New("file too large")
+
+// checkDeclaredSize fails a response whose body is announced larger than max before it is read, the
+// length of a compressed body is only known once decoded
+func checkDeclaredSize(res *http.Response, max int64) error {
+	if length := identityLength(res); max > 0 && length > max {
+		return fmt.Errorf("%d bytes, more than %d: %w", length, max, ErrTooLarge)
+	}
+	return nil
+}
+
+// sizeLimited fails the reads of r once more than max bytes were read
+type sizeLimited struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+// limitSize returns r limited to max bytes, r itself when max is 0
+func limitSize(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &sizeLimited{r: r, max: max}
+}
+
+func (l *sizeLimited) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, fmt.Errorf("more than %d bytes: %w", l.max, ErrTooLarge)
+	}
+	return n, err
+}
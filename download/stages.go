@@ -0,0 +1,171 @@
+package download
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stages of a job, in Result.Stages: the wait for a worker, the fetch of the body, the checksum and
+// validation hooks, the post process hooks, the wait for a sink worker and the sinks
+const (
+	StageQueue     = "queue"
+	StageFetch     = "fetch"
+	StageValidate  = "validate"
+	StageProcess   = "process"
+	StageSinkQueue = "sink_queue"
+	StageSink      = "sink"
+)
+
+// stageOrder is the order the stages are reported in
+var stageOrder = []string{StageQueue, StageFetch, StageValidate, StageProcess, StageSinkQueue, StageSink}
+
+// StageStats are the aggregates of a stage of the jobs of a run
+type StageStats struct {
+	Stage string `json:"stage"`
+	// Jobs counts the jobs that went through the stage
+	Jobs  int           `json:"jobs"`
+	Total time.Duration `json:"total"`
+	Mean  time.Duration `json:"mean"`
+	P95   time.Duration `json:"p95"`
+	// Share is the part of the time of the work stages the stage took, 0 for the queues
+	Share float64 `json:"share"`
+}
+
+// addStage adds elapsed to the time of the job in a stage, the attempts of a fetch add up
+func (r *Result) addStage(stage string, elapsed time.Duration) {
+	if r.Stages == nil {
+		r.Stages = map[string]time.Duration{}
+	}
+	r.Stages[stage] += elapsed
+}
+
+// stageStats collects the StageStats of a run
+type stageStats struct {
+	mu     sync.Mutex
+	stages map[string][]time.Duration
+}
+
+func (s *stageStats) job(r *Result) {
+	if len(r.Stages) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stages == nil {
+		s.stages = map[string][]time.Duration{}
+	}
+	for stage, elapsed := range r.Stages {
+		s.stages[stage] = append(s.stages[stage], elapsed)
+	}
+}
+
+// isQueue tells the stages waiting for a worker, those are not work
+func isQueue(stage string) bool {
+	return stage == StageQueue || stage == StageSinkQueue
+}
+
+// queueWait returns how long the job of key waited for a worker, since it was enqueued or, for the
+// jobs of SetJobs, since the pool started. Called with the lock held.
+func (d *Downloader) queueWait(key int) time.Duration {
+	since, ok := d.enqueued[key]
+	if ok {
+		delete(d.enqueued, key)
+	} else {
+		since = d.started
+		if d.jobsSet.After(since) {
+			since = d.jobsSet
+		}
+	}
+	if since.IsZero() {
+		return 0
+	}
+	return time.Since(since)
+}
+
+// StageStats returns the aggregates of each stage the jobs went through, in the order of the pipeline
+func (d *Downloader) StageStats() []StageStats {
+	d.stageStats.mu.Lock()
+	defer d.stageStats.mu.Unlock()
+
+	var work time.Duration
+	stats := make([]StageStats, 0, len(d.stageStats.stages))
+	for _, stage := range stageOrder {
+		samples := d.stageStats.stages[stage]
+		if len(samples) == 0 {
+			continue
+		}
+		sorted := append([]time.Duration(nil), samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		st := StageStats{Stage: stage, Jobs: len(sorted), P95: sorted[len(sorted)*95/100]}
+		for _, sample := range sorted {
+			st.Total += sample
+		}
+		st.Mean = st.Total / time.Duration(len(sorted))
+		if !isQueue(stage) {
+			work += st.Total
+		}
+		stats = append(stats, st)
+	}
+	if work > 0 {
+		for i := range stats {
+			if !isQueue(stats[i].Stage) {
+				stats[i].Share = float64(stats[i].Total) / float64(work)
+			}
+		}
+	}
+	return stats
+}
+
+// bottleneckHint returns the advice of the stage dominating the work of the jobs, pooled when the sinks
+// ran in sink workers
+func bottleneckHint(stage string, pooled bool) string {
+	switch stage {
+	case StageFetch:
+		return "the downloads dominate, more workers or requests per host would help if the hosts allow it"
+	case StageValidate, StageProcess:
+		return fmt.Sprintf("the %s hooks dominate, they run in the fetching workers: more workers would help if the cpu allows it", stage)
+	case StageSink:
+		if pooled {
+			return "the sinks dominate, more sink workers would help"
+		}
+		return "the sinks dominate, sink workers would upload apart from the downloads"
+	}
+	return ""
+}
+
+// printStageStats writes the per stage summary of the run and the stage the jobs spent the most time in
+func (d *Downloader) printStageStats() {
+	stats := d.StageStats()
+	if len(stats) == 0 {
+		return
+	}
+	var parts []string
+	var dominant, sinkQueue *StageStats
+	for i, st := range stats {
+		if st.Stage == StageSinkQueue {
+			sinkQueue = &stats[i]
+		}
+		mean, p95 := st.Mean.Round(time.Millisecond), st.P95.Round(time.Millisecond)
+		if isQueue(st.Stage) {
+			parts = append(parts, fmt.Sprintf("%s wait mean %s, p95 %s", st.Stage, mean, p95))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %.0f%% (mean %s, p95 %s)", st.Stage, st.Share*100, mean, p95))
+		if dominant == nil || st.Total > dominant.Total {
+			dominant = &stats[i]
+		}
+	}
+	d.logf("stages - %s", strings.Join(parts, "; "))
+	if dominant != nil {
+		if hint := bottleneckHint(dominant.Stage, sinkQueue != nil); hint != "" {
+			d.logf("stages - %s", hint)
+		}
+	}
+	// the fetching workers wait for the sink workers when their buffer is full
+	if sinkQueue != nil && dominant != nil && sinkQueue.Total > dominant.Total/2 {
+		d.logf("stages - the downloads wait for the sink workers, more sink workers or a larger sink buffer would help")
+	}
+}
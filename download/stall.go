@@ -0,0 +1,67 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStalled is returned when a transfer stays below the minimum speed for longer than the stall timeout
+var ErrStalled = errors.New("transfer stalled")
+
+// defaultStallTimeout is used when a minimum speed is set without a stall timeout
+const defaultStallTimeout = 30 * time.Second
+
+// watchStall samples the bytes read by wire and cancels the attempt once the speed has been under
+// minSpeed bytes per second, or no byte arrived with a zero minSpeed, for stallTimeout.
+// The returned stop function ends the watch and reports whether the attempt was cancelled as stalled.
+func watchStall(wire *countingReader, cancel context.CancelFunc, minSpeed int64, stallTimeout time.Duration) func() bool {
+	if minSpeed <= 0 && stallTimeout <= 0 {
+		return func() bool { return false }
+	}
+	if stallTimeout <= 0 {
+		stallTimeout = defaultStallTimeout
+	}
+
+	interval := time.Second
+	if stallTimeout < 4*interval {
+		interval = stallTimeout / 4
+	}
+
+	var stalled int32
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last, slowSince := wire.count(), time.Time{}
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				current := wire.count()
+				speed := float64(current-last) / interval.Seconds()
+				last = current
+				if speed > 0 && speed >= float64(minSpeed) {
+					slowSince = time.Time{}
+					continue
+				}
+				if slowSince.IsZero() {
+					slowSince = now
+				}
+				if now.Sub(slowSince) >= stallTimeout {
+					atomic.StoreInt32(&stalled, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return atomic.LoadInt32(&stalled) == 1
+	}
+}
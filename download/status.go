@@ -0,0 +1,87 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Not found policies
+const (
+	NotFoundFail = "fail"
+	NotFoundSkip = "skip"
+)
+
+// Redirect policies
+const (
+	RedirectFollow   = "follow"
+	RedirectSameHost = "same-host"
+	RedirectNone     = "none"
+)
+
+// ErrRedirectRefused is returned, wrapped, when the same host redirect policy refuses a redirect to
+// another host, the redirect is the same on every attempt so it is not retried
+var ErrRedirectRefused = errors.New("redirect to another host not allowed")
+
+// maxRedirects is the number of redirects followed before a request fails, as in the default http client
+const maxRedirects = 10
+
+// HTTPStatusError is returned, possibly wrapped, for responses that are not 2xx, their body is never
+// written. errors.As gets the status code of the failure.
+type HTTPStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected http status %s", e.Status)
+}
+
+// checkStatus returns an error for responses whose body must not be saved, a 404 under the skip
+// policy is reported as skipped
+func checkStatus(res *http.Response, notFound string) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	err := &HTTPStatusError{Code: res.StatusCode, Status: res.Status}
+	if res.StatusCode == http.StatusNotFound && notFound == NotFoundSkip {
+		return fmt.Errorf("%s: %w", err, ErrSkip)
+	}
+	return err
+}
+
+// retryable reports whether a failed attempt is worth retrying, skips, requests missing from the replayed
+// cassette, files too large, unsupported schemes, refused redirects, errors of the output files and client errors other
+// than 408 and 429 will fail the same way again
+func retryable(err error) bool {
+	if errors.Is(err, ErrSkip) || errors.Is(err, ErrNoSpace) || errors.Is(err, ErrNotRecorded) ||
+		errors.Is(err, ErrTooLarge) || errors.Is(err, ErrUnsupportedScheme) || errors.Is(err, ErrRedirectRefused) {
+		return false
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return false // a directory that can't be created or a file that can't be written
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusRequestTimeout || statusErr.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// checkRedirect returns the CheckRedirect function of the client for a redirect policy, with
+// RedirectNone the 3xx response itself is returned and reported as a status error
+func checkRedirect(policy string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		switch {
+		case policy == RedirectNone:
+			return http.ErrUseLastResponse
+		case len(via) >= maxRedirects:
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		case policy == RedirectSameHost && req.URL.Host != via[0].URL.Host:
+			return fmt.Errorf("%w: %s", ErrRedirectRefused, req.URL.Host)
+		}
+		return nil
+	}
+}
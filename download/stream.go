@@ -0,0 +1,66 @@
+package download
+
+import "time"
+
+// Enqueue adds jobs to the queue, also while the pool is running. Once Enqueue was called the workers
+// wait for more jobs when the queue is empty, until Close is called, so jobs can be streamed in over
+// time: call Enqueue, with no jobs if there are none yet, before Start. The keys must be unique in the run.
+func (d *Downloader) Enqueue(jobs ...*Job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.streaming = true
+	d.queue.Push(orderJobs(jobs, d.order, d.seed)...)
+	d.reserveNames(jobs)
+	if d.enqueued == nil {
+		d.enqueued = map[int]time.Time{}
+	}
+	now := time.Now()
+	for _, j := range jobs {
+		d.enqueued[j.Key] = now
+	}
+	d.eta.add(jobs)
+	d.wake.Broadcast()
+}
+
+// Close ends the intake of Enqueue, Start returns once the jobs already queued are processed
+func (d *Downloader) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.wake.Broadcast()
+}
+
+// Stream returns a channel receiving the result of each job as it completes, closed once Start returns.
+// The workers wait for their results to be received, so the channel must be drained while running.
+func (d *Downloader) Stream() <-chan *Result {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stream == nil {
+		d.stream = make(chan *Result, d.workers)
+		if d.finished {
+			close(d.stream)
+		}
+	}
+	return d.stream
+}
+
+// publish hands a result to the Stream channel, when there is one
+func (d *Downloader) publish(r *Result) {
+	d.mu.RLock()
+	stream := d.stream
+	d.mu.RUnlock()
+	if stream != nil {
+		stream <- r
+	}
+}
+
+// closeStream marks the run as finished and closes the Stream channel
+func (d *Downloader) closeStream() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finished = true
+	if d.stream != nil {
+		close(d.stream)
+	}
+}
@@ -0,0 +1,139 @@
+// Package testutil has test doubles of the download package.
+package testutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Fetcher is a download.Fetcher serving the requests with a handler in process, recorded by an
+// httptest.ResponseRecorder, so the downloader can be exercised without network
+type Fetcher struct {
+	Handler http.Handler
+	// Fail, when set, fails the requests it returns an error for before they reach the handler, e.g.
+	// to fake a refused connection
+	Fail func(req *http.Request) error
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// NewFetcher returns a fetcher serving the requests with h
+func NewFetcher(h http.Handler) *Fetcher {
+	return &Fetcher{Handler: h}
+}
+
+// Do serves the request, it fails with the error of the request context once it is done
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	if f.Fail != nil {
+		if err := f.Fail(req); err != nil {
+			return nil, err
+		}
+	}
+	rec := httptest.NewRecorder()
+	f.Handler.ServeHTTP(rec, req)
+	if err := req.Context().Err(); err != nil {
+		return nil, err // canceled while served
+	}
+	res := rec.Result()
+	res.Request = req
+	if res.Header.Get("Content-Encoding") == "" {
+		res.ContentLength = int64(rec.Body.Len())
+	}
+	return res, nil
+}
+
+// Requests returns the requests received, in order
+func (f *Fetcher) Requests() []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*http.Request(nil), f.requests...)
+}
+
+// Count returns the number of requests received for a path
+func (f *Fetcher) Count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, req := range f.requests {
+		if req.URL.Path == path {
+			n++
+		}
+	}
+	return n
+}
+
+// Response is a canned response of Responses
+type Response struct {
+	Status int // 200 when 0
+	Header http.Header
+	Body   []byte
+	// Delay is waited before the response, or until the request is canceled
+	Delay time.Duration
+}
+
+// Responses is a handler serving a canned response by url path, 404 for the other paths. A path with
+// several responses gets them in turn, the last one is repeated, e.g. a 503 then a 200 to test retries.
+type Responses struct {
+	mu     sync.Mutex
+	byPath map[string][]Response
+}
+
+// NewResponses returns a handler without responses, see Add
+func NewResponses() *Responses {
+	return &Responses{byPath: map[string][]Response{}}
+}
+
+// Add appends responses of a path
+func (rs *Responses) Add(path string, responses ...Response) *Responses {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.byPath[path] = append(rs.byPath[path], responses...)
+	return rs
+}
+
+func (rs *Responses) next(path string) (Response, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	responses, ok := rs.byPath[path]
+	if !ok || len(responses) == 0 {
+		return Response{}, false
+	}
+	if len(responses) > 1 {
+		rs.byPath[path] = responses[1:]
+	}
+	return responses[0], true
+}
+
+func (rs *Responses) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r, ok := rs.next(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if r.Delay > 0 {
+		t := time.NewTimer(r.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			return
+		}
+	}
+	for name, values := range r.Header {
+		w.Header()[name] = values
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	w.WriteHeader(r.Status)
+	w.Write(r.Body)
+}
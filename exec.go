@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/lawrence/sample/download"
+)
+
+// execPost returns a post process stage that runs command through the shell for each downloaded file.
+// The file is described by the SAMPLE_KEY, SAMPLE_URL, SAMPLE_PATH and SAMPLE_BYTES env variables
+// and by the json result on stdin, a non zero exit status marks the job as failed.
+func execPost(command string) func(*download.Result) error {
+	return func(r *download.Result) error {
+		metadata, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"SAMPLE_KEY="+strconv.Itoa(r.Key),
+			"SAMPLE_URL="+r.URL,
+			"SAMPLE_PATH="+r.Path,
+			"SAMPLE_BYTES="+strconv.FormatInt(r.Bytes, 10),
+		)
+		cmd.Stdin = bytes.NewReader(metadata)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("exec-post: %s", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/lawrence/sample/download"
+)
+
+// compileFilters compiles the --include or --exclude regular expressions
+func compileFilters(name string, patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s %q: %s", name, pattern, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// filterJobs keeps the jobs whose url matches one of the --include expressions, when there are some,
+// and none of the --exclude ones, the others are returned as filtered. The keys are unchanged so the
+// outputs keep their names.
+func filterJobs(opts options, jobs []*download.Job) (kept, filtered []*download.Job, err error) {
+	if len(opts.Include) == 0 && len(opts.Exclude) == 0 {
+		return jobs, nil, nil
+	}
+	include, err := compileFilters("include", opts.Include)
+	if err != nil {
+		return nil, nil, err
+	}
+	exclude, err := compileFilters("exclude", opts.Exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, j := range jobs {
+		if (len(include) == 0 || matchAny(include, j.URL)) && !matchAny(exclude, j.URL) {
+			kept = append(kept, j)
+		} else {
+			filtered = append(filtered, j)
+		}
+	}
+	fmt.Println(fmt.Sprintf("filter - %d of %d entries kept, %d filtered out", len(kept), len(jobs), len(filtered)))
+	return kept, filtered, nil
+}
+
+// filteredResults returns the skipped results of the filtered jobs, so the summary and the report
+// account for every entry of the manifest
+func filteredResults(jobs []*download.Job) []*download.Result {
+	results := make([]*download.Result, 0, len(jobs))
+	for _, j := range jobs {
+		r := download.NewResult(j)
+		r.Status = download.StatusSkipped
+		r.SetMeta("filtered", "true")
+		results = append(results, r)
+	}
+	return results
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
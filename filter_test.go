@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestFilteredJobsAreCountedInTheSummaryAndTheReport(t *testing.T) {
+	opts := options{}
+	opts.Exclude = []string{`\.gif$`}
+	jobs := []*download.Job{{Key: 1, URL: "http://a.com/1.jpg"}, {Key: 2, URL: "http://a.com/2.gif"}, {Key: 3, URL: "http://a.com/3.gif"}}
+	kept, filtered, err := filterJobs(opts, jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || len(filtered) != 2 {
+		t.Fatalf("%d jobs kept and %d filtered, want 1 and 2", len(kept), len(filtered))
+	}
+
+	results := append([]*download.Result{{Key: 1, URL: kept[0].URL, Status: download.StatusOK}}, filteredResults(filtered)...)
+	s := summarize(time.Now(), results)
+	if s.Jobs != 1 || s.Succeeded != 1 || s.Filtered != 2 {
+		t.Errorf("summary of %d jobs, %d succeeded, %d filtered, want 1, 1 and 2", s.Jobs, s.Succeeded, s.Filtered)
+	}
+	if text := (&runNotice{Summary: s}).text(); !strings.Contains(text, "2 filtered out") {
+		t.Errorf("summary line %q without the filtered entries", text)
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := writeReport(&report{Options: opts, Results: results}, path); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := readReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filtered != 2 || len(rep.Results) != 3 || rep.failed() != 0 {
+		t.Errorf("report of %d filtered, %d results, %d failed, want 2, 3 and 0", rep.Filtered, len(rep.Results), rep.failed())
+	}
+}
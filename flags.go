@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hiddenFlagPrefix marks the flags left out of the usage, the fault injection ones only meant for testing
+const hiddenFlagPrefix = "chaos-"
+
+// stringsFlag is a flag that can be repeated, each value is appended
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// sizeFlag is a number of bytes with an optional k, M or G suffix (powers of 1024)
+type sizeFlag struct {
+	n *int64
+}
+
+func (f sizeFlag) String() string {
+	if f.n == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*f.n, 10)
+}
+
+func (f sizeFlag) Set(value string) error {
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*f.n = n
+	return nil
+}
+
+// parseSize parses a number of bytes with an optional k, M or G suffix
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(value), "B"), "i")
+	if trimmed != "" {
+		switch trimmed[len(trimmed)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		case 't', 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/lawrence/sample/download"
+)
+
+// stdoutOutput is the -o of get writing the file to the standard output, as curl does
+const stdoutOutput = "-"
+
+// get downloads a single url with the retries, timeouts, auth and hooks of a download run, and writes
+// the file to -o or to the standard output, so scripts can use it where they would call curl. Any
+// content type is downloaded and the image stages are not available, see checkAnyType. The file goes
+// through a temporary output directory, no report nor history is written.
+func get(args []string) error {
+	fs := newFlagSet("get")
+	opts := addRunFlags(fs)
+	output := fs.String("o", stdoutOutput, "write the file to this path, - for the standard output")
+	fs.Parse(args)
+	var urls []string
+	for fs.NArg() > 0 { // the flags can follow the url, as in sample get url -o -
+		urls = append(urls, fs.Arg(0))
+		fs.Parse(fs.Args()[1:])
+	}
+
+	if len(urls) != 1 {
+		return errors.New("please supply the url to download")
+	}
+	opts.ContentTypeAny = true
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := checkURL(urls[0]); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "sample-get-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	opts.OutDir = dir
+	opts.Workers = 1
+	job := &download.Job{URL: urls[0]}
+	setAnyTypeExts([]*download.Job{job})
+
+	// the progress lines of the run go to the standard error, the standard output is the file's
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	results, err := process(*opts, []*download.Job{job})
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("%s was not downloaded", job.URL)
+	}
+	r := results[0]
+	if r.Status != download.StatusOK {
+		return fmt.Errorf("%s: %s: %s", job.URL, r.Status, r.Error)
+	}
+	if *output != stdoutOutput {
+		if err := os.Rename(r.Path, *output); err != nil {
+			return copyFile(r.Path, *output)
+		}
+		return nil
+	}
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(stdout, file)
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxGlobURLs bounds the urls an entry of the manifest can expand to
+const maxGlobURLs = 1000000
+
+// expandGlobs replaces the entries of the manifest with brace patterns by the urls they stand for, as curl
+// globbing does: {a,b,c} lists alternatives and {0001..0500} or {1..100..5} a range, zero padded like its
+// bounds. An expanded entry keeps its label, and its id gets the position of each url as a suffix. An
+// entry with an invalid pattern is kept as it is, with the error in Invalid.
+func expandGlobs(img *image) (*image, error) {
+	return expandEntries(img, expandGlob), nil
+}
+
+// expandEntries replaces each valid entry of the manifest by the urls expand returns for its url, see
+// expandGlobs
+func expandEntries(img *image, expand func(string) ([]string, error)) *image {
+	expanded := &image{}
+	for i, raw := range img.Urls {
+		reason := ""
+		if i < len(img.Invalid) {
+			reason = img.Invalid[i]
+		}
+		var urls []string
+		var err error
+		if reason == "" {
+			urls, err = expand(raw)
+		}
+		if reason != "" || err != nil {
+			urls = []string{raw}
+		}
+		if reason == "" && err != nil {
+			reason = fmt.Sprintf("url %q: %s", raw, err)
+		}
+		for n, url := range urls {
+			expanded.Urls = append(expanded.Urls, url)
+			if reason != "" {
+				expanded.Invalid = extend(expanded.Invalid, len(expanded.Urls))
+				expanded.Invalid[len(expanded.Urls)-1] = reason
+			}
+			if i < len(img.Labels) {
+				expanded.Labels = append(expanded.Labels, img.Labels[i])
+			}
+			if i < len(img.Manifests) {
+				expanded.Manifests = append(expanded.Manifests, img.Manifests[i])
+			}
+			if i < len(img.Variants) {
+				expanded.Variants = append(expanded.Variants, img.Variants[i])
+			}
+			if i < len(img.Originals) {
+				expanded.Originals = append(expanded.Originals, img.Originals[i])
+			}
+			if i < len(img.Checksums) && len(urls) == 1 {
+				expanded.Checksums = extend(expanded.Checksums, len(expanded.Urls))
+				expanded.Checksums[len(expanded.Urls)-1] = img.Checksums[i]
+			}
+			if i < len(img.IDs) {
+				id := img.IDs[i]
+				if id != "" && len(urls) > 1 {
+					id = fmt.Sprintf("%s-%d", id, n+1)
+				}
+				expanded.IDs = append(expanded.IDs, id)
+			}
+		}
+	}
+	return expanded
+}
+
+// expandGlob returns the urls of a brace pattern, the url itself when it has none
+func expandGlob(raw string) ([]string, error) {
+	start := strings.Index(raw, "{")
+	if start < 0 {
+		return []string{raw}, nil
+	}
+	end := strings.Index(raw[start:], "}")
+	if end < 0 {
+		return nil, fmt.Errorf("unclosed { at %d", start)
+	}
+	end += start
+
+	alternatives, err := globAlternatives(raw[start+1 : end])
+	if err != nil {
+		return nil, err
+	}
+	rest, err := expandGlob(raw[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(alternatives)*len(rest) > maxGlobURLs {
+		return nil, fmt.Errorf("expands to more than %d urls", maxGlobURLs)
+	}
+	var urls []string
+	for _, alternative := range alternatives {
+		for _, suffix := range rest {
+			urls = append(urls, raw[:start]+alternative+suffix)
+		}
+	}
+	return urls, nil
+}
+
+// globAlternatives returns the values of the content of a brace pattern
+func globAlternatives(pattern string) ([]string, error) {
+	parts := strings.Split(pattern, "..")
+	if len(parts) != 2 && len(parts) != 3 {
+		return strings.Split(pattern, ","), nil
+	}
+
+	lo, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range start %q", parts[0])
+	}
+	hi, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range end %q", parts[1])
+	}
+	step := 1
+	if len(parts) == 3 {
+		if step, err = strconv.Atoi(parts[2]); err != nil || step < 1 {
+			return nil, fmt.Errorf("invalid range step %q", parts[2])
+		}
+	}
+	if lo > hi {
+		return nil, fmt.Errorf("range %d..%d is decreasing", lo, hi)
+	}
+	if (hi-lo)/step >= maxGlobURLs {
+		return nil, fmt.Errorf("expands to more than %d urls", maxGlobURLs)
+	}
+
+	width := 0
+	if len(parts[0]) > 1 && parts[0][0] == '0' {
+		width = len(parts[0])
+	}
+	var values []string
+	for n := lo; n <= hi; n += step {
+		values = append(values, fmt.Sprintf("%0*d", width, n))
+	}
+	return values, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHealthStall is how long a run may go without completing a job before the pool is reported unhealthy
+const defaultHealthStall = 10 * time.Minute
+
+// check is the outcome of one dependency check of the health endpoints
+type check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// health is the reply of /healthz and /readyz, status is "ok" only when every check passed
+type health struct {
+	Status string   `json:"status"`
+	Checks []*check `json:"checks"`
+}
+
+// checkPool fails when a run has not completed any job for longer than the stall threshold
+func (s *server) checkPool() error {
+	if atomic.LoadInt32(&s.running) == 0 {
+		return nil
+	}
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&s.progressed)))
+	if since > s.healthStall {
+		return fmt.Errorf("no job completed for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// checkOutput fails when a file cannot be written to the output directory
+func (s *server) checkOutput() error {
+	if err := os.MkdirAll(s.opts.OutDir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.opts.OutDir, ".healthz")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkQueue fails when the redis server of the leader lock does not answer
+func (s *server) checkQueue() error {
+	reply, err := s.lock.command("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+// checks runs the dependency checks, the redis one only when a leader lock is configured
+func (s *server) checks() *health {
+	names := []string{"workers", "output"}
+	fns := []func() error{s.checkPool, s.checkOutput}
+	if s.lock != nil {
+		names, fns = append(names, "redis"), append(fns, s.checkQueue)
+	}
+
+	h := &health{Status: "ok"}
+	for i, fn := range fns {
+		c := &check{Name: names[i], Status: "ok"}
+		if err := fn(); err != nil {
+			c.Status, c.Error = "fail", err.Error()
+			h.Status = "fail"
+		}
+		h.Checks = append(h.Checks, c)
+	}
+	return h
+}
+
+// writeHealth replies with the checks, with a 503 status when one failed
+func writeHealth(w http.ResponseWriter, h *health) {
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, h)
+}
+
+// handleHealth reports whether the dependencies of the node are healthy
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.checks())
+}
+
+// handleReady is the readiness probe, the node is ready when its dependencies are healthy and it
+// is not shutting down
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	h := s.checks()
+	c := &check{Name: "serving", Status: "ok"}
+	if atomic.LoadInt32(&s.ready) == 0 {
+		c.Status, c.Error = "fail", "shutting down"
+		h.Status = "fail"
+	}
+	h.Checks = append([]*check{c}, h.Checks...)
+	writeHealth(w, h)
+}
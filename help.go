@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commandHelp is the help of a command, shown by -h before and after its flags
+type commandHelp struct {
+	usage    string
+	summary  string
+	examples []string
+}
+
+// help is the help of the download run, named sample like its flag set, and of each command
+var help = map[string]commandHelp{
+	"sample": {
+		usage:   "sample [flags] images.json|images.csv|dir...|--resume-last",
+		summary: "download the urls of the images files into the output directory",
+		examples: []string{
+			"sample --out data --workers 8 images.json",
+			"sample --out data --dataset --split 80,10,10 labeled.csv",
+			"sample --out data --retries 5 --retry-budget 0.2 --max-per-host 4 --report run.json manifests/",
+			"sample --out data --interactive --on-conflict prompt images.json",
+			"sample --out data --checkpoint-interval 30s images.json",
+			"sample --out data --resume-last",
+			"sample --out data --stream-through --s3-out s3://assets/raw images.json",
+		},
+	},
+	"retry": {
+		usage:    "sample retry --report run.json",
+		summary:  "download again the jobs of a report that did not complete, with the options of the run",
+		examples: []string{"sample retry --report run.json", "sample retry --report run.json --exec-post ./index.sh"},
+	},
+	"serve": {
+		usage:   "sample serve [flags]",
+		summary: "run a worker node serving the job api, the dashboard and the scheduled syncs",
+		examples: []string{
+			"sample serve --listen :8080 --out /data",
+			"sample serve --sync images.json --sync-interval 1h --leader-redis redis://redis:6379",
+			"sample serve --monitor images.json --monitor-interval 10m --notify-webhook https://hooks.example.com/assets",
+		},
+	},
+	"coordinate": {
+		usage:    "sample coordinate --nodes url,url [flags] images.json",
+		summary:  "split the jobs of the images files in chunks dispatched to worker nodes",
+		examples: []string{"sample coordinate --nodes http://10.0.0.2:8080,http://10.0.0.3:8080 --chunk-size 200 images.json"},
+	},
+	"diff": {
+		usage:    "sample diff [flags] old.json new.json",
+		summary:  "download the entries added or changed between two versions of an images file",
+		examples: []string{"sample diff --out data --prune images-v1.json images-v2.json"},
+	},
+	"check": {
+		usage:   "sample check [flags] images.json",
+		summary: "check the urls of the images files answer, with their status, latency, size and type, without downloading",
+		examples: []string{
+			"sample check --workers 16 images.json",
+			"sample check --json images.json | jq '.[] | select(.status >= 400)'",
+		},
+	},
+	"get": {
+		usage:   "sample get [flags] url [-o path|-]",
+		summary: "download a single url to the standard output or -o, with the retries and auth of a run",
+		examples: []string{
+			"sample get --retries 3 --timeout 30s https://example.com/model.bin -o model.bin",
+			"sample get --oauth2-token-url https://auth.example.com/token --oauth2-client-id cli https://api.example.com/export | jq .",
+		},
+	},
+	"verify": {
+		usage:   "sample verify [flags] images.json",
+		summary: "check the files of the output directory against the images files without downloading",
+		examples: []string{
+			"sample verify --dir data images.json",
+			"sample verify --dir data --report run.json --extra images.json",
+		},
+	},
+	"report": {
+		usage:   "sample report [flags] | sample report diff [flags] old.json new.json",
+		summary: "print the success rate, throughput, failure causes and failing hosts of the recent runs, or diff the reports of two runs",
+		examples: []string{
+			"sample report --out data --since 2w",
+			"sample report diff --fail monday.json tuesday.json",
+		},
+	},
+	"report diff": {
+		usage:    "sample report diff [flags] old.json new.json",
+		summary:  "list the urls newly failing, recovered, or whose size or content changed between the reports of two runs",
+		examples: []string{"sample report diff --json monday.json tuesday.json | jq '.[] | select(.kind == \"content\")'"},
+	},
+	"mockserver": {
+		usage:   "sample mockserver [flags]",
+		summary: "serve synthetic images with latency, failures and a rate limit, to benchmark and test runs",
+		examples: []string{
+			"sample mockserver --latency 50ms --jitter 100ms --error-rate 0.1",
+			"sample mockserver --rate-limit 20 --bandwidth 256k --reset-rate 0.05",
+		},
+	},
+	"self-update": {
+		usage:   "sample self-update [flags]",
+		summary: "replace the binary by the latest release once its signature and checksum are verified",
+		examples: []string{
+			"sample self-update --check",
+			"sudo sample self-update",
+		},
+	},
+	"version": {
+		usage:    "sample version [--json]",
+		summary:  "print the version of the binary, with --json its build info and what it supports",
+		examples: []string{"sample version --json | jq -r .schemes[]"},
+	},
+	"completion": {
+		usage:   "sample completion bash|zsh|fish",
+		summary: "print the shell completion script of the commands and flags",
+		examples: []string{
+			`eval "$(sample completion bash)"`,
+			`sample completion fish > ~/.config/fish/completions/sample.fish`,
+		},
+	},
+}
+
+// newFlagSet returns the flag set of a command with the usage of its help
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { printUsage(fs) }
+	return fs
+}
+
+// printUsage prints the help of the command of fs around its flags, the hidden ones left out
+func printUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	h, ok := help[fs.Name()]
+	if ok {
+		fmt.Fprintf(out, "Usage: %s\n\n%s\n\n", h.usage, h.summary)
+	} else {
+		fmt.Fprintf(out, "Usage of %s:\n", fs.Name())
+	}
+	if fs.Name() == "sample" {
+		fmt.Fprintln(out, "Commands:")
+		for _, name := range commandNames() {
+			fmt.Fprintf(out, "  %-12s %s\n", name, help[name].summary)
+		}
+		fmt.Fprintln(out)
+	}
+
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(out)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, hiddenFlagPrefix) {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	fmt.Fprintln(out, "Flags:")
+	visible.PrintDefaults()
+
+	if ok && len(h.examples) > 0 {
+		fmt.Fprintln(out, "\nExamples:")
+		for _, example := range h.examples {
+			fmt.Fprintf(out, "  %s\n", example)
+		}
+	}
+}
+
+// commandNames returns the names of the commands that have a help, sorted
+func commandNames() []string {
+	names := make([]string, 0, len(help))
+	for name := range help {
+		if name != "sample" && !strings.Contains(name, " ") { // not the sub commands, as report diff
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
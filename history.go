@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// historyNone disables the run history
+const historyNone = "none"
+
+// historyAverageRuns is the number of previous runs the expected job size is averaged over
+const historyAverageRuns = 10
+
+// runSummary is the line the run history keeps of each run
+type runSummary struct {
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"duration"`
+	Jobs      int           `json:"jobs"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	// Invalid is the number of entries of the manifest skipped as invalid, Filtered of those left out by
+	// --include and --exclude, they are not counted as jobs
+	Invalid  int   `json:"invalid,omitempty"`
+	Filtered int   `json:"filtered,omitempty"`
+	Bytes    int64 `json:"bytes"`
+	// Files is the number of files of the output directory after the run
+	Files int                    `json:"files"`
+	Hosts map[string]hostSummary `json:"hosts,omitempty"`
+	// Errors counts the failed jobs by the download.Error* class of their error
+	Errors map[string]int `json:"errors,omitempty"`
+}
+
+type hostSummary struct {
+	Jobs   int `json:"jobs"`
+	Failed int `json:"failed"`
+}
+
+// historyPath is the run history file of the options, <out>/.history.jsonl by default, empty when disabled
+func historyPath(opts options) string {
+	switch opts.History {
+	case historyNone:
+		return ""
+	case "":
+		return filepath.Join(opts.OutDir, ".history.jsonl")
+	}
+	return opts.History
+}
+
+// recordRun appends the summary of a run to the history, failing to do so doesn't fail the run
+func recordRun(opts options, started time.Time, results []*download.Result) {
+	path := historyPath(opts)
+	if path == "" {
+		return
+	}
+	summary := summarize(started, results)
+	summary.Files = countFiles(opts.OutDir)
+	line, err := json.Marshal(summary)
+	if err == nil {
+		err = withFileLock(path, true, func() error {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(append(line, '\n')); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("history - can't record the run in %s: %s", path, err))
+	}
+}
+
+func summarize(started time.Time, results []*download.Result) *runSummary {
+	s := &runSummary{Started: started, Duration: time.Since(started), Hosts: map[string]hostSummary{}, Errors: map[string]int{}}
+	for _, r := range results {
+		if r.Meta["invalid"] == "true" {
+			s.Invalid++
+			continue
+		}
+		if r.Meta["filtered"] == "true" {
+			s.Filtered++
+			continue
+		}
+		s.Jobs++
+		failed := r.Status != download.StatusOK && r.Status != download.StatusSkipped
+		if failed {
+			s.Failed++
+			if r.ErrorClass != "" {
+				s.Errors[r.ErrorClass]++
+			}
+		} else {
+			s.Succeeded++
+		}
+		if r.Status == download.StatusOK {
+			s.Bytes += r.Bytes
+		}
+		if u, err := url.Parse(r.URL); err == nil && u.Host != "" {
+			h := s.Hosts[u.Host]
+			h.Jobs++
+			if failed {
+				h.Failed++
+			}
+			s.Hosts[u.Host] = h
+		}
+	}
+	return s
+}
+
+// countFiles returns the number of files of dir, hidden ones left out
+func countFiles(dir string) int {
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0 {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// readHistory returns the summaries of the runs started since
+func readHistory(path string, since time.Time) ([]*runSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []*runSummary
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		s := &runSummary{}
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			continue // a line cut by a crash
+		}
+		if !s.Started.Before(since) {
+			runs = append(runs, s)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs, scanner.Err()
+}
+
+// averageJobSize returns the bytes per succeeded job of the last runs of the history, the size the
+// progress estimate expects of the jobs until some completed, 0 without history
+func averageJobSize(opts options) int64 {
+	path := historyPath(opts)
+	if path == "" {
+		return 0
+	}
+	runs, err := readHistory(path, time.Time{})
+	if err != nil {
+		return 0
+	}
+	if len(runs) > historyAverageRuns {
+		runs = runs[len(runs)-historyAverageRuns:]
+	}
+	var bytes int64
+	succeeded := 0
+	for _, r := range runs {
+		bytes += r.Bytes
+		succeeded += r.Succeeded
+	}
+	if succeeded == 0 {
+		return 0
+	}
+	return bytes / int64(succeeded)
+}
+
+// parseSince parses a duration with the d (days) and w (weeks) units on top of the time.ParseDuration ones
+func parseSince(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// history prints the trends of the runs recorded in the history of an output directory: the success rate
+// and throughput of each run, the growth of the mirrored files and the hosts failing in the last run only.
+// report diff compares the reports of two runs instead, see reportDiff.
+func history(args []string) error {
+	if len(args) > 0 && args[0] == "diff" {
+		return reportDiff(args[1:])
+	}
+	fs := newFlagSet("report")
+	out := fs.String("out", ".data", "output directory of the runs")
+	path := fs.String("history", "", "run history file, <out>/.history.jsonl by default")
+	sinceFlag := fs.String("since", "7d", "only report the runs started within this duration, e.g. 36h, 7d or 2w")
+	fs.Parse(args)
+
+	since, err := parseSince(*sinceFlag)
+	if err != nil {
+		return err
+	}
+	if *path == "" {
+		*path = historyPath(options{Options: download.Options{OutDir: *out}})
+	}
+	runs, err := readHistory(*path, time.Now().Add(-since))
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return errors.New("no runs since " + *sinceFlag)
+	}
+
+	fmt.Println(fmt.Sprintf("%-17s %8s %8s %12s %8s %8s", "started", "jobs", "success", "throughput", "files", "invalid"))
+	for _, r := range runs {
+		fmt.Println(fmt.Sprintf("%-17s %8d %7.1f%% %10s/s %8d %8d", r.Started.Local().Format("2006-01-02 15:04"),
+			r.Jobs, r.successRate(), humanBytes(int64(r.throughput())), r.Files, r.Invalid))
+	}
+
+	first, last := runs[0], runs[len(runs)-1]
+	fmt.Println()
+	fmt.Println(fmt.Sprintf("success rate %.1f%% -> %.1f%%, throughput %s/s -> %s/s, files %d -> %d (%+d)",
+		first.successRate(), last.successRate(), humanBytes(int64(first.throughput())), humanBytes(int64(last.throughput())),
+		first.Files, last.Files, last.Files-first.Files))
+
+	if len(last.Errors) > 0 {
+		causes := make([]string, 0, len(last.Errors))
+		for class := range last.Errors {
+			causes = append(causes, class)
+		}
+		// the most frequent cause first
+		sort.Slice(causes, func(i, j int) bool {
+			if last.Errors[causes[i]] != last.Errors[causes[j]] {
+				return last.Errors[causes[i]] > last.Errors[causes[j]]
+			}
+			return causes[i] < causes[j]
+		})
+		for i, class := range causes {
+			causes[i] = fmt.Sprintf("%s %d", class, last.Errors[class])
+		}
+		fmt.Println("failures of the last run: " + strings.Join(causes, ", "))
+	}
+
+	var failing []string
+	for host, h := range last.Hosts {
+		if h.Failed == 0 {
+			continue
+		}
+		before := false
+		for _, r := range runs[:len(runs)-1] {
+			before = before || r.Hosts[host].Failed > 0
+		}
+		if !before {
+			failing = append(failing, fmt.Sprintf("%s (%d of %d failed)", host, h.Failed, h.Jobs))
+		}
+	}
+	sort.Strings(failing)
+	if len(failing) > 0 {
+		fmt.Println("newly failing hosts: " + strings.Join(failing, ", "))
+	}
+	return nil
+}
+
+func (s *runSummary) successRate() float64 {
+	if s.Jobs == 0 {
+		return 100
+	}
+	return 100 * float64(s.Succeeded) / float64(s.Jobs)
+}
+
+func (s *runSummary) throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// humanBytes renders n with a kB, MB or GB unit (powers of 1024)
+func humanBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value, i := float64(n), 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[i]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// hostTemplate is the section of the host config applied to the requests to the hosts of its pattern.
+// The $VARIABLES and secret references of the headers and the credentials are expanded, see expandSecrets.
+type hostTemplate struct {
+	pattern string
+	policy  *download.HostPolicy
+
+	Headers       map[string]string `json:"headers,omitempty"`
+	Auth          *hostAuth         `json:"auth,omitempty"`
+	RateLimit     float64           `json:"rate_limit,omitempty"`
+	MaxConcurrent int               `json:"max_concurrent,omitempty"`
+	Retries       *int              `json:"retries,omitempty"`
+	RetryDelay    string            `json:"retry_delay,omitempty"`
+}
+
+// hostAuth is either a bearer token or basic credentials
+type hostAuth struct {
+	Bearer   string `json:"bearer,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// hostConfig is the list of host templates, the most specific pattern first
+type hostConfig []*hostTemplate
+
+// loadHostConfig reads a json object of host templates keyed by host pattern, see hostPatterns
+func loadHostConfig(path string) (hostConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sections := map[string]*hostTemplate{}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var config hostConfig
+	for pattern, t := range sections {
+		t.pattern = strings.ToLower(strings.TrimSpace(pattern))
+		t.policy = &download.HostPolicy{RateLimit: t.RateLimit, MaxConcurrent: t.MaxConcurrent, Retries: t.Retries}
+		if t.RetryDelay != "" {
+			if t.policy.RetryDelay, err = time.ParseDuration(t.RetryDelay); err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", path, pattern, err)
+			}
+		}
+		if t.RateLimit < 0 || t.MaxConcurrent < 0 || (t.Retries != nil && *t.Retries < 0) {
+			return nil, fmt.Errorf("%s: %s: limits can't be negative", path, pattern)
+		}
+		config = append(config, t)
+	}
+	// exact hosts before wildcards, longer wildcards before shorter ones
+	sort.Slice(config, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(config[i].pattern, "*."), strings.HasPrefix(config[j].pattern, "*.")
+		if wi != wj {
+			return wj
+		}
+		if len(config[i].pattern) != len(config[j].pattern) {
+			return len(config[i].pattern) > len(config[j].pattern)
+		}
+		return config[i].pattern < config[j].pattern
+	})
+	return config, nil
+}
+
+// template returns the template of the most specific pattern matching the url, nil when none does
+func (c hostConfig) template(u *url.URL) *hostTemplate {
+	for _, t := range c {
+		if (hostPatterns{t.pattern}).matches(u) {
+			return t
+		}
+	}
+	return nil
+}
+
+// policy is the host policy lookup of the downloader
+func (c hostConfig) policy(u *url.URL) *download.HostPolicy {
+	if t := c.template(u); t != nil {
+		return t.policy
+	}
+	return nil
+}
+
+// apply is the before request hook setting the headers and the credentials of the template
+func (c hostConfig) apply(req *http.Request) error {
+	t := c.template(req.URL)
+	if t == nil {
+		return nil
+	}
+	for name, value := range t.Headers {
+		value, err := expandSecrets(value)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	if t.Auth != nil {
+		if t.Auth.Bearer != "" {
+			bearer, err := expandSecrets(t.Auth.Bearer)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		} else if t.Auth.Username != "" {
+			username, err := expandSecrets(t.Auth.Username)
+			if err != nil {
+				return err
+			}
+			password, err := expandSecrets(t.Auth.Password)
+			if err != nil {
+				return err
+			}
+			req.SetBasicAuth(username, password)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// hostPatterns are the hosts credentials are sent to, a host name or host:port, *.example.com matching
+// the sub domains of example.com
+type hostPatterns []string
+
+// parseHostPatterns reads a comma separated list of patterns
+func parseHostPatterns(list string) hostPatterns {
+	var patterns hostPatterns
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			patterns = append(patterns, host)
+		}
+	}
+	return patterns
+}
+
+func (p hostPatterns) matches(u *url.URL) bool {
+	host, hostPort := strings.ToLower(u.Hostname()), strings.ToLower(u.Host)
+	for _, h := range p {
+		if host == h || hostPort == h || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+	return false
+}
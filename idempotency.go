@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Headers of the idempotent chunk submissions: the key a client sends again when it retries a
+// submission, and the one telling the reply is the one of the original submission
+const (
+	idempotencyHeader        = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// defaultIdempotencyTTL is how long the reply of a submission is kept for the retries of its key
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// submission is a chunk submitted with an idempotency key, done is closed once its reply is known
+type submission struct {
+	fingerprint string // sha256 of the body, a retry must send the same chunk
+	done        chan struct{}
+	reply       *chunkResults // nil when the run failed, the key is then forgotten
+	finished    time.Time
+}
+
+// idempotencyKeys dedups the chunk submissions retried by the clients: a key seen before gets the run
+// id and results of its first submission instead of downloading the chunk again, a retry arriving while
+// the first submission is running waits for it. The keys are kept in memory for the ttl after their run
+// completed, those of the tenants are scoped to them.
+type idempotencyKeys struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	submissions map[string]*submission
+}
+
+func newIdempotencyKeys(ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{ttl: ttl, submissions: map[string]*submission{}}
+}
+
+// bodyFingerprint returns the fingerprint of the body of a submission
+func bodyFingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// begin returns the submission of the key and true when it is a new one, the caller runs it then calls
+// end. The expired keys are dropped first.
+func (k *idempotencyKeys) begin(key, fingerprint string) (*submission, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	expired := time.Now().Add(-k.ttl)
+	for key, s := range k.submissions {
+		if !s.finished.IsZero() && s.finished.Before(expired) {
+			delete(k.submissions, key)
+		}
+	}
+	if s, ok := k.submissions[key]; ok {
+		return s, false
+	}
+	s := &submission{fingerprint: fingerprint, done: make(chan struct{})}
+	k.submissions[key] = s
+	return s, true
+}
+
+// end records the reply of a submission, a nil reply forgets the key so a retry runs the chunk again
+func (k *idempotencyKeys) end(key string, s *submission, reply *chunkResults) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s.reply, s.finished = reply, time.Now()
+	if reply == nil {
+		delete(k.submissions, key)
+	}
+	close(s.done)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Formats of the bodies of --ingest-url
+const (
+	ingestMultipart = "multipart"
+	ingestRaw       = "raw"
+)
+
+// ingestTokenEnv sets the bearer token of --ingest-url without saving it in the report
+const ingestTokenEnv = "SAMPLE_INGEST_TOKEN"
+
+// ingestHeaderPrefix prefixes the headers of the path, url and sha256 of a raw upload, the fields of
+// a multipart one
+const ingestHeaderPrefix = "X-Sample-"
+
+// Defaults of the ingest uploads: the time a request has when --timeout is not set, and the delay
+// before a retry, multiplied by the attempt
+const (
+	ingestTimeout    = 5 * time.Minute
+	ingestRetryDelay = time.Second
+)
+
+// ingestSink sends each download to the ingest endpoint of an asset service, as the file part of a
+// multipart/form-data body with path, url and sha256 fields, or as the raw body with those in
+// X-Sample- headers. The uploads failing on the network, a 5xx, a 408 or a 429 are retried
+// --ingest-retries times. The id of the asset, from the id of a json reply or the Location header,
+// is kept in the ingest meta of the result.
+type ingestSink struct {
+	client  *http.Client
+	target  string
+	method  string
+	format  string
+	field   string
+	token   string
+	retries int
+	outDir  string
+}
+
+func newIngestSink(opts options) (*ingestSink, error) {
+	u, err := url.Parse(opts.IngestURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("--ingest-url %q is not an http or https url", opts.IngestURL)
+	}
+	token := opts.IngestToken
+	if token == "" {
+		token = os.Getenv(ingestTokenEnv)
+	}
+	if token, err = secretRefs(token); err != nil {
+		return nil, err
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = ingestTimeout
+	}
+	return &ingestSink{
+		client:  &http.Client{Timeout: timeout},
+		target:  opts.IngestURL,
+		method:  opts.IngestMethod,
+		format:  opts.IngestFormat,
+		field:   opts.IngestField,
+		token:   token,
+		retries: opts.IngestRetries,
+		outDir:  opts.OutDir,
+	}, nil
+}
+
+func (s *ingestSink) Put(r *download.Result) error {
+	if r.Path == "" {
+		return nil
+	}
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	open := func() (io.ReadCloser, error) { return os.Open(r.Path) }
+	return s.upload(r, sinkPath(s.outDir, r.Path), open, info.Size())
+}
+
+// PutStream sends body as the output at name in a single attempt, the body can't be read again: the
+// --retries of the download retry it. The sha256 is only known once the body was read, it then comes
+// after the file part of a multipart upload and is left out of a raw one.
+func (s *ingestSink) PutStream(r *download.Result, name string, body io.Reader) error {
+	id, _, err := s.send(r, name, func() (io.ReadCloser, error) { return ioutil.NopCloser(body), nil }, -1)
+	if err != nil {
+		return fmt.Errorf("ingest: %w", err)
+	}
+	r.SetMeta("ingest", id)
+	return nil
+}
+
+// upload sends the content open returns, opened again for each attempt, as the output at rel
+func (s *ingestSink) upload(r *download.Result, rel string, open func() (io.ReadCloser, error), size int64) error {
+	for attempt := 1; ; attempt++ {
+		id, retry, err := s.send(r, rel, open, size)
+		if err == nil {
+			r.SetMeta("ingest", id)
+			return nil
+		}
+		if !retry || attempt > s.retries {
+			return fmt.Errorf("ingest: %w", err)
+		}
+		fmt.Println(fmt.Sprintf("ingest - Retrying job #%d - %s: %s", r.Key, rel, err))
+		time.Sleep(ingestRetryDelay * time.Duration(attempt))
+	}
+}
+
+// send makes an attempt of an upload and returns the id of the asset, or whether its error is worth
+// another attempt
+func (s *ingestSink) send(r *download.Result, rel string, open func() (io.ReadCloser, error), size int64) (string, bool, error) {
+	content, err := open()
+	if err != nil {
+		return "", false, err
+	}
+	defer content.Close()
+	contentType := mime.TypeByExtension(path.Ext(rel))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	var req *http.Request
+	if s.format == ingestRaw {
+		if req, err = http.NewRequest(s.method, s.target, content); err != nil {
+			return "", false, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(rel)}))
+		for _, f := range [][2]string{{"Path", rel}, {"Url", r.URL}, {"Sha256", r.SHA256}} {
+			if f[1] != "" {
+				req.Header.Set(ingestHeaderPrefix+f[0], f[1])
+			}
+		}
+	} else {
+		body, w := io.Pipe()
+		form := multipart.NewWriter(w)
+		go func() {
+			w.CloseWithError(writeIngestForm(form, s.field, rel, contentType, r, content))
+		}()
+		defer body.Close() // ends the writer when the request failed before reading the whole body
+		if req, err = http.NewRequest(s.method, s.target, body); err != nil {
+			return "", false, err
+		}
+		req.Header.Set("Content-Type", form.FormDataContentType())
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer res.Body.Close()
+	reply, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+		return "", retry, fmt.Errorf("%s %s: %w", s.method, s.target, &download.HTTPStatusError{Code: res.StatusCode, Status: res.Status})
+	}
+	return ingestID(res, reply), false, nil
+}
+
+// writeIngestForm writes the path and url fields, the file part, then the sha256 field of a multipart
+// upload, the sha256 of a streamed body is known once it was read
+func writeIngestForm(form *multipart.Writer, field, rel, contentType string, r *download.Result, content io.Reader) error {
+	for _, f := range [][2]string{{"path", rel}, {"url", r.URL}} {
+		if err := form.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": field, "filename": path.Base(rel)}))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return err
+	}
+	if r.SHA256 != "" {
+		if err := form.WriteField("sha256", r.SHA256); err != nil {
+			return err
+		}
+	}
+	return form.Close()
+}
+
+// ingestID returns the id of the uploaded asset, that of a json reply, else its Location header, else
+// its status
+func ingestID(res *http.Response, reply []byte) string {
+	var asset struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(reply, &asset) == nil && len(asset.ID) > 0 && string(asset.ID) != "null" {
+		return strings.Trim(string(asset.ID), `"`)
+	}
+	if location := res.Header.Get("Location"); location != "" {
+		return location
+	}
+	return res.Status
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Conflict policies of --on-conflict, what a job does when its output file already exists
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictPrompt    = "prompt"
+)
+
+// planHosts is the number of hosts listed by the plan preview
+const planHosts = 5
+
+// prompter asks questions on the terminal, one at a time as the workers may ask concurrently
+type prompter struct {
+	mu  sync.Mutex
+	in  *bufio.Reader
+	out io.Writer
+}
+
+var (
+	terminalOnce sync.Once
+	terminal     *prompter
+)
+
+// newPrompter returns the prompter of the terminal, shared so no answer is lost in the buffer of
+// another, nil when the standard input is not a terminal so the non interactive defaults apply
+func newPrompter() *prompter {
+	terminalOnce.Do(func() {
+		info, err := os.Stdin.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return
+		}
+		if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, null) {
+			return
+		}
+		terminal = &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	})
+	return terminal
+}
+
+// ask prints the question and returns the lowercased answer, empty at the end of the input
+func (p *prompter) ask(question string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.out, question)
+	answer, err := p.in.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(p.out)
+	}
+	return strings.ToLower(strings.TrimSpace(answer))
+}
+
+// confirmPlan prints the plan of the run and asks whether to start it, without a terminal the run
+// starts once the plan is printed
+func confirmPlan(opts options, jobs []*download.Job, invalid []*download.Result) error {
+	fmt.Println(describePlan(opts, jobs, invalid))
+	p := newPrompter()
+	if p == nil {
+		fmt.Println("plan - not a terminal, starting without confirmation")
+		return nil
+	}
+	switch p.ask("Start the run? [y/N] ") {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("run aborted")
+}
+
+// describePlan summarizes the jobs of a run: their hosts, and the outputs that already exist with what
+// --on-conflict does with them
+func describePlan(opts options, jobs []*download.Job, invalid []*download.Result) string {
+	hosts := map[string]int{}
+	existing := 0
+	for _, j := range jobs {
+		host := j.URL
+		if u, err := url.Parse(j.URL); err == nil {
+			host = u.Host
+		}
+		hosts[host]++
+		if _, err := os.Stat(download.OutputPath(opts.OutDir, j)); err == nil {
+			existing++
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return hosts[names[i]] > hosts[names[j]] || hosts[names[i]] == hosts[names[j]] && names[i] < names[j]
+	})
+	var top []string
+	for i, host := range names {
+		if i == planHosts {
+			top = append(top, fmt.Sprintf("%d more", len(names)-planHosts))
+			break
+		}
+		top = append(top, fmt.Sprintf("%s %d", host, hosts[host]))
+	}
+
+	lines := []string{
+		fmt.Sprintf("plan - %d jobs into %s with %d workers", len(jobs), opts.OutDir, opts.Workers),
+		fmt.Sprintf("plan - %d hosts: %s", len(hosts), strings.Join(top, ", ")),
+	}
+	if existing > 0 {
+		lines = append(lines, fmt.Sprintf("plan - %d outputs already exist, on conflict: %s", existing, opts.OnConflict))
+	}
+	counts := map[string]int{}
+	for _, r := range invalid {
+		if r.Meta["filtered"] == "true" {
+			counts["filtered"]++
+		} else {
+			counts["invalid"]++
+		}
+	}
+	if counts["invalid"] > 0 {
+		lines = append(lines, fmt.Sprintf("plan - %d invalid entries skipped", counts["invalid"]))
+	}
+	if counts["filtered"] > 0 {
+		lines = append(lines, fmt.Sprintf("plan - %d entries filtered out", counts["filtered"]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// conflictCheck is the before job hook of --on-conflict, nil when the existing outputs are overwritten.
+// Without a terminal, prompt falls back to overwriting as the runs always did.
+func conflictCheck(opts options) func(*download.Result) error {
+	policy := opts.OnConflict
+	var p *prompter
+	if policy == conflictPrompt {
+		if p = newPrompter(); p == nil {
+			policy = conflictOverwrite
+		}
+	}
+	if policy == conflictOverwrite {
+		return nil
+	}
+
+	var mu sync.Mutex
+	all := "" // the answer for all the next conflicts, once given
+	return func(r *download.Result) error {
+		path := download.OutputPath(opts.OutDir, &download.Job{Key: r.Key, ID: r.ID, Dir: r.Dir, Ext: r.Ext})
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		skip := policy == conflictSkip
+		if policy == conflictPrompt {
+			mu.Lock() // held while asking, so an answer for all is seen by the jobs waiting to ask
+			answer := all
+			if answer == "" {
+				answer = p.ask(fmt.Sprintf("%s exists, overwrite? [y]es, [n]o, [a]ll, [s]kip all: ", path))
+				switch answer {
+				case "a", "all":
+					all = "y"
+				case "s", "skip all":
+					all = "n"
+				}
+			}
+			mu.Unlock()
+			skip = !(answer == "y" || answer == "yes" || answer == "a" || answer == "all")
+		}
+		if !skip {
+			return nil
+		}
+		r.Path, r.Bytes = path, info.Size()
+		r.SetMeta("conflict", "kept")
+		return fmt.Errorf("%s exists: %w", path, download.ErrSkip)
+	}
+}
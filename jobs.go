@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// defaultJobsLimit is the page size of GET /jobs
+const defaultJobsLimit = 100
+
+// jobRecord is a result kept in the job store with the run it belongs to
+type jobRecord struct {
+	Run       string    `json:"run"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	*download.Result
+}
+
+// jobStore is an append only json lines file of the results of every run of the node
+type jobStore struct {
+	sync.Mutex
+	path string
+}
+
+func openJobStore(path string) (*jobStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &jobStore{path: path}, nil
+}
+
+// newRunID returns a sortable identifier of a run
+func newRunID(submitted time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return submitted.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// add appends the results of a run
+func (s *jobStore) add(run, tenant string, submitted time.Time, results []*download.Result) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, r := range results {
+		if err := encoder.Encode(&jobRecord{Run: run, Tenant: tenant, Submitted: submitted, Result: r}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// jobFilter selects records of the store, empty fields match every record
+type jobFilter struct {
+	statuses []string
+	host     string
+	run      string
+	tenant   string
+	after    time.Time
+	before   time.Time
+}
+
+// parseJobFilter reads the status (comma separated), host, run, tenant, submitted_after and
+// submitted_before (RFC 3339) query parameters
+func parseJobFilter(query url.Values) (*jobFilter, error) {
+	f := &jobFilter{host: strings.ToLower(query.Get("host")), run: query.Get("run"), tenant: query.Get("tenant")}
+	if status := query.Get("status"); status != "" {
+		f.statuses = strings.Split(status, ",")
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"submitted_after", &f.after}, {"submitted_before", &f.before}} {
+		if value := query.Get(p.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", p.name, err)
+			}
+			*p.t = t
+		}
+	}
+	return f, nil
+}
+
+func (f *jobFilter) match(r *jobRecord) bool {
+	if f.run != "" && r.Run != f.run {
+		return false
+	}
+	if f.tenant != "" && r.Tenant != f.tenant {
+		return false
+	}
+	if !f.after.IsZero() && !r.Submitted.After(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && !r.Submitted.Before(f.before) {
+		return false
+	}
+	if f.statuses != nil && indexOf(f.statuses, r.Status) < 0 {
+		return false
+	}
+	if f.host != "" {
+		u, err := url.Parse(r.URL)
+		if err != nil || strings.ToLower(u.Hostname()) != f.host {
+			return false
+		}
+	}
+	return true
+}
+
+// query returns a page of the matching records in the order they were stored, most recent first with
+// desc, and their total count
+func (s *jobStore) query(f *jobFilter, offset, limit int, desc bool) ([]*jobRecord, int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return []*jobRecord{}, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	page := []*jobRecord{}
+	var matches []*jobRecord // all of them are needed to page from the end
+	total := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		r := &jobRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil || r.Result == nil {
+			continue // a line cut short by a crash
+		}
+		if !f.match(r) {
+			continue
+		}
+		if desc {
+			matches = append(matches, r)
+		} else if total >= offset && len(page) < limit {
+			page = append(page, r)
+		}
+		total++
+	}
+	for i := len(matches) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, matches[i])
+	}
+	return page, total, scanner.Err()
+}
+
+// jobsPage is the reply of GET /jobs, next is the offset of the next page when there is one
+type jobsPage struct {
+	Jobs  []*jobRecord `json:"jobs"`
+	Total int          `json:"total"`
+	Next  *int         `json:"next,omitempty"`
+}
+
+// handleJobs queries the job store with the filters of parseJobFilter and the offset and limit
+// pagination parameters, order=desc lists the most recent jobs first. Tenants only see their own jobs.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	f, err := parseJobFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t := tenantOf(r.Context()); t != nil {
+		f.tenant = t.Name
+	}
+	offset, limit := 0, defaultJobsLimit
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"offset", &offset}, {"limit", &limit}} {
+		if value := query.Get(p.name); value != "" {
+			if *p.value, err = strconv.Atoi(value); err != nil || *p.value < 0 {
+				http.Error(w, fmt.Sprintf("invalid %s %q", p.name, value), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	jobs, total, err := s.store.query(f, offset, limit, query.Get("order") == "desc")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := &jobsPage{Jobs: jobs, Total: total}
+	if next := offset + len(jobs); next < total {
+		page.Next = &next
+	}
+	writeJSON(w, http.StatusOK, page)
+}
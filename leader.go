@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// renewScript extends the lock only if it is still held by this replica
+const renewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+
+// releaseScript deletes the lock only if it is still held by this replica
+const releaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisLock elects a leader among replicas with a redis key holding the id of the leader, set with an
+// expiry the leader keeps renewing so another replica takes over when it goes away
+type redisLock struct {
+	addr     string
+	password string
+	db       string
+	key      string
+	id       string
+	ttl      time.Duration
+	leader   int32 // set atomically
+}
+
+// newRedisLock parses a redis://[:password@]host:port[/db] url
+func newRedisLock(rawurl, key string, ttl time.Duration) (*redisLock, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url %q, expected redis://[:password@]host:port[/db]", rawurl)
+	}
+	host, _ := os.Hostname()
+	l := &redisLock{
+		addr: u.Host,
+		db:   strings.TrimPrefix(u.Path, "/"),
+		key:  key,
+		id:   fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		ttl:  ttl,
+	}
+	if u.User != nil {
+		l.password, _ = u.User.Password()
+	}
+	return l, nil
+}
+
+// isLeader reports whether this replica held the lock at the last campaign round
+func (l *redisLock) isLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+// campaign tries to take or renew the lock every third of its ttl until stop is closed, then releases it
+func (l *redisLock) campaign(stop <-chan struct{}) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		l.round()
+		select {
+		case <-stop:
+			if l.isLeader() {
+				l.command("EVAL", releaseScript, "1", l.key, l.id)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *redisLock) round() {
+	ttl := strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)
+	var leader bool
+	var err error
+	if l.isLeader() {
+		var reply string
+		reply, err = l.command("EVAL", renewScript, "1", l.key, l.id, ttl)
+		leader = reply == "1"
+	} else {
+		var reply string
+		reply, err = l.command("SET", l.key, l.id, "NX", "PX", ttl)
+		leader = reply == "OK"
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("leader election - %s", err))
+		leader = false // without redis we can't tell, so stand by
+	}
+
+	if leader != l.isLeader() {
+		if leader {
+			fmt.Println("leader election - elected leader")
+		} else {
+			fmt.Println("leader election - standing by as follower")
+		}
+	}
+	var value int32
+	if leader {
+		value = 1
+	}
+	atomic.StoreInt32(&l.leader, value)
+}
+
+// command sends a command on a new connection, after AUTH and SELECT when configured, and returns the reply
+func (l *redisLock) command(args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", l.addr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	if l.password != "" {
+		if _, err := redisDo(conn, reader, "AUTH", l.password); err != nil {
+			return "", err
+		}
+	}
+	if l.db != "" {
+		if _, err := redisDo(conn, reader, "SELECT", l.db); err != nil {
+			return "", err
+		}
+	}
+	return redisDo(conn, reader, args...)
+}
+
+// redisDo writes a command in the RESP protocol and reads a simple, integer or bulk string reply
+func redisDo(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if size < 0 {
+			return "", nil // nil reply
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return "", err
+		}
+		return string(data[:size]), nil
+	default:
+		return "", fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+// withFileLock runs fn, files are not locked on windows
+func withFileLock(path string, exclusive bool, fn func() error) error {
+	return fn()
+}
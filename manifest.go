@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// readImages reads the images files, a directory stands for the .json and .csv files it contains in name
+// order. Several files are merged into one list, a url listed by an earlier file is left out of the later
+// ones, and the file of each url is kept in Manifests.
+func readImages(paths []string) (*image, error) {
+	var files []string
+	for _, path := range paths {
+		dir, err := ioutil.ReadDir(path)
+		if err != nil {
+			files = append(files, path) // not a directory, or reported by readImageFile
+			continue
+		}
+		var names []string
+		for _, info := range dir {
+			ext := strings.ToLower(filepath.Ext(info.Name()))
+			if !info.IsDir() && (ext == ".json" || ext == ".csv") && !strings.HasPrefix(info.Name(), ".") {
+				names = append(names, filepath.Join(path, info.Name()))
+			}
+		}
+		sort.Strings(names)
+		files = append(files, names...)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no images files in " + strings.Join(paths, ", "))
+	}
+	if len(files) == 1 {
+		return readImageFile(files[0])
+	}
+
+	merged := &image{}
+	seen := map[string]bool{}
+	duplicates := 0
+	for _, file := range files {
+		img, err := readImageFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for i, url := range img.Urls {
+			invalid := i < len(img.Invalid) && img.Invalid[i] != ""
+			if seen[entryKey(img, i)] && !invalid {
+				duplicates++
+				continue
+			}
+			merged.Urls = append(merged.Urls, url)
+			merged.Manifests = append(merged.Manifests, file)
+			if invalid {
+				merged.Invalid = extend(merged.Invalid, len(merged.Urls))
+				merged.Invalid[len(merged.Urls)-1] = img.Invalid[i]
+			}
+			if i < len(img.Labels) && img.Labels[i] != "" {
+				merged.Labels = extend(merged.Labels, len(merged.Urls))
+				merged.Labels[len(merged.Urls)-1] = img.Labels[i]
+			}
+			if i < len(img.IDs) && img.IDs[i] != "" {
+				merged.IDs = extend(merged.IDs, len(merged.Urls))
+				merged.IDs[len(merged.Urls)-1] = img.IDs[i]
+			}
+			if i < len(img.Checksums) && img.Checksums[i] != "" {
+				merged.Checksums = extend(merged.Checksums, len(merged.Urls))
+				merged.Checksums[len(merged.Urls)-1] = img.Checksums[i]
+			}
+			if i < len(img.Srcsets) && img.Srcsets[i] != "" {
+				merged.Srcsets = extend(merged.Srcsets, len(merged.Urls))
+				merged.Srcsets[len(merged.Urls)-1] = img.Srcsets[i]
+			}
+			if i < len(img.Variants) && len(img.Variants[i]) > 0 {
+				merged.Variants = extendVariants(merged.Variants, len(merged.Urls))
+				merged.Variants[len(merged.Urls)-1] = img.Variants[i]
+			}
+		}
+		for i := range img.Urls {
+			seen[entryKey(img, i)] = true
+		}
+	}
+	fmt.Println(fmt.Sprintf("manifest - merged %d urls of %d files, %d duplicates left out", len(merged.Urls), len(files), duplicates))
+	if merged.Labels != nil {
+		merged.Labels = extend(merged.Labels, len(merged.Urls))
+	}
+	return merged, nil
+}
+
+// entryKey identifies an entry in the duplicates of merged images files: its url, and its srcset as the
+// src alone doesn't make the entry a duplicate
+func entryKey(img *image, i int) string {
+	if i < len(img.Srcsets) && img.Srcsets[i] != "" {
+		return img.Urls[i] + " " + img.Srcsets[i]
+	}
+	return img.Urls[i]
+}
+
+// imageEntry is the object form of an entry of the urls of an images file
+type imageEntry struct {
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	Label    string   `json:"label"`
+	Checksum string   `json:"checksum"`
+	Srcset   string   `json:"srcset"`
+	Variants []string `json:"variants"`
+}
+
+// UnmarshalJSON reads the urls of an images file, each is a url string or an {"id", "url", "label",
+// "checksum", "srcset", "variants"} object whose id, label, checksum, srcset and variants go to IDs,
+// Labels, Checksums, Srcsets and Variants. The top level "variants" are those of the entries without their own. The entries that are
+// neither are left without url and get their reason in Invalid.
+func (img *image) UnmarshalJSON(data []byte) error {
+	var content struct {
+		Urls      []json.RawMessage `json:"urls"`
+		Labels    []string          `json:"labels"`
+		IDs       []string          `json:"ids"`
+		Checksums []string          `json:"checksums"`
+		Variants  []string          `json:"variants"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+
+	img.Urls, img.Labels, img.IDs, img.Checksums = make([]string, len(content.Urls)), content.Labels, content.IDs, content.Checksums
+	for i, raw := range content.Urls {
+		if err := json.Unmarshal(raw, &img.Urls[i]); err == nil {
+			continue
+		}
+		entry := imageEntry{}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			img.Invalid = extend(img.Invalid, len(content.Urls))
+			img.Invalid[i] = "neither a url nor an object with a url"
+			continue
+		}
+		img.Urls[i] = entry.URL
+		if entry.ID != "" {
+			img.IDs = extend(img.IDs, len(content.Urls))
+			img.IDs[i] = entry.ID
+		}
+		if entry.Label != "" {
+			img.Labels = extend(img.Labels, len(content.Urls))
+			img.Labels[i] = entry.Label
+		}
+		if entry.Checksum != "" {
+			img.Checksums = extend(img.Checksums, len(content.Urls))
+			img.Checksums[i] = entry.Checksum
+		}
+		if entry.Srcset != "" {
+			img.Srcsets = extend(img.Srcsets, len(content.Urls))
+			img.Srcsets[i] = entry.Srcset
+		}
+		if entry.Variants != nil {
+			img.Variants = extendVariants(img.Variants, len(content.Urls))
+			img.Variants[i] = entry.Variants
+		}
+	}
+	if len(content.Variants) > 0 {
+		img.Variants = extendVariants(img.Variants, len(content.Urls))
+		for i, variants := range img.Variants {
+			if variants == nil {
+				img.Variants[i] = content.Variants
+			}
+		}
+	}
+	return nil
+}
+
+// extend returns values with empty strings appended up to n
+func extend(values []string, n int) []string {
+	for len(values) < n {
+		values = append(values, "")
+	}
+	return values
+}
+
+// extendVariants returns variants with empty lists appended up to n
+func extendVariants(variants [][]string, n int) [][]string {
+	for len(variants) < n {
+		variants = append(variants, nil)
+	}
+	return variants
+}
+
+// maxInvalidWarnings is the number of invalid entries listed in the warnings of a run, the others are counted
+const maxInvalidWarnings = 20
+
+// skipInvalid leaves the jobs of the invalid entries out, warning of them, and returns them as skipped results
+func skipInvalid(jobs []*download.Job, reasons map[int]string) ([]*download.Job, []*download.Result) {
+	var valid []*download.Job
+	var invalid []*download.Result
+	for _, j := range jobs {
+		reason, ok := reasons[j.Key]
+		if !ok {
+			valid = append(valid, j)
+			continue
+		}
+		if len(invalid) < maxInvalidWarnings {
+			fmt.Println(fmt.Sprintf("manifest - invalid entry %d skipped: %s", j.Key, reason))
+		}
+		r := download.NewResult(j)
+		r.Status, r.Error = download.StatusSkipped, "invalid entry: "+reason
+		r.SetMeta("invalid", "true")
+		invalid = append(invalid, r)
+	}
+	if len(invalid) > 0 {
+		fmt.Println(fmt.Sprintf("manifest - %d invalid entries skipped, --strict aborts on them", len(invalid)))
+	}
+	return valid, invalid
+}
+
+// validateEntries returns the reason each entry of the manifest can't be downloaded, parallel to the
+// urls, nil when they all can: the entry could not be read, it has no url or one no request can be made
+// of, its checksum is not "algorithm:hex" or hex of a known length, or its id can't name an output file
+// or is used by an earlier entry. Entries without an id keep their key name.
+func validateEntries(img *image) []string {
+	var reasons []string
+	invalid := func(i int, reason string) {
+		reasons = extend(reasons, len(img.Urls))
+		reasons[i] = reason
+	}
+	ids := map[string]bool{}
+	for i, raw := range img.Urls {
+		if i < len(img.Invalid) && img.Invalid[i] != "" {
+			invalid(i, img.Invalid[i])
+			continue
+		}
+		if err := checkURL(raw); err != nil {
+			invalid(i, err.Error())
+			continue
+		}
+		if i < len(img.Checksums) && img.Checksums[i] != "" {
+			if _, _, err := download.ParseChecksum(img.Checksums[i]); err != nil {
+				invalid(i, err.Error())
+				continue
+			}
+		}
+		if i >= len(img.IDs) || img.IDs[i] == "" {
+			continue
+		}
+		id := img.IDs[i]
+		if !validFileName(id) {
+			invalid(i, fmt.Sprintf("id %q is not a valid file name", id))
+		} else if key, err := strconv.Atoi(id); err == nil && key != i {
+			invalid(i, fmt.Sprintf("id %q is the file name of entry %d", id, key))
+		} else if ids[id] {
+			invalid(i, fmt.Sprintf("id %q is used by an earlier entry", id))
+		}
+		ids[id] = true
+	}
+	return reasons
+}
+
+// validFileName tells whether name can name a file of its directory: without a path separator, not hidden
+// and not padded with spaces
+func validFileName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".") && strings.TrimSpace(name) == name
+}
+
+// checkJobPaths rejects the jobs whose output would not be a file of the output directory: their id is
+// checked as the ids of the images files, each element of their dir the same way, and their ext is a
+// dot and a name
+func checkJobPaths(j *download.Job) error {
+	if j.ID != "" && !validFileName(j.ID) {
+		return fmt.Errorf("job #%d: id %q is not a valid file name", j.Key, j.ID)
+	}
+	if j.Dir != "" {
+		for _, elem := range strings.Split(j.Dir, "/") {
+			if !validFileName(elem) {
+				return fmt.Errorf("job #%d: dir %q is not a sub directory", j.Key, j.Dir)
+			}
+		}
+	}
+	if j.Ext != "" && (!strings.HasPrefix(j.Ext, ".") || !validFileName(j.Ext[1:])) {
+		return fmt.Errorf("job #%d: ext %q is not a valid file extension", j.Key, j.Ext)
+	}
+	return nil
+}
+
+// locateInvalid prefixes the reasons of the invalid entries of a json images file with their line and column
+func locateInvalid(img *image, data []byte) {
+	if len(img.Invalid) == 0 {
+		return
+	}
+	offsets := elementOffsets(data, "urls")
+	for i, reason := range img.Invalid {
+		if reason != "" && i < len(offsets) {
+			line, column := lineColumn(data, offsets[i])
+			img.Invalid[i] = fmt.Sprintf("line %d column %d: %s", line, column, reason)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// applyMirrors adds a mirror url to each job whose host has a host=mirror-host mapping
+func applyMirrors(jobs []*download.Job, mirrors []string) error {
+	hosts := map[string][]string{}
+	for _, mirror := range mirrors {
+		parts := strings.SplitN(mirror, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid --mirror %q, expected host=mirror-host", mirror)
+		}
+		hosts[parts[0]] = append(hosts[parts[0]], parts[1])
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	for _, j := range jobs {
+		u, err := url.Parse(j.URL)
+		if err != nil {
+			continue // the download reports the bad url
+		}
+		j.Mirrors = nil
+		for _, host := range hosts[u.Host] {
+			mirror := *u
+			mirror.Host = host
+			j.Mirrors = append(j.Mirrors, mirror.String())
+		}
+	}
+	return nil
+}
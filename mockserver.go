@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	goimage "image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mockImagesCached is the number of generated images kept, the cache is emptied when it is full
+const mockImagesCached = 1024
+
+// mockServer serves a synthetic jpeg for any path, the same path always gets the same image, with the
+// latency, failures and rate limit of its flags
+type mockServer struct {
+	width, height int
+	quality       int
+	latency       time.Duration
+	jitter        time.Duration
+	errorRate     float64
+	errorStatus   int
+	resetRate     float64
+	bandwidth     int64 // bytes per second of each response, 0 for no limit
+	bucket        *tokenBucket
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	images map[string][]byte
+	served map[int]int // by status
+}
+
+// mockserver runs the mock server until it is stopped
+func mockserver(args []string) error {
+	fs := newFlagSet("mockserver")
+	listen := fs.String("listen", "127.0.0.1:8090", "address the mock server listens on")
+	size := fs.String("size", "640x480", "width x height of the generated images")
+	quality := fs.Int("quality", 80, "jpeg quality of the generated images")
+	latency := fs.Duration("latency", 0, "wait before each response")
+	jitter := fs.Duration("jitter", 0, "random extra wait of up to this long before each response")
+	errorRate := fs.Float64("error-rate", 0, "fraction of the requests answered with --error-status, e.g. 0.1")
+	errorStatus := fs.Int("error-status", http.StatusServiceUnavailable, "status of the failed requests")
+	resetRate := fs.Float64("reset-rate", 0, "fraction of the responses whose connection is closed halfway through the body")
+	var bandwidth int64
+	fs.Var(sizeFlag{&bandwidth}, "bandwidth", "bytes per second of each response, e.g. 512k for slow transfers")
+	rateLimit := fs.Float64("rate-limit", 0, "requests per second served, the others get a 429 with Retry-After, 0 for no limit")
+	seed := fs.Int64("seed", 1, "seed of the latency jitter and of the failures")
+	fs.Parse(args)
+
+	var width, height int
+	if _, err := fmt.Sscanf(*size, "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid --size %q, expected e.g. 640x480", *size)
+	}
+	if *errorRate < 0 || *errorRate > 1 || *resetRate < 0 || *resetRate > 1 {
+		return errors.New("--error-rate and --reset-rate must be between 0 and 1")
+	}
+	if *errorStatus < 400 || *errorStatus > 599 {
+		return fmt.Errorf("--error-status %d is not an error status", *errorStatus)
+	}
+	s := &mockServer{
+		width:       width,
+		height:      height,
+		quality:     *quality,
+		latency:     *latency,
+		jitter:      *jitter,
+		errorRate:   *errorRate,
+		errorStatus: *errorStatus,
+		resetRate:   *resetRate,
+		bandwidth:   bandwidth,
+		rand:        rand.New(rand.NewSource(*seed)),
+		images:      map[string][]byte{},
+		served:      map[int]int{},
+	}
+	if *rateLimit > 0 {
+		s.bucket = newTokenBucket(*rateLimit)
+	}
+
+	fmt.Println(fmt.Sprintf("mockserver - serving %dx%d images on http://%s", width, height, *listen))
+	return http.ListenAndServe(*listen, s)
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/stats" {
+		s.writeStats(w)
+		return
+	}
+	if s.bucket != nil && !s.bucket.take() {
+		w.Header().Set("Retry-After", "1")
+		s.reply(w, http.StatusTooManyRequests)
+		return
+	}
+
+	s.mu.Lock()
+	wait := s.latency
+	if s.jitter > 0 {
+		wait += time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+	failed := s.rand.Float64() < s.errorRate
+	reset := s.rand.Float64() < s.resetRate
+	s.mu.Unlock()
+	select {
+	case <-time.After(wait):
+	case <-r.Context().Done():
+		return
+	}
+	if failed {
+		s.reply(w, s.errorStatus)
+		return
+	}
+
+	body, err := s.image(r.URL.Path)
+	if err != nil {
+		s.reply(w, http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Header.Get("If-None-Match") == etag {
+		s.reply(w, http.StatusNotModified)
+		return
+	}
+	s.count(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if reset {
+		s.resetHalfway(w, body)
+		return
+	}
+	s.write(w, body)
+}
+
+// reply sends a status without body
+func (s *mockServer) reply(w http.ResponseWriter, status int) {
+	s.count(status)
+	if status != http.StatusNotModified {
+		w.Header().Del("Content-Length")
+	}
+	w.WriteHeader(status)
+}
+
+func (s *mockServer) count(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.served[status]++
+}
+
+// write sends the body at the --bandwidth rate, in chunks of a tenth of a second
+func (s *mockServer) write(w http.ResponseWriter, body []byte) {
+	if s.bandwidth <= 0 {
+		w.Write(body)
+		return
+	}
+	chunk := int(s.bandwidth / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	flusher, _ := w.(http.Flusher)
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[n:]
+		if len(body) > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(s.bandwidth))
+		}
+	}
+}
+
+// resetHalfway sends half of the body and closes the connection, the client sees a truncated transfer
+func (s *mockServer) resetHalfway(w http.ResponseWriter, body []byte) {
+	half := body[:len(body)/2]
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.write(w, half)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	s.write(w, half)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0) // a reset rather than a clean close
+	}
+	conn.Close()
+}
+
+// image returns the jpeg of a path, drawn from a seed derived from the path
+func (s *mockServer) image(path string) ([]byte, error) {
+	s.mu.Lock()
+	body, ok := s.images[path]
+	s.mu.Unlock()
+	if ok {
+		return body, nil
+	}
+
+	sum := sha256.Sum256([]byte(path))
+	r := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:8]))))
+	img := goimage.NewRGBA(goimage.Rect(0, 0, s.width, s.height))
+	from := color.RGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255}
+	to := color.RGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255}
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			t := float64(x+y) / float64(s.width+s.height)
+			noise := uint8(r.Intn(16))
+			img.Set(x, y, color.RGBA{
+				mix(from.R, to.R, t) + noise,
+				mix(from.G, to.G, t) + noise,
+				mix(from.B, to.B, t) + noise,
+				255,
+			})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: s.quality}); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.images) >= mockImagesCached {
+		s.images = map[string][]byte{}
+	}
+	s.images[path] = buf.Bytes()
+	return buf.Bytes(), nil
+}
+
+func mix(from, to uint8, t float64) uint8 {
+	return uint8(float64(from) + (float64(to)-float64(from))*t)
+}
+
+// writeStats writes the number of responses served by status
+func (s *mockServer) writeStats(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain")
+	for _, status := range sortedStatuses(s.served) {
+		fmt.Fprintf(w, "%d %d\n", status, s.served[status])
+	}
+}
+
+func sortedStatuses(counts map[int]int) []int {
+	statuses := make([]int, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	return statuses
+}
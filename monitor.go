@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events of the monitor, posted to --notify-webhook and appended to --events
+const (
+	eventAssetChanged   = "asset.changed"
+	eventAssetFailed    = "asset.failed"
+	eventAssetRecovered = "asset.recovered"
+)
+
+// monitorTimeout is the time a url has to send its content when --timeout is not set
+const monitorTimeout = 5 * time.Minute
+
+// assetState is what the monitor knows of a url: the validators of its last response and the sha256
+// of its content
+type assetState struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Bytes        int64     `json:"bytes"`
+	Error        string    `json:"error,omitempty"`
+	Checked      time.Time `json:"checked"`
+	Changed      time.Time `json:"changed"`
+}
+
+// assetEvent tells a url changed, started failing or recovered
+type assetEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	URL    string    `json:"url"`
+	Before string    `json:"before_sha256,omitempty"`
+	After  string    `json:"after_sha256,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// monitor revalidates the urls of a manifest every interval without downloading them to the output
+// directory: a conditional GET with the ETag and Last-Modified of the previous check, and the sha256
+// of the content when it was sent again. An event is emitted when the sha256 of a url changes, and
+// when a url starts failing or recovers. The states are kept in a json file so a restart doesn't
+// report every url again.
+type monitor struct {
+	opts      options
+	manifest  string
+	statePath string
+	checker   *linkChecker
+	assets    map[string]assetState
+}
+
+func newMonitor(opts options, manifest, statePath string) (*monitor, error) {
+	checker, err := newLinkChecker(opts, monitorTimeout)
+	if err != nil {
+		return nil, err
+	}
+	m := &monitor{opts: opts, manifest: manifest, statePath: statePath, checker: checker, assets: map[string]assetState{}}
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &m.assets)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", statePath, err)
+	}
+	return m, nil
+}
+
+// run revalidates the manifest every interval until stop is closed, see runScheduled
+func (m *monitor) run(interval time.Duration, lock *redisLock, stop <-chan struct{}) {
+	runScheduled(interval, lock, stop, func() {
+		if err := m.revalidate(); err != nil {
+			fmt.Println(fmt.Sprintf("monitor - %s", err))
+		}
+	})
+}
+
+// revalidate checks every url of the manifest once, emits the events of the changes and saves the
+// states, those of the urls no longer in the manifest are dropped
+func (m *monitor) revalidate() error {
+	jobs, invalid, err := manifestJobs(m.opts, m.manifest)
+	if err == nil {
+		jobs, _, err = filterJobs(m.opts, jobs)
+	}
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for _, j := range jobs {
+		if _, ok := invalid[j.Key]; !ok {
+			urls = append(urls, j.URL)
+		}
+	}
+
+	var mu sync.Mutex
+	assets := map[string]assetState{}
+	var events []*assetEvent
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < m.opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				previous, known := m.assets[u] // only replaced once the workers are done
+				state, event := m.check(u, previous, known)
+				mu.Lock()
+				assets[u] = state
+				if event != nil {
+					events = append(events, event)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+
+	m.assets = assets
+	changed := 0
+	for _, e := range events {
+		if e.Event == eventAssetChanged {
+			changed++
+		}
+		m.emit(e)
+	}
+	fmt.Println(fmt.Sprintf("monitor - %d urls of %s revalidated, %d changed", len(urls), m.manifest, changed))
+	return m.save()
+}
+
+// check revalidates a url from its previous state, known is false the first time the url is seen, and
+// returns its new state with the event of the change if there is one
+func (m *monitor) check(u string, previous assetState, known bool) (assetState, *assetEvent) {
+	now := time.Now()
+	header := http.Header{}
+	if previous.SHA256 != "" {
+		if previous.ETag != "" {
+			header.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			header.Set("If-Modified-Since", previous.LastModified)
+		}
+	}
+	state := previous
+	state.Checked = now
+	res, err := m.checker.send(http.MethodGet, u, header)
+	if err == nil && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotModified {
+		err = fmt.Errorf("unexpected http status %s", res.Status)
+	}
+	var sum string
+	if err == nil && res.StatusCode == http.StatusOK {
+		hash := sha256.New()
+		var n int64
+		if n, err = io.Copy(hash, res.Body); err == nil {
+			// the validators are kept with the sha256 of the same content only
+			sum = hex.EncodeToString(hash.Sum(nil))
+			state.Bytes, state.ETag, state.LastModified = n, res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+		}
+	}
+	if res != nil {
+		res.Body.Close()
+	}
+	if err != nil {
+		state.Error = err.Error()
+		if previous.Error == "" {
+			return state, &assetEvent{Time: now, Event: eventAssetFailed, URL: u, Before: previous.SHA256, Error: state.Error}
+		}
+		return state, nil
+	}
+
+	state.Error = ""
+	if sum != "" && sum != previous.SHA256 {
+		state.SHA256 = sum
+		if known && previous.SHA256 != "" {
+			state.Changed = now
+			return state, &assetEvent{Time: now, Event: eventAssetChanged, URL: u, Before: previous.SHA256, After: sum, Bytes: state.Bytes}
+		}
+	}
+	if known && previous.Error != "" {
+		return state, &assetEvent{Time: now, Event: eventAssetRecovered, URL: u, After: state.SHA256, Bytes: state.Bytes}
+	}
+	return state, nil
+}
+
+// emit prints the event, appends it to --events and posts it to --notify-webhook, failing to do so is
+// reported only
+func (m *monitor) emit(e *assetEvent) {
+	line := fmt.Sprintf("monitor - %s %s", e.Event, e.URL)
+	if e.Event == eventAssetChanged {
+		line += fmt.Sprintf(": sha256 %.12s -> %.12s", e.Before, e.After)
+	} else if e.Error != "" {
+		line += ": " + e.Error
+	}
+	fmt.Println(line)
+
+	if m.opts.Events != "" {
+		data, err := json.Marshal(e)
+		if err == nil {
+			err = appendEventLine(m.opts.Events, data)
+		}
+		if err != nil {
+			fmt.Println(fmt.Sprintf("events - can't write the event: %s", err))
+		}
+	}
+	if m.opts.NotifyWebhook != "" {
+		if err := postNotice(m.opts.NotifyWebhook, e); err != nil {
+			fmt.Println(fmt.Sprintf("notify - webhook %s failed: %s", webhookHost(m.opts.NotifyWebhook), err))
+		}
+	}
+}
+
+// appendEventLine appends a json line to the --events file, - for stdout
+func appendEventLine(path string, data []byte) error {
+	data = append(data, '\n')
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (m *monitor) save() error {
+	data, err := json.MarshalIndent(m.assets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.statePath)
+}
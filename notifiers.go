@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Types of the --notifiers entries, and when they are sent
+const (
+	notifierSlack = "slack"
+	notifierSMTP  = "smtp"
+
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+)
+
+// notifierConfig is an entry of the --notifiers file, a slack incoming webhook or an smtp server the
+// summary of each run is sent to. The $VARIABLES of its values are expanded from the environment, and
+// the secret references of the webhook url and the credentials, see expandSecrets.
+type notifierConfig struct {
+	Type string `json:"type"`
+	// On is when the summary is sent: always, the default, or on failure when jobs did not complete
+	On string `json:"on,omitempty"`
+	// WebhookURL is the slack incoming webhook
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// Host is the host:port of the smtp server, the mail is sent over STARTTLS when the server offers it
+	Host     string   `json:"host,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// loadNotifiers reads the json array of notifiers of a --notifiers file
+func loadNotifiers(path string) ([]*notifierConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var notifiers []*notifierConfig
+	if err := json.Unmarshal(data, &notifiers); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for i, n := range notifiers {
+		if n.On == "" {
+			n.On = notifyAlways
+		}
+		var err error
+		switch {
+		case n.On != notifyAlways && n.On != notifyFailure:
+			err = fmt.Errorf("unknown on %q, expected always or failure", n.On)
+		case n.Type == notifierSlack && n.WebhookURL == "":
+			err = fmt.Errorf("slack notifier without webhook_url")
+		case n.Type == notifierSMTP && (n.Host == "" || n.From == "" || len(n.To) == 0):
+			err = fmt.Errorf("smtp notifier requires host, from and to")
+		case n.Type != notifierSlack && n.Type != notifierSMTP:
+			err = fmt.Errorf("unknown notifier type %q, expected slack or smtp", n.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: notifier %d: %s", path, i, err)
+		}
+	}
+	return notifiers, nil
+}
+
+func (n *notifierConfig) send(notice *runNotice) error {
+	if n.On == notifyFailure && notice.ExitStatus == 0 {
+		return nil
+	}
+	if n.Type == notifierSlack {
+		return n.sendSlack(notice)
+	}
+	return n.sendMail(notice)
+}
+
+func (n *notifierConfig) sendSlack(notice *runNotice) error {
+	text := "*" + notice.subject() + "*\n" + notice.text()
+	if errs := notice.topErrorLines(); len(errs) > 0 {
+		text += "\nTop failures:\n" + strings.Join(errs, "\n")
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	webhook, err := expandSecrets(n.WebhookURL)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return redactURL(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack: %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *notifierConfig) sendMail(notice *runNotice) error {
+	host := os.ExpandEnv(n.Host)
+	from := os.ExpandEnv(n.From)
+	var to []string
+	for _, addr := range n.To {
+		to = append(to, os.ExpandEnv(addr))
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, strings.Join(to, ", "), notice.subject(), time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", notice.text())
+	if errs := notice.topErrorLines(); len(errs) > 0 {
+		fmt.Fprintf(&msg, "\r\nTop failures:\r\n%s\r\n", strings.Join(errs, "\r\n"))
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		server, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return err
+		}
+		username, err := expandSecrets(n.Username)
+		if err != nil {
+			return err
+		}
+		password, err := expandSecrets(n.Password)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", username, password, server)
+	}
+	return smtp.SendMail(host, auth, from, to, msg.Bytes())
+}
+
+// subject is the title of the summary, telling whether the run completed
+func (n *runNotice) subject() string {
+	if n.ExitStatus != 0 {
+		return "sample run failed: " + n.Error
+	}
+	return "sample run completed"
+}
+
+// topErrorLines formats the most frequent errors of the run
+func (n *runNotice) topErrorLines() []string {
+	var lines []string
+	for _, e := range n.TopErrors {
+		lines = append(lines, fmt.Sprintf("- %s (%d), e.g. %s", e.Error, e.Count, e.Example))
+	}
+	return lines
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Limits of the run notifications: the failed jobs and distinct errors they list, and the time a webhook
+// has to answer
+const (
+	notifyFailures  = 10
+	notifyTopErrors = 5
+	notifyTimeout   = 10 * time.Second
+)
+
+// runNotice is the payload of the run finished webhook
+type runNotice struct {
+	Event string `json:"event"`
+	// ExitStatus is the status the run exits with, 1 when some jobs did not complete, and Error why
+	ExitStatus int         `json:"exit_status"`
+	Error      string      `json:"error,omitempty"`
+	OutDir     string      `json:"out_dir"`
+	Summary    *runSummary `json:"summary"`
+	// Failures are the first notifyFailures results that did not complete, TopErrors the most frequent
+	// errors of all of them
+	Failures  []*download.Result `json:"failures,omitempty"`
+	TopErrors []errorCount       `json:"top_errors,omitempty"`
+}
+
+// errorCount is the number of jobs that failed with an error, and the url of one of them
+type errorCount struct {
+	Error   string `json:"error"`
+	Count   int    `json:"count"`
+	Example string `json:"example_url"`
+}
+
+// notifyRun sends the run finished notifications of the options, err is the outcome of the run. A
+// notification that fails is reported but doesn't fail the run.
+func notifyRun(opts options, started time.Time, results []*download.Result, err error) {
+	if !opts.NotifyDesktop && opts.NotifyWebhook == "" && opts.Notifiers == "" {
+		return
+	}
+	notice := &runNotice{Event: "run.finished", OutDir: opts.OutDir, Summary: summarize(started, results)}
+	if err != nil {
+		notice.ExitStatus, notice.Error = 1, err.Error()
+	}
+	var failed []*download.Result
+	for _, r := range results {
+		if r.Status != download.StatusOK && r.Status != download.StatusSkipped {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) > notifyFailures {
+		notice.Failures = failed[:notifyFailures]
+	} else {
+		notice.Failures = failed
+	}
+	notice.TopErrors = topErrors(failed)
+
+	if opts.NotifyWebhook != "" {
+		if err := postNotice(opts.NotifyWebhook, notice); err != nil {
+			fmt.Println(fmt.Sprintf("notify - webhook %s failed: %s", webhookHost(opts.NotifyWebhook), err))
+		}
+	}
+	if opts.Notifiers != "" {
+		notifiers, err := loadNotifiers(opts.Notifiers)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("notify - %s", err))
+		}
+		for _, n := range notifiers {
+			if err := n.send(notice); err != nil {
+				fmt.Println(fmt.Sprintf("notify - %s notifier failed: %s", n.Type, err))
+			}
+		}
+	}
+	if opts.NotifyDesktop {
+		if err := notifyDesktop("sample run finished", notice.text()); err != nil {
+			fmt.Println(fmt.Sprintf("notify - desktop notification failed: %s", err))
+		}
+	}
+}
+
+// topErrors counts the failures by error, the most frequent notifyTopErrors first
+func topErrors(failed []*download.Result) []errorCount {
+	byError := map[string]*errorCount{}
+	var counts []*errorCount
+	for _, r := range failed {
+		c, ok := byError[r.Error]
+		if !ok {
+			c = &errorCount{Error: r.Error, Example: r.URL}
+			byError[r.Error] = c
+			counts = append(counts, c)
+		}
+		c.Count++
+	}
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+	var top []errorCount
+	for i, c := range counts {
+		if i == notifyTopErrors {
+			break
+		}
+		top = append(top, *c)
+	}
+	return top
+}
+
+// text is the one line summary of the notice
+func (n *runNotice) text() string {
+	s := n.Summary
+	parts := []string{fmt.Sprintf("%d of %d jobs completed in %s", s.Succeeded, s.Jobs, s.Duration.Round(time.Second))}
+	if s.Failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed", s.Failed))
+	}
+	if s.Invalid > 0 {
+		parts = append(parts, fmt.Sprintf("%d invalid entries", s.Invalid))
+	}
+	if s.Filtered > 0 {
+		parts = append(parts, fmt.Sprintf("%d filtered out", s.Filtered))
+	}
+	parts = append(parts, humanBytes(s.Bytes)+" into "+n.OutDir)
+	return strings.Join(parts, ", ")
+}
+
+// postNotice posts a notice as json, a runNotice or the assetEvent of a monitor
+func postNotice(webhook string, notice interface{}) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return redactURL(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// webhookHost returns the host of a webhook url, the logs show it rather than the url whose path or query
+// may hold a token
+func webhookHost(webhook string) string {
+	u, err := url.Parse(webhook)
+	if err != nil || u.Host == "" {
+		return "(invalid url)"
+	}
+	return u.Host
+}
+
+// redactURL returns the error of a request without its url, see webhookHost
+func redactURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s %s: %w", urlErr.Op, webhookHost(urlErr.URL), urlErr.Err)
+	}
+	return err
+}
+
+// notifyDesktop shows a notification with the tool of the platform: notify-send, osascript or powershell
+func notifyDesktop(title, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		script := `Add-Type -AssemblyName System.Windows.Forms;` +
+			`$n = New-Object System.Windows.Forms.NotifyIcon;` +
+			`$n.Icon = [System.Drawing.SystemIcons]::Information;` +
+			`$n.Visible = $true;` +
+			`$n.ShowBalloonTip(10000, $env:SAMPLE_TITLE, $env:SAMPLE_MESSAGE, 'Info');` +
+			`Start-Sleep -Seconds 10; $n.Dispose()`
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+		cmd.Env = append(os.Environ(), "SAMPLE_TITLE="+title, "SAMPLE_MESSAGE="+message)
+		return cmd.Start() // the balloon is shown while powershell sleeps, the run doesn't wait for it
+	default:
+		cmd = exec.Command("notify-send", "--app-name=sample", title, message)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string literal
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookFailuresDontLogTheURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webhook := server.URL + "/hooks/secret-token?key=secret-key"
+	server.Close()
+
+	err := postNotice(webhook, &runNotice{Event: "run.finished"})
+	if err == nil {
+		t.Fatal("post to a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %q holds the webhook url", err)
+	}
+	if host := webhookHost(webhook); host != strings.TrimPrefix(server.URL, "http://") {
+		t.Errorf("webhook host %q", host)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauth2SecretEnv sets the client secret without saving it in the report, retries read it from there
+const oauth2SecretEnv = "SAMPLE_OAUTH2_CLIENT_SECRET"
+
+// oauth2Leeway refreshes a token that far ahead of its expiry so it does not expire mid request
+const oauth2Leeway = 30 * time.Second
+
+// errTokenRejected fails an attempt answered with a 401, the token is refreshed for the next attempt
+var errTokenRejected = errors.New("oauth2 token rejected")
+
+// oauth2Source fetches a token with the client credentials grant and sets it as the Bearer
+// Authorization header of the requests to the matching hosts, refreshing it before it expires
+type oauth2Source struct {
+	tokenURL string
+	clientID string
+	secret   string
+	scopes   string
+	hosts    hostPatterns
+	client   *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newOAuth2Source returns nil when no token url is configured
+func newOAuth2Source(opts options) *oauth2Source {
+	if opts.OAuth2TokenURL == "" {
+		return nil
+	}
+	secret := opts.OAuth2ClientSecret
+	if secret == "" {
+		secret = os.Getenv(oauth2SecretEnv)
+	}
+	s := &oauth2Source{
+		tokenURL: opts.OAuth2TokenURL,
+		clientID: opts.OAuth2ClientID,
+		secret:   secret,
+		scopes:   strings.Join(strings.FieldsFunc(opts.OAuth2Scopes, func(r rune) bool { return r == ',' || r == ' ' }), " "),
+		hosts:    parseHostPatterns(opts.OAuth2Hosts),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	return s
+}
+
+// authorize is the before request hook setting the token
+func (s *oauth2Source) authorize(req *http.Request) error {
+	if !s.hosts.matches(req.URL) {
+		return nil
+	}
+	token, err := s.current()
+	if err != nil {
+		return fmt.Errorf("oauth2: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// check is the after response hook dropping a token rejected by the server
+func (s *oauth2Source) check(res *http.Response) error {
+	if res.StatusCode != http.StatusUnauthorized || !s.hosts.matches(res.Request.URL) {
+		return nil
+	}
+	s.mu.Lock()
+	if res.Request.Header.Get("Authorization") == "Bearer "+s.token {
+		s.token = ""
+	}
+	s.mu.Unlock()
+	return errTokenRejected
+}
+
+// current returns the cached token, fetching a new one when it is missing or about to expire
+func (s *oauth2Source) current() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && (s.expiry.IsZero() || time.Now().Add(oauth2Leeway).Before(s.expiry)) {
+		return s.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s.scopes != "" {
+		form.Set("scope", s.scopes)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	secret, err := secretRefs(s.secret)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(secret))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	reply := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}{}
+	json.Unmarshal(body, reply)
+	if res.StatusCode != http.StatusOK || reply.AccessToken == "" {
+		if reply.Error != "" {
+			return "", fmt.Errorf("token endpoint: %s %s", reply.Error, reply.Description)
+		}
+		return "", fmt.Errorf("token endpoint: unexpected http status %s", res.Status)
+	}
+
+	s.token, s.expiry = reply.AccessToken, time.Time{}
+	if reply.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(reply.ExpiresIn) * time.Second)
+	}
+	return s.token, nil
+}
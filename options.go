@@ -0,0 +1,434 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// options are the settings a run was started with, they are saved in the report so a retry can reuse them
+type options struct {
+	download.Options
+	ExecPost           string        `json:"-"` // not saved in the report, see secretOptions
+	Clamd              string        `json:"clamd,omitempty"`
+	Infected           string        `json:"infected,omitempty"`
+	QuarantineDir      string        `json:"quarantine_dir,omitempty"`
+	NearDup            string        `json:"near_dup,omitempty"`
+	NearDupThreshold   int           `json:"near_dup_threshold,omitempty"`
+	Dataset            bool          `json:"dataset,omitempty"`
+	Split              string        `json:"split,omitempty"`
+	ShardDirs          string        `json:"shard_dirs,omitempty"`
+	CheckpointInterval time.Duration `json:"checkpoint_interval,omitempty"`
+	VerifyDecode       bool          `json:"verify_decode,omitempty"`
+	ContentTypeAny     bool          `json:"content_type_any,omitempty"`
+	Animated           string        `json:"animated,omitempty"`
+	SanitizeSVG        bool          `json:"sanitize_svg,omitempty"`
+	RasterizeDPI       int           `json:"rasterize_dpi,omitempty"`
+	Mirrors            stringsFlag   `json:"mirrors,omitempty"`
+	DedupDB            string        `json:"dedup_db,omitempty"`
+	Force              bool          `json:"force,omitempty"`
+	ShardIndex         int           `json:"shard_index,omitempty"`
+	ShardCount         int           `json:"shard_count,omitempty"`
+	ShardMode          string        `json:"shard_mode,omitempty"`
+	PresignCommand     string        `json:"-"` // not saved in the report, see secretOptions
+	PresignExpiry      time.Duration `json:"presign_expiry,omitempty"`
+	OAuth2TokenURL     string        `json:"oauth2_token_url,omitempty"`
+	OAuth2ClientID     string        `json:"oauth2_client_id,omitempty"`
+	OAuth2ClientSecret string        `json:"-"` // not saved in the report, see oauth2SecretEnv
+	OAuth2Scopes       string        `json:"oauth2_scopes,omitempty"`
+	OAuth2Hosts        string        `json:"oauth2_hosts,omitempty"`
+	SigV4Service       string        `json:"sigv4_service,omitempty"`
+	SigV4Region        string        `json:"sigv4_region,omitempty"`
+	SigV4Hosts         string        `json:"sigv4_hosts,omitempty"`
+	CookieJar          string        `json:"cookie_jar,omitempty"`
+	Session            string        `json:"session,omitempty"`
+	HostConfig         string        `json:"host_config,omitempty"`
+	StripParams        string        `json:"strip_params,omitempty"`
+	SortQuery          bool          `json:"sort_query,omitempty"`
+	StripFragment      bool          `json:"strip_fragment,omitempty"`
+	RewriteRules       string        `json:"rewrite_rules,omitempty"`
+	URLTransform       string        `json:"-"` // not saved in the report, see secretOptions
+	GlobOff            bool          `json:"glob_off,omitempty"`
+	FollowTorrent      bool          `json:"follow_torrent,omitempty"`
+	Zsync              bool          `json:"zsync,omitempty"`
+	TorrentSeed        time.Duration `json:"torrent_seed,omitempty"`
+	WebDAVUser         string        `json:"webdav_user,omitempty"`
+	WebDAVPassword     string        `json:"-"` // not saved in the report, see webdavPasswordEnv
+	WebDAVOut          string        `json:"webdav_out,omitempty"`
+	SMBOut             string        `json:"smb_out,omitempty"`
+	SMBUser            string        `json:"smb_user,omitempty"`
+	SMBPassword        string        `json:"-"` // not saved in the report, see smbPasswordEnv
+	IngestURL          string        `json:"-"` // not saved in the report, see secretOptions
+	IngestMethod       string        `json:"ingest_method,omitempty"`
+	IngestFormat       string        `json:"ingest_format,omitempty"`
+	IngestField        string        `json:"ingest_field,omitempty"`
+	IngestToken        string        `json:"-"` // not saved in the report, see ingestTokenEnv
+	IngestRetries      int           `json:"ingest_retries,omitempty"`
+	S3Out              string        `json:"s3_out,omitempty"`
+	S3PartSize         int64         `json:"s3_part_size,omitempty"`
+	S3Retries          int           `json:"s3_retries,omitempty"`
+	StreamThrough      bool          `json:"stream_through,omitempty"`
+	PreferWidth        int           `json:"prefer_width,omitempty"`
+	PreferDensity      float64       `json:"prefer_density,omitempty"`
+	Strict             bool          `json:"strict,omitempty"`
+	OnConflict         string        `json:"on_conflict,omitempty"`
+	Include            stringsFlag   `json:"include,omitempty"`
+	Exclude            stringsFlag   `json:"exclude,omitempty"`
+	Offset             int           `json:"offset,omitempty"`
+	Limit              int           `json:"limit,omitempty"`
+	Sample             int           `json:"sample,omitempty"`
+	History            string        `json:"history,omitempty"`
+	Progress           time.Duration `json:"progress,omitempty"`
+	Events             string        `json:"events,omitempty"`
+	NotifyDesktop      bool          `json:"notify_desktop,omitempty"`
+	NotifyWebhook      string        `json:"-"` // not saved in the report, see secretOptions
+	Notifiers          string        `json:"notifiers,omitempty"`
+	SumsFile           string        `json:"sums_file,omitempty"`
+	SumsFormat         string        `json:"sums_format,omitempty"`
+	Provenance         string        `json:"provenance,omitempty"`
+	Sign               string        `json:"sign,omitempty"`
+	SignKey            string        `json:"sign_key,omitempty"`
+	// Prune, PruneDryRun, Interactive and ResumeLast are only flags of a download run, they are not saved
+	// so a retry doesn't prune or ask
+	Prune       bool `json:"-"`
+	PruneDryRun bool `json:"-"`
+	Interactive bool `json:"-"`
+	ResumeLast  bool `json:"-"`
+}
+
+// secretOption is an option not saved in the report and the checkpoint of a run, a secret or a command or
+// url that may embed one, the retry and the resume of the run get it again from its flag or its
+// environment variable
+type secretOption struct {
+	flag  string
+	env   string // none when empty
+	value *string
+}
+
+func secretOptions(opts *options) []secretOption {
+	return []secretOption{
+		{"oauth2-client-secret", oauth2SecretEnv, &opts.OAuth2ClientSecret},
+		{"webdav-password", webdavPasswordEnv, &opts.WebDAVPassword},
+		{"smb-password", smbPasswordEnv, &opts.SMBPassword},
+		{"ingest-token", ingestTokenEnv, &opts.IngestToken},
+		{"ingest-url", "", &opts.IngestURL},
+		{"exec-post", "", &opts.ExecPost},
+		{"presign-command", "", &opts.PresignCommand},
+		{"notify-webhook", "", &opts.NotifyWebhook},
+		{"url-transform", "", &opts.URLTransform},
+	}
+}
+
+// given tells whether the option is set by its flag or its environment variable
+func (o secretOption) given() bool {
+	return *o.value != "" || o.env != "" && os.Getenv(o.env) != ""
+}
+
+// secretFlags returns the flags of the secret options the run is given, recorded with its options
+func secretFlags(opts options) []string {
+	var flags []string
+	for _, secret := range secretOptions(&opts) {
+		if secret.given() {
+			flags = append(flags, secret.flag)
+		}
+	}
+	return flags
+}
+
+// restoreSecrets returns the saved options of a run with the secret options of current, and the flags,
+// or the environment variables, of the ones the run was given, by flags, that current misses
+func restoreSecrets(saved options, flags []string, current options) (options, []string) {
+	given := secretOptions(&current)
+	var missing []string
+	for i, secret := range secretOptions(&saved) {
+		*secret.value = *given[i].value
+		if secret.given() {
+			continue
+		}
+		for _, flag := range flags {
+			if flag != secret.flag {
+				continue
+			}
+			if secret.env != "" {
+				missing = append(missing, fmt.Sprintf("--%s or $%s", secret.flag, secret.env))
+			} else {
+				missing = append(missing, "--"+secret.flag)
+			}
+		}
+	}
+	return saved, missing
+}
+
+// addRunFlags defines the flags of a download run on fs and returns the options they are parsed into
+func addRunFlags(fs *flag.FlagSet) *options {
+	opts := &options{}
+	fs.IntVar(&opts.Workers, "workers", workersCount, "number of concurrent workers")
+	fs.DurationVar(&opts.Timeout, "timeout", 0, "per request timeout, 0 means no timeout")
+	fs.StringVar(&opts.OutDir, "out", ".data", "output directory")
+	fs.IntVar(&opts.Retries, "retries", 0, "number of times a failed download is retried")
+	fs.Float64Var(&opts.RetryBudget, "retry-budget", 0, "ratio of the requests of the last minute the retries of the run can add up to, plus 10, so an outage fails fast instead of retrying every job, e.g. 0.2, 0 for no budget")
+	fs.StringVar(&opts.ExecPost, "exec-post", "", "shell command run for each downloaded file, see execPost")
+	fs.StringVar(&opts.Clamd, "clamd", "", "scan downloaded files with the clamd daemon at this unix socket path or host:port")
+	fs.StringVar(&opts.Infected, "infected", infectedQuarantine, "what to do with infected files: quarantine or delete")
+	fs.StringVar(&opts.QuarantineDir, "quarantine-dir", ".quarantine", "directory infected files are moved to")
+	fs.StringVar(&opts.NearDup, "near-dup", "", "detect near duplicate images by perceptual hash: flag or skip")
+	fs.IntVar(&opts.NearDupThreshold, "near-dup-threshold", 5, "max hamming distance between hashes of near duplicate images")
+	fs.BoolVar(&opts.Dataset, "dataset", false, "write images to <split>/<label> sub directories and a dataset.csv summary")
+	fs.StringVar(&opts.Split, "split", "80,10,10", "train,val,test split ratios of the dataset mode")
+	fs.DurationVar(&opts.CheckpointInterval, "checkpoint-interval", 0, "journal the run to <out>/.checkpoint.jsonl, flushed this often, e.g. 30s, so --resume-last can recover it if it crashes, no checkpoint when 0")
+	fs.StringVar(&opts.ShardDirs, "shard-dirs", "", "spread the outputs over sub directories: hash[:levels] by the sha1 of their name, as ab/abcdef.jpg, or key[:size] by ranges of keys")
+	fs.StringVar(&opts.NotFound, "not-found", download.NotFoundFail, "what to do with 404 responses: fail or skip")
+	fs.StringVar(&opts.Redirects, "redirects", download.RedirectFollow, "redirect policy: follow, same-host or none")
+	fs.StringVar(&opts.Encodings, "accept-encoding", "", "comma separated encodings to request (gzip, deflate, not br or zstd) or none to disable compression")
+	fs.Var(sizeFlag{&opts.MinSpeed}, "min-speed", "bytes per second under which a transfer counts as stalled, e.g. 10k")
+	fs.DurationVar(&opts.StallTimeout, "stall-timeout", 0, "abort and retry a transfer stalled for this long, 30s when only --min-speed is set")
+	fs.Var(sizeFlag{&opts.MaxTotalBytes}, "max-total-bytes", "stop starting new jobs once this many bytes were downloaded, e.g. 2G")
+	fs.DurationVar(&opts.MaxDuration, "max-duration", 0, "stop starting new jobs after the run lasted this long")
+	fs.Var(sizeFlag{&opts.MaxDiskUsage}, "max-disk-usage", "quota on the size of the output directory, e.g. 10G")
+	fs.Var(sizeFlag{&opts.MaxFileSize}, "max-file-size", "fail the downloads larger than this size, by their Content-Length before they are read when known, e.g. 500M")
+	fs.Var(sizeFlag{&opts.MaxMemory}, "max-memory", "hold the intake of new jobs while the heap is close to this size, e.g. 512M")
+	fs.IntVar(&opts.MaxOpenFiles, "max-open-files", 0, "open files the jobs in flight may use, the raised rlimit of the process when 0, -1 for no cap")
+	fs.BoolVar(&opts.NoPreallocate, "no-preallocate", false, "don't reserve the disk space of the files whose size is known before writing them")
+	fs.StringVar(&opts.Fsync, "fsync", download.FsyncNever, "when the written files are synced to disk: never, per-file or batch")
+	fs.Var(sizeFlag{&opts.IOBuffer}, "io-buffer", "size of the read and write buffers of the transfers, e.g. 1M for fast mirror jobs")
+	fs.StringVar(&opts.Checksums, "checksums", "", "comma separated checksums computed while the files are written, on top of sha256: md5, sha1 or sha512")
+	fs.BoolVar(&opts.ChecksumSidecars, "checksum-sidecars", false, "write the checksums of each file next to it as <file>.<algorithm>, in the sha256sum -c format")
+	fs.StringVar(&opts.DiskPolicy, "disk-policy", download.DiskStop, "what to do when the disk quota is reached: stop or prune-oldest")
+	fs.BoolVar(&opts.ContentDisposition, "content-disposition", false, "name the files by the Content-Disposition filename of the responses, like curl -OJ")
+	fs.StringVar(&opts.NameCollision, "name-collision", download.NameRename, "what to do when two files get the same --content-disposition name: rename, overwrite or key")
+	fs.StringVar(&opts.CASDir, "cas", "", "content addressable store directory, outputs are hard linked to it and stored urls are not downloaded again")
+	fs.BoolVar(&opts.FastSkip, "fast-skip", false, "send a HEAD request for the files of the previous runs and download only the changed ones")
+	fs.StringVar(&opts.CASLinks, "cas-links", download.CASHardLinks, "how outputs link to the --cas objects: hard or symlink, symlinks allow a store on another file system")
+	fs.StringVar(&opts.HTTPCacheDir, "http-cache", "", "directory of a local http cache honoring Cache-Control shared by runs")
+	fs.StringVar(&opts.Record, "record", "", "cassette directory the requests and responses of the run are recorded to, for --replay")
+	fs.StringVar(&opts.Replay, "replay", "", "cassette directory of a --record run the responses are served from, without network")
+	fs.StringVar(&opts.PresignCommand, "presign-command", "", "shell command printing the presigned url of $SAMPLE_URL, for urls that are not http(s)")
+	fs.DurationVar(&opts.PresignExpiry, "presign-expiry", defaultPresignExpiry, "validity of the presigned s3:// and gs:// urls")
+	fs.StringVar(&opts.OAuth2TokenURL, "oauth2-token-url", "", "token endpoint of the oauth2 client credentials grant")
+	fs.StringVar(&opts.OAuth2ClientID, "oauth2-client-id", "", "oauth2 client id")
+	fs.StringVar(&opts.OAuth2ClientSecret, "oauth2-client-secret", "", "oauth2 client secret or its secretref://, defaults to $"+oauth2SecretEnv)
+	fs.StringVar(&opts.OAuth2Scopes, "oauth2-scopes", "", "comma separated oauth2 scopes")
+	fs.StringVar(&opts.OAuth2Hosts, "oauth2-hosts", "", "comma separated hosts the oauth2 token is sent to, *.example.com matches the sub domains")
+	fs.StringVar(&opts.SigV4Service, "sigv4-service", "", "sign the requests to --sigv4-hosts with AWS SigV4 for this service, e.g. execute-api or s3")
+	fs.StringVar(&opts.SigV4Region, "sigv4-region", "", "region of the SigV4 signatures, defaults to $AWS_REGION")
+	fs.StringVar(&opts.SigV4Hosts, "sigv4-hosts", "", "comma separated hosts whose requests are SigV4 signed, *.example.com matches the sub domains")
+	fs.StringVar(&opts.CookieJar, "cookie-jar", "", "json file the cookies are loaded from and saved to, so sessions outlive a run")
+	fs.StringVar(&opts.Session, "session", "", "json file of the requests sent before downloading to open a session, e.g. a login")
+	fs.StringVar(&opts.HostConfig, "host-config", "", "json file of headers, auth, rate limits and retries keyed by host pattern")
+	fs.Float64Var(&opts.HedgePercentile, "hedge-percentile", 0, "send a second request when the response is slower than this percentile of the recent ones, e.g. 95")
+	fs.DurationVar(&opts.HedgeDelay, "hedge-delay", 0, "hedging delay until enough response times are known, 1s by default")
+	fs.Float64Var(&opts.RateLimit, "rate-limit", 0, "maximum number of requests per second, 0 for no limit")
+	fs.IntVar(&opts.MaxPerHost, "max-per-host", 0, "maximum number of concurrent requests to a host, 0 for no cap")
+	fs.StringVar(&opts.StripParams, "strip-params", "", "comma separated query params removed from the urls, * matches any sequence and tracking stands for utm_*, fbclid, gclid...")
+	fs.BoolVar(&opts.SortQuery, "sort-query", false, "sort the query params of the urls")
+	fs.BoolVar(&opts.StripFragment, "strip-fragment", false, "remove the #fragment of the urls")
+	fs.StringVar(&opts.RewriteRules, "rewrite-rules", "", "json file of host mappings and regexp rules rewriting the urls, e.g. to internal mirrors, before --url-transform")
+	fs.StringVar(&opts.URLTransform, "url-transform", "", "rewrite the urls before the download with s/regexp/replacement/[g] expressions separated by ;, or a shell command filtering them line by line")
+	fs.StringVar(&opts.OnConflict, "on-conflict", conflictOverwrite, "what a job does when its output already exists: overwrite, skip or prompt, prompt overwrites without a terminal")
+	fs.BoolVar(&opts.Strict, "strict", false, "abort when an entry of the manifest is invalid, instead of skipping it with a warning")
+	fs.BoolVar(&opts.GlobOff, "globoff", false, "don't expand the {a,b} and {001..100} patterns of the urls, as curl --globoff")
+	fs.BoolVar(&opts.Zsync, "zsync", false, "fetch only the blocks an existing output lacks when the url has a .zsync control file, else the whole file")
+	fs.BoolVar(&opts.FollowTorrent, "follow-torrent", false, "download the content of the .torrent urls rather than the .torrent files, as the magnet: urls, with aria2c")
+	fs.DurationVar(&opts.TorrentSeed, "torrent-seed", 0, "keep seeding a torrent this long once it is downloaded, 0 to stop right away")
+	fs.StringVar(&opts.WebDAVUser, "webdav-user", "", "user of the basic auth of the dav:// and davs:// urls and of --webdav-out")
+	fs.StringVar(&opts.WebDAVPassword, "webdav-password", "", "password of --webdav-user or its secretref://, defaults to $"+webdavPasswordEnv)
+	fs.StringVar(&opts.WebDAVOut, "webdav-out", "", "also upload each download to this WebDAV collection, at its path in the output directory")
+	fs.StringVar(&opts.SMBOut, "smb-out", "", "also copy each download to this smb://server/share/dir with smbclient, at its path in the output directory")
+	fs.StringVar(&opts.SMBUser, "smb-user", "", `user of --smb-out, DOMAIN\user in a domain, the share is accessed as a guest without one`)
+	fs.StringVar(&opts.SMBPassword, "smb-password", "", "password of --smb-user or its secretref://, e.g. to the keychain, defaults to $"+smbPasswordEnv)
+	fs.StringVar(&opts.IngestURL, "ingest-url", "", "also upload each download to the ingest endpoint of an asset service at this url")
+	fs.StringVar(&opts.IngestMethod, "ingest-method", http.MethodPost, "method of the --ingest-url uploads: POST or PUT")
+	fs.StringVar(&opts.IngestFormat, "ingest-format", ingestMultipart, "body of the --ingest-url uploads: multipart, a form with the file and its path, url and sha256, or raw")
+	fs.StringVar(&opts.IngestField, "ingest-field", "file", "form field of the file of the multipart --ingest-url uploads")
+	fs.StringVar(&opts.IngestToken, "ingest-token", "", "bearer token of --ingest-url or its secretref://, defaults to $"+ingestTokenEnv)
+	fs.IntVar(&opts.IngestRetries, "ingest-retries", 3, "number of times an --ingest-url upload failing on the network, a 5xx, a 408 or a 429 is retried")
+	fs.StringVar(&opts.S3Out, "s3-out", "", "also upload each download to this s3://bucket/prefix, at its path in the output directory, with the aws credentials")
+	fs.Var(sizeFlag{&opts.S3PartSize}, "s3-part-size", "size of the parts of the --s3-out multipart uploads, between 5M and 5G, 8M by default, smaller objects are sent at once")
+	fs.IntVar(&opts.S3Retries, "s3-retries", 3, "number of times a request of --s3-out, a part of an upload alone, failing on the network, a 5xx or a 429 is retried")
+	fs.IntVar(&opts.SinkWorkers, "sink-workers", 0, "upload to --webdav-out, --smb-out, --ingest-url and --s3-out with this many workers of their own instead of the downloading ones, 0 to upload in the downloading worker")
+	fs.IntVar(&opts.SinkBuffer, "sink-buffer", 0, "downloads waiting for a --sink-workers upload before the downloading workers wait too, --sink-workers by default")
+	fs.BoolVar(&opts.StreamThrough, "stream-through", false, "stream the downloads to --s3-out or --ingest-url as they arrive without writing them to the output directory, a failed stream is retried with the download by --retries")
+	fs.IntVar(&opts.PreferWidth, "prefer-width", 0, "pick the narrowest srcset candidate of an entry at least this many pixels wide, 0 for the widest")
+	fs.Float64Var(&opts.PreferDensity, "prefer-density", 0, "pick the srcset candidate of the lowest density at least this one, e.g. 2 for 2x, when they have no widths, 0 for the highest")
+	fs.Var(&opts.Include, "include", "only download the urls matching this regular expression, can be repeated")
+	fs.Var(&opts.Exclude, "exclude", "skip the urls matching this regular expression, can be repeated")
+	fs.StringVar(&opts.Order, "order", download.OrderManifest, "order the jobs are started in: manifest, shuffle (by --seed) or host to group them by host")
+	fs.IntVar(&opts.Offset, "offset", 0, "skip this many entries of the manifest, after the filters")
+	fs.IntVar(&opts.Limit, "limit", 0, "only process this many entries of the manifest from --offset, 0 for all")
+	fs.IntVar(&opts.Sample, "sample", 0, "process a random subset of this many entries, e.g. to smoke test a manifest")
+	fs.Int64Var(&opts.Seed, "seed", 1, "seed of the --sample draw and of the shuffle --order")
+	fs.DurationVar(&opts.Progress, "progress", 0, "print the progress and estimated remaining time of the run at this interval, e.g. 10s")
+	fs.StringVar(&opts.Events, "events", "", "append the completed jobs and the progress of the run as json lines to this file, - for stdout")
+	fs.BoolVar(&opts.NotifyDesktop, "notify-desktop", false, "show a desktop notification with the summary when the run finishes")
+	fs.StringVar(&opts.NotifyWebhook, "notify-webhook", "", "POST the summary and the failures of the run as json to this url when it finishes")
+	fs.StringVar(&opts.Notifiers, "notifiers", "", "json file of the slack webhooks and smtp servers the summary of each run is sent to, see notifierConfig")
+	fs.StringVar(&opts.SumsFile, "sums-file", "", "write the sha256 of all the outputs to this file after the run, e.g. <out>/SHA256SUMS")
+	fs.StringVar(&opts.SumsFormat, "sums-format", sumsGNU, "format of the --sums-file: gnu for sha256sum -c or bsd for shasum -c")
+	fs.StringVar(&opts.Provenance, "provenance", "", "write an in-toto provenance statement of the outputs, their urls, hashes and response headers, to this file")
+	fs.StringVar(&opts.ResponseHeaders, "response-headers", "", "comma separated response headers kept in the results, "+provenanceHeaders+" with --provenance")
+	fs.StringVar(&opts.Sign, "sign", "", "sign the report and the --sums-file with gpg or cosign, next to them as .asc or .sig")
+	fs.StringVar(&opts.SignKey, "sign-key", "", "gpg key id or cosign key reference of --sign, the default gpg key or keyless cosign otherwise")
+	fs.StringVar(&opts.History, "history", "", "file the summaries of the runs are appended to for sample report, <out>/.history.jsonl by default or none")
+	fs.StringVar(&opts.DedupDB, "dedup-db", "", "log file of the downloaded urls shared by runs, urls already downloaded to the output directory are skipped")
+	fs.BoolVar(&opts.Force, "force", false, "download urls found in the --dedup-db log again")
+	fs.BoolVar(&opts.VerifyDecode, "verify-decode", false, "fully decode each image and retry the ones that are corrupt")
+	fs.BoolVar(&opts.ContentTypeAny, "content-type-any", false, "download any kind of file, videos, archives or models, named with the extension of their url rather than .jpg and without the image stages")
+	fs.BoolVar(&opts.SanitizeSVG, "sanitize-svg", false, "strip the scripts, event handlers and javascript: urls of the downloaded svg")
+	fs.IntVar(&opts.RasterizeDPI, "rasterize-dpi", 0, "rasterize the downloaded svg and pdf to a jpeg of their first page at this dpi, with rsvg-convert and pdftoppm, 0 to keep them")
+	fs.StringVar(&opts.Animated, "animated", animatedKeep, "what to do with the animated gif, webp and png: keep, first-frame for a jpeg still, or mp4 or webm to convert them with ffmpeg")
+	fs.Var(&opts.Mirrors, "mirror", "host=mirror-host alternate host retries are sent to, can be repeated")
+	fs.IntVar(&opts.ShardIndex, "shard-index", -1, "shard of the manifest to process, from $"+shardIndexEnv+" when not set")
+	fs.IntVar(&opts.ShardCount, "shard-count", 0, "number of shards the manifest is split into")
+	fs.StringVar(&opts.ShardMode, "shard-mode", shardHash, "how jobs are assigned to shards: hash or range")
+	fs.Float64Var(&opts.ChaosFailRate, "chaos-fail-rate", 0, "fraction of the requests failed before they are sent")
+	fs.Float64Var(&opts.ChaosSlowRate, "chaos-slow-rate", 0, "fraction of the responses whose body reads are slowed by --chaos-slow-read")
+	fs.DurationVar(&opts.ChaosSlowRead, "chaos-slow-read", 0, "wait before each read of the slowed bodies, 100ms by default")
+	fs.Float64Var(&opts.ChaosTruncateRate, "chaos-truncate-rate", 0, "fraction of the responses whose body ends early without error")
+	fs.Int64Var(&opts.ChaosSeed, "chaos-seed", 0, "seed of the chaos draws")
+	return opts
+}
+
+// validate checks the values of the flags that only accept a few choices
+func (opts *options) validate() error {
+	if err := opts.resolveShardIndex(); err != nil {
+		return err
+	}
+	if opts.ShardIndex < 0 || (opts.ShardCount > 0 && opts.ShardIndex >= opts.ShardCount) {
+		return fmt.Errorf("--shard-index %d is out of the %d shards", opts.ShardIndex, opts.ShardCount)
+	}
+	if opts.ShardMode != shardHash && opts.ShardMode != shardRange {
+		return fmt.Errorf("unknown --shard-mode %q", opts.ShardMode)
+	}
+	if err := checkAnyType(opts); err != nil {
+		return err
+	}
+	if _, err := parseShardDirs(opts.ShardDirs); err != nil {
+		return err
+	}
+	if opts.IngestMethod != http.MethodPost && opts.IngestMethod != http.MethodPut {
+		return fmt.Errorf("unknown --ingest-method %q, expected POST or PUT", opts.IngestMethod)
+	}
+	if opts.IngestFormat != ingestMultipart && opts.IngestFormat != ingestRaw {
+		return fmt.Errorf("unknown --ingest-format %q, expected multipart or raw", opts.IngestFormat)
+	}
+	if opts.IngestRetries < 0 {
+		return fmt.Errorf("--ingest-retries can't be negative")
+	}
+	if opts.S3PartSize != 0 && (opts.S3PartSize < minS3PartSize || opts.S3PartSize > maxS3PartSize) {
+		return fmt.Errorf("--s3-part-size must be between 5M and 5G")
+	}
+	if opts.S3Retries < 0 {
+		return fmt.Errorf("--s3-retries can't be negative")
+	}
+	if opts.SinkWorkers < 0 || opts.SinkBuffer < 0 {
+		return fmt.Errorf("--sink-workers and --sink-buffer can't be negative")
+	}
+	if err := checkStreamThrough(opts); err != nil {
+		return err
+	}
+	if opts.CheckpointInterval < 0 {
+		return fmt.Errorf("--checkpoint-interval can't be negative")
+	}
+	if opts.TorrentSeed < 0 {
+		return fmt.Errorf("--torrent-seed can't be negative")
+	}
+	if opts.RasterizeDPI < 0 {
+		return fmt.Errorf("--rasterize-dpi can't be negative")
+	}
+	if opts.PreferWidth < 0 || opts.PreferDensity < 0 {
+		return fmt.Errorf("--prefer-width and --prefer-density can't be negative")
+	}
+	switch opts.Animated {
+	case "", animatedKeep, animatedFirstFrame, animatedMP4, animatedWebM:
+	default:
+		return fmt.Errorf("unknown --animated action %q", opts.Animated)
+	}
+	if opts.Infected != infectedQuarantine && opts.Infected != infectedDelete {
+		return fmt.Errorf("unknown --infected action %q", opts.Infected)
+	}
+	if opts.NotFound != download.NotFoundFail && opts.NotFound != download.NotFoundSkip {
+		return fmt.Errorf("unknown --not-found policy %q", opts.NotFound)
+	}
+	if opts.Redirects != download.RedirectFollow && opts.Redirects != download.RedirectSameHost && opts.Redirects != download.RedirectNone {
+		return fmt.Errorf("unknown --redirects policy %q", opts.Redirects)
+	}
+	if opts.DiskPolicy != download.DiskStop && opts.DiskPolicy != download.DiskPruneOldest {
+		return fmt.Errorf("unknown --disk-policy %q", opts.DiskPolicy)
+	}
+	if opts.NameCollision != download.NameRename && opts.NameCollision != download.NameOverwrite && opts.NameCollision != download.NameKey {
+		return fmt.Errorf("unknown --name-collision policy %q", opts.NameCollision)
+	}
+	if opts.Fsync != download.FsyncNever && opts.Fsync != download.FsyncPerFile && opts.Fsync != download.FsyncBatch {
+		return fmt.Errorf("unknown --fsync policy %q", opts.Fsync)
+	}
+	if opts.CASLinks != download.CASHardLinks && opts.CASLinks != download.CASSymlinks {
+		return fmt.Errorf("unknown --cas-links mode %q", opts.CASLinks)
+	}
+	for _, rate := range []float64{opts.ChaosFailRate, opts.ChaosSlowRate, opts.ChaosTruncateRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("the --chaos rates must be between 0 and 1")
+		}
+	}
+	if opts.RetryBudget < 0 || opts.RetryBudget > 1 {
+		return fmt.Errorf("--retry-budget must be between 0 and 1")
+	}
+	if opts.OnConflict != conflictOverwrite && opts.OnConflict != conflictSkip && opts.OnConflict != conflictPrompt {
+		return fmt.Errorf("unknown --on-conflict policy %q", opts.OnConflict)
+	}
+	if opts.SumsFormat != sumsGNU && opts.SumsFormat != sumsBSD {
+		return fmt.Errorf("unknown --sums-format %q", opts.SumsFormat)
+	}
+	if opts.Provenance != "" && opts.ResponseHeaders == "" {
+		opts.ResponseHeaders = provenanceHeaders
+	}
+	if opts.Sign != "" && opts.Sign != signGPG && opts.Sign != signCosign {
+		return fmt.Errorf("unknown --sign signer %q", opts.Sign)
+	}
+	if opts.Notifiers != "" {
+		// read now rather than when the run is over
+		if _, err := loadNotifiers(opts.Notifiers); err != nil {
+			return err
+		}
+	}
+	if opts.Record != "" && opts.Replay != "" {
+		return fmt.Errorf("--record and --replay can't be used together")
+	}
+	if opts.OAuth2TokenURL != "" && (opts.OAuth2ClientID == "" || opts.OAuth2Hosts == "") {
+		return fmt.Errorf("--oauth2-token-url requires --oauth2-client-id and --oauth2-hosts")
+	}
+	if opts.SigV4Service != "" && opts.SigV4Hosts == "" {
+		return fmt.Errorf("--sigv4-service requires --sigv4-hosts")
+	}
+	if opts.HedgePercentile < 0 || opts.HedgePercentile > 100 {
+		return fmt.Errorf("--hedge-percentile must be between 0 and 100")
+	}
+	if opts.RateLimit < 0 || opts.MaxPerHost < 0 {
+		return fmt.Errorf("--rate-limit and --max-per-host can't be negative")
+	}
+	if opts.Order != download.OrderManifest && opts.Order != download.OrderShuffle && opts.Order != download.OrderHost {
+		return fmt.Errorf("unknown --order %q", opts.Order)
+	}
+	if opts.Offset < 0 || opts.Limit < 0 || opts.Sample < 0 {
+		return fmt.Errorf("--offset, --limit and --sample can't be negative")
+	}
+	if _, err := compileFilters("include", opts.Include); err != nil {
+		return err
+	}
+	if _, err := compileFilters("exclude", opts.Exclude); err != nil {
+		return err
+	}
+	if err := download.ValidateEncodings(opts.Encodings); err != nil {
+		return err
+	}
+	if err := download.ValidateChecksums(opts.Checksums); err != nil {
+		return err
+	}
+	if opts.NearDup != "" && opts.NearDup != nearDupFlag && opts.NearDup != nearDupSkip {
+		return fmt.Errorf("unknown --near-dup mode %q", opts.NearDup)
+	}
+	return nil
+}
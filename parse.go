@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+)
+
+// maxManifestSize is the size limit of the images files, a larger file is rejected rather than read, a
+// variable so the tests can lower it
+var maxManifestSize int64 = 1 << 30
+
+// maxURLLength is the length limit of the urls of the images files
+const maxURLLength = 8 << 10
+
+// utf8BOM is skipped at the start of the images files, spreadsheet tools write it
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// manifestError locates an error of an images file by line and column, when they are known
+type manifestError struct {
+	path   string
+	line   int
+	column int
+	err    error
+}
+
+func (e *manifestError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.path, e.line, e.column, e.err)
+	}
+	return fmt.Sprintf("%s: %s", e.path, e.err)
+}
+
+func (e *manifestError) Unwrap() error {
+	return e.err
+}
+
+// readManifest reads an images file within maxManifestSize, without its byte order mark
+func readManifest(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxManifestSize {
+		return nil, &manifestError{path: path, err: fmt.Errorf("larger than the limit of %s", humanBytes(maxManifestSize))}
+	}
+	return bytes.TrimPrefix(data, utf8BOM), nil
+}
+
+// checkURL rejects the urls no request can be made of
+func checkURL(raw string) error {
+	if raw == "" {
+		return errors.New("no url")
+	}
+	if len(raw) > maxURLLength {
+		return fmt.Errorf("url of %d bytes is longer than the limit of %d", len(raw), maxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if isTorrentURL(u) {
+		return nil
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute url", raw)
+	}
+	return nil
+}
+
+// jsonError turns an error of decoding data, the json images file at path, into a manifestError at
+// the line and column it occurred, with a message naming the json types rather than the Go ones
+func jsonError(path string, data []byte, err error) error {
+	e := &manifestError{path: path, err: err}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		e.line, e.column = lineColumn(data, syntaxErr.Offset-1)
+		e.err = errors.New(syntaxErr.Error())
+	case errors.As(err, &typeErr):
+		e.line, e.column = lineColumn(data, typeErr.Offset-1)
+		what := "the images file"
+		if typeErr.Field != "" {
+			what = typeErr.Field
+		}
+		e.err = fmt.Errorf("%s is %s, expected %s", what, article(typeErr.Value), article(jsonKind(typeErr.Type)))
+	}
+	return e
+}
+
+// csvError turns an error of the csv reader into a manifestError at its line and column
+func csvError(path string, err error) error {
+	e := &manifestError{path: path, err: err}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		e.line, e.column, e.err = parseErr.Line, parseErr.Column, parseErr.Err
+	}
+	return e
+}
+
+// lineColumn returns the 1 based line and column of a byte offset of data
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// elementOffsets returns the byte offsets of the elements of the array of a key of the top level object
+// of data, as far as it could be scanned
+func elementOffsets(data []byte, key string) []int64 {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
+	}
+	var offsets []int64
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return offsets
+		}
+		if t != key {
+			var skipped json.RawMessage
+			if dec.Decode(&skipped) != nil {
+				return offsets
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return offsets
+		}
+		for dec.More() {
+			offsets = append(offsets, skipSeparators(data, dec.InputOffset()))
+			var skipped json.RawMessage
+			if dec.Decode(&skipped) != nil {
+				return offsets
+			}
+		}
+		return offsets
+	}
+	return offsets
+}
+
+// skipSeparators returns the offset of the first byte from offset that is not a space or a comma
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// jsonKind names the json type decoded into a Go type
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Ptr:
+		return jsonKind(t.Elem())
+	}
+	return "number"
+}
+
+// article prefixes a json type with its indefinite article
+func article(kind string) string {
+	switch kind {
+	case "array", "object":
+		return "an " + kind
+	}
+	return "a " + kind
+}
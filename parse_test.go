@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeImages writes an images file named name and returns its path
+func writeImages(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadImageFile(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		urls []string
+	}{
+		{"images.json", `{"urls": ["http://a.com/1.jpg", {"url": "http://a.com/2.jpg", "id": "two"}]}`, []string{"http://a.com/1.jpg", "http://a.com/2.jpg"}},
+		{"images.json", "\xef\xbb\xbf" + `{"urls": ["http://a.com/1.jpg"]}`, []string{"http://a.com/1.jpg"}},
+		{"images.csv", "url,label\nhttp://a.com/1.jpg,cat\n", []string{"http://a.com/1.jpg"}},
+		{"images.CSV", "\xef\xbb\xbfurl,label\nhttp://a.com/1.jpg,cat\n", []string{"http://a.com/1.jpg"}},
+	}
+	for _, test := range tests {
+		img, err := readImageFile(writeImages(t, test.name, []byte(test.data)))
+		if err != nil {
+			t.Errorf("%q: %s", test.data, err)
+			continue
+		}
+		if strings.Join(img.Urls, " ") != strings.Join(test.urls, " ") {
+			t.Errorf("%q: urls %q, want %q", test.data, img.Urls, test.urls)
+		}
+	}
+}
+
+func TestReadImageFileSizeLimit(t *testing.T) {
+	defer func(limit int64) { maxManifestSize = limit }(maxManifestSize)
+	data := []byte(`{"urls": ["http://a.com/1.jpg"]}`)
+	maxManifestSize = int64(len(data))
+	if _, err := readImageFile(writeImages(t, "images.json", data)); err != nil {
+		t.Errorf("file at the limit: %s", err)
+	}
+
+	maxManifestSize = int64(len(data)) - 1
+	for _, name := range []string{"images.json", "images.csv"} {
+		_, err := readImageFile(writeImages(t, name, data))
+		var manifestErr *manifestError
+		if !errors.As(err, &manifestErr) || !strings.Contains(err.Error(), "larger than the limit") {
+			t.Errorf("%s over the limit: %v", name, err)
+		}
+	}
+}
+
+func TestReadImageFileErrorsAreLocated(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"{\"urls\": [\n  \"http://a.com/1.jpg\",\n]}", ":3:1: invalid character ']' looking for beginning of value"},
+		{"\xef\xbb\xbf{\"urls\": [\n  \"http://a.com/1.jpg\"\n  \"http://a.com/2.jpg\"]}", ":3:3: invalid character '\"' after array element"},
+		{"{\n  \"urls\": \"http://a.com/1.jpg\"\n}", ":2:30: urls is a string, expected an array"}, // at the end of the value,
+		{"[\"http://a.com/1.jpg\"]", ":1:1: the images file is an array, expected an object"},
+		{"{\"urls\": [", ":1:10: unexpected end of JSON input"},
+	}
+	for _, test := range tests {
+		path := writeImages(t, "images.json", []byte(test.data))
+		_, err := readImageFile(path)
+		if err == nil || err.Error() != path+test.want {
+			t.Errorf("%q: %v, want %s", test.data, err, path+test.want)
+		}
+	}
+}
+
+func TestLineColumn(t *testing.T) {
+	data := []byte("ab\ncd\n\nef")
+	tests := []struct {
+		offset       int64
+		line, column int
+	}{
+		{-1, 1, 1}, {0, 1, 1}, {1, 1, 2}, {3, 2, 1}, {4, 2, 2}, {6, 3, 1}, {8, 4, 2}, {100, 4, 3},
+	}
+	for _, test := range tests {
+		if line, column := lineColumn(data, test.offset); line != test.line || column != test.column {
+			t.Errorf("offset %d: %d:%d, want %d:%d", test.offset, line, column, test.line, test.column)
+		}
+	}
+}
+
+func TestElementOffsets(t *testing.T) {
+	tests := []struct {
+		data string
+		want []int64
+	}{
+		{`{"urls": ["a", {"url": "b"}, 3]}`, []int64{10, 15, 29}},
+		{"{\"labels\": [\"x\"], \"urls\": [\n  \"a\",\n  \"b\"\n]}", []int64{30, 37}},
+		{`{"urls": []}`, nil},
+		{`{"urls": "a"}`, nil},
+		{`["a"]`, nil},
+		{`{"urls": ["a", "b" "c"]}`, []int64{10, 15, 19}}, // scanned as far as it could be
+		{`{"other": {"urls": ["a"]}}`, nil},
+	}
+	for _, test := range tests {
+		got := elementOffsets([]byte(test.data), "urls")
+		if len(got) != len(test.want) {
+			t.Errorf("%s: %v, want %v", test.data, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: %v, want %v", test.data, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestInvalidEntriesAreLocated(t *testing.T) {
+	data := "{\"urls\": [\n  \"http://a.com/1.jpg\",\n  42,\n  {\"url\": \"http://a.com/3.jpg\"}\n]}"
+	img, err := readImageFile(writeImages(t, "images.json", []byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := validateEntries(img)
+	if len(reasons) < 2 || reasons[1] != "line 3 column 3: neither a url nor an object with a url" {
+		t.Errorf("reasons %q", reasons)
+	}
+}
+
+func FuzzReadImageFile(f *testing.F) {
+	f.Add([]byte(`{"urls": ["http://a.com/1.jpg", {"url": "http://a.com/2.jpg", "id": "two"}], "labels": ["cat"]}`))
+	f.Add([]byte("\xef\xbb\xbf{\"urls\": [\n  \"http://a.com/1.jpg\",\n]}"))
+	f.Add([]byte(`{"urls": [42, null, {}], "variants": ["small"]}`))
+	f.Add([]byte(`{"urls": "http://a.com/1.jpg"}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := writeImages(t, "images.json", data)
+		img, err := readImageFile(path)
+		if err != nil {
+			var manifestErr *manifestError
+			if !errors.As(err, &manifestErr) {
+				t.Fatalf("%v is not a manifestError", err)
+			}
+			if manifestErr.line > 0 && manifestErr.line > bytes.Count(data, []byte("\n"))+1 {
+				t.Fatalf("error at line %d of %d lines", manifestErr.line, bytes.Count(data, []byte("\n"))+1)
+			}
+			return
+		}
+		validateEntries(img)
+		if offsets := elementOffsets(bytes.TrimPrefix(data, utf8BOM), "urls"); len(offsets) > len(img.Urls) {
+			t.Fatalf("%d offsets of %d urls", len(offsets), len(img.Urls))
+		}
+	})
+}
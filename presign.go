@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// defaultPresignExpiry is how long a presigned url stays valid, it is signed right before each request
+const defaultPresignExpiry = 15 * time.Minute
+
+// presigner turns the s3://bucket/key and gs://bucket/key urls of a manifest into presigned https urls
+// right before each request, so manifests carry no credentials. S3 urls are signed with the standard AWS
+// credentials chain, and with AWS_ENDPOINT_URL for S3 compatible stores, GCS urls with the service account key
+// of GOOGLE_APPLICATION_CREDENTIALS. With a command, the command presigns every url that is not http(s).
+type presigner struct {
+	command string
+	expiry  time.Duration
+
+	aws     *awsChain
+	gcsOnce sync.Once
+	gcs     *gcsKey
+	gcsErr  error
+}
+
+func newPresigner(command string, expiry time.Duration) *presigner {
+	if expiry <= 0 {
+		expiry = defaultPresignExpiry
+	}
+	return &presigner{command: command, expiry: expiry, aws: newAWSChain()}
+}
+
+// sign is the before request hook replacing the url of the request by its presigned url
+func (p *presigner) sign(req *http.Request) error {
+	if req.URL.Scheme == "http" || req.URL.Scheme == "https" || req.URL.Scheme == schemeRsync || isTorrentURL(req.URL) {
+		return nil
+	}
+
+	var signed string
+	var err error
+	switch {
+	case p.command != "":
+		signed, err = p.run(req.URL.String())
+	case req.URL.Scheme == "s3":
+		signed, err = p.signS3(req.URL, time.Now())
+	case req.URL.Scheme == "gs":
+		signed, err = p.signGCS(req.URL, time.Now())
+	default:
+		return fmt.Errorf("%w %q", download.ErrUnsupportedScheme, req.URL.Scheme)
+	}
+	if err != nil {
+		return fmt.Errorf("presign: %s", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		return fmt.Errorf("presign: %s", err)
+	}
+	req.URL = u
+	req.Host = "" // the host of the signed url
+	return nil
+}
+
+// run presigns a url with the command, it gets the url in SAMPLE_URL and the expiry in seconds in
+// SAMPLE_EXPIRY and prints the presigned url
+func (p *presigner) run(rawurl string) (string, error) {
+	cmd := exec.Command("sh", "-c", p.command)
+	cmd.Env = append(os.Environ(),
+		"SAMPLE_URL="+rawurl,
+		"SAMPLE_EXPIRY="+strconv.Itoa(int(p.expiry/time.Second)),
+	)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	signed := strings.TrimSpace(string(out))
+	if signed == "" {
+		return "", errors.New("the presign command printed no url")
+	}
+	return signed, nil
+}
+
+// signS3 presigns a GET of the object with the query string form of the AWS signature version 4
+func (p *presigner) signS3(u *url.URL, now time.Time) (string, error) {
+	creds, err := p.aws.get()
+	if err != nil {
+		return "", err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("%s is not a s3://bucket/key url", u)
+	}
+
+	region := awsRegion()
+	scheme, host, path, err := s3Endpoint(bucket, key, region)
+	if err != nil {
+		return "", err
+	}
+
+	date := now.UTC().Format("20060102T150405Z")
+	scope := date[:8] + "/" + region + "/s3/aws4_request"
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {creds.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {date},
+		"X-Amz-Expires":       {strconv.Itoa(int(p.expiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	path = uriEncode(path, true)
+	canonical := strings.Join([]string{"GET", path, canonicalQuery(query), "host:" + host, "", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, sha256Hex([]byte(canonical))}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(sigv4Key(creds.SecretAccessKey, date[:8], region, "s3"), toSign))
+	return scheme + "://" + host + path + "?" + canonicalQuery(query) + "&X-Amz-Signature=" + signature, nil
+}
+
+// s3Endpoint returns the scheme, host and path of an object: on the virtual host of its bucket, on the
+// regional endpoint for the buckets with dots, or on AWS_ENDPOINT_URL with the path style of the S3
+// compatible stores
+func s3Endpoint(bucket, key, region string) (string, string, string, error) {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return "", "", "", err
+		}
+		return e.Scheme, e.Host, "/" + bucket + "/" + key, nil
+	}
+	if strings.Contains(bucket, ".") {
+		// the certificate of the virtual host does not cover buckets with dots
+		return "https", "s3." + region + ".amazonaws.com", "/" + bucket + "/" + key, nil
+	}
+	return "https", bucket + ".s3." + region + ".amazonaws.com", "/" + key, nil
+}
+
+// gcsKey is the part of a service account key file used to sign urls
+type gcsKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	key         *rsa.PrivateKey
+}
+
+func loadGCSKey() (*gcsKey, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return nil, errors.New("GOOGLE_APPLICATION_CREDENTIALS is not set")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := &gcsKey{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil || k.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a service account key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if k.key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return k, nil
+	}
+	var ok bool
+	if k.key, ok = parsed.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("%s: not a rsa key", path)
+	}
+	return k, nil
+}
+
+// signGCS presigns a GET of the object with the V4 signature of Cloud Storage
+func (p *presigner) signGCS(u *url.URL, now time.Time) (string, error) {
+	p.gcsOnce.Do(func() { p.gcs, p.gcsErr = loadGCSKey() })
+	if p.gcsErr != nil {
+		return "", p.gcsErr
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("%s is not a gs://bucket/key url", u)
+	}
+
+	const host = "storage.googleapis.com"
+	date := now.UTC().Format("20060102T150405Z")
+	scope := date[:8] + "/auto/storage/goog4_request"
+	query := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {p.gcs.ClientEmail + "/" + scope},
+		"X-Goog-Date":          {date},
+		"X-Goog-Expires":       {strconv.Itoa(int(p.expiry / time.Second))},
+		"X-Goog-SignedHeaders": {"host"},
+	}
+	path := uriEncode("/"+bucket+"/"+key, true)
+	canonical := strings.Join([]string{"GET", path, canonicalQuery(query), "host:" + host, "", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	toSign := strings.Join([]string{"GOOG4-RSA-SHA256", date, scope, sha256Hex([]byte(canonical))}, "\n")
+	digest := sha256.Sum256([]byte(toSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.gcs.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return "https://" + host + path + "?" + canonicalQuery(query) + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// event is a line of the --events stream: a completed job, a periodic progress or the end of the run,
+// each with the progress of the run
+type event struct {
+	Time     time.Time         `json:"time"`
+	Event    string            `json:"event"`
+	Result   *download.Result  `json:"result,omitempty"`
+	Progress download.Progress `json:"progress"`
+}
+
+// progressReporter prints a progress line every --progress interval and writes the --events stream
+type progressReporter struct {
+	mu       sync.Mutex
+	d        *download.Downloader
+	interval time.Duration
+	lines    bool
+	w        io.WriteCloser // nil without --events
+	encoder  *json.Encoder
+	stop     chan struct{}
+}
+
+// newProgressReporter returns the reporter of the --progress and --events options, nil when both are off
+func newProgressReporter(opts options) (*progressReporter, error) {
+	if opts.Progress <= 0 && opts.Events == "" {
+		return nil, nil
+	}
+	p := &progressReporter{interval: opts.Progress, lines: opts.Progress > 0, stop: make(chan struct{})}
+	switch opts.Events {
+	case "":
+	case "-":
+		p.w = nopCloser{os.Stdout}
+	default:
+		f, err := os.OpenFile(opts.Events, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		p.w = f
+	}
+	if p.w != nil {
+		p.encoder = json.NewEncoder(p.w)
+	}
+	if p.interval <= 0 {
+		p.interval = 5 * time.Second // of the progress events
+	}
+	return p, nil
+}
+
+// options attach the reporter to the downloader and emit an event for each completed job
+func (p *progressReporter) options() []download.Option {
+	attach := func(d *download.Downloader) {
+		p.d = d
+		go p.tick()
+	}
+	return []download.Option{attach, download.WithOnComplete(func(r *download.Result) { p.emit("job", r) })}
+}
+
+func (p *progressReporter) tick() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if p.lines {
+				fmt.Println("progress - " + formatProgress(p.d.Progress()))
+			}
+			p.emit("progress", nil)
+		}
+	}
+}
+
+func (p *progressReporter) emit(name string, r *download.Result) {
+	if p.encoder == nil {
+		return
+	}
+	e := &event{Time: time.Now(), Event: name, Result: r, Progress: p.d.Progress()}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.encoder.Encode(e); err != nil {
+		fmt.Println(fmt.Sprintf("events - can't write the event: %s", err))
+	}
+}
+
+// close ends the progress with a done event
+func (p *progressReporter) close() error {
+	close(p.stop)
+	p.emit("done", nil)
+	if p.w == nil {
+		return nil
+	}
+	return p.w.Close()
+}
+
+// formatProgress renders the counts and estimate of a run for the progress lines
+func formatProgress(p download.Progress) string {
+	line := fmt.Sprintf("%d/%d jobs, %s", p.Done, p.Total, humanBytes(p.Bytes))
+	if p.RemainingBytes > 0 {
+		line += fmt.Sprintf(", ~%s left", humanBytes(p.RemainingBytes))
+	}
+	line += fmt.Sprintf(", %s/s", humanBytes(int64(p.Throughput)))
+	if p.ETA >= 0 {
+		line += ", eta " + p.ETA.Round(time.Second).String()
+	}
+	return line
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// The in-toto statement and SLSA provenance types of the --provenance document
+const (
+	inTotoStatement     = "https://in-toto.io/Statement/v1"
+	slsaProvenance      = "https://slsa.dev/provenance/v1"
+	provenanceBuilder   = "https://github.com/lawrence/sample"
+	provenanceBuildType = "https://github.com/lawrence/sample/download/v1"
+)
+
+// provenanceHeaders are the response headers kept for the provenance when --response-headers is not set
+const provenanceHeaders = "content-type,content-length,etag,last-modified"
+
+// statement is an in-toto statement of the outputs of a run, with a SLSA provenance predicate whose
+// resolved dependencies are the urls they were downloaded from
+type statement struct {
+	Type          string              `json:"_type"`
+	Subject       []resourceDesc      `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type resourceDesc struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition struct {
+		BuildType            string         `json:"buildType"`
+		ExternalParameters   interface{}    `json:"externalParameters"`
+		ResolvedDependencies []resourceDesc `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			FinishedOn time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// provenanceParameters are the options of a run its provenance records, those shaping which files were
+// downloaded and how they were checked and converted. The credentials, commands, endpoints, limits and
+// local paths of the run are left out, the document is meant to be shared.
+type provenanceParameters struct {
+	Retries            int         `json:"retries"`
+	NotFound           string      `json:"not_found,omitempty"`
+	Redirects          string      `json:"redirects,omitempty"`
+	Encodings          string      `json:"encodings,omitempty"`
+	Checksums          string      `json:"checksums,omitempty"`
+	MaxFileSize        int64       `json:"max_file_size,omitempty"`
+	ContentDisposition bool        `json:"content_disposition,omitempty"`
+	NameCollision      string      `json:"name_collision,omitempty"`
+	Mirrors            stringsFlag `json:"mirrors,omitempty"`
+	StripParams        string      `json:"strip_params,omitempty"`
+	SortQuery          bool        `json:"sort_query,omitempty"`
+	StripFragment      bool        `json:"strip_fragment,omitempty"`
+	GlobOff            bool        `json:"glob_off,omitempty"`
+	FollowTorrent      bool        `json:"follow_torrent,omitempty"`
+	Zsync              bool        `json:"zsync,omitempty"`
+	PreferWidth        int         `json:"prefer_width,omitempty"`
+	PreferDensity      float64     `json:"prefer_density,omitempty"`
+	Strict             bool        `json:"strict,omitempty"`
+	Include            stringsFlag `json:"include,omitempty"`
+	Exclude            stringsFlag `json:"exclude,omitempty"`
+	Offset             int         `json:"offset,omitempty"`
+	Limit              int         `json:"limit,omitempty"`
+	Sample             int         `json:"sample,omitempty"`
+	Seed               int64       `json:"seed,omitempty"`
+	ShardIndex         int         `json:"shard_index,omitempty"`
+	ShardCount         int         `json:"shard_count,omitempty"`
+	ShardMode          string      `json:"shard_mode,omitempty"`
+	VerifyDecode       bool        `json:"verify_decode,omitempty"`
+	ContentTypeAny     bool        `json:"content_type_any,omitempty"`
+	Animated           string      `json:"animated,omitempty"`
+	SanitizeSVG        bool        `json:"sanitize_svg,omitempty"`
+	RasterizeDPI       int         `json:"rasterize_dpi,omitempty"`
+	NearDup            string      `json:"near_dup,omitempty"`
+	NearDupThreshold   int         `json:"near_dup_threshold,omitempty"`
+	Dataset            bool        `json:"dataset,omitempty"`
+	Split              string      `json:"split,omitempty"`
+}
+
+func newProvenanceParameters(opts options) provenanceParameters {
+	return provenanceParameters{
+		Retries: opts.Retries, NotFound: opts.NotFound, Redirects: opts.Redirects, Encodings: opts.Encodings,
+		Checksums: opts.Checksums, MaxFileSize: opts.MaxFileSize,
+		ContentDisposition: opts.ContentDisposition, NameCollision: opts.NameCollision,
+		Mirrors: opts.Mirrors, StripParams: opts.StripParams, SortQuery: opts.SortQuery, StripFragment: opts.StripFragment,
+		GlobOff: opts.GlobOff, FollowTorrent: opts.FollowTorrent, Zsync: opts.Zsync,
+		PreferWidth: opts.PreferWidth, PreferDensity: opts.PreferDensity, Strict: opts.Strict,
+		Include: opts.Include, Exclude: opts.Exclude, Offset: opts.Offset, Limit: opts.Limit, Sample: opts.Sample, Seed: opts.Seed,
+		ShardIndex: opts.ShardIndex, ShardCount: opts.ShardCount, ShardMode: opts.ShardMode,
+		VerifyDecode: opts.VerifyDecode, ContentTypeAny: opts.ContentTypeAny, Animated: opts.Animated,
+		SanitizeSVG: opts.SanitizeSVG, RasterizeDPI: opts.RasterizeDPI,
+		NearDup: opts.NearDup, NearDupThreshold: opts.NearDupThreshold, Dataset: opts.Dataset, Split: opts.Split,
+	}
+}
+
+// writeProvenance writes the provenance statement of the completed outputs of the results to path, the
+// subjects named relative to its directory
+func writeProvenance(path string, opts options, results []*download.Result) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	st := statement{Type: inTotoStatement, Subject: []resourceDesc{}, PredicateType: slsaProvenance}
+	p := &st.Predicate
+	p.BuildDefinition.BuildType = provenanceBuildType
+	p.BuildDefinition.ExternalParameters = map[string]interface{}{"options": newProvenanceParameters(opts)}
+	p.BuildDefinition.ResolvedDependencies = []resourceDesc{}
+	p.RunDetails.Builder.ID = provenanceBuilder
+	p.RunDetails.Builder.Version = map[string]string{"sample": version}
+	p.RunDetails.Metadata.FinishedOn = time.Now().UTC()
+
+	sorted := append([]*download.Result(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	for _, r := range sorted {
+		if r.Path == "" || r.Status != download.StatusOK && r.Status != download.StatusSkipped {
+			continue
+		}
+		digest := map[string]string{}
+		for algorithm, sum := range r.Checksums {
+			digest[algorithm] = sum
+		}
+		digest[download.ChecksumSHA256] = r.SHA256
+		if r.SHA256 == "" {
+			sums, _, err := download.HashFile(r.Path, download.ChecksumSHA256)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			digest[download.ChecksumSHA256] = sums[download.ChecksumSHA256]
+		}
+		st.Subject = append(st.Subject, resourceDesc{Name: relativeName(dir, r.Path), Digest: digest})
+
+		dep := resourceDesc{URI: r.URL, Digest: digest, Annotations: map[string]string{}}
+		if r.Source != "" {
+			dep.Annotations["source"] = r.Source
+		}
+		for name, value := range r.Headers {
+			dep.Annotations["header."+name] = value
+		}
+		if len(dep.Annotations) == 0 {
+			dep.Annotations = nil
+		}
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, dep)
+	}
+
+	content, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
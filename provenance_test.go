@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestProvenanceRecordsOnlyTheParametersOfTheDownloads(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "1.jpg")
+	if err := ioutil.WriteFile(file, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := leakyOptions(filepath.Join(dir, "private-out-dir"))
+	opts.CookieJar, opts.SignKey, opts.OAuth2TokenURL = "/home/me/cookies.txt", "/home/me/sign.key", "https://auth/token?client_secret=s"
+	opts.StripParams, opts.Include = "utm_source", stringsFlag{"*.jpg"}
+	results := []*download.Result{{Key: 1, URL: "http://example.com/1.jpg", Path: file, Status: download.StatusOK}}
+
+	path := filepath.Join(dir, "provenance.json")
+	if err := writeProvenance(path, opts, results); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range append(leakedSecrets, "private-out-dir", "cookies.txt", "sign.key", "client_secret") {
+		if strings.Contains(string(data), leak) {
+			t.Errorf("the provenance has %s", leak)
+		}
+	}
+
+	var st statement
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatal(err)
+	}
+	params, _ := st.Predicate.BuildDefinition.ExternalParameters.(map[string]interface{})["options"].(map[string]interface{})
+	if params["retries"] != 3.0 || params["strip_params"] != "utm_source" || params["include"] == nil {
+		t.Errorf("parameters %v", params)
+	}
+	deps := st.Predicate.BuildDefinition.ResolvedDependencies
+	if len(st.Subject) != 1 || len(deps) != 1 || deps[0].URI != "http://example.com/1.jpg" || deps[0].Digest[download.ChecksumSHA256] == "" {
+		t.Errorf("subjects %+v, dependencies %+v", st.Subject, deps)
+	}
+}
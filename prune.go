@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// prune deletes the files of the output directory that no entry of the images file produced, or only
+// lists them with --prune-dry-run. Nothing is deleted when some jobs of the run did not complete.
+func prune(rep *report, imageFilePaths []string) error {
+	if failed := rep.failed(); failed > 0 && !rep.Options.PruneDryRun {
+		fmt.Println(fmt.Sprintf("prune - skipped, %d jobs did not complete", failed))
+		return nil
+	}
+	// every shard of the manifest, the shards may share the output directory
+	jobs, _, err := manifestJobs(rep.Options, imageFilePaths...)
+	if err != nil {
+		return err
+	}
+	return pruneOutputs(rep.Options.OutDir, jobs, rep.Results, rep.Options.PruneDryRun)
+}
+
+// pruneOutputs removes the output files under outDir that none of the jobs writes, see strayOutputs
+func pruneOutputs(outDir string, jobs []*download.Job, results []*download.Result, dryRun bool) error {
+	stray, err := strayOutputs(outDir, jobs, results)
+	if err != nil {
+		return err
+	}
+	for _, path := range stray {
+		if dryRun {
+			fmt.Println(fmt.Sprintf("prune - would remove %s", path))
+		} else if err := os.Remove(path); err != nil {
+			return err
+		} else {
+			fmt.Println(fmt.Sprintf("prune - removed %s", path))
+		}
+	}
+	if dryRun {
+		fmt.Println(fmt.Sprintf("prune - %d files would be removed", len(stray)))
+	} else {
+		fmt.Println(fmt.Sprintf("prune - %d files removed", len(stray)))
+	}
+	return nil
+}
+
+// strayOutputs returns the output files under outDir that none of the jobs writes, nor the results of
+// the run, whose files can be named otherwise by the response. Only the files named like outputs are
+// considered, <key> with the extension of an output or with ids any .jpg, and hidden directories are not
+// entered, so the indexes, summaries and quarantine kept in the output directory are left out.
+func strayOutputs(outDir string, jobs []*download.Job, results []*download.Result) ([]string, error) {
+	outDir = filepath.Clean(outDir)
+	keep := make(map[string]bool, len(jobs))
+	ids := false // the manifest names its outputs, any .jpg file may then be a past one
+	exts := map[string]bool{download.DefaultExt: true}
+	for _, j := range jobs {
+		keep[download.OutputPath(outDir, j)] = true
+		ids = ids || j.ID != ""
+		exts[download.JobExt(j)] = true
+	}
+	for _, r := range results {
+		if r.Path != "" {
+			keep[filepath.Clean(r.Path)] = true
+		}
+	}
+
+	var stray []string
+	err := filepath.Walk(outDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != outDir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := outputExt(info.Name(), exts)
+		if ext != "" && (isOutputName(info.Name(), ext) || ids && ext == download.DefaultExt) && !keep[path] {
+			stray = append(stray, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return stray, err
+}
+
+// isOutputName reports whether name is the name of an output file, <key> and its extension
+func isOutputName(name, ext string) bool {
+	key, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+	return strings.HasSuffix(name, ext) && err == nil && key >= 0
+}
+
+// outputExt returns the longest of the extensions of the outputs name ends with, empty when none
+func outputExt(name string, exts map[string]bool) string {
+	longest := ""
+	for ext := range exts {
+		if strings.HasSuffix(name, ext) && len(ext) > len(longest) {
+			longest = ext
+		}
+	}
+	return longest
+}
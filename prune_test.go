@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestPruneKeepsTheOutputsNamedByTheResponse(t *testing.T) {
+	dir := t.TempDir()
+	jobs := []*download.Job{{Key: 1, URL: "http://a.com/1"}, {Key: 2, ID: "two", URL: "http://a.com/2"}}
+	// job 2 was named by the Content-Disposition of its response
+	results := []*download.Result{
+		{Key: 1, Path: filepath.Join(dir, "1.jpg"), Status: download.StatusOK},
+		{Key: 2, ID: "two", Path: filepath.Join(dir, "cat.jpg"), Status: download.StatusOK},
+	}
+	for _, name := range []string{"1.jpg", "cat.jpg", "old.jpg", "3.jpg", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneOutputs(dir, jobs, results, false); err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range map[string]bool{"1.jpg": true, "cat.jpg": true, "old.jpg": false, "3.jpg": false, "notes.txt": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept && err != nil {
+			t.Errorf("%s removed", name)
+		} else if !kept && !os.IsNotExist(err) {
+			t.Errorf("%s kept", name)
+		}
+	}
+}
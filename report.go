@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/lawrence/sample/download"
+)
+
+// report is the result file of a run
+type report struct {
+	Options options `json:"options"`
+	// Secrets are the flags of the secret options of the run, given again to retry it
+	Secrets []string `json:"secrets,omitempty"`
+	// Filtered is the number of results of the entries left out by --include and --exclude
+	Filtered int                `json:"filtered,omitempty"`
+	Results  []*download.Result `json:"results"`
+}
+
+// failed returns the number of jobs that did not complete
+func (r *report) failed() int {
+	count := 0
+	for _, res := range r.Results {
+		if res.Status != download.StatusOK && res.Status != download.StatusSkipped {
+			count++
+		}
+	}
+	return count
+}
+
+// merge replaces the results of the report with the retried ones of the same key
+func (r *report) merge(retried []*download.Result) {
+	byKey := make(map[int]*download.Result, len(retried))
+	for _, res := range retried {
+		byKey[res.Key] = res
+	}
+	for i, res := range r.Results {
+		if updated, ok := byKey[res.Key]; ok {
+			r.Results[i] = updated
+		}
+	}
+}
+
+// writeReport saves the report as json to path, results are ordered by job key
+func writeReport(r *report, path string) error {
+	sort.Slice(r.Results, func(i, j int) bool { return r.Results[i].Key < r.Results[j].Key })
+	r.Secrets = secretFlags(r.Options)
+	r.Filtered = 0
+	for _, res := range r.Results {
+		if res.Meta["filtered"] == "true" {
+			r.Filtered++
+		}
+	}
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// readReport loads a report previously written by writeReport
+func readReport(path string) (*report, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &report{}
+	if err := json.Unmarshal(content, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// finish writes the dataset summary in dataset mode, the --sums-file, the --provenance and the report if
+// a path was given, all signed with --sign, it returns an error when some jobs did not complete
+func finish(r *report, path string) error {
+	if r.Options.Dataset {
+		if err := writeDatasetSummary(r.Options.OutDir, r.Results); err != nil {
+			return err
+		}
+	}
+	var signed []string
+	if r.Options.SumsFile != "" {
+		if err := writeSums(r.Options.SumsFile, r.Options.SumsFormat, r.Results); err != nil {
+			return err
+		}
+		signed = append(signed, r.Options.SumsFile)
+	}
+	if r.Options.Provenance != "" {
+		if err := writeProvenance(r.Options.Provenance, r.Options, r.Results); err != nil {
+			return err
+		}
+		signed = append(signed, r.Options.Provenance)
+	}
+	if path != "" {
+		if err := writeReport(r, path); err != nil {
+			return err
+		}
+		signed = append(signed, path)
+	}
+	if r.Options.Sign != "" {
+		for _, file := range signed {
+			sigPath, err := signFile(r.Options.Sign, r.Options.SignKey, file)
+			if err != nil {
+				return err
+			}
+			fmt.Println(fmt.Sprintf("sign - %s signed in %s", file, sigPath))
+		}
+	}
+	if failed := r.failed(); failed > 0 {
+		return fmt.Errorf("%d of %d jobs did not complete", failed, len(r.Results))
+	}
+	return nil
+}
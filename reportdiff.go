@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Kinds of the changes of a url between two runs
+const (
+	changeFailing   = "failing"
+	changeRecovered = "recovered"
+	changeSize      = "size"
+	changeContent   = "content"
+	changeAdded     = "added"
+	changeRemoved   = "removed"
+)
+
+// runChange is how a url changed between two runs
+type runChange struct {
+	Kind   string `json:"kind"`
+	URL    string `json:"url"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// reportDiff compares the reports of two runs of a manifest, e.g. of the same scheduled sync, by url:
+// the urls newly failing or recovered, and those downloaded by both whose size or sha256 changed, which
+// tells an upstream asset changed without its url. The urls only one of the runs has are listed too.
+// With --fail the diff fails when a url is newly failing or its content changed, so it can alert.
+func reportDiff(args []string) error {
+	fs := newFlagSet("report diff")
+	asJSON := fs.Bool("json", false, "print the changes as a json array")
+	fail := fs.Bool("fail", false, "exit with an error when a url newly fails or its content changed")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("please supply the reports of the two runs, the older one first")
+	}
+	before, err := readReport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := readReport(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	changes := diffRuns(before.Results, after.Results)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if changes == nil {
+			changes = []runChange{}
+		}
+		if err := enc.Encode(changes); err != nil {
+			return err
+		}
+	} else {
+		printRunChanges(changes)
+	}
+	alerts := 0
+	for _, c := range changes {
+		if c.Kind == changeFailing || c.Kind == changeContent {
+			alerts++
+		}
+	}
+	if *fail && alerts > 0 {
+		return fmt.Errorf("%d urls newly failing or changed", alerts)
+	}
+	return nil
+}
+
+// diffRuns returns the changes of the urls of the results of two runs, in the order of the kinds then
+// of the urls. The invalid entries are left out, a url appearing twice is compared once.
+func diffRuns(before, after []*download.Result) []runChange {
+	old := resultsByURL(before)
+	current := resultsByURL(after)
+	var changes []runChange
+	for u, b := range old {
+		a, ok := current[u]
+		if !ok {
+			changes = append(changes, runChange{Kind: changeRemoved, URL: u, Before: b.Status})
+			continue
+		}
+		bOK, aOK := resultOK(b), resultOK(a)
+		switch {
+		case bOK && !aOK:
+			changes = append(changes, runChange{Kind: changeFailing, URL: u, Before: b.Status, After: a.Status + ": " + a.Error})
+		case !bOK && aOK:
+			changes = append(changes, runChange{Kind: changeRecovered, URL: u, Before: b.Status, After: a.Status})
+		case b.Status == download.StatusOK && a.Status == download.StatusOK:
+			if b.SHA256 != "" && a.SHA256 != "" && b.SHA256 != a.SHA256 {
+				changes = append(changes, runChange{Kind: changeContent, URL: u, Before: b.SHA256, After: a.SHA256})
+			} else if b.Bytes != a.Bytes {
+				changes = append(changes, runChange{Kind: changeSize, URL: u, Before: humanBytes(b.Bytes), After: humanBytes(a.Bytes)})
+			}
+		}
+	}
+	for u, a := range current {
+		if _, ok := old[u]; !ok {
+			changes = append(changes, runChange{Kind: changeAdded, URL: u, After: a.Status})
+		}
+	}
+	order := map[string]int{changeFailing: 0, changeContent: 1, changeSize: 2, changeRecovered: 3, changeAdded: 4, changeRemoved: 5}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return order[changes[i].Kind] < order[changes[j].Kind]
+		}
+		return changes[i].URL < changes[j].URL
+	})
+	return changes
+}
+
+// resultsByURL indexes the results of the valid entries that were not filtered out by url, the first one
+// of a url is kept
+func resultsByURL(results []*download.Result) map[string]*download.Result {
+	byURL := map[string]*download.Result{}
+	for _, r := range results {
+		if r.Meta["invalid"] == "true" || r.Meta["filtered"] == "true" {
+			continue
+		}
+		if _, ok := byURL[r.URL]; !ok {
+			byURL[r.URL] = r
+		}
+	}
+	return byURL
+}
+
+// resultOK reports whether a result is a download or a skip, the unprocessed ones are not failures
+func resultOK(r *download.Result) bool {
+	return r.Status == download.StatusOK || r.Status == download.StatusSkipped || r.Status == download.StatusUnprocessed
+}
+
+// printRunChanges prints the changes with a count by kind
+func printRunChanges(changes []runChange) {
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+		return
+	}
+	counts := map[string]int{}
+	for _, c := range changes {
+		counts[c.Kind]++
+		line := fmt.Sprintf("%-10s %s", c.Kind, c.URL)
+		switch {
+		case c.Before != "" && c.After != "":
+			line += fmt.Sprintf(": %s -> %s", c.Before, c.After)
+		case c.Before != "":
+			line += ": " + c.Before
+		case c.After != "":
+			line += ": " + c.After
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+	fmt.Println(fmt.Sprintf("%d failing, %d content changed, %d size changed, %d recovered, %d added, %d removed",
+		counts[changeFailing], counts[changeContent], counts[changeSize], counts[changeRecovered], counts[changeAdded], counts[changeRemoved]))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// retry re-runs the failed, timed out and unprocessed jobs of a previous report with the same options.
+// The jobs keep their original keys so outputs land in the same files, and the report is updated in place.
+// The secret options of the run, not saved in the report, are given again by their flags.
+func retry(args []string) error {
+	fs := newFlagSet("retry")
+	reportPath := fs.String("report", "", "result file of the run to retry")
+	given := &options{}
+	for _, secret := range secretOptions(given) {
+		usage := "as given to the run, not saved in its report"
+		if secret.env != "" {
+			usage += ", defaults to $" + secret.env
+		}
+		fs.StringVar(secret.value, secret.flag, "", usage)
+	}
+	fs.Parse(args)
+
+	if *reportPath == "" {
+		return errors.New("please supply the --report file to retry")
+	}
+
+	rep, err := readReport(*reportPath)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	if rep.Options, missing = restoreSecrets(rep.Options, rep.Secrets, *given); len(missing) > 0 {
+		return fmt.Errorf("the secret options of the run are not saved in its report, give %s again to retry it", strings.Join(missing, ", "))
+	}
+
+	jobs := jobsFromResults(rep.Results)
+	if len(jobs) == 0 {
+		fmt.Println("nothing to retry")
+		return nil
+	}
+
+	started := time.Now()
+	results, err := process(rep.Options, jobs)
+	if err != nil {
+		return err
+	}
+	recordRun(rep.Options, started, results)
+
+	rep.merge(results)
+	err = finish(rep, *reportPath)
+	notifyRun(rep.Options, started, rep.Results, err)
+	return err
+}
+
+// jobsFromResults builds jobs for the failed, timed out and unprocessed results, keeping their original keys
+func jobsFromResults(results []*download.Result) []*download.Job {
+	var jobs []*download.Job
+	for _, res := range results {
+		switch res.Status {
+		case download.StatusFailed, download.StatusTimeout, download.StatusUnprocessed:
+			jobs = append(jobs, res.Job())
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// rewriteRules are the --rewrite-rules of the manifest urls: a table mapping hosts to others, e.g.
+// internal mirrors, then regexp rules applied in turn
+type rewriteRules struct {
+	hosts []hostMapping // the most specific pattern first
+	rules []urlSubstitution
+}
+
+type hostMapping struct {
+	pattern string
+	scheme  string // of the target, empty to keep the one of the url
+	host    string
+}
+
+// rewriteFile is the json of a --rewrite-rules file, a regexp rule replaces all its matches and its
+// replacement refers to the groups as $1 or ${name}:
+//
+//	{
+//	  "hosts": {"cdn.example.com": "mirror.internal:8080", "*.img.example.com": "https://img-mirror.internal"},
+//	  "rules": [{"match": "_small\\.jpg$", "replace": "_large.jpg"}]
+//	}
+type rewriteFile struct {
+	Hosts map[string]string `json:"hosts"`
+	Rules []struct {
+		Match   string `json:"match"`
+		Replace string `json:"replace"`
+	} `json:"rules"`
+}
+
+// loadRewriteRules reads a --rewrite-rules file, nil when path is empty
+func loadRewriteRules(path string) (*rewriteRules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rewriteFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	r := &rewriteRules{}
+	for pattern, target := range file.Hosts {
+		m := hostMapping{pattern: strings.ToLower(strings.TrimSpace(pattern)), host: target}
+		if i := strings.Index(target, "://"); i >= 0 {
+			m.scheme, m.host = target[:i], target[i+3:]
+		}
+		if m.pattern == "" || m.host == "" || strings.ContainsAny(m.host, "/?#") {
+			return nil, fmt.Errorf("%s: invalid host mapping %q: %q", path, pattern, target)
+		}
+		r.hosts = append(r.hosts, m)
+	}
+	// exact hosts before wildcards, longer wildcards before shorter ones, as the host config
+	sort.Slice(r.hosts, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(r.hosts[i].pattern, "*."), strings.HasPrefix(r.hosts[j].pattern, "*.")
+		if wi != wj {
+			return wj
+		}
+		if len(r.hosts[i].pattern) != len(r.hosts[j].pattern) {
+			return len(r.hosts[i].pattern) > len(r.hosts[j].pattern)
+		}
+		return r.hosts[i].pattern < r.hosts[j].pattern
+	})
+	for i, rule := range file.Rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %s", path, i, err)
+		}
+		r.rules = append(r.rules, urlSubstitution{re: re, replacement: rule.Replace, global: true})
+	}
+	return r, nil
+}
+
+// rewrite returns the url with its host mapped, then the rules applied
+func (r *rewriteRules) rewrite(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		for _, m := range r.hosts {
+			if (hostPatterns{m.pattern}).matches(u) {
+				u.Host = m.host
+				if m.scheme != "" {
+					u.Scheme = m.scheme
+				}
+				raw = u.String()
+				break
+			}
+		}
+	}
+	for _, s := range r.rules {
+		raw = s.apply(raw)
+	}
+	return raw
+}
+
+// rewriteJobs applies the rules to the urls of the jobs but the invalid ones
+func rewriteJobs(jobs []*download.Job, r *rewriteRules, invalid map[int]string) {
+	if r == nil {
+		return
+	}
+	for _, j := range jobs {
+		if _, ok := invalid[j.Key]; !ok {
+			setJobURL(j, r.rewrite(j.URL))
+		}
+	}
+}
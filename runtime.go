@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// runtimeStats are the figures of the process reported by --runtime-stats and in GET /stats
+type runtimeStats struct {
+	Goroutines int `json:"goroutines"`
+	// HeapAlloc is the size of the live and not yet collected objects, HeapSys what the heap took
+	// from the system and Sys all the memory the runtime took
+	HeapAlloc uint64 `json:"heap_alloc"`
+	HeapSys   uint64 `json:"heap_sys"`
+	Sys       uint64 `json:"sys"`
+	GCs       uint32 `json:"gcs"`
+	// PauseTotal is the time the collections stopped the world since the start
+	PauseTotal time.Duration `json:"pause_total"`
+}
+
+func readRuntimeStats() runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return runtimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  m.HeapAlloc,
+		HeapSys:    m.HeapSys,
+		Sys:        m.Sys,
+		GCs:        m.NumGC,
+		PauseTotal: time.Duration(m.PauseTotalNs),
+	}
+}
+
+// logRuntimeStats prints the runtime stats every interval until stop is closed
+func logRuntimeStats(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			st := readRuntimeStats()
+			fmt.Println(fmt.Sprintf("runtime - %d goroutines, heap %s of %s, sys %s, %d gcs, %s paused",
+				st.Goroutines, humanBytes(int64(st.HeapAlloc)), humanBytes(int64(st.HeapSys)), humanBytes(int64(st.Sys)),
+				st.GCs, st.PauseTotal.Round(time.Microsecond)))
+		}
+	}
+}
+
+// servePprof serves the net/http/pprof profiles under /debug/pprof/ on addr. It is a listener of its own
+// so the profiles are not exposed with the api, addr is meant to be a loopback or private address.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	fmt.Println(fmt.Sprintf("pprof - serving the profiles on %s/debug/pprof/", addr))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Println(fmt.Sprintf("pprof - %s", err))
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Bounds of the parts of the S3 multipart uploads, all but the last part must have the minimum size
+const (
+	defaultS3PartSize = 8 << 20
+	minS3PartSize     = 5 << 20
+	maxS3PartSize     = 5 << 30
+	maxS3Parts        = 10000
+)
+
+// Defaults of the S3 requests: the time one has when --timeout is not set, and the delay before a
+// retry of a part, multiplied by the attempt
+const (
+	s3Timeout    = 5 * time.Minute
+	s3RetryDelay = time.Second
+)
+
+// s3Sink uploads each download to the bucket and prefix of --s3-out, signed with the AWS credentials
+// chain. The content is read in parts of --s3-part-size, from the file or, with --stream-through, from
+// the body as it arrives, so a single part is held in memory by upload. An object smaller than a part
+// is sent with a PUT, a larger one with the multipart upload API: a part failing on the network, a 5xx
+// or a 429 is sent again alone, up to --s3-retries times, and an upload that fails for good is aborted
+// so no part is left billed.
+type s3Sink struct {
+	client   *http.Client
+	chain    *awsChain
+	region   string
+	bucket   string
+	prefix   string
+	partSize int64
+	parts    *sync.Pool // of the part buffers, reused by the uploads as they are sent again on retries
+	retries  int
+	outDir   string
+}
+
+// s3Upload is the reply to the creation of a multipart upload
+type s3Upload struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// s3CompletedPart is a part listed by the completion of a multipart upload
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func newS3Sink(opts options) (*s3Sink, error) {
+	u, err := url.Parse(opts.S3Out)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("--s3-out %q is not a s3://bucket/prefix url", opts.S3Out)
+	}
+	region := opts.SigV4Region
+	if region == "" {
+		region = awsRegion()
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = s3Timeout
+	}
+	partSize := opts.S3PartSize
+	if partSize == 0 {
+		partSize = defaultS3PartSize
+	}
+	return &s3Sink{
+		client:   &http.Client{Timeout: timeout},
+		chain:    newAWSChain(),
+		region:   region,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		partSize: partSize,
+		parts:    &sync.Pool{New: func() interface{} { return make([]byte, partSize) }},
+		retries:  opts.S3Retries,
+		outDir:   opts.OutDir,
+	}, nil
+}
+
+func (s *s3Sink) Put(r *download.Result) error {
+	if r.Path == "" {
+		return nil
+	}
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.PutStream(r, sinkPath(s.outDir, r.Path), file)
+}
+
+// PutStream uploads body as the object of the output at name, below the prefix
+func (s *s3Sink) PutStream(r *download.Result, name string, body io.Reader) error {
+	key := path.Join(s.prefix, name)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part := s.parts.Get().([]byte)
+	defer s.parts.Put(part)
+	n, err := io.ReadFull(body, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if _, err := s.send(http.MethodPut, key, nil, part[:n], contentType); err != nil {
+			return fmt.Errorf("s3: %w", err)
+		}
+	} else if err != nil {
+		return err
+	} else if err := s.multipart(key, contentType, part, body); err != nil {
+		return fmt.Errorf("s3: %w", err)
+	}
+	r.SetMeta("s3", "s3://"+s.bucket+"/"+key)
+	return nil
+}
+
+// multipart uploads the object of the full first part and the rest of body, aborting the upload when
+// a part or the completion fails
+func (s *s3Sink) multipart(key, contentType string, part []byte, body io.Reader) error {
+	reply, err := s.send(http.MethodPost, key, url.Values{"uploads": {""}}, nil, contentType)
+	if err != nil {
+		return err
+	}
+	upload := &s3Upload{}
+	if err := xml.Unmarshal(reply, upload); err != nil || upload.UploadID == "" {
+		return fmt.Errorf("no upload id in the reply to the creation of the upload of %s", key)
+	}
+
+	complete := &s3CompleteUpload{}
+	n := len(part)
+	for number := 1; n > 0; number++ {
+		if number > maxS3Parts {
+			err = fmt.Errorf("more than %d parts of --s3-part-size", maxS3Parts)
+			break
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload.UploadID}}
+		var etag string
+		if etag, err = s.sendPart(key, query, part[:n]); err != nil {
+			break
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: number, ETag: etag})
+		n, err = io.ReadFull(body, part)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			if n == 0 {
+				break
+			}
+		} else if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var data []byte
+		if data, err = xml.Marshal(complete); err == nil {
+			// the completion may fail with an error document in a 200
+			reply, err = s.send(http.MethodPost, key, url.Values{"uploadId": {upload.UploadID}}, data, "application/xml")
+			if err == nil && bytes.Contains(reply, []byte("<Error>")) {
+				err = fmt.Errorf("completion of the upload of %s failed: %s", key, reply)
+			}
+		}
+	}
+	if err != nil {
+		if _, abortErr := s.send(http.MethodDelete, key, url.Values{"uploadId": {upload.UploadID}}, nil, ""); abortErr != nil {
+			fmt.Println(fmt.Sprintf("s3 - can't abort the upload of %s: %s", key, abortErr))
+		}
+		return err
+	}
+	return nil
+}
+
+// sendPart sends a part of a multipart upload and returns its ETag
+func (s *s3Sink) sendPart(key string, query url.Values, part []byte) (string, error) {
+	var etag string
+	err := s.retry(func() (bool, error) {
+		res, err := s.request(http.MethodPut, key, query, part, "")
+		if err != nil {
+			return true, err
+		}
+		defer res.Body.Close()
+		io.Copy(ioutil.Discard, res.Body)
+		if retry, err := checkS3Status(res); err != nil {
+			return retry, fmt.Errorf("part %s of %s: %w", query.Get("partNumber"), key, err)
+		}
+		etag = res.Header.Get("ETag")
+		return false, nil
+	})
+	return etag, err
+}
+
+// send sends a request, retried like the parts, and returns the body of its reply
+func (s *s3Sink) send(method, key string, query url.Values, body []byte, contentType string) ([]byte, error) {
+	var reply []byte
+	err := s.retry(func() (bool, error) {
+		res, err := s.request(method, key, query, body, contentType)
+		if err != nil {
+			return true, err
+		}
+		defer res.Body.Close()
+		if reply, err = ioutil.ReadAll(io.LimitReader(res.Body, 1<<20)); err != nil {
+			return true, err
+		}
+		if retry, err := checkS3Status(res); err != nil {
+			return retry, fmt.Errorf("%s %s: %w", method, key, err)
+		}
+		return false, nil
+	})
+	return reply, err
+}
+
+// retry calls attempt until it succeeds, fails with an error not worth another attempt or the retries
+// are exhausted
+func (s *s3Sink) retry(attempt func() (bool, error)) error {
+	for i := 1; ; i++ {
+		retry, err := attempt()
+		if err == nil || !retry || i > s.retries {
+			return err
+		}
+		fmt.Println(fmt.Sprintf("s3 - Retrying: %s", err))
+		time.Sleep(s3RetryDelay * time.Duration(i))
+	}
+}
+
+// request sends a request of the object key with the sigv4 signature of body
+func (s *s3Sink) request(method, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	scheme, host, objectPath, err := s3Endpoint(s.bucket, key, s.region)
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{Scheme: scheme, Host: host, Path: objectPath, RawQuery: canonicalQuery(query)}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	creds, err := s.chain.get()
+	if err != nil {
+		return nil, err
+	}
+	signPayload(req, creds, s.region, "s3", time.Now(), sha256Hex(body))
+	return s.client.Do(req)
+}
+
+// checkS3Status returns the error of a reply that is not a success, and whether it is worth another attempt
+func checkS3Status(res *http.Response) (bool, error) {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+	return retry, &download.HTTPStatusError{Code: res.StatusCode, Status: res.Status}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+const (
+	infectedQuarantine = "quarantine"
+	infectedDelete     = "delete"
+)
+
+// clamdChunkSize is the size of the INSTREAM chunks, it must stay below the StreamMaxLength of clamd
+const clamdChunkSize = 64 * 1024
+
+// scanClamd returns a post process stage that streams each downloaded file to the clamd daemon at addr.
+// addr is a unix socket path or a host:port, infected files are moved to quarantineDir or deleted
+// depending on the action and their job is marked as failed.
+func scanClamd(addr, action, quarantineDir string) func(*download.Result) error {
+	return func(r *download.Result) error {
+		verdict, err := clamdScan(addr, r.Path)
+		if err != nil {
+			return fmt.Errorf("clamd: %s", err)
+		}
+		if verdict == "" {
+			return nil
+		}
+
+		if action == infectedDelete {
+			err = os.Remove(r.Path)
+		} else if err = os.MkdirAll(quarantineDir, 0755); err == nil {
+			err = os.Rename(r.Path, filepath.Join(quarantineDir, filepath.Base(r.Path)))
+		}
+		if err != nil {
+			return fmt.Errorf("infected with %s, %s failed: %s", verdict, action, err)
+		}
+		r.Path = ""
+		return fmt.Errorf("infected with %s", verdict)
+	}
+}
+
+// clamdScan sends the file at path with the INSTREAM command and returns the signature name if it is infected
+func clamdScan(addr, path string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(append(size, buf[:n]...)); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// the reply looks like "stream: OK" or "stream: Eicar-Signature FOUND"
+	reply = strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("unexpected reply %q", reply)
+	}
+}
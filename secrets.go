@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretTimeout is the time a secret manager has to answer
+const secretTimeout = 10 * time.Second
+
+// secretRefPattern matches the secret references of a value, secretref://<store>/<path>[#<key>]
+var secretRefPattern = regexp.MustCompile(`secretref://[^\s"',]+`)
+
+// secrets caches the resolved references, a secret manager is asked once per run. Failures are not
+// cached so a transient one is retried on the next use.
+var secrets = struct {
+	sync.Mutex
+	values map[string]string
+}{values: map[string]string{}}
+
+// expandSecrets expands the $VARIABLES of a value from the environment, then its secret references,
+// see secretRefs
+func expandSecrets(value string) (string, error) {
+	return secretRefs(os.ExpandEnv(value))
+}
+
+// secretRefs replaces the secret references of a value by the secret they point to, so credentials
+// don't need to be in flags or config files:
+//
+//	secretref://env/NAME                   the NAME env variable
+//	secretref://file/run/secrets/token     the content of the absolute path, e.g. a mounted secret
+//	secretref://keychain/service#account   the OS keychain: security on macOS, secret-tool on linux
+//	secretref://vault/secret/data/app#key  a key of a Vault kv secret, with $VAULT_ADDR and $VAULT_TOKEN
+//	secretref://aws-sm/name#key            an AWS Secrets Manager secret, a key of it when it is json
+func secretRefs(value string) (string, error) {
+	var failed error
+	expanded := secretRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		secret, err := resolveSecret(ref)
+		if err != nil && failed == nil {
+			failed = err
+		}
+		return secret
+	})
+	if failed != nil {
+		return "", failed
+	}
+	return expanded, nil
+}
+
+func resolveSecret(ref string) (string, error) {
+	secrets.Lock()
+	secret, ok := secrets.values[ref]
+	secrets.Unlock()
+	if ok {
+		return secret, nil
+	}
+
+	rest := strings.TrimPrefix(ref, "secretref://")
+	key := ""
+	if i := strings.LastIndex(rest, "#"); i >= 0 {
+		rest, key = rest[:i], rest[i+1:]
+	}
+	store, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		store, path = rest[:i], rest[i+1:]
+	}
+	if path == "" {
+		return "", fmt.Errorf("%s: expected secretref://<store>/<path>", ref)
+	}
+	var err error
+	switch store {
+	case "env":
+		var ok bool
+		if secret, ok = os.LookupEnv(path); !ok {
+			err = fmt.Errorf("%s is not set", path)
+		}
+	case "file":
+		var data []byte
+		data, err = ioutil.ReadFile("/" + strings.TrimPrefix(path, "/"))
+		secret = strings.TrimRight(string(data), "\r\n")
+	case "keychain":
+		secret, err = keychainSecret(path, key)
+		key = ""
+	case "vault":
+		secret, err = vaultSecret(path, key)
+		key = ""
+	case "aws-sm":
+		secret, err = awsSecret(path)
+	default:
+		err = fmt.Errorf("unknown secret store %q, expected env, file, keychain, vault or aws-sm", store)
+	}
+	if err == nil && key != "" {
+		secret, err = jsonKey(secret, key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", ref, err)
+	}
+
+	secrets.Lock()
+	secrets.values[ref] = secret
+	secrets.Unlock()
+	return secret, nil
+}
+
+// keychainSecret reads a generic password of the OS keychain by service and, optionally, account
+func keychainSecret(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		args := []string{"find-generic-password", "-w", "-s", service}
+		if account != "" {
+			args = append(args, "-a", account)
+		}
+		cmd = exec.Command("security", args...)
+	case "linux", "freebsd", "openbsd":
+		args := []string{"lookup", "service", service}
+		if account != "" {
+			args = append(args, "account", account)
+		}
+		cmd = exec.Command("secret-tool", args...)
+	default:
+		return "", fmt.Errorf("no keychain support on %s", runtime.GOOS)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// vaultSecret reads a key of a secret of the Vault at $VAULT_ADDR, of a kv version 1 or 2 engine
+func vaultSecret(path, key string) (string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", errors.New("$VAULT_ADDR and $VAULT_TOKEN must be set")
+	}
+	if key == "" {
+		return "", errors.New("expected the #key of the vault secret")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	body, err := secretRequest(req)
+	if err != nil {
+		return "", err
+	}
+	reply := &struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, reply); err != nil {
+		return "", err
+	}
+	data := reply.Data
+	if nested, ok := data["data"]; ok { // kv version 2 nests the secret
+		var v2 map[string]json.RawMessage
+		if json.Unmarshal(nested, &v2) == nil {
+			data = v2
+		}
+	}
+	raw, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("no key %q", key)
+	}
+	return rawString(raw), nil
+}
+
+// awsSecret reads the SecretString of an AWS Secrets Manager secret, by name or arn, signed with the
+// credentials of the AWS chain
+func awsSecret(id string) (string, error) {
+	region := awsRegion()
+	if parts := strings.Split(id, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	creds, err := newAWSChain().get()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signPayload(req, creds, region, "secretsmanager", time.Now(), sha256Hex(payload))
+	body, err := secretRequest(req)
+	if err != nil {
+		return "", err
+	}
+	reply := &struct {
+		SecretString *string `json:"SecretString"`
+	}{}
+	if err := json.Unmarshal(body, reply); err != nil {
+		return "", err
+	}
+	if reply.SecretString == nil {
+		return "", errors.New("the secret is binary, only string secrets are supported")
+	}
+	return *reply.SecretString, nil
+}
+
+// secretRequest sends a request to a secret manager and returns the body of its 200 response
+func secretRequest(req *http.Request) ([]byte, error) {
+	client := &http.Client{Timeout: secretTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", res.Status)
+	}
+	return body, nil
+}
+
+// jsonKey returns a key of a json object secret
+func jsonKey(secret, key string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("the secret is not a json object for #%s", key)
+	}
+	raw, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("no key %q", key)
+	}
+	return rawString(raw), nil
+}
+
+// rawString is the string of a json string, or the json of another value
+func rawString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the release files, a larger one is not read
+const (
+	maxReleaseIndexSize  = 1 << 20
+	maxReleaseBinarySize = 512 << 20
+)
+
+// defaultReleaseURL is the release index of the latest version, its ed25519 signature is at the same
+// url with a .sig suffix
+const defaultReleaseURL = "https://github.com/lawrence/sample/releases/latest/download/release.json"
+
+// releaseKey is the hex ed25519 public key the release indexes are signed with, set at build time with
+// -ldflags "-X main.releaseKey=...", the builds from source have none and need --public-key
+var releaseKey = ""
+
+// release is the index of a release, the binaries by <os>_<arch>
+type release struct {
+	Version string                  `json:"version"`
+	Assets  map[string]releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// selfUpdate replaces the running binary by the latest release. The release index must be signed by
+// the release key and the binary must match its checksum, the binary is then renamed over the running
+// one so an interrupted update leaves the old binary in place.
+func selfUpdate(args []string) error {
+	fs := newFlagSet("self-update")
+	releaseURL := fs.String("release-url", defaultReleaseURL, "url of the release index")
+	publicKey := fs.String("public-key", releaseKey, "hex ed25519 public key the release index is signed with")
+	check := fs.Bool("check", false, "only report whether a newer release is available")
+	force := fs.Bool("force", false, "install the release even when it is not newer than the running binary")
+	timeout := fs.Duration("timeout", 5*time.Minute, "time the update has to download the release")
+	fs.Parse(args)
+
+	key, err := hex.DecodeString(*publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("please supply the hex ed25519 --public-key of the releases, this binary was built without one")
+	}
+	client := &http.Client{Timeout: *timeout}
+
+	index, err := fetchRelease(client, *releaseURL)
+	if err != nil {
+		return err
+	}
+	sig, err := fetchRelease(client, *releaseURL+".sig")
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, index, decodeSignature(sig)) {
+		return fmt.Errorf("%s: the signature does not match the release key", *releaseURL)
+	}
+	var rel release
+	if err := json.Unmarshal(index, &rel); err != nil {
+		return fmt.Errorf("%s: %v", *releaseURL, err)
+	}
+
+	newer := compareVersions(rel.Version, version) > 0
+	if *check {
+		if newer {
+			fmt.Println(fmt.Sprintf("self-update - %s is available, running %s", rel.Version, version))
+		} else {
+			fmt.Println(fmt.Sprintf("self-update - %s is up to date", version))
+		}
+		return nil
+	}
+	if !newer && !*force {
+		fmt.Println(fmt.Sprintf("self-update - %s is up to date, latest release %s", version, rel.Version))
+		return nil
+	}
+	platform := runtime.GOOS + "_" + runtime.GOARCH
+	asset, ok := rel.Assets[platform]
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s", rel.Version, platform)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if err := installBinary(client, asset, exe); err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("self-update - updated %s from %s to %s", exe, version, rel.Version))
+	return nil
+}
+
+// fetchRelease returns the body of a release file
+func fetchRelease(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReleaseIndexSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxReleaseIndexSize {
+		return nil, fmt.Errorf("%s: larger than the limit of %s", url, humanBytes(maxReleaseIndexSize))
+	}
+	return data, nil
+}
+
+// decodeSignature returns the signature of a .sig file, hex encoded or raw
+func decodeSignature(data []byte) []byte {
+	if sig, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		return sig
+	}
+	return data
+}
+
+// installBinary downloads the binary of asset next to exe and renames it over exe once its checksum matched
+func installBinary(client *http.Client, asset releaseAsset, exe string) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(asset.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", asset.URL, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), "."+filepath.Base(exe)+".update-")
+	if err != nil {
+		return fmt.Errorf("can't write next to %s, update it with the permissions of its directory: %v", exe, err)
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, maxReleaseBinarySize+1))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n > maxReleaseBinarySize {
+		return fmt.Errorf("%s: larger than the limit of %s", asset.URL, humanBytes(maxReleaseBinarySize))
+	}
+	if asset.Size > 0 && n != asset.Size {
+		return fmt.Errorf("%s: got %d bytes, expected %d", asset.URL, n, asset.Size)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, asset.SHA256) {
+		return fmt.Errorf("%s: sha256 %s does not match the release checksum %s", asset.URL, sum, asset.SHA256)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		// a running binary can't be replaced but it can be renamed
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// compareVersions compares two dotted versions like 1.10.2, a v prefix and a -suffix are ignored and
+// dev, the builds from source, is older than any release
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		switch {
+		case x > y:
+			return 1
+		case x < y:
+			return -1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// chunk is a slice of a manifest sent by the coordinator to a worker node
+type chunk struct {
+	Jobs []*download.Job `json:"jobs"`
+}
+
+// chunkResults is the reply of a worker node once the chunk is processed
+type chunkResults struct {
+	Run     string             `json:"run,omitempty"`
+	Results []*download.Result `json:"results"`
+}
+
+// server is a worker node of the distributed mode, it downloads the chunks posted by the coordinator
+type server struct {
+	opts    options // changed by the admin api, see options
+	optsMu  sync.Mutex
+	current map[*download.Downloader]*tenant // downloaders of the runs in progress
+	mux     *http.ServeMux
+	store   *jobStore
+	keys    *idempotencyKeys // of the chunk submissions
+	// adminToken is the bearer token of the admin api, disabled when empty
+	adminToken string
+	// chunks are processed one at a time so the stage indexes of the output directory stay consistent
+	chunkMu sync.Mutex
+	lock    *redisLock // nil without leader election
+	// set atomically
+	ready       int32
+	running     int32 // number of runs in progress
+	progressed  int64 // unix nanoseconds of the run start or of its last completed job
+	completed   int64
+	failed      int64
+	transferred int64
+	started     time.Time
+	healthStall time.Duration
+}
+
+// serve runs a worker node with the run flags, listening for chunks on --listen
+func serve(args []string) error {
+	fs := newFlagSet("serve")
+	opts := addRunFlags(fs)
+	listen := fs.String("listen", ":8080", "address the node listens on")
+	syncManifest := fs.String("sync", "", "images file downloaded every --sync-interval")
+	syncInterval := fs.Duration("sync-interval", time.Hour, "interval of the --sync runs")
+	syncReport := fs.String("sync-report", "", "write the results of each sync as json to this file")
+	monitorManifest := fs.String("monitor", "", "images file whose urls are revalidated every --monitor-interval, with an event when the content of one changes")
+	monitorInterval := fs.Duration("monitor-interval", 15*time.Minute, "interval of the --monitor revalidations")
+	monitorState := fs.String("monitor-state", "", "json file of the validators and sha256 of the --monitor urls, <out>/.monitor.json by default")
+	leaderRedis := fs.String("leader-redis", "", "redis://[:password@]host:port[/db] used to elect the replica running the syncs")
+	leaderKey := fs.String("leader-key", "sample-leader", "redis key of the leader lock")
+	leaderTTL := fs.Duration("leader-ttl", 15*time.Second, "expiry of the leader lock, a new leader is elected within it")
+	adminToken := fs.String("admin-token", os.Getenv(adminTokenEnv), "bearer token of the admin api or its secretref://, disabled when empty, defaults to $"+adminTokenEnv)
+	tlsCert := fs.String("tls-cert", "", "certificate file, serve the api over https with --tls-key")
+	tlsKey := fs.String("tls-key", "", "private key file of --tls-cert")
+	tlsClientCA := fs.String("tls-client-ca", "", "CA file verifying the client certificates accepted by the api")
+	tenants := fs.String("tenants", "", "json file of the tenants scoping the api to their output sub directory, quota and limits")
+	apiTokens := fs.String("api-tokens", "", "file of \"token [requests per second]\" lines accepted as bearer tokens by the api")
+	jobStorePath := fs.String("job-store", "", "json lines file keeping the results of every run, <out>/.jobs.jsonl by default")
+	idempotencyTTL := fs.Duration("idempotency-ttl", defaultIdempotencyTTL, "how long the reply of a chunk posted with an Idempotency-Key is replayed to the retries of the key")
+	healthStall := fs.Duration("health-stall", defaultHealthStall, "report the workers unhealthy when a run completes no job for this long")
+	pprofAddr := fs.String("pprof", "", "serve the pprof profiles on this address, e.g. localhost:6060")
+	runtimeInterval := fs.Duration("runtime-stats", 0, "print the goroutines, heap and gc stats at this interval, e.g. 1m")
+	fs.Parse(args)
+
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("--tls-cert and --tls-key go together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		return errors.New("--tls-client-ca requires --tls-cert")
+	}
+	auth := &apiAuth{clientCert: *tlsClientCA != ""}
+	if *apiTokens != "" {
+		var err error
+		if auth.tokens, err = loadTokens(*apiTokens); err != nil {
+			return err
+		}
+	}
+	if *tenants != "" {
+		t, err := loadTenants(*tenants)
+		if err == nil {
+			err = auth.addTenants(t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var lock *redisLock
+	if *leaderRedis != "" {
+		var err error
+		if lock, err = newRedisLock(*leaderRedis, *leaderKey, *leaderTTL); err != nil {
+			return err
+		}
+	}
+
+	if *jobStorePath == "" {
+		*jobStorePath = filepath.Join(opts.OutDir, ".jobs.jsonl")
+	}
+	store, err := openJobStore(*jobStorePath)
+	if err != nil {
+		return err
+	}
+
+	s := newServer(*opts, auth)
+	s.store = store
+	s.lock = lock
+	s.healthStall = *healthStall
+	s.keys.ttl = *idempotencyTTL
+	if *adminToken != "" {
+		if s.adminToken, err = secretRefs(*adminToken); err != nil {
+			return err
+		}
+		s.mux.HandleFunc("/admin/limits", s.handleLimits)
+	}
+	httpServer := &http.Server{Addr: *listen, Handler: s}
+	if *tlsCert != "" {
+		var err error
+		if httpServer.TLSConfig, err = serverTLS(*tlsClientCA); err != nil {
+			return err
+		}
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		// on SIGTERM stop being ready, then let the chunks in flight complete before exiting
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+		fmt.Println("shutting down")
+		sdNotify("STOPPING=1")
+		s.setReady(false)
+		err := httpServer.Shutdown(context.Background())
+		s.chunkMu.Lock() // wait for a sync in progress
+		stopped <- err
+	}()
+
+	stop := make(chan struct{})
+	campaigning := &sync.WaitGroup{}
+	if lock != nil {
+		campaigning.Add(1)
+		go func() {
+			defer campaigning.Done()
+			lock.campaign(stop)
+		}()
+	}
+	defer func() {
+		close(stop)
+		campaigning.Wait() // the lock is released for another replica to take over
+	}()
+	if *syncManifest != "" {
+		go s.runSyncs(*syncManifest, *syncReport, *syncInterval, lock, stop)
+	}
+	if *monitorManifest != "" {
+		if *monitorState == "" {
+			*monitorState = filepath.Join(opts.OutDir, ".monitor.json")
+		}
+		m, err := newMonitor(*opts, *monitorManifest, *monitorState)
+		if err != nil {
+			return err
+		}
+		go m.run(*monitorInterval, lock, stop)
+	}
+
+	if interval := watchdogInterval(); interval > 0 {
+		go runWatchdog(interval, stop)
+	}
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
+	}
+	if *runtimeInterval > 0 {
+		go logRuntimeStats(*runtimeInterval, stop)
+	}
+
+	// listen on the socket passed by systemd when socket activated, on --listen otherwise
+	l, err := activatedListener()
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		if l, err = net.Listen("tcp", *listen); err != nil {
+			return err
+		}
+	}
+	fmt.Println(fmt.Sprintf("serving on %s", l.Addr()))
+	s.setReady(true)
+	sdNotify("READY=1")
+	serveFn := httpServer.Serve
+	if *tlsCert != "" {
+		serveFn = func(l net.Listener) error { return httpServer.ServeTLS(l, *tlsCert, *tlsKey) }
+	}
+	if err := serveFn(l); err != http.ErrServerClosed {
+		return err
+	}
+	return <-stopped
+}
+
+// run downloads the jobs in the namespace of the tenant, nil for the default one, and returns the run id
+// the results are kept under in the job store. The runs of a namespace are serialized and their progress
+// is tracked for the pool check.
+func (s *server) run(t *tenant, jobs []*download.Job) (string, []*download.Result, error) {
+	submitted := time.Now()
+	mu := &s.chunkMu
+	if t != nil {
+		mu = &t.mu
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	atomic.StoreInt64(&s.progressed, time.Now().UnixNano())
+	atomic.AddInt32(&s.running, 1)
+	defer atomic.AddInt32(&s.running, -1)
+
+	opts := s.options()
+	if t != nil {
+		t.apply(&opts)
+		if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+			return "", nil, err
+		}
+	}
+	var attached *download.Downloader
+	defer func() { s.detach(attached) }()
+	attach := func(d *download.Downloader) {
+		attached = d
+		s.attach(d, t)
+	}
+	results, err := process(opts, jobs, attach, download.WithOnComplete(func(r *download.Result) {
+		atomic.StoreInt64(&s.progressed, time.Now().UnixNano())
+		s.count(r)
+	}))
+	if err != nil || s.store == nil {
+		return "", results, err
+	}
+
+	run, tenant := newRunID(submitted), ""
+	if t != nil {
+		tenant = t.Name
+	}
+	if err := s.store.add(run, tenant, submitted, results); err != nil {
+		fmt.Println(fmt.Sprintf("job store - can't record run %s: %s", run, err))
+	}
+	return run, results, nil
+}
+
+// newServer creates a node, the chunks api is protected by auth when it has tokens or client certificates
+func newServer(opts options, auth *apiAuth) *server {
+	s := &server{
+		opts:        opts,
+		current:     map[*download.Downloader]*tenant{},
+		mux:         http.NewServeMux(),
+		healthStall: defaultHealthStall,
+		started:     time.Now(),
+		keys:        newIdempotencyKeys(defaultIdempotencyTTL),
+	}
+	protect := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if auth.tokens != nil || auth.clientCert {
+		protect = auth.wrap
+	}
+	s.mux.HandleFunc("/chunks", protect(s.handleChunk))
+	s.mux.HandleFunc("/jobs", protect(s.handleJobs))
+	s.mux.HandleFunc("/stats", protect(s.handleStats))
+	s.mux.HandleFunc("/", s.handleUI)
+	s.mux.HandleFunc("/livez", s.handleLive)
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	return s
+}
+
+func (s *server) setReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&s.ready, value)
+}
+
+// handleLive is the liveness probe, the node is alive as long as it answers
+func (s *server) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleChunk downloads the posted chunk and replies with its results once all its jobs are processed.
+// A chunk posted with an Idempotency-Key gets the reply of the first submission of the key, see
+// idempotencyKeys. The chunks are limited to the size of an images file, and those of jobs whose output
+// would be out of the output directory of the node, or of the tenant, are rejected.
+func (s *server) handleChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestSize))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	c := &chunk{}
+	if err := json.Unmarshal(body, c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, j := range c.Jobs {
+		if j == nil {
+			http.Error(w, "null job", http.StatusBadRequest)
+			return
+		}
+		if err := checkJobPaths(j); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	t := tenantOf(r.Context())
+	key := r.Header.Get(idempotencyHeader)
+	var sub *submission
+	if key != "" {
+		if t != nil {
+			key = t.Name + "/" + key
+		}
+		fingerprint := bodyFingerprint(body)
+		for sub == nil {
+			first, isNew := s.keys.begin(key, fingerprint)
+			if isNew {
+				sub = first
+				break
+			}
+			if first.fingerprint != fingerprint {
+				http.Error(w, "the idempotency key was used by another chunk", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-first.done:
+			case <-r.Context().Done():
+				return
+			}
+			if first.reply != nil {
+				w.Header().Set(idempotentReplayedHeader, "true")
+				writeJSON(w, http.StatusOK, first.reply)
+				return
+			}
+			// the first submission failed, this one runs the chunk again
+		}
+	}
+
+	run, results, err := s.run(t, c.Jobs)
+	if err != nil {
+		if sub != nil {
+			s.keys.end(key, sub, nil)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reply := &chunkResults{Run: run, Results: results}
+	if sub != nil {
+		s.keys.end(key, sub, reply)
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// writeJSON replies with v encoded as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
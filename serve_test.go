@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestCheckJobPaths(t *testing.T) {
+	valid := []*download.Job{
+		{Key: 1},
+		{Key: 2, ID: "cat-1", Ext: ".jpg"},
+		{Key: 3, Dir: "train/cat", Ext: ".tar.gz"},
+	}
+	for _, j := range valid {
+		if err := checkJobPaths(j); err != nil {
+			t.Errorf("%+v: %s", j, err)
+		}
+	}
+	invalid := []*download.Job{
+		{Key: 1, ID: "../x"},
+		{Key: 2, ID: `a\b`},
+		{Key: 3, ID: ".hidden"},
+		{Key: 4, Dir: "../../other-tenant"},
+		{Key: 5, Dir: "/etc"},
+		{Key: 6, Dir: "train/../../x"},
+		{Key: 7, Dir: "train//cat"},
+		{Key: 8, Ext: "/../../x"},
+		{Key: 9, Ext: "jpg"},
+		{Key: 10, Ext: ".."},
+	}
+	for _, j := range invalid {
+		if err := checkJobPaths(j); err == nil {
+			t.Errorf("%+v: no error", j)
+		}
+	}
+}
+
+func TestHandleChunkRejectsTheJobsOutOfTheOutputDirectory(t *testing.T) {
+	s := newServer(options{}, &apiAuth{})
+	for _, body := range []string{
+		`{"jobs": [{"key": 1, "url": "http://a.com/1.jpg", "dir": "../../other-tenant"}]}`,
+		`{"jobs": [{"key": 1, "url": "http://a.com/1.jpg"}, {"key": 2, "url": "http://a.com/2.jpg", "id": "../x"}]}`,
+		`{"jobs": [{"key": 1, "url": "http://a.com/1.jpg", "ext": "/../../x"}]}`,
+		`{"jobs": [null]}`,
+	} {
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/chunks", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestHandleChunkLimitsTheBody(t *testing.T) {
+	defer func(limit int64) { maxManifestSize = limit }(maxManifestSize)
+	maxManifestSize = 16
+	s := newServer(options{}, &apiAuth{})
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/chunks", strings.NewReader(`{"jobs": [{"key": 1, "url": "http://a.com/1.jpg"}]}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", rec.Code)
+	}
+}
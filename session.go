@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openSession opens the cookie jar, in memory without --cookie-jar, and sends the priming requests
+// of the session file with it
+func openSession(opts options) (*cookieJar, error) {
+	jar, err := openCookieJar(opts.CookieJar)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Session == "" {
+		return jar, nil
+	}
+	requests, err := readSession(opts.Session)
+	if err != nil {
+		return nil, err
+	}
+	if err := prime(jar, requests, opts.Timeout); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+// cookieJar is a cookie jar saved to a json file, so sessions outlive a run
+type cookieJar struct {
+	*cookiejar.Jar
+	mu      sync.Mutex
+	path    string
+	cookies map[string]*storedCookie // by domain, path and name
+}
+
+// storedCookie is a cookie of the jar file, with the host it came from when it has no domain
+type storedCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	HostOnly bool      `json:"host_only,omitempty"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HTTPOnly bool      `json:"http_only,omitempty"`
+}
+
+// openCookieJar loads the cookies of the jar file, an empty jar is created when it does not exist yet
+func openCookieJar(path string) (*cookieJar, error) {
+	jar, _ := cookiejar.New(nil)
+	j := &cookieJar{Jar: jar, path: path, cookies: map[string]*storedCookie{}}
+
+	if path == "" {
+		return j, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored []*storedCookie
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for _, c := range stored {
+		if !c.Expires.IsZero() && c.Expires.Before(time.Now()) {
+			continue
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		cookie := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Expires: c.Expires, Secure: c.Secure, HttpOnly: c.HTTPOnly}
+		if !c.HostOnly {
+			cookie.Domain = c.Domain
+		}
+		j.Jar.SetCookies(&url.URL{Scheme: scheme, Host: c.Domain, Path: c.Path}, []*http.Cookie{cookie})
+		j.cookies[c.Domain+";"+c.Path+";"+c.Name] = c
+	}
+	return j, nil
+}
+
+// SetCookies keeps track of the cookies set by the responses on top of storing them in the jar
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		stored := &storedCookie{Name: c.Name, Value: c.Value, Domain: strings.TrimPrefix(strings.ToLower(c.Domain), "."), Path: c.Path, Secure: c.Secure, HTTPOnly: c.HttpOnly}
+		if stored.Domain == "" {
+			stored.Domain, stored.HostOnly = u.Hostname(), true
+		}
+		if stored.Path == "" || stored.Path[0] != '/' {
+			stored.Path = defaultCookiePath(u.Path)
+		}
+		if c.MaxAge > 0 {
+			stored.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+		} else if !c.Expires.IsZero() {
+			stored.Expires = c.Expires
+		}
+
+		key := stored.Domain + ";" + stored.Path + ";" + stored.Name
+		if c.MaxAge < 0 || (!stored.Expires.IsZero() && stored.Expires.Before(time.Now())) {
+			delete(j.cookies, key) // deleted by the server
+			continue
+		}
+		j.cookies[key] = stored
+	}
+}
+
+// defaultCookiePath is the directory of the request path, the path of a cookie set without one
+func defaultCookiePath(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+// save writes the cookies that have not expired to the jar file
+func (j *cookieJar) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stored := []*storedCookie{}
+	for _, c := range j.cookies {
+		if c.Expires.IsZero() || c.Expires.After(time.Now()) {
+			stored = append(stored, c)
+		}
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// primeRequest is a request sent before the downloads to open a session, e.g. to a login form. The
+// $VARIABLES of its url, headers, form and body are expanded from the environment.
+type primeRequest struct {
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Form    map[string]string `json:"form,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// readSession reads the json list of priming requests of a session file
+func readSession(path string) ([]*primeRequest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var requests []*primeRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return requests, nil
+}
+
+// prime sends the priming requests in order with the jar, stopping at the first error status
+func prime(jar http.CookieJar, requests []*primeRequest, timeout time.Duration) error {
+	client := &http.Client{Jar: jar, Timeout: timeout}
+	for i, p := range requests {
+		method := p.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		var body io.Reader
+		contentType := ""
+		if p.Form != nil {
+			form := url.Values{}
+			for name, value := range p.Form {
+				value, err := expandSecrets(value)
+				if err != nil {
+					return fmt.Errorf("priming request #%d: %s", i+1, err)
+				}
+				form.Set(name, value)
+			}
+			body, contentType = strings.NewReader(form.Encode()), "application/x-www-form-urlencoded"
+			if p.Method == "" {
+				method = http.MethodPost
+			}
+		} else if p.Body != "" {
+			expanded, err := expandSecrets(p.Body)
+			if err != nil {
+				return fmt.Errorf("priming request #%d: %s", i+1, err)
+			}
+			body = strings.NewReader(expanded)
+		}
+
+		req, err := http.NewRequest(method, os.ExpandEnv(p.URL), body)
+		if err != nil {
+			return fmt.Errorf("priming request #%d: %s", i+1, err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for name, value := range p.Headers {
+			value, err := expandSecrets(value)
+			if err != nil {
+				return fmt.Errorf("priming request #%d: %s", i+1, err)
+			}
+			req.Header.Set(name, value)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("priming request #%d: %s", i+1, err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode >= 400 {
+			return fmt.Errorf("priming request #%d: unexpected http status %s", i+1, res.Status)
+		}
+		fmt.Println(fmt.Sprintf("session - primed %s %s: %s", method, req.URL.Redacted(), res.Status))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Shard modes
+const (
+	shardHash  = "hash"
+	shardRange = "range"
+)
+
+// shardIndexEnv is set by kubernetes on the pods of an Indexed Job
+const shardIndexEnv = "JOB_COMPLETION_INDEX"
+
+// resolveShardIndex takes the shard index from the environment of an Indexed Job when the flag is not set
+func (opts *options) resolveShardIndex() error {
+	if opts.ShardIndex >= 0 {
+		return nil
+	}
+	opts.ShardIndex = 0
+	if env := os.Getenv(shardIndexEnv); env != "" {
+		index, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", shardIndexEnv, env)
+		}
+		opts.ShardIndex = index
+	}
+	return nil
+}
+
+// shardJobs keeps the jobs of shard index out of count. In hash mode a job belongs to the shard of its
+// url hash, so shards stay stable when entries are added, in range mode each shard is a contiguous slice.
+func shardJobs(jobs []*download.Job, index, count int, mode string) []*download.Job {
+	if count <= 1 {
+		return jobs
+	}
+	if mode == shardRange {
+		return jobs[index*len(jobs)/count : (index+1)*len(jobs)/count]
+	}
+
+	var shard []*download.Job
+	for _, j := range jobs {
+		h := fnv.New32a()
+		h.Write([]byte(j.URL))
+		if int(h.Sum32()%uint32(count)) == index {
+			shard = append(shard, j)
+		}
+	}
+	return shard
+}
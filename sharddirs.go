@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Modes of --shard-dirs
+const (
+	shardDirsHash = "hash"
+	shardDirsKey  = "key"
+)
+
+// Defaults and bounds of the --shard-dirs modes: the levels of two hex characters of the hash mode,
+// 256 directories each, and the keys per directory of the key mode
+const (
+	defaultShardLevels = 1
+	maxShardLevels     = 4
+	defaultShardSize   = 1000
+)
+
+// shardDirs is a parsed --shard-dirs
+type shardDirs struct {
+	mode string
+	n    int // levels of the hash mode, keys per directory of the key mode
+}
+
+// parseShardDirs parses hash[:levels] or key[:size], the empty value disables the sharding
+func parseShardDirs(value string) (*shardDirs, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(value, ":", 2)
+	mode := parts[0]
+	s := &shardDirs{mode: mode}
+	switch mode {
+	case shardDirsHash:
+		s.n = defaultShardLevels
+	case shardDirsKey:
+		s.n = defaultShardSize
+	default:
+		return nil, fmt.Errorf("unknown --shard-dirs mode %q, expected hash[:levels] or key[:size]", mode)
+	}
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 || mode == shardDirsHash && n > maxShardLevels {
+			return nil, fmt.Errorf("invalid --shard-dirs %q", value)
+		}
+		s.n = n
+	}
+	return s, nil
+}
+
+// assignShardDirs spreads the outputs over sub directories of their directory so none gets hundreds
+// of thousands of files: by the sha1 of the file name, ab/abcdef.jpg, or by ranges of keys,
+// 12000-12999/12345.jpg. Both only depend on the name or the key of a job, so the runs, verify and
+// prune agree on the path of an output.
+func assignShardDirs(jobs []*download.Job, s *shardDirs) {
+	for _, j := range jobs {
+		var dir string
+		if s.mode == shardDirsKey {
+			start := j.Key / s.n * s.n
+			dir = fmt.Sprintf("%d-%d", start, start+s.n-1)
+		} else {
+			name := filepath.Base(download.OutputPath("", j))
+			sum := sha1.Sum([]byte(name))
+			prefix := hex.EncodeToString(sum[:s.n])
+			var levels []string
+			for i := 0; i < len(prefix); i += 2 {
+				levels = append(levels, prefix[i:i+2])
+			}
+			dir = filepath.Join(levels...)
+		}
+		j.Dir = filepath.Join(j.Dir, dir)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Signers of --sign
+const (
+	signGPG    = "gpg"
+	signCosign = "cosign"
+)
+
+// signFile writes a detached signature of path with the signer of --sign: path.asc, armored, with gpg
+// and path.sig with cosign. The key is a gpg key id or a cosign key reference, without one gpg signs
+// with its default key and cosign keyless through sigstore. The passphrase of a cosign key is read
+// from $COSIGN_PASSWORD.
+func signFile(signer, key, path string) (string, error) {
+	var cmd *exec.Cmd
+	var sigPath string
+	switch signer {
+	case signGPG:
+		sigPath = path + ".asc"
+		args := []string{"--batch", "--yes", "--armor", "--detach-sign", "--output", sigPath}
+		if key != "" {
+			args = append(args, "--local-user", key)
+		}
+		cmd = exec.Command("gpg", append(args, path)...)
+	case signCosign:
+		sigPath = path + ".sig"
+		args := []string{"sign-blob", "--yes", "--output-signature", sigPath}
+		if key != "" {
+			args = append(args, "--key", key)
+		}
+		cmd = exec.Command("cosign", append(args, path)...)
+	default:
+		return "", fmt.Errorf("unknown signer %q", signer)
+	}
+	cmd.Stdin = os.Stdin // gpg and cosign may ask for a passphrase
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", fmt.Errorf("sign %s: %s: %s", path, err, msg)
+		}
+		return "", fmt.Errorf("sign %s: %s", path, err)
+	}
+	return sigPath, nil
+}
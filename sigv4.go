@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the payload hash of the requests without a body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sigv4Signer signs the requests to the matching hosts with an AWS signature version 4 Authorization
+// header, for assets behind API Gateway (service execute-api) or S3 REST endpoints (service s3)
+type sigv4Signer struct {
+	service string
+	region  string
+	hosts   hostPatterns
+	chain   *awsChain
+}
+
+// newSigV4Signer returns nil when no service is configured
+func newSigV4Signer(opts options) *sigv4Signer {
+	if opts.SigV4Service == "" {
+		return nil
+	}
+	region := opts.SigV4Region
+	if region == "" {
+		region = awsRegion()
+	}
+	return &sigv4Signer{service: opts.SigV4Service, region: region, hosts: parseHostPatterns(opts.SigV4Hosts), chain: newAWSChain()}
+}
+
+// sign is the before request hook setting the signature headers
+func (s *sigv4Signer) sign(req *http.Request) error {
+	if !s.hosts.matches(req.URL) {
+		return nil
+	}
+	creds, err := s.chain.get()
+	if err != nil {
+		return fmt.Errorf("sigv4: %s", err)
+	}
+	signRequest(req, creds, s.region, s.service, time.Now())
+	return nil
+}
+
+// signRequest sets the X-Amz-* headers and the Authorization header of a request without a body,
+// the host and X-Amz-* headers are signed
+func signRequest(req *http.Request, creds *awsCredentials, region, service string, now time.Time) {
+	signPayload(req, creds, region, service, now, emptySHA256)
+}
+
+// signPayload signs a request whose body has the hex sha256 payloadHash
+func signPayload(req *http.Request, creds *awsCredentials, region, service string, now time.Time, payloadHash string) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// S3 encodes the path once, the other services encode the escaped path again
+	path := uriEncode(req.URL.EscapedPath(), true)
+	if service == "s3" {
+		path = uriEncode(req.URL.Path, true)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	scope := date[:8] + "/" + region + "/" + service + "/aws4_request"
+	canonical := strings.Join([]string{req.Method, path, canonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, sha256Hex([]byte(canonical))}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(sigv4Key(creds.SecretAccessKey, date[:8], region, service), toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/lawrence/sample/download"
+)
+
+// sliceJobs keeps the --limit jobs from --offset, then a random --sample of them in their manifest order,
+// the same --seed draws the same sample
+func sliceJobs(opts options, jobs []*download.Job) []*download.Job {
+	if opts.Offset >= len(jobs) {
+		jobs = nil
+	} else {
+		jobs = jobs[opts.Offset:]
+	}
+	if opts.Limit > 0 && opts.Limit < len(jobs) {
+		jobs = jobs[:opts.Limit]
+	}
+	if opts.Sample <= 0 || opts.Sample >= len(jobs) {
+		return jobs
+	}
+
+	picked := make([]*download.Job, 0, opts.Sample)
+	for _, i := range rand.New(rand.NewSource(opts.Seed)).Perm(len(jobs))[:opts.Sample] {
+		picked = append(picked, jobs[i])
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i].Key < picked[j].Key })
+	return picked
+}
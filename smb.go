@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/lawrence/sample/download"
+)
+
+// smbPasswordEnv sets the SMB password without saving it in the report, retries read it from there
+const smbPasswordEnv = "SAMPLE_SMB_PASSWORD"
+
+// smbExists is the error of smbclient creating a directory that exists
+const smbExists = "NT_STATUS_OBJECT_NAME_COLLISION"
+
+// smbSink copies each download to a directory of an SMB share with smbclient, at its path in the output
+// directory, so downloads land on a Windows file server without mounting its share. The directories of
+// the path are created as they are first needed.
+type smbSink struct {
+	service  string // the //server/share of smbclient
+	dir      string // in the share, without leading or trailing /
+	port     string
+	user     string
+	password string
+	outDir   string
+
+	mu      sync.Mutex
+	created map[string]bool // directories known to exist
+}
+
+// newSMBSink returns the sink of --smb-out, an smb://server[:port]/share[/dir] url. The user is
+// --smb-user, or that of the url, as DOMAIN\user when it is in a domain, and the password
+// --smb-password or $SAMPLE_SMB_PASSWORD, which can be a secretref:// to the keychain. Without a user
+// the share is accessed as a guest.
+func newSMBSink(opts options) (*smbSink, error) {
+	u, err := url.Parse(opts.SMBOut)
+	if err != nil {
+		return nil, err
+	}
+	share := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Scheme != "smb" || u.Hostname() == "" || share[0] == "" {
+		return nil, fmt.Errorf("--smb-out %q is not a smb://server/share url", opts.SMBOut)
+	}
+	s := &smbSink{
+		service: "//" + u.Hostname() + "/" + share[0],
+		port:    u.Port(),
+		user:    opts.SMBUser,
+		outDir:  opts.OutDir,
+		created: map[string]bool{},
+	}
+	if len(share) > 1 {
+		s.dir = strings.Trim(share[1], "/")
+	}
+	password := opts.SMBPassword
+	if password == "" {
+		password = os.Getenv(smbPasswordEnv)
+	}
+	if u.User != nil && s.user == "" {
+		s.user = u.User.Username()
+	}
+	if s.password, err = secretRefs(password); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *smbSink) Put(r *download.Result) error {
+	if r.Path == "" {
+		return nil
+	}
+	rel := sinkPath(s.outDir, r.Path)
+	remote := path.Join(s.dir, rel)
+	if !smbQuotable(remote) || !smbQuotable(r.Path) {
+		return fmt.Errorf("smb: can't copy %q, smbclient can't be given a name with a \", a ; or a control character", rel)
+	}
+	if err := s.mkdir(path.Dir(remote)); err != nil {
+		return err
+	}
+	if _, err := s.run(fmt.Sprintf(`put "%s" "%s"`, r.Path, smbPath(remote))); err != nil {
+		return err
+	}
+	r.SetMeta("smb", "smb:"+s.service+"/"+remote)
+	return nil
+}
+
+// mkdir creates dir and its parents in the share, those that are not known to exist yet
+func (s *smbSink) mkdir(dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parent := ""
+	for _, name := range strings.Split(dir, "/") {
+		parent = path.Join(parent, name)
+		if s.created[parent] {
+			continue
+		}
+		if out, err := s.run(fmt.Sprintf(`mkdir "%s"`, smbPath(parent))); err != nil && !strings.Contains(out, smbExists) {
+			return err
+		}
+		s.created[parent] = true
+	}
+	return nil
+}
+
+// run runs an smbclient command on the share, the password is passed in the environment
+// rather than the arguments other users can read
+func (s *smbSink) run(command string) (string, error) {
+	args := []string{s.service, "--max-protocol=SMB3", "-c", command}
+	if s.port != "" {
+		args = append(args, "--port="+s.port)
+	}
+	if s.user != "" {
+		args = append(args, "--user="+s.user)
+	} else {
+		args = append(args, "--no-pass")
+	}
+	cmd := exec.Command("smbclient", args...)
+	cmd.Env = append(os.Environ(), "PASSWD="+s.password)
+	out, err := cmd.CombinedOutput()
+	msg := strings.TrimSpace(string(out))
+	if err == nil && strings.Contains(msg, "NT_STATUS_") {
+		return msg, fmt.Errorf("smbclient: %s", msg) // -c can exit 0 when its command failed
+	}
+	if err != nil {
+		if msg != "" {
+			return msg, fmt.Errorf("smbclient: %s: %s", err, msg)
+		}
+		return msg, fmt.Errorf("smbclient: %s", err)
+	}
+	return msg, nil
+}
+
+// smbQuotable tells whether a path can be quoted in an smbclient -c command: smbclient does not escape
+// the " of the names, splits the commands on ; and the lines, so the name of a download can't run
+// another command on the share
+func smbQuotable(p string) bool {
+	for _, c := range p {
+		if c == '"' || c == ';' || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// smbPath returns a path of the share with the \ separators of smbclient
+func smbPath(p string) string {
+	return strings.Replace(p, "/", `\`, -1)
+}
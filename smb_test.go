@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lawrence/sample/download"
+)
+
+func TestSMBSinkRejectsTheNamesThatWouldRunCommands(t *testing.T) {
+	var opts options
+	opts.OutDir, opts.SMBOut = t.TempDir(), "smb://files.example.com/share/assets"
+	s, err := newSMBSink(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`a;del *.jpg`, "a\nrm x.jpg", `a".jpg`, "a\x00.jpg", "a\r.jpg"} {
+		err := s.Put(&download.Result{Key: 1, Path: filepath.Join(opts.OutDir, name)})
+		if err == nil || !strings.HasPrefix(err.Error(), "smb: can't copy") {
+			t.Errorf("%q: %v, want the name rejected before smbclient runs", name, err)
+		}
+	}
+}
+
+func TestSMBQuotable(t *testing.T) {
+	for p, want := range map[string]bool{
+		"assets/train/cat/1.jpg": true,
+		"assets/photo (1) é.jpg": true,
+		"assets/a;b.jpg":         false,
+		"assets/a\tb.jpg":        false,
+		`assets/a"b.jpg`:         false,
+	} {
+		if got := smbQuotable(p); got != want {
+			t.Errorf("smbQuotable(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
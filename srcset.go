@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// srcsetCandidate is an image candidate of a srcset attribute, with its w or x descriptor
+type srcsetCandidate struct {
+	url     string
+	width   int     // 0 without a w descriptor
+	density float64 // 0 without an x descriptor
+}
+
+// selectSrcsets replaces the url of the entries with a srcset by its best candidate: the narrowest at
+// least width pixels wide, or the one of the lowest density at least density when the candidates have no
+// width, and the largest when none is as large or the target is 0. The relative candidates are resolved
+// against the url of the entry, its src, which is kept as the original url when another is picked.
+func selectSrcsets(img *image, width int, density float64) {
+	for i, srcset := range img.Srcsets {
+		if srcset == "" || i < len(img.Invalid) && img.Invalid[i] != "" {
+			continue
+		}
+		picked, err := pickSrcset(img.Urls[i], srcset, width, density)
+		if err != nil {
+			img.Invalid = extend(img.Invalid, len(img.Urls))
+			img.Invalid[i] = "srcset: " + err.Error()
+			continue
+		}
+		if img.Urls[i] != "" && picked != img.Urls[i] {
+			img.Originals = extend(img.Originals, len(img.Urls))
+			if img.Originals[i] == "" {
+				img.Originals[i] = img.Urls[i]
+			}
+		}
+		img.Urls[i] = picked
+	}
+}
+
+// pickSrcset returns the url of the candidate of srcset selectSrcsets picks, resolved against src
+func pickSrcset(src, srcset string, width int, density float64) (string, error) {
+	candidates, err := parseSrcset(srcset)
+	if err != nil {
+		return "", err
+	}
+	byWidth := false
+	for _, c := range candidates {
+		byWidth = byWidth || c.width > 0
+	}
+	size := func(c srcsetCandidate) float64 {
+		if byWidth {
+			return float64(c.width)
+		}
+		if c.density == 0 {
+			return 1
+		}
+		return c.density
+	}
+	target := density
+	if byWidth {
+		target = float64(width)
+	}
+
+	var best, largest *srcsetCandidate
+	for i := range candidates {
+		c := &candidates[i]
+		if byWidth && c.width == 0 {
+			continue // a density candidate among width ones, the html spec drops the srcset then
+		}
+		if largest == nil || size(*c) > size(*largest) {
+			largest = c
+		}
+		if target > 0 && size(*c) >= target && (best == nil || size(*c) < size(*best)) {
+			best = c
+		}
+	}
+	if best == nil {
+		best = largest
+	}
+	base, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(best.url)
+	if err != nil {
+		return "", fmt.Errorf("candidate %q: %s", best.url, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// parseSrcset splits a srcset attribute in its candidates, as the html spec does: a url up to a space,
+// the commas ending it being separators, then its descriptor up to the next comma
+func parseSrcset(srcset string) ([]srcsetCandidate, error) {
+	var candidates []srcsetCandidate
+	rest := srcset
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n,")
+		if rest == "" {
+			break
+		}
+		end := strings.IndexAny(rest, " \t\r\n")
+		if end < 0 {
+			end = len(rest)
+		}
+		c := srcsetCandidate{url: rest[:end]}
+		rest = rest[end:]
+		descriptor := ""
+		if trimmed := strings.TrimRight(c.url, ","); trimmed != c.url {
+			c.url = trimmed
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			descriptor, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		if err := c.describe(descriptor); err != nil {
+			return nil, fmt.Errorf("candidate %q: %s", c.url, err)
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no candidates")
+	}
+	return candidates, nil
+}
+
+// describe sets the width or the density of a descriptor such as 800w or 1.5x
+func (c *srcsetCandidate) describe(descriptor string) error {
+	if descriptor == "" {
+		return nil
+	}
+	value := descriptor[:len(descriptor)-1]
+	switch descriptor[len(descriptor)-1] {
+	case 'w':
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid width %q", descriptor)
+		}
+		c.width = n
+	case 'x':
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid density %q", descriptor)
+		}
+		c.density = n
+	default:
+		return fmt.Errorf("unknown descriptor %q, expected e.g. 800w or 2x", descriptor)
+	}
+	return nil
+}
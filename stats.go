@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// stats is the reply of GET /stats, the counters add up the runs since the node started
+type stats struct {
+	Started   time.Time `json:"started"`
+	Runs      int32     `json:"runs"`
+	Queued    int       `json:"queued"`
+	Inflight  int       `json:"inflight"`
+	Completed int64     `json:"completed"`
+	Failed    int64     `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	// RemainingBytes and ETA estimate what is left of the runs in progress, ETA is -1 while unknown
+	RemainingBytes int64         `json:"remaining_bytes"`
+	ETA            time.Duration `json:"eta"`
+	Runtime        runtimeStats  `json:"runtime"`
+}
+
+// count adds a finished job to the counters of the node
+func (s *server) count(r *download.Result) {
+	switch r.Status {
+	case download.StatusOK:
+		atomic.AddInt64(&s.completed, 1)
+	case download.StatusSkipped:
+		return // nothing was transferred
+	default:
+		atomic.AddInt64(&s.failed, 1)
+	}
+	n := r.TransferBytes // only set when the body was compressed
+	if n == 0 {
+		n = r.Bytes
+	}
+	atomic.AddInt64(&s.transferred, n)
+}
+
+// handleStats replies with the queue depth of the runs in progress and the counters of the node
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	st := &stats{
+		Started:   s.started,
+		Runs:      atomic.LoadInt32(&s.running),
+		Completed: atomic.LoadInt64(&s.completed),
+		Failed:    atomic.LoadInt64(&s.failed),
+		Bytes:     atomic.LoadInt64(&s.transferred),
+		Runtime:   readRuntimeStats(),
+	}
+	s.optsMu.Lock()
+	for d := range s.current {
+		p := d.Progress()
+		st.Queued += p.Queued
+		st.Inflight += p.Inflight
+		st.RemainingBytes += p.RemainingBytes
+		if p.ETA < 0 || st.ETA < 0 {
+			st.ETA = -1
+		} else if p.ETA > st.ETA {
+			st.ETA = p.ETA
+		}
+	}
+	s.optsMu.Unlock()
+	writeJSON(w, http.StatusOK, st)
+}
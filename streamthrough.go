@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lawrence/sample/download"
+)
+
+// checkStreamThrough checks --stream-through has a remote sink to stream to and none of the stages that
+// need the file of a download, the bodies are never written to the output directory
+func checkStreamThrough(opts *options) error {
+	if !opts.StreamThrough {
+		return nil
+	}
+	if (opts.S3Out == "") == (opts.IngestURL == "") {
+		return errors.New("--stream-through requires either --s3-out or --ingest-url")
+	}
+	if opts.SinkWorkers > 0 {
+		return errors.New("--stream-through uploads as it downloads, size it with --workers rather than --sink-workers")
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"--webdav-out", opts.WebDAVOut != ""},
+		{"--smb-out", opts.SMBOut != ""},
+		{"--exec-post", opts.ExecPost != ""},
+		{"--clamd", opts.Clamd != ""},
+		{"--near-dup", opts.NearDup != ""},
+		{"--verify-decode", opts.VerifyDecode},
+		{"--sanitize-svg", opts.SanitizeSVG},
+		{"--rasterize-dpi", opts.RasterizeDPI > 0},
+		{"--animated", opts.Animated != animatedKeep},
+		{"--checksum-sidecars", opts.ChecksumSidecars},
+		{"--cas", opts.CASDir != ""},
+		{"--zsync", opts.Zsync},
+	} {
+		if f.set {
+			return fmt.Errorf("%s needs the downloaded files, it can't be used with --stream-through", f.name)
+		}
+	}
+	return nil
+}
+
+// newPassThrough returns the sink --stream-through streams the downloads to
+func newPassThrough(opts options) (download.PassThrough, error) {
+	if opts.S3Out != "" {
+		return newS3Sink(opts)
+	}
+	return newIngestSink(opts)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Formats of the --sums-file, the one of sha256sum and the BSD one of shasum --tag
+const (
+	sumsGNU = "gnu"
+	sumsBSD = "bsd"
+)
+
+// writeSums writes the sha256 of every output of the results to path, relative to its directory so the
+// set can be checked with `sha256sum -c` from there. The outputs whose sha256 was not computed, e.g.
+// skipped as already downloaded, are read again.
+func writeSums(path, format string, results []*download.Result) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	lines := map[string]string{} // by name, the outputs of duplicate jobs may share a file
+	for _, r := range results {
+		if r.Path == "" || r.Status != download.StatusOK && r.Status != download.StatusSkipped {
+			continue
+		}
+		sum := r.SHA256
+		if sum == "" {
+			sums, _, err := download.HashFile(r.Path, download.ChecksumSHA256)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			sum = sums[download.ChecksumSHA256]
+		}
+		name := relativeName(dir, r.Path)
+		if format == sumsBSD {
+			lines[name] = fmt.Sprintf("SHA256 (%s) = %s\n", name, sum)
+		} else {
+			lines[name] = fmt.Sprintf("%s  %s\n", sum, name)
+		}
+	}
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var content strings.Builder
+	for _, name := range names {
+		content.WriteString(lines[name])
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// relativeName is the slash separated path of a file relative to the absolute dir, or its path when it
+// is not under dir
+func relativeName(dir, path string) string {
+	name := path
+	if abs, err := filepath.Abs(path); err == nil {
+		if rel, err := filepath.Rel(dir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+	}
+	return filepath.ToSlash(name)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// syncCheck is how often a follower checks whether it was elected and its sync is due
+const syncCheck = 5 * time.Second
+
+// runSyncs downloads the manifest every interval until stop is closed, see runScheduled
+func (s *server) runSyncs(manifest, reportPath string, interval time.Duration, lock *redisLock, stop <-chan struct{}) {
+	runScheduled(interval, lock, stop, func() {
+		if err := s.sync(manifest, reportPath); err != nil {
+			fmt.Println(fmt.Sprintf("sync - %s", err))
+		}
+	})
+}
+
+// runScheduled calls fn every interval until stop is closed. With a leader lock only the elected
+// replica calls it, the others stand by and a replica taking over calls it right away.
+func runScheduled(interval time.Duration, lock *redisLock, stop <-chan struct{}, fn func()) {
+	check := interval
+	if lock != nil && check > syncCheck {
+		check = syncCheck
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		if (lock == nil || lock.isLeader()) && time.Since(last) >= interval {
+			last = time.Now()
+			fn()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync runs the manifest once, one at a time with the chunks
+func (s *server) sync(manifest, reportPath string) error {
+	opts := s.options()
+	jobs, invalid, err := loadJobs(opts, manifest)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("sync - %d jobs of %s", len(jobs), manifest))
+	started := time.Now()
+	_, results, err := s.run(nil, jobs)
+	if err != nil {
+		notifyRun(opts, started, invalid, err)
+		return err
+	}
+	results = append(results, invalid...)
+	err = finish(&report{Options: opts, Results: results}, reportPath)
+	notifyRun(opts, started, results, err)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// tenant is a namespace of the node api, with its own output directory, disk quota and rate limits.
+// The runs of a tenant are serialized while the tenants run concurrently.
+type tenant struct {
+	Name  string `json:"-"`
+	Token string `json:"token,omitempty"`
+	// Prefix is the output sub directory of the tenant, its name by default
+	Prefix string `json:"prefix,omitempty"`
+	// MaxDiskUsage is the quota of the output sub directory, in bytes or with a k, M, G or T suffix
+	MaxDiskUsage string `json:"max_disk_usage,omitempty"`
+	// RateLimit and MaxPerHost cap the download limits of the node for the tenant runs
+	RateLimit  float64 `json:"rate_limit,omitempty"`
+	MaxPerHost int     `json:"max_per_host,omitempty"`
+	// APIRate is the number of api requests per second allowed to the tenant
+	APIRate float64 `json:"api_rate,omitempty"`
+
+	quota int64
+	api   *tokenBucket // nil without APIRate
+	mu    sync.Mutex
+}
+
+// loadTenants reads a json object of tenants keyed by name
+func loadTenants(path string) (map[string]*tenant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tenants := map[string]*tenant{}
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for name, t := range tenants {
+		t.Name = name
+		if t.Prefix == "" {
+			t.Prefix = name
+		}
+		t.Prefix = filepath.Clean(t.Prefix)
+		if filepath.IsAbs(t.Prefix) || t.Prefix == "." || t.Prefix == ".." || strings.HasPrefix(t.Prefix, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("tenant %s: prefix %q is not a sub directory", name, t.Prefix)
+		}
+		if t.MaxDiskUsage != "" {
+			if t.quota, err = parseSize(t.MaxDiskUsage); err != nil {
+				return nil, fmt.Errorf("tenant %s: %s", name, err)
+			}
+		}
+		if t.RateLimit < 0 || t.MaxPerHost < 0 || t.APIRate < 0 {
+			return nil, fmt.Errorf("tenant %s: limits can't be negative", name)
+		}
+		if t.APIRate > 0 {
+			t.api = newTokenBucket(t.APIRate)
+		}
+	}
+	return tenants, nil
+}
+
+// apply scopes the run options to the tenant
+func (t *tenant) apply(opts *options) {
+	opts.OutDir = filepath.Join(opts.OutDir, t.Prefix)
+	if t.quota > 0 {
+		opts.MaxDiskUsage = t.quota
+	}
+	opts.RateLimit = lowerLimit(opts.RateLimit, t.RateLimit)
+	opts.MaxPerHost = int(lowerLimit(float64(opts.MaxPerHost), float64(t.MaxPerHost)))
+}
+
+// lowerLimit returns the lowest of two limits, 0 meaning no limit
+func lowerLimit(a, b float64) float64 {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx carrying the tenant of the request, nil for the default namespace
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantOf returns the tenant of a request authorized by apiAuth, nil for the default namespace
+func tenantOf(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// writeTenants writes a tenants file and returns its path
+func writeTenants(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTenants(t *testing.T) {
+	tenants, err := loadTenants(writeTenants(t, `{
+		"acme": {"token": "acme-token", "max_disk_usage": "2k", "api_rate": 5},
+		"globex": {"prefix": "teams/globex/", "rate_limit": 10}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, globex := tenants["acme"], tenants["globex"]
+	if acme.Name != "acme" || acme.Prefix != "acme" || acme.quota != 2048 || acme.api == nil {
+		t.Errorf("acme %+v", acme)
+	}
+	if globex.Prefix != filepath.Join("teams", "globex") || globex.quota != 0 || globex.api != nil {
+		t.Errorf("globex %+v", globex)
+	}
+
+	for _, data := range []string{
+		`{"acme": {"prefix": "/data"}}`,
+		`{"acme": {"prefix": "../other"}}`,
+		`{"acme": {"prefix": "."}}`,
+		`{"acme": {"max_disk_usage": "lots"}}`,
+		`{"acme": {"max_per_host": -1}}`,
+		`["acme"]`,
+	} {
+		if _, err := loadTenants(writeTenants(t, data)); err == nil {
+			t.Errorf("%s: no error", data)
+		}
+	}
+}
+
+func TestTenantApply(t *testing.T) {
+	tn := &tenant{Prefix: "acme", quota: 1024, RateLimit: 5, MaxPerHost: 8}
+	var opts options
+	opts.OutDir, opts.MaxDiskUsage, opts.RateLimit, opts.MaxPerHost = "data", 1<<20, 10, 4
+	tn.apply(&opts)
+	if opts.OutDir != filepath.Join("data", "acme") || opts.MaxDiskUsage != 1024 || opts.RateLimit != 5 || opts.MaxPerHost != 4 {
+		t.Errorf("options %+v", opts)
+	}
+
+	// the node has no limit, the tenant ones apply
+	opts = options{}
+	opts.OutDir = "data"
+	tn.apply(&opts)
+	if opts.RateLimit != 5 || opts.MaxPerHost != 8 {
+		t.Errorf("options %+v", opts)
+	}
+}
+
+// authorize sends a request through the auth and returns the response code and the tenant of the
+// request, "-" when it was rejected
+func authorize(a *apiAuth, r *http.Request) (int, string) {
+	name := "-"
+	rec := httptest.NewRecorder()
+	a.wrap(func(w http.ResponseWriter, r *http.Request) {
+		name = ""
+		if t := tenantOf(r.Context()); t != nil {
+			name = t.Name
+		}
+	})(rec, r)
+	return rec.Code, name
+}
+
+func TestAPIAuthScopesTheRequestsToTheirTenant(t *testing.T) {
+	tenants := map[string]*tenant{
+		"acme":   {Name: "acme", Token: "acme-token"},
+		"globex": {Name: "globex"}, // client certificate only
+		"slow":   {Name: "slow", Token: "slow-token", api: newTokenBucket(1)},
+	}
+	a := &apiAuth{tokens: map[string]*principal{"admin-token": {}}, clientCert: true}
+	if err := a.addTenants(tenants); err != nil {
+		t.Fatal(err)
+	}
+	bearer := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	withCert := func(cn string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		code   int
+		tenant string
+	}{
+		{"admin token", bearer("admin-token"), http.StatusOK, ""},
+		{"tenant token", bearer("acme-token"), http.StatusOK, "acme"},
+		{"unknown token", bearer("nope"), http.StatusUnauthorized, "-"},
+		{"no token", httptest.NewRequest(http.MethodGet, "/jobs", nil), http.StatusUnauthorized, "-"},
+		{"tenant certificate", withCert("globex"), http.StatusOK, "globex"},
+		{"other certificate", withCert("ops"), http.StatusOK, ""},
+		{"tenant rate", bearer("slow-token"), http.StatusOK, "slow"},
+		{"tenant rate exceeded", bearer("slow-token"), http.StatusTooManyRequests, "-"},
+	}
+	for _, test := range tests {
+		code, tenant := authorize(a, test.req)
+		if code != test.code || tenant != test.tenant {
+			t.Errorf("%s: %d %q, want %d %q", test.name, code, tenant, test.code, test.tenant)
+		}
+	}
+}
+
+func TestAddTenantsRejectsATokenInUse(t *testing.T) {
+	a := &apiAuth{tokens: map[string]*principal{"shared": {}}}
+	if err := a.addTenants(map[string]*tenant{"acme": {Name: "acme", Token: "shared"}}); err == nil {
+		t.Error("no error for the token of another principal")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Schemes of the torrent entries: a magnet link, or torrent: followed by the url or path of a
+// .torrent file
+const (
+	schemeMagnet  = "magnet"
+	schemeTorrent = "torrent"
+)
+
+// torrentProtocol fetches the magnet: and torrent: urls with aria2c into a temporary directory, the
+// response body is the file of the torrent, or a tar of its files when it has several. Seeding stops
+// once the download completes unless seed is set.
+type torrentProtocol struct {
+	seed time.Duration
+}
+
+// isTorrentURL reports whether a url is fetched by the torrentProtocol, such urls have no host
+func isTorrentURL(u *url.URL) bool {
+	switch u.Scheme {
+	case schemeMagnet:
+		return strings.Contains(u.RawQuery, "xt=")
+	case schemeTorrent:
+		return u.Opaque != ""
+	}
+	return false
+}
+
+// followTorrents replaces the urls of the .torrent files by torrent: urls, so the content of the
+// torrents is downloaded rather than the .torrent files, the url of the manifest is kept as the
+// original one
+func followTorrents(jobs []*download.Job, invalid map[int]string) {
+	for _, j := range jobs {
+		if _, ok := invalid[j.Key]; ok {
+			continue
+		}
+		u, err := url.Parse(j.URL)
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") && strings.HasSuffix(strings.ToLower(u.Path), ".torrent") {
+			setJobURL(j, schemeTorrent+":"+j.URL)
+		}
+	}
+}
+
+func (t *torrentProtocol) RoundTrip(req *http.Request) (*http.Response, error) {
+	source := req.URL.String()
+	if req.URL.Scheme == schemeTorrent {
+		source = req.URL.Opaque
+	}
+	dir, err := ioutil.TempDir("", "sample-torrent-")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"--dir=" + dir,
+		"--seed-time=" + strconv.FormatFloat(t.seed.Minutes(), 'f', -1, 64),
+		"--follow-torrent=mem",
+		"--bt-save-metadata=false",
+		"--summary-interval=0",
+		"--console-log-level=warn",
+		source,
+	}
+	cmd := exec.CommandContext(req.Context(), "aria2c", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return nil, fmt.Errorf("aria2c: %s: %s", err, msg)
+		}
+		return nil, fmt.Errorf("aria2c: %s", err)
+	}
+
+	files, err := torrentFiles(dir)
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("the torrent %s has no files", source)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	res := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+	if len(files) == 1 {
+		file, err := os.Open(filepath.Join(dir, files[0]))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		res.ContentLength = info.Size()
+		res.Header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		res.Body = &tempBody{ReadCloser: file, dir: dir}
+		return res, nil
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, dir, files))
+	}()
+	res.ContentLength = -1
+	res.Header.Set("Content-Type", "application/x-tar")
+	res.Body = &tempBody{ReadCloser: reader, dir: dir}
+	return res, nil
+}
+
+// torrentFiles returns the files aria2c wrote to dir, relative to it and in name order, without its
+// control files
+func torrentFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".aria2") {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// writeTar writes the files of dir to w as a tar archive
+func writeTar(w io.Writer, dir string, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, name := range files {
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, file)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// tempBody is a response body read from a temporary directory, removed once the body is closed
+type tempBody struct {
+	io.ReadCloser
+	dir string
+}
+
+func (b *tempBody) Close() error {
+	err := b.ReadCloser.Close()
+	os.RemoveAll(b.dir)
+	return err
+}
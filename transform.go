@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/lawrence/sample/download"
+)
+
+// urlTransform rewrites the urls of the manifest before they are downloaded, with substitutions or a
+// command, the jobs keep the url of the manifest as their original url
+type urlTransform struct {
+	substitutions []urlSubstitution
+	command       string
+}
+
+// urlSubstitution is an s/regexp/replacement/[g] expression, the replacement refers to the groups as $1
+// or ${name} as in regexp.Expand
+type urlSubstitution struct {
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// parseURLTransform returns the transform of --url-transform, nil when it is empty. It is a list of
+// substitutions separated by ;, e.g. s/cdn1\./cdn2./;s/_small\.jpg$/_large.jpg/, or else a shell
+// command reading the urls on its stdin, one per line, and writing each rewritten url on a line.
+func parseURLTransform(expr string) (*urlTransform, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+	if !isSubstitution(expr) {
+		return &urlTransform{command: expr}, nil
+	}
+	t := &urlTransform{}
+	for rest := expr; rest != ""; {
+		if !isSubstitution(rest) {
+			return nil, fmt.Errorf("--url-transform: expected an s/regexp/replacement/ expression at %q", rest)
+		}
+		delim := rest[1:2]
+		parts, after, ok := splitSubstitution(rest[2:], delim[0])
+		if !ok {
+			return nil, fmt.Errorf("--url-transform: unterminated expression %q", rest)
+		}
+		flags := after
+		if i := strings.Index(after, ";"); i >= 0 {
+			flags, after = after[:i], after[i+1:]
+		} else {
+			after = ""
+		}
+		s := urlSubstitution{replacement: parts[1]}
+		switch strings.TrimSpace(flags) {
+		case "":
+		case "g":
+			s.global = true
+		default:
+			return nil, fmt.Errorf("--url-transform: unknown flags %q, only g is supported", flags)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("--url-transform: %s", err)
+		}
+		s.re = re
+		t.substitutions = append(t.substitutions, s)
+		rest = strings.TrimSpace(after)
+	}
+	return t, nil
+}
+
+// isSubstitution reports whether expr starts like an s/regexp/replacement/ expression, any ascii
+// punctuation but ; and the backslash can delimit it
+func isSubstitution(expr string) bool {
+	if len(expr) < 3 || expr[0] != 's' || expr[1] == ';' || expr[1] == '\\' || expr[1] > unicode.MaxASCII {
+		return false
+	}
+	c := rune(expr[1])
+	return unicode.IsPunct(c) || unicode.IsSymbol(c)
+}
+
+// splitSubstitution splits the regexp and the replacement delimited by delim, a delimiter escaped with
+// a backslash is part of them
+func splitSubstitution(s string, delim byte) ([2]string, string, bool) {
+	var parts [2]string
+	var part strings.Builder
+	n := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case s[i] == delim:
+			parts[n] = part.String()
+			part.Reset()
+			if n++; n == 2 {
+				return parts, s[i+1:], true
+			}
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	return parts, "", false
+}
+
+func (s urlSubstitution) apply(u string) string {
+	if s.global {
+		return s.re.ReplaceAllString(u, s.replacement)
+	}
+	match := s.re.FindStringSubmatchIndex(u)
+	if match == nil {
+		return u
+	}
+	replaced := s.re.ExpandString(nil, s.replacement, u, match)
+	return u[:match[0]] + string(replaced) + u[match[1]:]
+}
+
+// transformJobs rewrites the urls of the jobs, but the invalid ones, and records the url of the
+// manifest of the jobs whose url changed
+func transformJobs(jobs []*download.Job, t *urlTransform, invalid map[int]string) error {
+	if t == nil {
+		return nil
+	}
+	var valid []*download.Job
+	for _, j := range jobs {
+		if _, ok := invalid[j.Key]; !ok {
+			valid = append(valid, j)
+		}
+	}
+	urls := make([]string, len(valid))
+	for i, j := range valid {
+		urls[i] = j.URL
+	}
+
+	if t.command != "" {
+		rewritten, err := runURLCommand(t.command, urls)
+		if err != nil {
+			return err
+		}
+		urls = rewritten
+	} else {
+		for i := range urls {
+			for _, s := range t.substitutions {
+				urls[i] = s.apply(urls[i])
+			}
+		}
+	}
+	for i, j := range valid {
+		setJobURL(j, urls[i])
+	}
+	return nil
+}
+
+// setJobURL replaces the url of a job by a rewrite of it, the first url is kept as the original one
+func setJobURL(j *download.Job, u string) {
+	if u == j.URL {
+		return
+	}
+	if j.Original == "" {
+		j.Original = j.URL
+	}
+	j.URL = u
+}
+
+// runURLCommand pipes the urls through the shell command, which must write as many lines
+func runURLCommand(command string, urls []string) ([]string, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(strings.Join(urls, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("--url-transform: %s", err)
+	}
+	lines := strings.Split(string(bytes.TrimRight(out, "\n")), "\n")
+	if len(lines) != len(urls) {
+		return nil, fmt.Errorf("--url-transform: the command wrote %d urls for %d", len(lines), len(urls))
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return lines, nil
+}
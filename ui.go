@@ -0,0 +1,27 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboard holds the page, script and style of the dashboard
+//
+//go:embed ui
+var dashboard embed.FS
+
+// dashboardFiles serves the files of the dashboard at the root of the node
+var dashboardFiles = func() http.Handler {
+	files, err := fs.Sub(dashboard, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}()
+
+// handleUI serves the dashboard of the node, it polls /stats and /jobs and posts manifests to /chunks
+// with the token saved in the browser
+func (s *server) handleUI(w http.ResponseWriter, r *http.Request) {
+	dashboardFiles.ServeHTTP(w, r)
+}
@@ -0,0 +1,105 @@
+var token = document.getElementById("token");
+token.value = localStorage.getItem("sample-token") || "";
+token.onchange = function() { localStorage.setItem("sample-token", token.value); };
+
+function api(path, options) {
+	options = options || {};
+	options.headers = options.headers || {};
+	if (token.value) options.headers["Authorization"] = "Bearer " + token.value;
+	return fetch(path, options).then(function(res) {
+		if (!res.ok) return res.text().then(function(text) { throw new Error(res.status + " " + text); });
+		return res.json();
+	});
+}
+
+function showError(err) { document.getElementById("error").textContent = err ? err.message : ""; }
+
+function size(n) {
+	var units = ["B", "kB", "MB", "GB"];
+	var i = 0;
+	while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+	return n.toFixed(i ? 1 : 0) + " " + units[i] + "/s";
+}
+
+function duration(ns) {
+	if (ns < 0) return "estimating";
+	var s = Math.round(ns / 1e9);
+	if (s < 60) return s + "s";
+	if (s < 3600) return Math.floor(s / 60) + "m" + ("0" + s % 60).slice(-2) + "s";
+	return Math.floor(s / 3600) + "h" + ("0" + Math.floor(s % 3600 / 60)).slice(-2) + "m";
+}
+
+var samples = [], last = null;
+function drawChart() {
+	var canvas = document.getElementById("chart"), ctx = canvas.getContext("2d");
+	ctx.clearRect(0, 0, canvas.width, canvas.height);
+	var max = Math.max.apply(null, samples.concat([1]));
+	ctx.strokeStyle = "#3a7";
+	ctx.beginPath();
+	samples.forEach(function(v, i) {
+		var x = i * canvas.width / 59, y = canvas.height - 4 - v / max * (canvas.height - 8);
+		if (i) ctx.lineTo(x, y); else ctx.moveTo(x, y);
+	});
+	ctx.stroke();
+	ctx.fillText(size(max), 4, 12);
+}
+
+function refreshStats() {
+	api("/stats").then(function(st) {
+		["runs", "queued", "inflight", "completed", "failed"].forEach(function(k) {
+			document.getElementById(k).textContent = st[k];
+		});
+		document.getElementById("eta").textContent = st.runs ? duration(st.eta) : "-";
+		var now = Date.now();
+		if (last) {
+			var rate = (st.bytes - last.bytes) / ((now - last.at) / 1000);
+			samples.push(Math.max(rate, 0));
+			if (samples.length > 60) samples.shift();
+			document.getElementById("rate").textContent = size(rate);
+			drawChart();
+		}
+		last = {bytes: st.bytes, at: now};
+		showError(null);
+	}).catch(showError);
+}
+
+function refreshFailures() {
+	api("/jobs?status=failed,timeout&order=desc&limit=20").then(function(page) {
+		var body = document.getElementById("failures");
+		body.innerHTML = "";
+		page.jobs.forEach(function(j) {
+			var row = document.createElement("tr");
+			[new Date(j.submitted).toLocaleString(), j.run, j.key, j.url, j.status, j.error || ""].forEach(function(v) {
+				var cell = document.createElement("td");
+				cell.textContent = v;
+				row.appendChild(cell);
+			});
+			body.appendChild(row);
+		});
+	}).catch(showError);
+}
+
+function submit(urls) {
+	var jobs = urls.map(function(url, key) { return {key: key, url: url}; });
+	var status = document.getElementById("submitted");
+	status.textContent = "running " + jobs.length + " jobs...";
+	api("/chunks", {method: "POST", body: JSON.stringify({jobs: jobs})}).then(function(res) {
+		var ok = res.results.filter(function(r) { return r.status === "ok"; }).length;
+		status.textContent = "run " + res.run + ": " + ok + " of " + jobs.length + " downloaded";
+		refreshFailures();
+	}).catch(function(err) { status.textContent = ""; showError(err); });
+}
+
+document.getElementById("submit").onclick = function() {
+	var file = document.getElementById("file").files[0];
+	if (file) {
+		file.text().then(function(text) { submit(JSON.parse(text).urls || []); }).catch(showError);
+		return;
+	}
+	submit(document.getElementById("urls").value.split("\n").map(function(l) { return l.trim(); }).filter(Boolean));
+};
+
+refreshStats();
+refreshFailures();
+setInterval(refreshStats, 2000);
+setInterval(refreshFailures, 10000);
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardIsServedFromTheEmbeddedFiles(t *testing.T) {
+	s := newServer(options{}, &apiAuth{})
+	for _, tc := range []struct {
+		path        string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{"/", http.StatusOK, "text/html", `<script src="dashboard.js">`},
+		{"/dashboard.js", http.StatusOK, "javascript", "refreshStats"},
+		{"/dashboard.css", http.StatusOK, "text/css", ".tiles"},
+		{"/missing", http.StatusNotFound, "", ""},
+	} {
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+		if rec.Code != tc.status {
+			t.Errorf("GET %s: status %d, want %d", tc.path, rec.Code, tc.status)
+			continue
+		}
+		if !strings.Contains(rec.Header().Get("Content-Type"), tc.contentType) {
+			t.Errorf("GET %s: content type %q, want %s", tc.path, rec.Header().Get("Content-Type"), tc.contentType)
+		}
+		if !strings.Contains(string(body), tc.contains) {
+			t.Errorf("GET %s: body without %q", tc.path, tc.contains)
+		}
+	}
+}
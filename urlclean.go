@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// trackingParams are the query parameters --strip-params tracking stands for
+var trackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "igshid", "yclid", "_ga"}
+
+// urlCleaner normalizes the urls of the manifest, so the variants of a url differing by tracking params,
+// param order or fragment are requested, deduplicated and recorded as the same url
+type urlCleaner struct {
+	strip         []string // patterns of the param names, * matches any sequence
+	sortQuery     bool
+	stripFragment bool
+}
+
+// newURLCleaner returns the cleaner of the --strip-params, --sort-query and --strip-fragment options,
+// nil when none is set
+func newURLCleaner(opts options) *urlCleaner {
+	c := &urlCleaner{sortQuery: opts.SortQuery, stripFragment: opts.StripFragment}
+	for _, name := range strings.Split(opts.StripParams, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "tracking":
+			c.strip = append(c.strip, trackingParams...)
+		default:
+			c.strip = append(c.strip, name)
+		}
+	}
+	if len(c.strip) == 0 && !c.sortQuery && !c.stripFragment {
+		return nil
+	}
+	return c
+}
+
+// clean returns the cleaned url, the kept params are left encoded as they were
+func (c *urlCleaner) clean(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw // the download reports the bad url
+	}
+	if c.stripFragment {
+		u.Fragment, u.RawFragment = "", ""
+	}
+
+	var pairs []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, err := url.QueryUnescape(strings.SplitN(pair, "=", 2)[0])
+		if err != nil || !c.stripped(name) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if c.sortQuery {
+		sort.Strings(pairs)
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+	u.ForceQuery = false
+	return u.String()
+}
+
+func (c *urlCleaner) stripped(name string) bool {
+	for _, pattern := range c.strip {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanJobs replaces the urls of the jobs by their cleaned url
+func cleanJobs(jobs []*download.Job, c *urlCleaner) {
+	if c == nil {
+		return
+	}
+	for _, j := range jobs {
+		j.URL = c.clean(j.URL)
+	}
+}
+
+// uniqueJobs returns the first job of each url, and the jobs left out by the key of the job of their url
+func uniqueJobs(jobs []*download.Job) ([]*download.Job, map[int][]*download.Job) {
+	first := map[string]*download.Job{}
+	duplicates := map[int][]*download.Job{}
+	var unique []*download.Job
+	for _, j := range jobs {
+		if f, ok := first[j.URL]; ok {
+			duplicates[f.Key] = append(duplicates[f.Key], j)
+			continue
+		}
+		first[j.URL] = j
+		unique = append(unique, j)
+	}
+	return unique, duplicates
+}
+
+// duplicateResults gives the duplicates of a downloaded job a link to its file, or a copy, and
+// returns their results, the duplicates of a job that did not complete share its outcome
+func duplicateResults(results []*download.Result, duplicates map[int][]*download.Job, outDir string) []*download.Result {
+	var copies []*download.Result
+	for _, r := range results {
+		for _, j := range duplicates[r.Key] {
+			dup := *r
+			dup.SetJob(j)
+			dup.Meta = nil
+			for k, v := range r.Meta {
+				dup.SetMeta(k, v)
+			}
+			dup.SetMeta("duplicate_of", fmt.Sprint(r.Key))
+			if r.Path != "" {
+				dup.Path = download.OutputPath(outDir, j)
+				if err := linkOrCopy(r.Path, dup.Path); err != nil {
+					dup.Status, dup.Error, dup.ErrorClass, dup.Path = download.StatusFailed, err.Error(), download.ClassifyError(err), ""
+				}
+			}
+			copies = append(copies, &dup)
+		}
+	}
+	return copies
+}
+
+// linkOrCopy replaces to with a hard link to from, or a copy when they can't be linked
+func linkOrCopy(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	os.Remove(to)
+	if os.Link(from, to) == nil {
+		return nil
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	return dst.Close()
+}
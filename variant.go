@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// expandVariants replaces the entries of the manifest that have variants by an entry per variant, e.g.
+// the sizes of a responsive image. A variant starting with ? sets query parameters of the url, as
+// ?w=800&q=75, a template with "://" is the whole url, as {scheme}://{host}/large{dir}/{name}{ext}, and
+// any other template replaces the file name, as {name}@2x{ext}. The empty variant is the url itself.
+// The id of a variant is the id of its entry, or its key, with the name of the variant as a suffix,
+// e.g. 12_w800, and the url of the entry is kept as its original url.
+func expandVariants(img *image) *image {
+	if len(img.Variants) == 0 {
+		return img
+	}
+	expanded := &image{}
+	add := func(i int, u, id, original string) {
+		if i < len(img.Originals) && img.Originals[i] != "" {
+			original = img.Originals[i] // the src a srcset candidate replaced
+		}
+		expanded.Urls = append(expanded.Urls, u)
+		n := len(expanded.Urls)
+		if i < len(img.Invalid) && img.Invalid[i] != "" {
+			expanded.Invalid = extend(expanded.Invalid, n)
+			expanded.Invalid[n-1] = img.Invalid[i]
+		}
+		if i < len(img.Labels) {
+			expanded.Labels = extend(expanded.Labels, n)
+			expanded.Labels[n-1] = img.Labels[i]
+		}
+		if i < len(img.Manifests) {
+			expanded.Manifests = extend(expanded.Manifests, n)
+			expanded.Manifests[n-1] = img.Manifests[i]
+		}
+		if id != "" {
+			expanded.IDs = extend(expanded.IDs, n)
+			expanded.IDs[n-1] = id
+		}
+		if original != "" {
+			expanded.Originals = extend(expanded.Originals, n)
+			expanded.Originals[n-1] = original
+		}
+	}
+	for i, raw := range img.Urls {
+		id := ""
+		if i < len(img.IDs) {
+			id = img.IDs[i]
+		}
+		var variants []string
+		if i < len(img.Variants) && (i >= len(img.Invalid) || img.Invalid[i] == "") {
+			variants = img.Variants[i]
+		}
+		if len(variants) == 0 {
+			add(i, raw, id, "")
+			if i < len(img.Checksums) && img.Checksums[i] != "" {
+				expanded.Checksums = extend(expanded.Checksums, len(expanded.Urls))
+				expanded.Checksums[len(expanded.Urls)-1] = img.Checksums[i]
+			}
+			continue
+		}
+		base := id
+		if base == "" {
+			base = strconv.Itoa(i)
+		}
+		for n, v := range variants {
+			u, err := applyVariant(raw, v)
+			if err != nil {
+				add(i, raw, "", "")
+				expanded.Invalid = extend(expanded.Invalid, len(expanded.Urls))
+				expanded.Invalid[len(expanded.Urls)-1] = fmt.Sprintf("variant %q: %s", v, err)
+				continue
+			}
+			if v == "" {
+				add(i, u, id, "")
+				continue
+			}
+			name := variantName(v)
+			if name == "" {
+				name = fmt.Sprintf("v%d", n+1)
+			}
+			add(i, u, base+"_"+name, raw)
+		}
+	}
+	if img.Labels != nil {
+		expanded.Labels = extend(expanded.Labels, len(expanded.Urls))
+	}
+	return expanded
+}
+
+// applyVariant returns the url of a variant of raw, see expandVariants
+func applyVariant(raw, variant string) (string, error) {
+	if variant == "" {
+		return raw, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(variant, "?") {
+		params, err := url.ParseQuery(variant[1:])
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for key, values := range params {
+			query[key] = values
+		}
+		u.RawQuery = encodeQuery(query, u.RawQuery)
+		return u.String(), nil
+	}
+
+	dir, file := path.Split(u.Path)
+	ext := path.Ext(file)
+	fields := map[string]string{
+		"scheme": u.Scheme,
+		"host":   u.Host,
+		"dir":    strings.TrimSuffix(dir, "/"),
+		"name":   strings.TrimSuffix(file, ext),
+		"ext":    ext,
+		"query":  u.RawQuery,
+	}
+	expanded, err := expandTemplate(variant, fields)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(variant, "://") {
+		return expanded, nil
+	}
+	u.Path = dir + expanded
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// encodeQuery encodes the query parameters in the order of the raw query they were parsed from, the
+// new ones after them in name order, so a variant only changes what it sets
+func encodeQuery(query url.Values, raw string) string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(raw, "&") {
+		key, _ := url.QueryUnescape(strings.SplitN(pair, "=", 2)[0])
+		if _, ok := query[key]; ok && !seen[key] {
+			keys, seen[key] = append(keys, key), true
+		}
+	}
+	var added []string
+	for key := range query {
+		if !seen[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	var parts []string
+	for _, key := range append(keys, added...) {
+		for _, value := range query[key] {
+			parts = append(parts, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// expandTemplate replaces the {field} placeholders of a variant template
+func expandTemplate(template string, fields map[string]string) (string, error) {
+	var b strings.Builder
+	for rest := template; rest != ""; {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unclosed { at %d", len(template)-len(rest)+start)
+		}
+		field := rest[start+1 : start+end]
+		value, ok := fields[field]
+		if !ok {
+			return "", fmt.Errorf("unknown field {%s}", field)
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(value)
+		rest = rest[start+end+1:]
+	}
+	return b.String(), nil
+}
+
+// variantName names a variant in the ids of its urls: the parameters of a query as w800-q75, the
+// letters and digits of a template but its placeholders, as 2x for {name}@2x{ext}
+func variantName(variant string) string {
+	if strings.HasPrefix(variant, "?") {
+		variant = strings.NewReplacer("=", "", "&", "-").Replace(variant[1:])
+	} else if i := strings.Index(variant, "://"); i >= 0 {
+		variant = variant[i+3:]
+	}
+	var words []string
+	var word strings.Builder
+	placeholder := false
+	for _, c := range variant {
+		switch {
+		case c == '{':
+			placeholder = true
+		case c == '}':
+			placeholder = false
+		case placeholder:
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' && word.Len() > 0:
+			word.WriteRune(c)
+			continue
+		}
+		if word.Len() > 0 {
+			words = append(words, strings.TrimRight(word.String(), "."))
+			word.Reset()
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, strings.TrimRight(word.String(), "."))
+	}
+	return strings.Join(words, "-")
+}
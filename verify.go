@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lawrence/sample/download"
+)
+
+// outputDrift is how an output differs from what was expected of it
+type outputDrift struct {
+	path   string
+	kind   string // missing, size, checksum or extra
+	detail string
+}
+
+// verify checks the output directory against the images files without downloading: every entry must
+// have its file, with the checksum of the entry, and with --report the size and sha256 the run wrote.
+// The drifts are listed and make verify fail, so it can assert a deployed output directory.
+func verify(args []string) error {
+	fs := newFlagSet("verify")
+	opts := options{}
+	fs.StringVar(&opts.OutDir, "dir", ".data", "output directory to verify")
+	fs.BoolVar(&opts.Dataset, "dataset", false, "the images are in <split>/<label> sub directories")
+	fs.StringVar(&opts.Split, "split", "80,10,10", "train,val,test split ratios of the dataset mode")
+	fs.BoolVar(&opts.GlobOff, "globoff", false, "the urls were not expanded as globs")
+	fs.StringVar(&opts.ShardDirs, "shard-dirs", "", "the outputs are in the sub directories of --shard-dirs")
+	fs.BoolVar(&opts.ContentTypeAny, "content-type-any", false, "the files are named with the extension of their url, as with --content-type-any")
+	reportPath := fs.String("report", "", "result file of the run, its sizes and sha256 are expected of the files")
+	extra := fs.Bool("extra", false, "also report the output files no entry writes")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		return errors.New("please supply the images.json file path")
+	}
+	jobs, invalid, err := manifestJobs(opts, fs.Args()...)
+	if err != nil {
+		return err
+	}
+	expected := map[int]*download.Result{}
+	if *reportPath != "" {
+		rep, err := readReport(*reportPath)
+		if err != nil {
+			return err
+		}
+		for _, r := range rep.Results {
+			if r.Status == download.StatusOK || r.Status == download.StatusSkipped && r.SHA256 != "" {
+				expected[r.Key] = r
+			}
+		}
+	}
+
+	var drifts []outputDrift
+	checked := 0
+	for _, j := range jobs {
+		if _, ok := invalid[j.Key]; ok {
+			continue
+		}
+		checked++
+		var r *download.Result
+		if e, ok := expected[j.Key]; ok && e.URL == j.URL {
+			r = e
+		}
+		if drift := verifyOutput(opts.OutDir, j, r); drift != nil {
+			drifts = append(drifts, *drift)
+		}
+	}
+	if *extra {
+		var results []*download.Result // of the report, their files are not extra
+		for _, r := range expected {
+			results = append(results, r)
+		}
+		stray, err := strayOutputs(opts.OutDir, jobs, results)
+		if err != nil {
+			return err
+		}
+		for _, path := range stray {
+			drifts = append(drifts, outputDrift{path: path, kind: "extra", detail: "no entry writes it"})
+		}
+	}
+
+	counts := map[string]int{}
+	for _, d := range drifts {
+		counts[d.kind]++
+		fmt.Println(fmt.Sprintf("verify - %s %s: %s", d.kind, d.path, d.detail))
+	}
+	fmt.Println(fmt.Sprintf("verify - %d of %d files ok, %d missing, %d size, %d checksum, %d extra",
+		checked-counts["missing"]-counts["size"]-counts["checksum"], checked,
+		counts["missing"], counts["size"], counts["checksum"], counts["extra"]))
+	if len(invalid) > 0 {
+		fmt.Println(fmt.Sprintf("verify - %d invalid entries not checked", len(invalid)))
+	}
+	if len(drifts) > 0 {
+		return fmt.Errorf("%d outputs drifted from %s", len(drifts), opts.OutDir)
+	}
+	return nil
+}
+
+// verifyOutput checks the file of a job against the checksum of the job and the size and sha256 of
+// its result r, when there is one
+func verifyOutput(outDir string, j *download.Job, r *download.Result) *outputDrift {
+	path := download.OutputPath(outDir, j)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return &outputDrift{path: path, kind: "missing", detail: j.URL}
+	}
+	if r != nil && r.Bytes > 0 && info.Size() != r.Bytes {
+		return &outputDrift{path: path, kind: "size", detail: fmt.Sprintf("%d bytes instead of %d", info.Size(), r.Bytes)}
+	}
+
+	want := map[string]string{}
+	if r != nil && r.SHA256 != "" {
+		want[download.ChecksumSHA256] = r.SHA256
+	}
+	if j.Checksum != "" {
+		algorithm, sum, err := download.ParseChecksum(j.Checksum)
+		if err != nil {
+			return &outputDrift{path: path, kind: "checksum", detail: err.Error()}
+		}
+		want[algorithm] = sum
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	algorithms := make([]string, 0, len(want))
+	for algorithm := range want {
+		algorithms = append(algorithms, algorithm)
+	}
+	sums, _, err := download.HashFile(path, algorithms...)
+	if err != nil {
+		return &outputDrift{path: path, kind: "missing", detail: err.Error()}
+	}
+	for _, algorithm := range download.ChecksumNames() {
+		if w, ok := want[algorithm]; ok && sums[algorithm] != w {
+			return &outputDrift{path: path, kind: "checksum", detail: fmt.Sprintf("%s %s instead of %s", algorithm, sums[algorithm], w)}
+		}
+	}
+	return nil
+}
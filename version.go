@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/lawrence/sample/download"
+)
+
+// The release, commit and build date of the binary, set at build time with e.g.
+// -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)",
+// dev for the builds from source whose commit and date come from the build info of the go toolchain
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is what `sample version --json` reports, so wrappers can tell what the binary supports
+// without parsing its help
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	// Schemes are the url schemes of the manifests, Backends the storage services they are presigned for
+	Schemes   []string `json:"schemes"`
+	Backends  []string `json:"backends"`
+	Protocols []string `json:"protocols"`
+	Encodings []string `json:"encodings"`
+	Checksums []string `json:"checksums"`
+	// ImageFormats are the formats --verify-decode and --near-dup decode
+	ImageFormats []string `json:"image_formats"`
+	Auth         []string `json:"auth"`
+	Commands     []string `json:"commands"`
+	Features     []string `json:"features"`
+}
+
+// versionCommand prints the version of the binary, with --json what it supports
+func versionCommand(args []string) error {
+	fs := newFlagSet("version")
+	asJSON := fs.Bool("json", false, "print the build info and the capabilities as json")
+	fs.Parse(args)
+
+	info := readBuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	line := "sample " + info.Version
+	if info.Commit != "" {
+		line += " (" + shortCommit(info.Commit) + ")"
+	}
+	if info.BuildDate != "" {
+		line += " built " + info.BuildDate
+	}
+	fmt.Println(line)
+	fmt.Println(info.GoVersion + " " + info.Platform)
+	return nil
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:      version,
+		Commit:       commit,
+		BuildDate:    buildDate,
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Schemes:      []string{"http", "https", "s3", "gs", "magnet", "torrent", "rsync", "dav", "davs"},
+		Backends:     []string{"s3", "gcs"},
+		Protocols:    []string{"http/1.1", "h2"},
+		Encodings:    download.EncodingNames(),
+		Checksums:    download.ChecksumNames(),
+		ImageFormats: []string{"gif", "jpeg", "png"}, // registered in dhash.go
+		Auth:         []string{"cookies", "session", "oauth2", "sigv4"},
+		Commands:     commandNames(),
+		Features: []string{
+			"cas", "http-cache", "dedup-db", "fast-skip", "clamd", "near-dup", "verify-decode",
+			"mirror", "record", "replay", "dataset", "cluster", "leader-redis",
+		},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
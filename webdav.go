@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// Schemes of the WebDAV urls, fetched over http and https, as the file managers name them
+const (
+	schemeDAV  = "dav"
+	schemeDAVs = "davs"
+)
+
+// webdavPasswordEnv sets the WebDAV password without saving it in the report, retries read it from there
+const webdavPasswordEnv = "SAMPLE_WEBDAV_PASSWORD"
+
+// webdavTimeout is the time a listing or an upload request has when --timeout is not set
+const webdavTimeout = 5 * time.Minute
+
+// propfindBody asks a PROPFIND for the type of the resources, which tells the collections
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+
+// davClient sends the WebDAV requests of the listings and of the sink, with the basic auth of
+// --webdav-user when it is set, else that of the url
+type davClient struct {
+	client   *http.Client
+	user     string
+	password string
+}
+
+func newDAVClient(opts options) (*davClient, error) {
+	password := opts.WebDAVPassword
+	if password == "" {
+		password = os.Getenv(webdavPasswordEnv)
+	}
+	password, err := secretRefs(password)
+	if err != nil {
+		return nil, err
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = webdavTimeout
+	}
+	return &davClient{client: &http.Client{Timeout: timeout}, user: opts.WebDAVUser, password: password}, nil
+}
+
+// isDAVURL reports whether a url is a dav: or davs: one
+func isDAVURL(u *url.URL) bool {
+	return u.Scheme == schemeDAV || u.Scheme == schemeDAVs
+}
+
+// httpURL returns the http or https url of a dav or davs one
+func httpURL(u *url.URL) *url.URL {
+	h := *u
+	if u.Scheme == schemeDAVs {
+		h.Scheme = "https"
+	} else if u.Scheme == schemeDAV {
+		h.Scheme = "http"
+	}
+	return &h
+}
+
+// authorize is the before request hook of the dav urls of the manifests, it sends them over http or
+// https with the credentials of the client
+func (c *davClient) authorize(req *http.Request) error {
+	if !isDAVURL(req.URL) {
+		return nil
+	}
+	req.URL = httpURL(req.URL)
+	req.Host = req.URL.Host
+	c.setAuth(req)
+	return nil
+}
+
+func (c *davClient) setAuth(req *http.Request) {
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+}
+
+func (c *davClient) do(method string, u *url.URL, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.setAuth(req)
+	return c.client.Do(req)
+}
+
+// expandWebDAV replaces the entries of the manifest whose dav or davs url ends with a / by the files of
+// that collection and of the collections below it, in path order, listed with PROPFIND. The urls of
+// the other entries are left as they are, see expandGlobs for the ids and the invalid entries.
+func expandWebDAV(img *image, c *davClient) *image {
+	return expandEntries(img, func(raw string) ([]string, error) {
+		u, err := url.Parse(raw)
+		if err != nil || !isDAVURL(u) || !strings.HasSuffix(u.Path, "/") {
+			return []string{raw}, nil
+		}
+		urls, err := c.list(u)
+		if err == nil && len(urls) == 0 {
+			err = fmt.Errorf("the collection %s has no files", raw)
+		}
+		return urls, err
+	})
+}
+
+// davMultistatus is the part of a PROPFIND response the listings read
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status       string `xml:"status"`
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"prop>resourcetype"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// list returns the dav urls of the files of the collection at u, walking the collections below it one
+// level at a time as servers often refuse the requests of an infinite depth
+func (c *davClient) list(u *url.URL) ([]string, error) {
+	var files []string
+	pending := []*url.URL{u}
+	seen := map[string]bool{u.Path: true}
+	for len(pending) > 0 {
+		collection := pending[0]
+		pending = pending[1:]
+		header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+		res, err := c.do("PROPFIND", httpURL(collection), strings.NewReader(propfindBody), header)
+		if err != nil {
+			return nil, err
+		}
+		var status davMultistatus
+		if res.StatusCode == http.StatusMultiStatus {
+			err = xml.NewDecoder(res.Body).Decode(&status)
+		} else {
+			err = fmt.Errorf("PROPFIND %s: %s", collection, res.Status)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range status.Responses {
+			href, err := collection.Parse(strings.TrimSpace(r.Href))
+			if err != nil {
+				return nil, fmt.Errorf("PROPFIND %s: %s", collection, err)
+			}
+			href.Scheme, href.User = collection.Scheme, collection.User
+			if seen[href.Path] || href.Host != collection.Host || !strings.HasPrefix(href.Path, u.Path) {
+				continue
+			}
+			seen[href.Path] = true
+			isCollection := false
+			for _, p := range r.Propstat {
+				if p.ResourceType.Collection != nil && strings.Contains(p.Status, " 200 ") {
+					isCollection = true
+				}
+			}
+			if isCollection {
+				if !strings.HasSuffix(href.Path, "/") {
+					href.Path += "/"
+					href.RawPath = ""
+				}
+				pending = append(pending, href)
+				continue
+			}
+			if files = append(files, href.String()); len(files) > maxGlobURLs {
+				return nil, fmt.Errorf("the collection has more than %d files", maxGlobURLs)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// webdavSink uploads each download to a WebDAV collection, at its path in the output directory. The
+// collections of the path are created as they are first needed.
+type webdavSink struct {
+	client *davClient
+	base   *url.URL
+	outDir string
+
+	mu      sync.Mutex
+	created map[string]bool // collections known to exist
+}
+
+func newWebDAVSink(opts options, c *davClient) (*webdavSink, error) {
+	base, err := url.Parse(opts.WebDAVOut)
+	if err != nil {
+		return nil, err
+	}
+	if base.Host == "" {
+		return nil, fmt.Errorf("--webdav-out %q is not an absolute url", opts.WebDAVOut)
+	}
+	base = httpURL(base)
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &webdavSink{client: c, base: base, outDir: opts.OutDir, created: map[string]bool{}}, nil
+}
+
+func (s *webdavSink) Put(r *download.Result) error {
+	if r.Path == "" {
+		return nil
+	}
+	rel := sinkPath(s.outDir, r.Path)
+	if err := s.mkcol(path.Dir(rel)); err != nil {
+		return fmt.Errorf("webdav: %s", err)
+	}
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	target := s.base.ResolveReference(&url.URL{Path: rel})
+	req, err := http.NewRequest(http.MethodPut, target.String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if ct := mime.TypeByExtension(filepath.Ext(r.Path)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	s.client.setAuth(req)
+	res, err := s.client.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webdav: %w", err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	default:
+		return fmt.Errorf("webdav: PUT %s: %w", target, &download.HTTPStatusError{Code: res.StatusCode, Status: res.Status})
+	}
+	r.SetMeta("webdav", target.String())
+	return nil
+}
+
+// sinkPath returns the slash separated path a sink stores an output at, its path in the output
+// directory, or its name when it was written outside
+func sinkPath(outDir, output string) string {
+	rel, err := filepath.Rel(outDir, output)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(output)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// mkcol creates the base collection and those of dir below it, relative to the base url, that are not
+// known to exist yet
+func (s *webdavSink) mkcol(dir string) error {
+	collections := []string{s.base.Path}
+	if dir != "." {
+		for _, name := range strings.Split(dir, "/") {
+			collections = append(collections, collections[len(collections)-1]+name+"/")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, collection := range collections {
+		if s.created[collection] {
+			continue
+		}
+		res, err := s.client.do("MKCOL", s.base.ResolveReference(&url.URL{Path: collection}), nil, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		// 405 is the answer of an existing collection
+		if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("MKCOL %s: %s", collection, res.Status)
+		}
+		s.created[collection] = true
+	}
+	return nil
+}
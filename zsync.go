@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lawrence/sample/download"
+)
+
+// schemeRsync is fetched by the rsync command, with the existing output as the basis of its delta
+const schemeRsync = "rsync"
+
+// Bounds of the .zsync control files, a larger one is not read
+const (
+	maxZsyncControl   = 64 << 20
+	maxZsyncBlockSize = 1 << 20
+)
+
+// deltaProtocol fetches the urls of the jobs whose output exists by delta transfer: the http urls with
+// a .zsync control file only get the blocks the existing output lacks, the rsync urls are synced
+// against it. The other requests are left to the http client, as the http urls without control file
+// or whose delta didn't check out.
+type deltaProtocol struct {
+	outputs map[string]string // paths of the outputs by url
+	zsync   bool
+}
+
+// newDeltaProtocol returns the protocol of the jobs written under outDir
+func newDeltaProtocol(outDir string, jobs []*download.Job, zsync bool) *deltaProtocol {
+	p := &deltaProtocol{outputs: make(map[string]string, len(jobs)), zsync: zsync}
+	for _, j := range jobs {
+		p.outputs[j.URL] = download.OutputPath(outDir, j)
+	}
+	return p
+}
+
+func (p *deltaProtocol) RoundTrip(req *http.Request) (*http.Response, error) {
+	basis := p.outputs[req.URL.String()]
+	if req.URL.Scheme == schemeRsync {
+		return rsyncFetch(req, basis)
+	}
+	if !p.zsync || req.Method != http.MethodGet || basis == "" {
+		return nil, http.ErrSkipAltProtocol
+	}
+	if _, err := os.Stat(basis); err != nil {
+		return nil, http.ErrSkipAltProtocol
+	}
+	res, err := zsyncFetch(req, basis)
+	if err == errNoControl {
+		return nil, http.ErrSkipAltProtocol
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("zsync - %s: %s, downloading it whole", req.URL, err))
+		return nil, http.ErrSkipAltProtocol
+	}
+	return res, nil
+}
+
+// zsyncControl is a .zsync control file: its headers and the weak and strong checksums of the blocks
+type zsyncControl struct {
+	url         *url.URL // of the file, relative to the control file
+	blockSize   int
+	length      int64
+	rsumBytes   int
+	sumBytes    int
+	sha1        string
+	rsums       []uint32
+	sums        [][]byte
+	blocksByRef map[uint32][]int // the blocks by weak checksum
+}
+
+// errNoControl is the error of a url without .zsync control file
+var errNoControl = errors.New("no .zsync control file")
+
+// zsyncFetch rebuilds the file of the request from the blocks basis shares with it and the ranges of
+// the others, and returns it as the response. The rebuilt file must have the SHA-1 of the control file.
+func zsyncFetch(req *http.Request, basis string) (*http.Response, error) {
+	client := download.ProtocolFetcher(req)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	control, err := fetchZsyncControl(client, req)
+	if err != nil {
+		return nil, err
+	}
+	found, err := control.match(basis)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "sample-zsync-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "file")
+	fetched, err := control.rebuild(client, req, basis, found, path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	fmt.Println(fmt.Sprintf("zsync - %s: %d of %d blocks reused, %s fetched", req.URL, len(found), len(control.rsums), humanBytes(fetched)))
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Length": {strconv.FormatInt(control.length, 10)}},
+		ContentLength: control.length,
+		Body:          &tempBody{ReadCloser: file, dir: dir},
+		Request:       req,
+	}, nil
+}
+
+// fetchZsyncControl reads the control file of the request url, the url with .zsync appended
+func fetchZsyncControl(client download.Fetcher, req *http.Request) (*zsyncControl, error) {
+	controlURL := *req.URL
+	controlURL.Path += ".zsync"
+	controlURL.RawPath = ""
+	res, err := send(client, req, controlURL.String(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errNoControl
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control file: unexpected http status %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxZsyncControl+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxZsyncControl {
+		return nil, errors.New("control file larger than " + humanBytes(maxZsyncControl))
+	}
+	control, err := parseZsyncControl(data)
+	if err != nil {
+		return nil, fmt.Errorf("control file: %s", err)
+	}
+	control.url = req.URL
+	if header := control.urlHeader(data); header != "" {
+		if control.url, err = controlURL.Parse(header); err != nil {
+			return nil, fmt.Errorf("control file: %s", err)
+		}
+	}
+	return control, nil
+}
+
+// send makes a GET of u in the context of req, with the range when set. The headers of req are not
+// copied, those signed for its url would be wrong for u: the hooks of the client add those of u.
+func send(client download.Fetcher, req *http.Request, u, byteRange string) (*http.Response, error) {
+	sub, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		sub.Header.Set("Range", byteRange)
+		sub.Header.Set("Accept-Encoding", "identity")
+	}
+	return client.Do(sub)
+}
+
+// parseZsyncControl reads the headers of a control file, up to a blank line, and the checksums of its
+// blocks after them
+func parseZsyncControl(data []byte) (*zsyncControl, error) {
+	end := bytes.Index(data, []byte("\n\n"))
+	if end < 0 {
+		return nil, errors.New("no end of the headers")
+	}
+	c := &zsyncControl{}
+	hashLengths := ""
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		name, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		var err error
+		switch strings.ToLower(name) {
+		case "blocksize":
+			c.blockSize, err = strconv.Atoi(value)
+		case "length":
+			c.length, err = strconv.ParseInt(value, 10, 64)
+		case "hash-lengths":
+			hashLengths = value
+		case "sha-1":
+			c.sha1 = strings.ToLower(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if c.blockSize <= 0 || c.blockSize > maxZsyncBlockSize || c.blockSize&(c.blockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d", c.blockSize)
+	}
+	if c.length < 0 || c.sha1 == "" {
+		return nil, errors.New("no length or SHA-1")
+	}
+	var seqMatches int
+	if _, err := fmt.Sscanf(hashLengths, "%d,%d,%d", &seqMatches, &c.rsumBytes, &c.sumBytes); err != nil {
+		return nil, fmt.Errorf("hash lengths %q: %s", hashLengths, err)
+	}
+	if c.rsumBytes < 1 || c.rsumBytes > 4 || c.sumBytes < 3 || c.sumBytes > 16 {
+		return nil, fmt.Errorf("hash lengths %q out of bounds", hashLengths)
+	}
+
+	blocks := int((c.length + int64(c.blockSize) - 1) / int64(c.blockSize))
+	sums := data[end+2:]
+	if len(sums) < blocks*(c.rsumBytes+c.sumBytes) {
+		return nil, fmt.Errorf("%d block checksums for %d blocks", len(sums)/(c.rsumBytes+c.sumBytes), blocks)
+	}
+	c.blocksByRef = map[uint32][]int{}
+	for i := 0; i < blocks; i++ {
+		var rsum [4]byte
+		copy(rsum[4-c.rsumBytes:], sums[:c.rsumBytes])
+		weak := binary.BigEndian.Uint32(rsum[:])
+		c.rsums = append(c.rsums, weak)
+		c.sums = append(c.sums, sums[c.rsumBytes:c.rsumBytes+c.sumBytes])
+		c.blocksByRef[weak] = append(c.blocksByRef[weak], i)
+		sums = sums[c.rsumBytes+c.sumBytes:]
+	}
+	return c, nil
+}
+
+// urlHeader returns the URL header of the control file, empty when it has none
+func (c *zsyncControl) urlHeader(data []byte) string {
+	end := bytes.Index(data, []byte("\n\n"))
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		if strings.HasPrefix(strings.ToLower(line), "url:") {
+			return strings.TrimSpace(line[len("url:"):])
+		}
+	}
+	return ""
+}
+
+// weak truncates a rolling checksum to the bytes the control file keeps of it
+func (c *zsyncControl) weak(a, b uint16) uint32 {
+	sum := uint32(a)<<16 | uint32(b)
+	if c.rsumBytes < 4 {
+		sum &= 1<<(8*uint(c.rsumBytes)) - 1
+	}
+	return sum
+}
+
+// match scans basis with the rolling checksum of the blocks and returns the offset in basis of each
+// block it has, found by its weak checksum and confirmed by its md4. The blocks are zero padded, as is
+// the end of basis.
+func (c *zsyncControl) match(basis string) (map[int]int64, error) {
+	file, err := os.Open(basis)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	r := bufio.NewReaderSize(file, 1<<16)
+	bs := c.blockSize
+	shift := uint(bits.TrailingZeros(uint(bs)))
+	window := make([]byte, bs) // a ring, from head
+	head := 0
+	next := func() byte {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0
+		}
+		return b
+	}
+	fill := func() (uint16, uint16) {
+		var a, b uint16
+		for i := range window {
+			window[i] = next()
+			a += uint16(window[i])
+			b += a
+		}
+		head = 0
+		return a, b
+	}
+
+	found := map[int]int64{}
+	block := make([]byte, bs)
+	a, b := fill()
+	for pos := int64(0); pos < size; {
+		if candidates, ok := c.blocksByRef[c.weak(a, b)]; ok {
+			copy(block, window[head:])
+			copy(block[bs-head:], window[:head])
+			sum := md4Sum(block)
+			matched := false
+			for _, i := range candidates {
+				if _, ok := found[i]; !ok && bytes.Equal(sum[:c.sumBytes], c.sums[i]) {
+					found[i] = pos
+					matched = true
+				}
+			}
+			if matched {
+				pos += int64(bs)
+				a, b = fill()
+				continue
+			}
+		}
+		old, in := window[head], next()
+		window[head] = in
+		head = (head + 1) % bs
+		a += uint16(in) - uint16(old)
+		b += a - uint16(old)<<shift
+		pos++
+	}
+	return found, nil
+}
+
+// rebuild writes the file of the control file to path, from the blocks of basis found and the ranges
+// of the others, and returns the bytes fetched. A server ignoring the ranges or a SHA-1 mismatch
+// fails the rebuild.
+func (c *zsyncControl) rebuild(client download.Fetcher, req *http.Request, basis string, found map[int]int64, path string) (int64, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	local, err := os.Open(basis)
+	if err != nil {
+		return 0, err
+	}
+	defer local.Close()
+
+	bs := int64(c.blockSize)
+	block := make([]byte, bs)
+	var fetched int64
+	blocks := len(c.rsums)
+	for i := 0; i < blocks; {
+		if offset, ok := found[i]; ok {
+			n, err := local.ReadAt(block, offset)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			for ; n < len(block); n++ {
+				block[n] = 0
+			}
+			if _, err := out.WriteAt(block, int64(i)*bs); err != nil {
+				return 0, err
+			}
+			i++
+			continue
+		}
+		end := i + 1
+		for end < blocks {
+			if _, ok := found[end]; ok {
+				break
+			}
+			end++
+		}
+		start, stop := int64(i)*bs, int64(end)*bs
+		if stop > c.length {
+			stop = c.length
+		}
+		n, err := c.fetchRange(client, req, out, start, stop)
+		if err != nil {
+			return 0, err
+		}
+		fetched += n
+		i = end
+	}
+	if err := out.Truncate(c.length); err != nil {
+		return 0, err
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, out); err != nil {
+		return 0, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != c.sha1 {
+		return 0, fmt.Errorf("rebuilt file has SHA-1 %s instead of %s", sum, c.sha1)
+	}
+	return fetched, nil
+}
+
+// fetchRange writes the bytes from start to stop of the file to out at start
+func (c *zsyncControl) fetchRange(client download.Fetcher, req *http.Request, out *os.File, start, stop int64) (int64, error) {
+	res, err := send(client, req, c.url.String(), fmt.Sprintf("bytes=%d-%d", start, stop-1))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("range of %s: unexpected http status %s", c.url, res.Status)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(out, start), io.LimitReader(res.Body, stop-start))
+	if err == nil && n != stop-start {
+		err = fmt.Errorf("range of %s: %d bytes instead of %d", c.url, n, stop-start)
+	}
+	return n, err
+}
+
+// rsyncFetch syncs the rsync url of the request into a copy of basis, so only what changed is
+// transferred, and returns the file as the response
+func rsyncFetch(req *http.Request, basis string) (*http.Response, error) {
+	dir, err := ioutil.TempDir("", "sample-rsync-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "file")
+	if basis != "" {
+		if err := copyFile(basis, path); err != nil && !os.IsNotExist(err) {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	cmd := exec.CommandContext(req.Context(), "rsync", "--quiet", "--no-motd", "--inplace", req.URL.String(), path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return nil, fmt.Errorf("rsync: %s: %s", err, msg)
+		}
+		return nil, fmt.Errorf("rsync: %s", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Length": {strconv.FormatInt(info.Size(), 10)}},
+		ContentLength: info.Size(),
+		Body:          &tempBody{ReadCloser: file, dir: dir},
+		Request:       req,
+	}, nil
+}
+
+// copyFile copies the file at from to a new file at to
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// md4Sum returns the md4 digest of data, the strong checksum of the zsync blocks (RFC 1320)
+func md4Sum(data []byte) [16]byte {
+	s := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	n := len(data)
+	padded := make([]byte, (n+8)/64*64+64)
+	copy(padded, data)
+	padded[n] = 0x80
+	binary.LittleEndian.PutUint64(padded[len(padded)-8:], uint64(n)<<3)
+
+	var x [16]uint32
+	for chunk := padded; len(chunk) > 0; chunk = chunk[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(chunk[4*i:])
+		}
+		a, b, c, d := s[0], s[1], s[2], s[3]
+		for i := 0; i < 16; i++ {
+			f := (b & c) | (^b & d)
+			a = bits.RotateLeft32(a+f+x[i], md4Shifts[0][i%4])
+			a, b, c, d = d, a, b, c
+		}
+		for i := 0; i < 16; i++ {
+			g := (b & c) | (b & d) | (c & d)
+			a = bits.RotateLeft32(a+g+x[md4Order[0][i]]+0x5a827999, md4Shifts[1][i%4])
+			a, b, c, d = d, a, b, c
+		}
+		for i := 0; i < 16; i++ {
+			h := b ^ c ^ d
+			a = bits.RotateLeft32(a+h+x[md4Order[1][i]]+0x6ed9eba1, md4Shifts[2][i%4])
+			a, b, c, d = d, a, b, c
+		}
+		s[0], s[1], s[2], s[3] = s[0]+a, s[1]+b, s[2]+c, s[3]+d
+	}
+	var sum [16]byte
+	for i, v := range s {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
+
+// md4Shifts and md4Order are the rotations of the three rounds of md4 and the word order of the last two
+var (
+	md4Shifts = [3][4]int{{3, 7, 11, 19}, {3, 5, 9, 13}, {3, 9, 11, 15}}
+	md4Order  = [2][16]int{
+		{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15},
+		{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15},
+	}
+)
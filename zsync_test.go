@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawrence/sample/download"
+)
+
+// zsyncControlFile returns the .zsync control file of data with blocks of bs bytes, 4 bytes of rolling
+// checksum and 16 of md4
+func zsyncControlFile(data []byte, bs int) []byte {
+	sum := sha1.Sum(data)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "zsync: 0.6.2\nBlocksize: %d\nLength: %d\nHash-Lengths: 1,4,16\nSHA-1: %s\n\n", bs, len(data), hex.EncodeToString(sum[:]))
+	for off := 0; off < len(data); off += bs {
+		block := make([]byte, bs)
+		copy(block, data[off:])
+		var a, b uint16
+		for _, c := range block {
+			a += uint16(c)
+			b += a
+		}
+		var rsum [4]byte
+		binary.BigEndian.PutUint32(rsum[:], uint32(a)<<16|uint32(b))
+		buf.Write(rsum[:])
+		md4 := md4Sum(block)
+		buf.Write(md4[:])
+	}
+	return buf.Bytes()
+}
+
+func TestZsyncFetchSendsItsRequestsThroughTheDownloader(t *testing.T) {
+	const bs = 1024
+	file := make([]byte, 8*bs+100)
+	for i := range file {
+		file[i] = byte(i * 7 % 251)
+	}
+	control := zsyncControlFile(file, bs)
+
+	var mu sync.Mutex
+	var ranges int
+	var mismatches []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if got := r.Header.Get("X-Signed-For"); got != r.URL.Path {
+			mismatches = append(mismatches, fmt.Sprintf("%s signed for %q", r.URL.Path, got))
+		}
+		if r.Header.Get("Range") != "" {
+			ranges++
+		}
+		mu.Unlock()
+		if r.URL.Path == "/file.zsync" {
+			w.Write(control)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(file))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "sample-zsync-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	job := &download.Job{Key: 1, URL: srv.URL + "/file"}
+	// the basis differs from the file by its third block
+	basis := append([]byte(nil), file...)
+	for i := 2 * bs; i < 3*bs; i++ {
+		basis[i] ^= 0xff
+	}
+	if err := ioutil.WriteFile(download.OutputPath(dir, job), basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := newDeltaProtocol(dir, []*download.Job{job}, true)
+	d := download.NewDownloader(
+		download.WithOptions(download.Options{Workers: 1, OutDir: dir}),
+		download.WithLogger(discardLogger{}),
+		download.WithProtocol("http", delta),
+		download.WithBeforeRequest(func(req *http.Request) error {
+			req.Header.Set("X-Signed-For", req.URL.Path) // as a signature of the url would
+			return nil
+		}),
+	)
+	d.SetJobs([]*download.Job{job})
+	d.Start()
+
+	res := d.Results()[0]
+	if res.Status != download.StatusOK {
+		t.Fatalf("job %s: %s", res.Status, res.Error)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Fatal("the rebuilt file differs")
+	}
+	if ranges != 1 {
+		t.Errorf("%d range requests, want 1 for the changed block", ranges)
+	}
+	if len(mismatches) > 0 {
+		t.Errorf("requests with the headers of another url: %v", mismatches)
+	}
+}
+
+// discardLogger drops the progress lines of the downloaders of the tests
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}